@@ -0,0 +1,259 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"teriyake/goo/compiler"
+	"teriyake/goo/lexer"
+	"teriyake/goo/parser"
+	"teriyake/goo/typecheck"
+	"teriyake/goo/vm"
+)
+
+type FileWriter struct {
+	file *os.File
+}
+
+func NewFileWriter(fileName string) (*FileWriter, error) {
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &FileWriter{file}, nil
+}
+
+func (fw *FileWriter) Write(p []byte) (n int, err error) {
+	return fw.file.Write(p)
+}
+
+const usage = `Usage:
+  ./goo [-debug path/to/log.log] [-parallel n] [-memo] path/to/src.goo
+  ./goo [-debug path/to/log.log] [-parallel n] [-memo] run path/to/src.goo|path/to/out.gooc
+  ./goo build path/to/src.goo [-o path/to/out.gooc]
+  ./goo disasm path/to/src.goo|path/to/out.gooc
+  ./goo repl`
+
+func main() {
+	debugMode := flag.Bool("debug", false, "when enabled, the compiler and vm debug outputs will be piped to a log file")
+	parallelism := flag.Int("parallel", 0, "how many goroutines pmap and pfilter use, by default GOMAXPROCS")
+	memoize := flag.Bool("memo", false, "remember the results of calls of pure functions")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		fmt.Println(usage)
+		fmt.Println("\nFlags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	var logFilePath string
+	if *debugMode && len(args) > 0 {
+		logFilePath, args = args[0], args[1:]
+	}
+	if len(args) < 1 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+
+	// the debug trace goes to the log file so that it never mixes with the
+	// program's output
+	var trace io.Writer
+	if *debugMode && logFilePath != "" {
+		fw, err := NewFileWriter(logFilePath)
+		if err != nil {
+			fmt.Printf("Error opening log file %s: %s\n", logFilePath, err)
+			os.Exit(1)
+		}
+		defer fw.file.Close()
+		trace = fw
+	}
+
+	switch args[0] {
+	case "repl":
+		runREPL(os.Stdin, os.Stdout)
+	case "build":
+		if !build(args[1:], trace) {
+			os.Exit(1)
+		}
+	case "run", "disasm":
+		if len(args) < 2 {
+			fmt.Println(usage)
+			os.Exit(1)
+		}
+		if args[0] == "disasm" {
+			disasm(args[1])
+		} else {
+			run(args[1], trace, *parallelism, *memoize)
+		}
+	default:
+		run(args[0], trace, *parallelism, *memoize)
+	}
+}
+
+// build compiles a source file into a .gooc file.
+func build(args []string, trace io.Writer) bool {
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	outPath := flags.String("o", "", "path of the .gooc file to write, by default the source path with a .gooc extension")
+	// the source path may come before or after -o
+	var srcPaths []string
+	for {
+		flags.Parse(args)
+		args = flags.Args()
+		if len(args) == 0 {
+			break
+		}
+		srcPaths = append(srcPaths, args[0])
+		args = args[1:]
+	}
+	if len(srcPaths) != 1 {
+		fmt.Println(usage)
+		return false
+	}
+	srcFilePath := srcPaths[0]
+	if *outPath == "" {
+		*outPath = strings.TrimSuffix(srcFilePath, ".goo") + ".gooc"
+	}
+
+	srcCode, err := os.ReadFile(srcFilePath)
+	if err != nil {
+		fmt.Printf("Error reading source file %s: %s\n", srcFilePath, err)
+		return false
+	}
+	object, ok := compileSource(srcFilePath, string(srcCode), trace)
+	if !ok {
+		return false
+	}
+
+	data, err := object.MarshalBinary()
+	if err != nil {
+		fmt.Printf("Error encoding bytecode: %s\n", err)
+		return false
+	}
+	if err := os.WriteFile(*outPath, data, 0666); err != nil {
+		fmt.Printf("Error writing %s: %s\n", *outPath, err)
+		return false
+	}
+	return true
+}
+
+// run runs a source file, or a .gooc file written by build without compiling
+// it again.
+func run(path string, trace io.Writer, parallelism int, memoize bool) {
+	bytecodeInstructions, offsetMap, ok := load(path, trace)
+	if !ok {
+		return
+	}
+	// disasm skips this so that it can still show what is wrong
+	if err := vm.Verify(bytecodeInstructions, offsetMap); err != nil {
+		fmt.Printf("Error loading %s: %s\n", path, err)
+		return
+	}
+	if trace != nil {
+		fmt.Fprint(trace, compiler.Disassemble(bytecodeInstructions))
+		fmt.Fprintln(trace)
+	}
+
+	virtualMachine := vm.NewVM(bytecodeInstructions, offsetMap, os.Stdout, trace)
+	virtualMachine.SetParallelism(parallelism)
+	virtualMachine.SetMemoize(memoize)
+	if trace != nil {
+		fmt.Fprintf(trace, "Initial VM State: \n")
+		virtualMachine.Print(trace)
+		fmt.Fprintln(trace)
+	}
+
+	err := virtualMachine.Run()
+	if err != nil {
+		fmt.Printf("Error executing Goo code: %s\n", err)
+	}
+	if trace != nil {
+		fmt.Fprintf(trace, "Final VM State: \n")
+		virtualMachine.Print(trace)
+		fmt.Fprintln(trace)
+	}
+}
+
+// disasm prints the instructions of a source file or a .gooc file.
+func disasm(path string) {
+	bytecodeInstructions, _, ok := load(path, nil)
+	if !ok {
+		return
+	}
+	fmt.Print(compiler.Disassemble(bytecodeInstructions))
+}
+
+// load reads a .gooc file, or compiles a source file, into instructions for
+// the VM.
+func load(path string, trace io.Writer) ([]compiler.BytecodeInstruction, map[int]int, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Printf("Error reading source file %s: %s\n", path, err)
+		os.Exit(1)
+	}
+
+	var object *compiler.Object
+	if compiler.IsObject(data) {
+		object, err = compiler.ReadObject(data)
+		if err != nil {
+			fmt.Printf("Error loading %s: %s\n", path, err)
+			return nil, nil, false
+		}
+	} else {
+		var ok bool
+		object, ok = compileSource(path, string(data), trace)
+		if !ok {
+			return nil, nil, false
+		}
+	}
+
+	bytecodeInstructions, offsetMap, err := object.Instructions()
+	if err != nil {
+		fmt.Printf("Error decoding bytecode: %s\n", err)
+		return nil, nil, false
+	}
+	return bytecodeInstructions, offsetMap, true
+}
+
+// compileSource parses, type checks and compiles gooCode, printing any
+// errors.
+func compileSource(srcFilePath, gooCode string, trace io.Writer) (*compiler.Object, bool) {
+	if trace != nil {
+		fmt.Fprintf(trace, "DEBUG MODE ENABLED\n")
+		fmt.Fprintln(trace)
+		fmt.Fprintf(trace, "Input: %v\n", gooCode)
+		fmt.Fprintln(trace)
+	}
+
+	lex := lexer.NewFileLexer(srcFilePath, gooCode)
+	par := parser.NewParser(lex)
+	ast, err := par.Parse()
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		return nil, false
+	} else if trace != nil {
+		fmt.Fprintf(trace, "AST: %#v\n", ast)
+		fmt.Fprintln(trace)
+	}
+
+	if err := typecheck.Check(ast); err != nil {
+		if errs, ok := err.(lexer.ErrorList); ok {
+			for _, e := range errs {
+				fmt.Printf("Error: %s\n", e)
+			}
+		} else {
+			fmt.Printf("Error: %s\n", err)
+		}
+		return nil, false
+	}
+
+	comp := compiler.NewCompiler(trace)
+	object, err := comp.CompileObject(ast)
+	if err != nil {
+		fmt.Printf("Error compiling AST: %s\n", err)
+		return nil, false
+	}
+	return object, true
+}
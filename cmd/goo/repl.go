@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"teriyake/goo/compiler"
+	"teriyake/goo/lexer"
+	"teriyake/goo/parser"
+	"teriyake/goo/typecheck"
+	"teriyake/goo/vm"
+)
+
+const replHelp = `Enter goo expressions to evaluate them. Commands:
+  :type expr      show the type of expr without evaluating it
+  :bytecode expr  show the instructions compiled for expr
+  :env            list the defined variables and functions
+  :reset          forget all definitions
+  :help           show this message
+  :quit           exit the REPL`
+
+// repl keeps one checker, compiler and VM alive across inputs, so that
+// definitions made by one input can be used by the next.
+type repl struct {
+	out     io.Writer
+	checker *typecheck.Checker
+	comp    *compiler.Compiler
+	machine *vm.VM
+	// codeLen is the number of instructions compiled for earlier inputs
+	codeLen int
+}
+
+func newREPL(out io.Writer) *repl {
+	r := &repl{out: out}
+	r.reset()
+	return r
+}
+
+func (r *repl) reset() {
+	r.checker = typecheck.NewChecker()
+	r.comp = compiler.NewCompiler(nil)
+	r.machine = vm.NewVM(nil, nil, r.out, nil)
+	r.codeLen = 0
+}
+
+func runREPL(in io.Reader, out io.Writer) {
+	r := newREPL(out)
+	scanner := bufio.NewScanner(in)
+
+	fmt.Fprintln(out, "goo REPL, :help for commands")
+	for {
+		input, ok := readInput(scanner, out)
+		if !ok {
+			fmt.Fprintln(out)
+			return
+		}
+		input = strings.TrimSpace(input)
+		if input == "" {
+			continue
+		}
+		if strings.HasPrefix(input, ":") {
+			if quit := r.command(input); quit {
+				return
+			}
+			continue
+		}
+		r.eval(input)
+	}
+}
+
+// readInput reads lines until every bracket opened in them has been closed,
+// so that an expression can span several lines.
+func readInput(scanner *bufio.Scanner, out io.Writer) (string, bool) {
+	var input strings.Builder
+	prompt := "goo> "
+	for {
+		fmt.Fprint(out, prompt)
+		if !scanner.Scan() {
+			return input.String(), input.Len() > 0
+		}
+		input.WriteString(scanner.Text())
+		input.WriteString("\n")
+		if openBrackets(input.String()) <= 0 {
+			return input.String(), true
+		}
+		prompt = "...> "
+	}
+}
+
+// openBrackets counts the parentheses and square brackets in src that are
+// still open, ignoring those in strings and comments.
+func openBrackets(src string) int {
+	depth := 0
+	inString, inComment := false, false
+	for _, ch := range src {
+		switch {
+		case inComment:
+			inComment = ch != '\n'
+		case inString:
+			inString = ch != '\''
+		case ch == '\'':
+			inString = true
+		case ch == ';':
+			inComment = true
+		case ch == '(' || ch == '[':
+			depth++
+		case ch == ')' || ch == ']':
+			depth--
+		}
+	}
+	return depth
+}
+
+func (r *repl) command(input string) (quit bool) {
+	name, arg, _ := strings.Cut(input, " ")
+	arg = strings.TrimSpace(arg)
+
+	switch name {
+	case ":type":
+		r.showType(arg)
+	case ":bytecode":
+		r.showBytecode(arg)
+	case ":env":
+		r.showEnv()
+	case ":reset":
+		r.reset()
+		fmt.Fprintln(r.out, "environment reset")
+	case ":help":
+		fmt.Fprintln(r.out, replHelp)
+	case ":quit", ":q":
+		return true
+	default:
+		fmt.Fprintf(r.out, "Error: unknown command %s, :help lists the commands\n", name)
+	}
+	return false
+}
+
+// eval checks, compiles and runs each top-level expression of input in turn
+// and prints its value. An expression that fails leaves no definitions
+// behind.
+func (r *repl) eval(input string) {
+	program, err := parser.NewParser(lexer.NewLexer(input)).Parse()
+	if err != nil {
+		r.printError(err)
+		return
+	}
+
+	for _, expr := range program.Expressions {
+		checkerState, compilerState := r.checker.Checkpoint(), r.comp.Checkpoint()
+
+		t, err := r.checker.Check(expr)
+		if err == nil {
+			var code []compiler.BytecodeInstruction
+			var offsetMap map[int]int
+			code, offsetMap, err = r.comp.CompileMore(expr)
+			if err == nil {
+				err = vm.Verify(code, offsetMap)
+			}
+			if err == nil {
+				err = r.machine.Continue(code, offsetMap, r.codeLen)
+			}
+			if err == nil {
+				r.codeLen = len(code)
+			}
+		}
+		if err != nil {
+			r.checker.Restore(checkerState)
+			r.comp.Restore(compilerState)
+			r.printError(err)
+			return
+		}
+
+		if t == typecheck.Void {
+			continue
+		}
+		if value, ok := r.machine.StackTop(); ok {
+			fmt.Fprintln(r.out, formatValue(value))
+		}
+	}
+}
+
+func (r *repl) showType(src string) {
+	expr, ok := r.parseExpression(":type", src)
+	if !ok {
+		return
+	}
+	// a bare function name would be a call, but its type is more useful
+	if ident, ok := expr.(parser.Identifier); ok {
+		if t, ok := r.checker.Globals()[ident.Value]; ok {
+			fmt.Fprintln(r.out, t)
+			return
+		}
+	}
+
+	checkerState := r.checker.Checkpoint()
+	defer r.checker.Restore(checkerState)
+
+	t, err := r.checker.Check(expr)
+	if err != nil {
+		r.printError(err)
+		return
+	}
+	fmt.Fprintln(r.out, t)
+}
+
+func (r *repl) showBytecode(src string) {
+	expr, ok := r.parseExpression(":bytecode", src)
+	if !ok {
+		return
+	}
+	checkerState, compilerState := r.checker.Checkpoint(), r.comp.Checkpoint()
+	defer r.checker.Restore(checkerState)
+	defer r.comp.Restore(compilerState)
+
+	if _, err := r.checker.Check(expr); err != nil {
+		r.printError(err)
+		return
+	}
+	code, _, err := r.comp.CompileMore(expr)
+	if err != nil {
+		r.printError(err)
+		return
+	}
+	fmt.Fprint(r.out, compiler.Disassemble(code[r.codeLen:]))
+}
+
+func (r *repl) showEnv() {
+	globals := r.checker.Globals()
+	values := r.machine.Globals()
+
+	names := make([]string, 0, len(globals))
+	for name := range globals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		fmt.Fprintln(r.out, "no definitions")
+		return
+	}
+	for _, name := range names {
+		t := globals[name].String()
+		if symbol, ok := r.comp.Resolve(name); ok && symbol.Pure() {
+			t = "pure " + t
+		}
+		if value, ok := values[name]; ok {
+			fmt.Fprintf(r.out, "%s : %s = %s\n", name, t, formatValue(value))
+		} else {
+			fmt.Fprintf(r.out, "%s : %s\n", name, t)
+		}
+	}
+}
+
+func (r *repl) parseExpression(command, src string) (parser.Node, bool) {
+	program, err := parser.NewParser(lexer.NewLexer(src)).Parse()
+	if err != nil {
+		r.printError(err)
+		return nil, false
+	}
+	if len(program.Expressions) != 1 {
+		fmt.Fprintf(r.out, "Error: %s expects one expression\n", command)
+		return nil, false
+	}
+	return program.Expressions[0], true
+}
+
+func (r *repl) printError(err error) {
+	if errs, ok := err.(lexer.ErrorList); ok {
+		for _, e := range errs {
+			fmt.Fprintf(r.out, "Error: %s\n", e)
+		}
+		return
+	}
+	fmt.Fprintf(r.out, "Error: %s\n", err)
+}
+
+// formatValue formats a value the way it would be written in goo source.
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return "'" + v + "'"
+	case float64:
+		s := strconv.FormatFloat(v, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eEIN") {
+			s += ".0"
+		}
+		return s
+	case []interface{}:
+		elements := make([]string, len(v))
+		for i, element := range v {
+			elements[i] = formatValue(element)
+		}
+		return "[" + strings.Join(elements, " ") + "]"
+	case *vm.LambdaFunction:
+		return "<lambda>"
+	case *vm.Function:
+		return "<func " + v.Name + ">"
+	case *vm.Channel:
+		return "<chan>"
+	case *vm.Error:
+		return "<error " + v.Error() + ">"
+	}
+	return fmt.Sprint(value)
+}
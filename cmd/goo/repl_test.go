@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// session runs the REPL on input and returns what it printed after its
+// banner, with the prompts removed.
+func session(t *testing.T, input string) string {
+	t.Helper()
+	var out strings.Builder
+	runREPL(strings.NewReader(input), &out)
+	output := strings.TrimPrefix(out.String(), "goo REPL, :help for commands\n")
+	output = strings.ReplaceAll(output, "goo> ", "")
+	return strings.ReplaceAll(output, "...> ", "")
+}
+
+func TestREPL(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "definitions persist",
+			input: "(let x:int 2)\n(def double (n:int):int (* n 2))\n(double x)\n:env\n",
+			want:  "4\ndouble : pure (int) -> int\nx : int = 2\n\n",
+		},
+		{
+			name:  "multi-line input",
+			input: "(print\n  (+ 1 2))\n",
+			want:  "3\n\n",
+		},
+		{
+			name:  "type error leaves no definitions",
+			input: "(let y:int 'a')\ny\n:env\n",
+			want:  "Error: 1:12: cannot use string value as int in let y\nError: 1:1: undefined identifier: y\nno definitions\n\n",
+		},
+		{
+			// the failed input defined q in a global slot before failing, which
+			// the next definition must not reuse
+			name: "runtime error leaves no definitions",
+			input: "(if true ((let q:int 1) (print (/ 1 0))) else (print 2))\n" +
+				"(let w:int 5)\nw\nq\n:env\n(let q:int 3)\n(+ q w)\n",
+			want: "Error: 1:32: division by zero\n5\nError: 1:1: undefined identifier: q\n" +
+				"w : int = 5\n8\n\n",
+		},
+		{
+			// each input is verified before it runs
+			name:  "verified input",
+			input: "(def show (n:int) (if (> n 0) (n) else (print n)))\n(show -1)\n(show 1)\n",
+			want:  "-1\n\n",
+		},
+		{
+			name:  "type",
+			input: "(let x:int 2)\n:type (+ x 1)\n:type [x]\n",
+			want:  "int\n[int]\n\n",
+		},
+		{
+			name:  "reset",
+			input: "(let z:int 1)\n:reset\nz\n",
+			want:  "environment reset\nError: 1:1: undefined identifier: z\n\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := session(t, tt.input); got != tt.want {
+				t.Errorf("output = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
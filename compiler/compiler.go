@@ -3,8 +3,10 @@ package compiler
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
 	"math"
 	"strings"
+	"teriyake/goo/lexer"
 	"teriyake/goo/parser"
 )
 
@@ -19,24 +21,49 @@ const (
 	LESS
 	EQ
 	NEQ
-	PUSH_VARIABLE Opcode = iota + 20
-	PUSH_NUMBER
+	MOD
+	GEQ
+	LEQ
+	NOT
+	TO_INT
+	TO_FLOAT
+	LOAD_GLOBAL Opcode = iota + 20
+	PUSH_INT
+	PUSH_FLOAT
 	PUSH_BOOL
 	PUSH_STRING
-	DEFINE_VARIABLE
+	DEFINE_GLOBAL
 	DEFINE_FUNCTION
 	CREATE_LAMBDA
 	CALL_LAMBDA
-	IF Opcode = iota + 30
-	ELSE
-	ENDIF
+	JUMP_IF_FALSE Opcode = iota + 30
 	PRINT
 	RETURN
 	JUMP
 	CALL_FUNCTION
-	MAP = iota + 40
+	CALL_NATIVE
+	MAP Opcode = iota + 40
 	FILTER
 	REDUCE
+	BUILD_LIST
+	PMAP
+	PFILTER
+	LOAD_LOCAL Opcode = iota + 50
+	STORE_LOCAL
+	LOAD_UPVALUE
+	LOAD_FUNCTION
+	TAIL_CALL
+	SPAWN Opcode = iota + 60
+	MAKE_CHANNEL
+	SEND
+	RECV
+	CLOSE
+	SELECT
+	TRY Opcode = iota + 70
+	END_TRY
+	RAISE
+	MESSAGE
+	POP
 )
 
 func OpcodeToString(op Opcode) string {
@@ -49,24 +76,49 @@ func OpcodeToString(op Opcode) string {
 		LESS:            "LESS",
 		EQ:              "EQ",
 		NEQ:             "NEQ",
-		PUSH_VARIABLE:   "PUSH_VARIABLE",
-		PUSH_NUMBER:     "PUSH_NUMBER",
+		MOD:             "MOD",
+		GEQ:             "GEQ",
+		LEQ:             "LEQ",
+		NOT:             "NOT",
+		TO_INT:          "TO_INT",
+		TO_FLOAT:        "TO_FLOAT",
+		LOAD_GLOBAL:     "LOAD_GLOBAL",
+		PUSH_INT:        "PUSH_INT",
+		PUSH_FLOAT:      "PUSH_FLOAT",
 		PUSH_BOOL:       "PUSH_BOOL",
 		PUSH_STRING:     "PUSH_STRING",
-		DEFINE_VARIABLE: "DEFINE_VARIABLE",
+		DEFINE_GLOBAL:   "DEFINE_GLOBAL",
 		DEFINE_FUNCTION: "DEFINE_FUNCTION",
 		CREATE_LAMBDA:   "CREATE_LAMBDA",
 		CALL_LAMBDA:     "CALL_LAMBDA",
-		IF:              "IF",
-		ELSE:            "ELSE",
-		ENDIF:           "ENDIF",
+		JUMP_IF_FALSE:   "JUMP_IF_FALSE",
 		PRINT:           "PRINT",
 		RETURN:          "RETURN",
 		JUMP:            "JUMP",
 		CALL_FUNCTION:   "CALL_FUNCTION",
+		CALL_NATIVE:     "CALL_NATIVE",
 		MAP:             "MAP",
 		FILTER:          "FILTER",
 		REDUCE:          "REDUCE",
+		BUILD_LIST:      "BUILD_LIST",
+		PMAP:            "PMAP",
+		PFILTER:         "PFILTER",
+		LOAD_LOCAL:      "LOAD_LOCAL",
+		STORE_LOCAL:     "STORE_LOCAL",
+		LOAD_UPVALUE:    "LOAD_UPVALUE",
+		LOAD_FUNCTION:   "LOAD_FUNCTION",
+		TAIL_CALL:       "TAIL_CALL",
+		SPAWN:           "SPAWN",
+		MAKE_CHANNEL:    "MAKE_CHANNEL",
+		SEND:            "SEND",
+		RECV:            "RECV",
+		CLOSE:           "CLOSE",
+		SELECT:          "SELECT",
+		TRY:             "TRY",
+		END_TRY:         "END_TRY",
+		RAISE:           "RAISE",
+		MESSAGE:         "MESSAGE",
+		POP:             "POP",
 	}
 
 	return opcodeStrings[op]
@@ -74,7 +126,11 @@ func OpcodeToString(op Opcode) string {
 
 type BytecodeInstruction struct {
 	Opcode   Opcode
-	Operands []interface{}
+	Operands Operands
+	Pos      lexer.Position
+	// Offset is where the instruction starts in the raw bytecode, which is
+	// what jump targets and function addresses refer to.
+	Offset int
 }
 
 type DataType int
@@ -84,22 +140,54 @@ const (
 	FloatType
 	StringType
 	BoolType
+	ListType
+	ErrorType
 )
 
+var dataTypeNames = map[string]DataType{
+	"int":    IntType,
+	"float":  FloatType,
+	"string": StringType,
+	"bool":   BoolType,
+	"error":  ErrorType,
+}
+
+func (t DataType) String() string {
+	if t == ListType {
+		return "list"
+	}
+	for name, dataType := range dataTypeNames {
+		if dataType == t {
+			return name
+		}
+	}
+	return fmt.Sprintf("DataType(%d)", int(t))
+}
+
+func LookupDataType(name string) (DataType, bool) {
+	dataType, ok := dataTypeNames[name]
+	return dataType, ok
+}
+
+// ParseDataType is lenient for programs that have not been type checked;
+// typecheck.Check reports unknown type names before compilation.
 func ParseDataType(pt string) DataType {
-	switch pt {
-	case "int":
-		return IntType
-	case "float":
-		return FloatType
-	case "string":
-		return StringType
-	case "bool":
-		return BoolType
-	// more cases later
-	default:
-		return IntType // default to IntType for unknown types??
+	if dataType, ok := LookupDataType(pt); ok {
+		return dataType
 	}
+	return IntType
+}
+
+// dataTypeOf maps an annotation to its DataType. Omitted annotations, type
+// parameters and function types fall back to IntType like unknown names.
+func dataTypeOf(t parser.TypeExpr) DataType {
+	switch t := t.(type) {
+	case parser.NamedType:
+		return ParseDataType(t.Name)
+	case parser.ListType:
+		return ListType
+	}
+	return IntType
 }
 
 type SymbolType int
@@ -107,19 +195,96 @@ type SymbolType int
 const (
 	VariableSymbol SymbolType = iota
 	FunctionSymbol
+	NativeSymbol
 )
 
+func (t SymbolType) String() string {
+	switch t {
+	case VariableSymbol:
+		return "variable"
+	case FunctionSymbol:
+		return "function"
+	case NativeSymbol:
+		return "native function"
+	default:
+		return fmt.Sprintf("SymbolType(%d)", int(t))
+	}
+}
+
 type Symbol struct {
 	Name         string
 	Type         SymbolType
 	DataType     DataType
 	ParamNames   []string
 	StartAddress int
+	// Slot is where a variable is kept at run time: its index among the
+	// globals, or among the locals of the function that defines it.
+	Slot int
+	// purity is the purity of the function, or of the function a variable
+	// holds, or nil if it is not known.
+	purity *purity
+}
+
+// Pure reports whether the symbol is a function, or a variable holding one,
+// that the compiler found to be pure: one that does not print, call a Go
+// function not registered as pure, spawn tasks or use channels, directly or
+// through the functions it calls. It stays true only while that holds for
+// the code compiled so far, since later code can redefine a function it
+// calls.
+func (s Symbol) Pure() bool {
+	return s.purity.pure()
 }
 
 type SymbolTable struct {
 	Symbols map[string]Symbol
 	Parent  *SymbolTable
+	// function is the function or lambda whose scope this is, or nil for
+	// the global scope.
+	function *funcState
+}
+
+// funcState tracks the frame of a function or lambda while its body is
+// compiled.
+type funcState struct {
+	enclosing *funcState
+	locals    int
+	upvalues  []upvalue
+	purity    *purity
+	// tries is the number of try bodies being compiled, in which a ret
+	// cannot make a tail call, since the try must end after the call.
+	tries int
+}
+
+// upvalue is a variable of an enclosing function that a function or lambda
+// captures, identified by the function that defines it and its slot there.
+type upvalue struct {
+	Capture
+	owner *funcState
+	slot  int
+}
+
+// capture returns the index among f's upvalues of the variable in slot of
+// owner, capturing it through the functions in between if needed.
+func (f *funcState) capture(name string, owner *funcState, slot int) int {
+	for i, up := range f.upvalues {
+		if up.owner == owner && up.slot == slot {
+			return i
+		}
+	}
+	up := upvalue{Capture: Capture{Name: name, Local: f.enclosing == owner, Index: slot}, owner: owner, slot: slot}
+	if !up.Local {
+		up.Index = f.enclosing.capture(name, owner, slot)
+	}
+	f.upvalues = append(f.upvalues, up)
+	return len(f.upvalues) - 1
+}
+
+func (f *funcState) captures() []Capture {
+	captures := make([]Capture, len(f.upvalues))
+	for i, up := range f.upvalues {
+		captures[i] = up.Capture
+	}
+	return captures
 }
 
 func NewSymbolTable(parent *SymbolTable) *SymbolTable {
@@ -129,14 +294,18 @@ func NewSymbolTable(parent *SymbolTable) *SymbolTable {
 	}
 }
 
-func (st *SymbolTable) Print() {
-	fmt.Println("Symbol Table:")
+func (st *SymbolTable) Print(w io.Writer) {
+	fmt.Fprintln(w, "Symbol Table:")
 	for name, symbol := range st.Symbols {
-		fmt.Printf("Name: %s, Type: %s", name, symbol.Type)
-		if symbol.Type == FunctionSymbol {
-			fmt.Printf(", Param Names: %v", symbol.ParamNames)
+		fmt.Fprintf(w, "Name: %s, Type: %s", name, symbol.Type)
+		switch symbol.Type {
+		case FunctionSymbol:
+			fmt.Fprintf(w, ", Param Names: %v, Start Address: %d\n", symbol.ParamNames, symbol.StartAddress)
+		case VariableSymbol:
+			fmt.Fprintf(w, ", Slot: %d\n", symbol.Slot)
+		default:
+			fmt.Fprintln(w)
 		}
-		fmt.Printf(", Start Address: %d\n", symbol.StartAddress)
 	}
 }
 
@@ -148,8 +317,13 @@ func (st *SymbolTable) DefineSymbol(name string, symbolType SymbolType, dataType
 	}
 }
 
-func (st *SymbolTable) DefineVariable(name string, dataType DataType) {
-	st.DefineSymbol(name, VariableSymbol, dataType)
+func (st *SymbolTable) DefineVariable(name string, dataType DataType, slot int) {
+	st.Symbols[name] = Symbol{
+		Name:     name,
+		Type:     VariableSymbol,
+		DataType: dataType,
+		Slot:     slot,
+	}
 }
 
 func (st *SymbolTable) DefineFunction(name string, startAddress int, paramNames []string, returnType DataType) {
@@ -163,28 +337,26 @@ func (st *SymbolTable) DefineFunction(name string, startAddress int, paramNames
 	st.Symbols[name] = symbol
 }
 
+// setPurity records the purity of the function that name is or holds.
+func (st *SymbolTable) setPurity(name string, p *purity) {
+	symbol := st.Symbols[name]
+	symbol.purity = p
+	st.Symbols[name] = symbol
+}
+
 func (st *SymbolTable) Resolve(name string) (Symbol, bool) {
-	symbol, ok := st.Symbols[name]
-	if !ok && st.Parent != nil {
-		symbol, ok = st.Parent.Resolve(name)
-	}
+	symbol, _, ok := st.lookup(name)
 	return symbol, ok
 }
 
-func (st *SymbolTable) ResolveLocal(funcName, name string) (Symbol, bool) {
-	if symbol, ok := st.Symbols[name]; ok {
-		return symbol, ok
-	}
-
-	if st.Parent != nil {
-		return st.Parent.ResolveLocal(funcName, name)
+// lookup resolves name like Resolve, also returning the table defining it.
+func (st *SymbolTable) lookup(name string) (Symbol, *SymbolTable, bool) {
+	for table := st; table != nil; table = table.Parent {
+		if symbol, ok := table.Symbols[name]; ok {
+			return symbol, table, true
+		}
 	}
-	return Symbol{}, false
-}
-
-func (st *SymbolTable) IsLocal(name string) bool {
-	_, found := st.Symbols[name]
-	return found
+	return Symbol{}, nil, false
 }
 
 func (st *SymbolTable) IsFunction(name string) bool {
@@ -195,53 +367,106 @@ func (st *SymbolTable) IsFunction(name string) bool {
 	return symbol.Type == FunctionSymbol
 }
 
-func (st *SymbolTable) IsFunctionParameter(funcName, name string) bool {
-	symbol, ok := st.ResolveLocal(funcName, name)
-	if !ok {
-		return false
-	}
-	return symbol.Type == VariableSymbol
+type Compiler struct {
+	bytecode  []byte
+	positions map[int]lexer.Position
+	// constants are the strings, constant or the names of variables and
+	// functions, that the bytecode refers to by index.
+	constants     []string
+	constantIndex map[string]int
+	pos           lexer.Position
+	symbolTable   *SymbolTable
+	// function is the function or lambda being compiled, nil at the top
+	// level, and globals the number of global slots defined so far.
+	function *funcState
+	globals  int
+	// tail is set while the next node compiled is in tail position in a
+	// function or lambda: its value is what the function returns.
+	tail      bool
+	natives   *Registry
+	functions []FunctionInfo
+	trace     io.Writer
+	// names are the purities of the def names, lastLambda the purity of the
+	// last lambda compiled, and undo the changes made to purities, which
+	// Restore reverts back to a Checkpoint.
+	names      map[string]*purity
+	lastLambda *purity
+	undo       []func()
 }
 
-func (st *SymbolTable) UpdateFunctionStartAddress(name string, address int) {
-	if symbol, ok := st.Symbols[name]; ok && symbol.Type == FunctionSymbol {
-		symbol.StartAddress = address
-		st.Symbols[name] = symbol
+// NewCompiler creates a compiler. If trace is not nil, a trace of the
+// compilation is written to it.
+func NewCompiler(trace io.Writer) *Compiler {
+	return &Compiler{
+		bytecode:      []byte{},
+		positions:     make(map[int]lexer.Position),
+		constantIndex: make(map[string]int),
+		symbolTable:   NewSymbolTable(nil),
+		natives:       NewRegistry(),
+		trace:         trace,
+		names:         make(map[string]*purity),
 	}
 }
 
-type Compiler struct {
-	bytecode        []byte
-	symbolTable     *SymbolTable
-	currentFunction string
-	insideFunction  bool
-	debugMode       *bool
+// DefineGlobal declares a variable that the host sets before the program
+// runs, so that the program can refer to it.
+func (c *Compiler) DefineGlobal(name string, dataType DataType) {
+	c.defineGlobal(name, dataType)
 }
 
-func NewCompiler(d *bool) *Compiler {
-	return &Compiler{
-		bytecode:        []byte{},
-		symbolTable:     NewSymbolTable(nil),
-		currentFunction: "",
-		insideFunction:  false,
-		debugMode:       d,
+// defineGlobal defines a global variable and returns its slot. Defining a
+// name again reuses its slot, so that the VM reports the redefinition.
+func (c *Compiler) defineGlobal(name string, dataType DataType) int {
+	global := c.symbolTable
+	for global.Parent != nil {
+		global = global.Parent
 	}
+	slot := c.globals
+	if symbol, ok := global.Symbols[name]; ok && symbol.Type == VariableSymbol {
+		slot = symbol.Slot
+	} else {
+		c.globals++
+	}
+	global.DefineVariable(name, dataType, slot)
+	return slot
 }
 
-func (c *Compiler) setCurrentFunction(functionName string) {
-	c.currentFunction = functionName
+// defineLocal defines a variable in the function being compiled and returns
+// its slot.
+func (c *Compiler) defineLocal(name string, dataType DataType) int {
+	slot := c.function.locals
+	if symbol, ok := c.symbolTable.Symbols[name]; ok && symbol.Type == VariableSymbol {
+		slot = symbol.Slot
+	} else {
+		c.function.locals++
+	}
+	c.symbolTable.DefineVariable(name, dataType, slot)
+	return slot
 }
 
-func (c *Compiler) getCurrentFunction() string {
-	return c.currentFunction
+// DefineNatives makes the native functions in r callable from the program.
+// The VM running the program must be given the same registry.
+func (c *Compiler) DefineNatives(r *Registry) {
+	c.natives = r
+	for _, native := range r.Natives() {
+		c.symbolTable.DefineSymbol(native.Name, NativeSymbol, native.ResultType())
+		p := newPurity()
+		if !native.Pure {
+			p.effect = &effect{what: "calls Go function " + native.Name}
+		}
+		c.symbolTable.setPurity(native.Name, p)
+	}
 }
 
-func (c *Compiler) isInsideFunction() bool {
-	return c.currentFunction != ""
+// Resolve returns the symbol that name refers to at the top level.
+func (c *Compiler) Resolve(name string) (Symbol, bool) {
+	return c.symbolTable.Resolve(name)
 }
 
-func (c *Compiler) CompileASTByte(ast interface{}) ([]byte, error) {
-	c.bytecode = []byte{}
+// CompileASTByte compiles ast to raw bytecode, whose strings are indices
+// into Constants.
+func (c *Compiler) CompileASTByte(ast parser.Node) ([]byte, error) {
+	c.reset()
 
 	err := c.compileNode(ast)
 	if err != nil {
@@ -251,15 +476,15 @@ func (c *Compiler) CompileASTByte(ast interface{}) ([]byte, error) {
 	return c.bytecode, nil
 }
 
-func (c *Compiler) CompileAST(ast interface{}) ([]BytecodeInstruction, map[int]int, error) {
-	c.bytecode = []byte{}
+func (c *Compiler) CompileAST(ast parser.Node) ([]BytecodeInstruction, map[int]int, error) {
+	c.reset()
 
 	err := c.compileNode(ast)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	bytecodeInstructions, offsetMap, err := convertBytecode(c.bytecode, c.debugMode)
+	bytecodeInstructions, offsetMap, err := convertBytecode(c.bytecode, c.constants, c.positions, c.trace)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -267,278 +492,585 @@ func (c *Compiler) CompileAST(ast interface{}) ([]BytecodeInstruction, map[int]i
 	return bytecodeInstructions, offsetMap, nil
 }
 
-func (c *Compiler) compileNode(node interface{}) error {
-	//fmt.Println("Entering compileNode with node:", node)
+// CompileMore compiles ast after the code compiled so far, keeping the
+// definitions made by earlier calls, and returns the instructions for all of
+// it. The new instructions start where the previous result ended.
+func (c *Compiler) CompileMore(ast parser.Node) ([]BytecodeInstruction, map[int]int, error) {
+	if err := c.compileNode(ast); err != nil {
+		return nil, nil, err
+	}
+	return convertBytecode(c.bytecode, c.constants, c.positions, c.trace)
+}
 
-	switch n := node.(type) {
-	case []interface{}:
-		if len(n) == 0 {
-			return fmt.Errorf("empty expression")
-		}
+// Constants returns the constant pool of the bytecode compiled so far.
+func (c *Compiler) Constants() []string {
+	return c.constants
+}
 
-		if varNode, ok := n[0].(parser.TypeAnnotation); ok {
+func (c *Compiler) reset() {
+	c.bytecode = []byte{}
+	c.positions = make(map[int]lexer.Position)
+	c.functions = nil
+	c.constants = nil
+	c.constantIndex = make(map[string]int)
+}
 
-			if len(n) != 2 {
-				return fmt.Errorf("let expects two arguments")
-			}
-			varName := varNode.Variable
-			varType := varNode.Type
+// constant returns the index of s in the constant pool, adding it if it is
+// not there yet.
+func (c *Compiler) constant(s string) int {
+	index, ok := c.constantIndex[s]
+	if !ok {
+		index = len(c.constants)
+		c.constants = append(c.constants, s)
+		c.constantIndex[s] = index
+	}
+	return index
+}
 
-			err := c.compileNode(n[1])
-			if err != nil {
-				return err
-			}
+// Checkpoint records the compiler's state so that Restore can undo later
+// calls to CompileMore, such as ones that failed. The global slots defined
+// since are not given back: code that failed at run time may already have
+// stored values in them, which later definitions must not find there.
+type Checkpoint struct {
+	bytecodeLen  int
+	functionsLen int
+	undoLen      int
+	symbolTable  *SymbolTable
+	symbols      map[string]Symbol
+}
 
-			c.symbolTable.DefineVariable(varName, ParseDataType(varType))
+func (c *Compiler) Checkpoint() Checkpoint {
+	symbols := make(map[string]Symbol, len(c.symbolTable.Symbols))
+	for name, symbol := range c.symbolTable.Symbols {
+		symbols[name] = symbol
+	}
+	return Checkpoint{bytecodeLen: len(c.bytecode), functionsLen: len(c.functions), undoLen: len(c.undo), symbolTable: c.symbolTable, symbols: symbols}
+}
 
-			if *c.debugMode {
-				c.symbolTable.Print()
-			}
-			//fmt.Printf("Emitting DEFINE_VARIABLE for %s\n", varName.Value)
-			c.emit(DEFINE_VARIABLE, varName)
-			return nil
+func (c *Compiler) Restore(cp Checkpoint) {
+	// undone before the bytecode is cut, which they may patch
+	for i := len(c.undo) - 1; i >= cp.undoLen; i-- {
+		c.undo[i]()
+	}
+	clear(c.undo[cp.undoLen:])
+	c.undo = c.undo[:cp.undoLen]
+	c.bytecode = c.bytecode[:cp.bytecodeLen]
+	c.functions = c.functions[:cp.functionsLen]
+	c.function = nil
+	for offset := range c.positions {
+		if offset >= cp.bytecodeLen {
+			delete(c.positions, offset)
 		}
+	}
+	c.symbolTable = cp.symbolTable
+	c.symbolTable.Symbols = make(map[string]Symbol, len(cp.symbols))
+	for name, symbol := range cp.symbols {
+		c.symbolTable.Symbols[name] = symbol
+	}
+}
 
-		if identifierNode, ok := n[0].(parser.Identifier); ok {
-			switch identifierNode.Value {
-			case "def":
-				if len(n) < 3 {
-					return fmt.Errorf("function definition syntax error")
-				}
-				funcName, ok := n[1].(parser.Identifier)
-				if !ok {
-					return fmt.Errorf("function name must be an identifier")
-				}
-
-				paramsNode, ok := n[2].([]interface{})
-				if !ok {
-					return fmt.Errorf("function parameters must be in a list")
-				}
-
-				var paramNames []string
-				for _, param := range paramsNode {
-					paramName, ok := param.(parser.Identifier)
-					if !ok {
-						return fmt.Errorf("invalid parameter name in function definition")
-					}
-					paramNames = append(paramNames, paramName.Value)
-				}
-
-				err := c.compileNode(n[3:])
-				if err != nil {
-					return err
-				}
-
-				c.emit(DEFINE_FUNCTION, funcName.Value, paramNames)
+func (c *Compiler) errorf(format string, args ...interface{}) error {
+	return lexer.Errorf(c.pos, format, args...)
+}
 
-				return nil
-			case "print":
-				if len(n) != 2 {
-					return fmt.Errorf("print expects one argument")
-				}
-				err := c.compileNode(n[1])
-				if err != nil {
-					return err
-				}
-				c.emit(PRINT)
-				return nil
+func (c *Compiler) compileNode(node parser.Node) error {
+	//fmt.Println("Entering compileNode with node:", node)
+	if node == nil {
+		return c.errorf("missing expression")
+	}
+	// the parts of node are not in tail position unless compileTail says so
+	tail := c.tail
+	c.tail = false
+	if pos := node.Pos(); pos.IsValid() {
+		savedPos := c.pos
+		c.pos = pos
+		defer func() { c.pos = savedPos }()
+	}
 
+	switch n := node.(type) {
+	case parser.Program:
+		// only the value of the last expression is left on the stack, as
+		// the program's
+		for i, expr := range n.Expressions {
+			if err := c.compileNode(expr); err != nil {
+				return err
 			}
-		}
-
-		if funcNameNode, ok := n[0].(parser.Identifier); ok {
-			symbol, found := c.symbolTable.Resolve(funcNameNode.Value)
-			if found && symbol.Type == FunctionSymbol {
-				for _, arg := range n[1:] {
-					if err := c.compileNode(arg); err != nil {
-						return err
-					}
-				}
-				c.emit(CALL_FUNCTION, funcNameNode.Value)
-				return nil
+			if i < len(n.Expressions)-1 && !valueless(expr) {
+				c.emit(POP)
 			}
 		}
-
-		for _, operand := range n {
-			if _, ok := n[0].(parser.Operator); ok {
-				for _, operand := range n[1:] {
-					err := c.compileNode(operand)
-					if err != nil {
-						return err
-					}
-				}
-				return c.compileNode(n[0])
-			}
-			err := c.compileNode(operand)
-			if err != nil {
+	case parser.Block:
+		// the value of a block, such as the body of a function, lambda, try
+		// or catch, is that of its last expression
+		for i, expr := range n.Expressions {
+			last := i == len(n.Expressions)-1
+			if err := c.compileTail(expr, tail && last); err != nil {
 				return err
 			}
+			if !last && !valueless(expr) {
+				c.emit(POP)
+			}
+		}
+	case parser.LetStatement:
+		err := c.compileNode(n.Value)
+		if err != nil {
+			return err
+		}
+
+		name, dataType := n.Binding.Variable, dataTypeOf(n.Binding.Type)
+		fn, _ := c.functionValue(n.Value)
+		if c.function == nil {
+			c.emit(DEFINE_GLOBAL, c.defineGlobal(name, dataType), name)
+		} else {
+			c.emit(STORE_LOCAL, c.defineLocal(name, dataType), name)
+		}
+		if fn != nil {
+			_, table, _ := c.symbolTable.lookup(name)
+			table.setPurity(name, fn)
 		}
+
+		if c.trace != nil {
+			c.symbolTable.Print(c.trace)
+		}
+	case parser.CallExpression:
+		return c.compileCallExpression(n, tail)
+	case parser.BinaryExpression:
+		if n.Operator == "and" || n.Operator == "or" {
+			return c.compileLogicalExpression(n)
+		}
+		if err := c.compileNode(n.Left); err != nil {
+			return err
+		}
+		if err := c.compileNode(n.Right); err != nil {
+			return err
+		}
+		return c.compileOperator(n.Operator)
+	case parser.UnaryExpression:
+		if err := c.compileNode(n.Operand); err != nil {
+			return err
+		}
+		return c.compileOperator(n.Operator)
 	case parser.Identifier:
-		symbol, found := c.symbolTable.Resolve(n.Value)
+		symbol, table, found := c.symbolTable.lookup(n.Value)
 		if found {
-			if symbol.Type == FunctionSymbol {
-				c.emit(CALL_FUNCTION, n.Value)
-			} else if symbol.Type == VariableSymbol {
-				if c.isInsideFunction() && c.symbolTable.IsFunctionParameter(c.currentFunction, n.Value) {
-					c.emit(PUSH_VARIABLE, n.Value)
-				} else {
-					c.emit(PUSH_VARIABLE, n.Value)
+			if symbol.Type == FunctionSymbol && len(symbol.ParamNames) == 0 {
+				// a bare function name is a call without arguments
+				if err := c.calls(c.names[n.Value], n.Value); err != nil {
+					return err
 				}
+				c.emitCall(n.Value, tail)
+			} else if symbol.Type == FunctionSymbol {
+				c.emit(LOAD_FUNCTION, n.Value, symbol.StartAddress)
+			} else if symbol.Type == NativeSymbol {
+				return c.compileNativeCall(n.Value, nil)
+			} else if symbol.Type == VariableSymbol {
+				c.compileVariable(n.Value, symbol, table)
 			}
 		} else {
-			return fmt.Errorf("undefined identifier: %s", n.Value)
+			return c.errorf("undefined identifier: %s", n.Value)
 		}
-	case parser.Number:
-		c.emit(PUSH_NUMBER, n.Value)
+	case parser.Integer:
+		c.emit(PUSH_INT, n.Value)
+	case parser.Float:
+		c.emit(PUSH_FLOAT, n.Value)
 	case parser.Boolean:
 		c.emit(PUSH_BOOL, n.Value)
+	case parser.ListLiteral:
+		for _, element := range n.Elements {
+			if err := c.compileNode(element); err != nil {
+				return err
+			}
+		}
+		c.emit(BUILD_LIST, len(n.Elements))
 	case parser.String:
 		//fmt.Printf("Emitting String: %v\n", n.Value)
 		strVal := strings.Trim(n.Value, "'")
 		c.emit(PUSH_STRING, strVal)
-	case parser.Operator:
-		switch n.Value {
-		case "+":
-			c.emit(ADD)
-		case "-":
-			c.emit(SUB)
-		case "*":
-			c.emit(MUL)
-		case ">":
-			c.emit(GRT)
-		case "<":
-			c.emit(LESS)
-		case "=":
-			c.emit(EQ)
-		case "?":
-			c.emit(NEQ)
-		// ... other operators ...
-		default:
-			return fmt.Errorf("unknown operator: %s", n.Value)
-		}
 	case parser.IfStatement:
 		ifStatement := n
+		// an if without a value drops the value of a branch that has one,
+		// so that both leave the stack as they found it
+		discard := valueless(n)
 
 		err := c.compileNode(ifStatement.Condition)
 		if err != nil {
 			return err
 		}
 
-		c.emit(IF)
+		elseJump := c.emitJump(JUMP_IF_FALSE)
 
-		err = c.compileNode(ifStatement.ThenBlock)
-		if err != nil {
+		if err := c.compileBranch(ifStatement.ThenBlock, tail, discard); err != nil {
 			return err
 		}
 
 		if ifStatement.ElseBlock != nil {
-			c.emit(ELSE)
-			err = c.compileNode(ifStatement.ElseBlock)
-			if err != nil {
+			endJump := c.emitJump(JUMP)
+			c.patchJump(elseJump)
+			if err := c.compileBranch(ifStatement.ElseBlock, tail, discard); err != nil {
 				return err
 			}
+			c.patchJump(endJump)
+		} else {
+			c.patchJump(elseJump)
 		}
 
-		c.emit(ENDIF)
-
 		return nil
 	case parser.FunctionDefinition:
 		return c.compileFunctionDefinition(n)
 	case parser.ReturnStatement:
-		err := c.compileNode(n.ReturnValue)
+		if n.ReturnValue == nil {
+			c.emit(RETURN, 0)
+			return nil
+		}
+		err := c.compileTail(n.ReturnValue, c.function != nil && c.function.tries == 0)
 		if err != nil {
 			return err
 		}
-		c.emit(RETURN)
+		c.emit(RETURN, 1)
 		return nil
 	case parser.LambdaExpression:
-		lambdaExpr := node.(parser.LambdaExpression)
-		paramNames := make([]string, len(lambdaExpr.Params))
+		return c.compileLambdaExpression(n)
+	case parser.MapExpression:
+		return c.compileMapExpression(n)
+	case parser.FilterExpression:
+		return c.compileFilterExpression(n)
+	case parser.ReduceExpression:
+		return c.compileReduceExpression(n)
+	case parser.SpawnStatement:
+		if err := c.effect("spawns a task"); err != nil {
+			return err
+		}
+		return c.compileSpawnStatement(n)
+	case parser.ChannelExpression:
+		if err := c.effect("makes a channel"); err != nil {
+			return err
+		}
+		if n.Capacity != nil {
+			if err := c.compileNode(n.Capacity); err != nil {
+				return err
+			}
+		} else {
+			c.emit(PUSH_INT, int64(0))
+		}
+		c.emit(MAKE_CHANNEL)
+	case parser.SendStatement:
+		if err := c.effect("sends on a channel"); err != nil {
+			return err
+		}
+		if err := c.compileNode(n.Channel); err != nil {
+			return err
+		}
+		if err := c.compileNode(n.Value); err != nil {
+			return err
+		}
+		c.emit(SEND)
+	case parser.ReceiveExpression:
+		if err := c.effect("receives from a channel"); err != nil {
+			return err
+		}
+		if err := c.compileNode(n.Channel); err != nil {
+			return err
+		}
+		if n.Else == nil {
+			c.emit(RECV, 0)
+			return nil
+		}
+		if err := c.compileNode(n.Else); err != nil {
+			return err
+		}
+		c.emit(RECV, 1)
+	case parser.CloseStatement:
+		if err := c.effect("closes a channel"); err != nil {
+			return err
+		}
+		if err := c.compileNode(n.Channel); err != nil {
+			return err
+		}
+		c.emit(CLOSE)
+	case parser.SelectStatement:
+		if err := c.effect("selects on channels"); err != nil {
+			return err
+		}
+		return c.compileSelectStatement(n, tail)
+	case parser.TryExpression:
+		return c.compileTryExpression(n, tail)
+	case parser.RaiseStatement:
+		if err := c.compileNode(n.Value); err != nil {
+			return err
+		}
+		c.emit(RAISE)
 
-		jumpInstructionIndex := len(c.bytecode)
-		c.emit(JUMP, 0)
-		c.enterScope()
+	default:
+		return c.errorf("unknown node type: %T", n)
+	}
+
+	//fmt.Println("Exiting compileNode")
+	return nil
+}
+
+// compileVariable loads a variable from where it lives: a slot of the
+// current frame, an upvalue captured from an enclosing function, or a global.
+func (c *Compiler) compileVariable(name string, symbol Symbol, table *SymbolTable) {
+	switch table.function {
+	case nil:
+		c.emit(LOAD_GLOBAL, symbol.Slot, name)
+	case c.function:
+		c.emit(LOAD_LOCAL, symbol.Slot, name)
+	default:
+		c.emit(LOAD_UPVALUE, c.function.capture(name, table.function, symbol.Slot), name)
+	}
+}
+
+func (c *Compiler) compileOperator(operator string) error {
+	switch operator {
+	case "+":
+		c.emit(ADD)
+	case "-":
+		c.emit(SUB)
+	case "*":
+		c.emit(MUL)
+	case "/":
+		c.emit(DIV)
+	case "%":
+		c.emit(MOD)
+	case ">":
+		c.emit(GRT)
+	case "<":
+		c.emit(LESS)
+	case ">=":
+		c.emit(GEQ)
+	case "<=":
+		c.emit(LEQ)
+	case "=":
+		c.emit(EQ)
+	case "!=":
+		c.emit(NEQ)
+	case "not":
+		c.emit(NOT)
+	default:
+		return c.errorf("unknown operator: %s", operator)
+	}
+	return nil
+}
 
-		for i, param := range lambdaExpr.Params {
-			paramNames[i] = param.Variable
-			c.symbolTable.DefineVariable(param.Variable, ParseDataType(param.Type))
+// compileLogicalExpression compiles and/or so that the right operand is only
+// evaluated when the left one does not already decide the result.
+func (c *Compiler) compileLogicalExpression(n parser.BinaryExpression) error {
+	if err := c.compileNode(n.Left); err != nil {
+		return err
+	}
+	shortCircuit := c.emitJump(JUMP_IF_FALSE)
+
+	if n.Operator == "and" {
+		if err := c.compileNode(n.Right); err != nil {
+			return err
 		}
+		endJump := c.emitJump(JUMP)
+		c.patchJump(shortCircuit)
+		c.emit(PUSH_BOOL, false)
+		c.patchJump(endJump)
+		return nil
+	}
 
-		startAddress := len(c.bytecode)
-		for _, expr := range lambdaExpr.Body {
-			err := c.compileNode(expr)
+	c.emit(PUSH_BOOL, true)
+	endJump := c.emitJump(JUMP)
+	c.patchJump(shortCircuit)
+	if err := c.compileNode(n.Right); err != nil {
+		return err
+	}
+	c.patchJump(endJump)
+	return nil
+}
+
+// conversions maps the numeric conversion builtins to their opcodes.
+var conversions = map[string]Opcode{
+	"int":   TO_INT,
+	"float": TO_FLOAT,
+}
+
+func (c *Compiler) compileCallExpression(call parser.CallExpression, tail bool) error {
+	switch callee := call.Callee.(type) {
+	case parser.Identifier:
+		if callee.Value == "print" {
+			if len(call.Arguments) != 1 {
+				return c.errorf("print expects one argument")
+			}
+			if err := c.effect("calls print"); err != nil {
+				return err
+			}
+			err := c.compileNode(call.Arguments[0])
 			if err != nil {
 				return err
 			}
+			c.emit(PRINT)
+			return nil
 		}
-		endAddress := len(c.bytecode)
-		jumpOffset := len(c.bytecode) - jumpInstructionIndex
-		correctOffset := calculateCorrectedOffset(c.bytecode, jumpOffset) - 1
-		updateJumpInstruction(c.bytecode, jumpInstructionIndex, correctOffset)
-
-		//fmt.Printf("Symbol Table before capturing lambda variables: \n")
-		if *c.debugMode {
-			c.symbolTable.Print()
+		if callee.Value == "message" {
+			if len(call.Arguments) != 1 {
+				return c.errorf("message expects one argument")
+			}
+			if err := c.compileNode(call.Arguments[0]); err != nil {
+				return err
+			}
+			c.emit(MESSAGE)
+			return nil
 		}
-		capturedVariables, err := c.determineCapturedVariables(lambdaExpr.Body, lambdaExpr.Params)
-		if err != nil {
-			return fmt.Errorf("Error capturing lambda variables: %v\n", err)
+		if opcode, ok := conversions[callee.Value]; ok {
+			if len(call.Arguments) != 1 {
+				return c.errorf("%s expects one argument", callee.Value)
+			}
+			if err := c.compileNode(call.Arguments[0]); err != nil {
+				return err
+			}
+			c.emit(opcode)
+			return nil
 		}
-		//fmt.Printf("Captured lambda variables: %v\n", capturedVariables)
-
-		c.emit(CREATE_LAMBDA, startAddress, endAddress, len(lambdaExpr.Params), paramNames, len(capturedVariables), capturedVariables)
 
-		c.leaveScope()
+		symbol, table, found := c.symbolTable.lookup(callee.Value)
+		if !found {
+			return c.errorf("undefined function: %s", callee.Value)
+		}
+		if symbol.Type == NativeSymbol {
+			return c.compileNativeCall(callee.Value, call.Arguments)
+		}
+		if symbol.Type == VariableSymbol {
+			// a variable holding a lambda, called like one
+			if err := c.calls(symbol.purity, callee.Value); err != nil {
+				return err
+			}
+			c.compileVariable(callee.Value, symbol, table)
+			for _, arg := range call.Arguments {
+				if err := c.compileNode(arg); err != nil {
+					return err
+				}
+			}
+			c.emit(CALL_LAMBDA, len(call.Arguments))
+			return nil
+		}
+		if symbol.Type != FunctionSymbol {
+			return c.errorf("%s is not a function", callee.Value)
+		}
+		if len(call.Arguments) != len(symbol.ParamNames) {
+			return c.errorf("function %s expects %d arguments, got %d", callee.Value, len(symbol.ParamNames), len(call.Arguments))
+		}
+		if err := c.calls(c.names[callee.Value], callee.Value); err != nil {
+			return err
+		}
 
+		for _, arg := range call.Arguments {
+			if err := c.compileNode(arg); err != nil {
+				return err
+			}
+		}
+		c.emitCall(callee.Value, tail)
 		return nil
-	case parser.LambdaCall:
-		lambdaCall := node.(parser.LambdaCall)
-
-		err := c.compileNode(lambdaCall.Lambda)
+	case parser.LambdaExpression:
+		err := c.compileNode(callee)
 		if err != nil {
 			return err
 		}
+		if err := c.calls(c.lastLambda, "a lambda"); err != nil {
+			return err
+		}
 
-		for _, arg := range lambdaCall.Arguments {
+		for _, arg := range call.Arguments {
 			err := c.compileNode(arg)
 			if err != nil {
 				return err
 			}
 		}
 
-		c.emit(CALL_LAMBDA, len(lambdaCall.Arguments))
-
+		c.emit(CALL_LAMBDA, len(call.Arguments))
 		return nil
-	case parser.MapExpression:
-		return c.compileMapExpression(n)
-	case parser.FilterExpression:
-		return c.compileFilterExpression(n)
-	case parser.ReduceExpression:
-		return c.compileReduceExpression(n)
-
 	default:
-		return fmt.Errorf("unknown node type: %T", n)
+		return c.errorf("expression of type %T is not callable", callee)
 	}
+}
+
+func (c *Compiler) compileNativeCall(name string, args []parser.Node) error {
+	native, ok := c.natives.Lookup(name)
+	if !ok {
+		return c.errorf("undefined native function: %s", name)
+	}
+	if len(args) != native.ParamCount() {
+		return c.errorf("function %s expects %d arguments, got %d", name, native.ParamCount(), len(args))
+	}
+	if !native.Pure {
+		if err := c.effect("calls Go function " + name); err != nil {
+			return err
+		}
+	}
+
+	for _, arg := range args {
+		if err := c.compileNode(arg); err != nil {
+			return err
+		}
+	}
+	c.emit(CALL_NATIVE, name, len(args))
+	return nil
+}
+
+func (c *Compiler) compileLambdaExpression(lambdaExpr parser.LambdaExpression) error {
+	paramNames := make([]string, len(lambdaExpr.Params))
+
+	jumpInstructionIndex := c.emitJump(JUMP)
+	p := newPurity()
+	if lambdaExpr.Pure {
+		p.declared = "lambda"
+	}
+	c.enterFunction(p)
+
+	for i, param := range lambdaExpr.Params {
+		paramNames[i] = param.Variable
+		c.defineLocal(param.Variable, dataTypeOf(param.Type))
+	}
+
+	startAddress := len(c.bytecode)
+	err := c.compileTail(lambdaExpr.Body, true)
+	if err != nil {
+		return err
+	}
+	body := []parser.Node{lambdaExpr.Body}
+	if block, ok := lambdaExpr.Body.(parser.Block); ok {
+		body = block.Expressions
+	}
+	if !c.endsInReturn(body) {
+		c.emitReturn(body)
+	}
+	endAddress := len(c.bytecode)
+	c.patchJump(jumpInstructionIndex)
+
+	if c.trace != nil {
+		c.symbolTable.Print(c.trace)
+	}
+	fn := c.leaveFunction()
+
+	c.emit(CREATE_LAMBDA, startAddress, endAddress, len(lambdaExpr.Params), paramNames, fn.locals, fn.captures(), fn.purity.pure())
+	c.markPure(fn)
+	c.lastLambda = fn.purity
 
-	//fmt.Println("Exiting compileNode")
 	return nil
 }
 
 func (c *Compiler) compileMapExpression(mapExpr parser.MapExpression) error {
 	err := c.compileNode(mapExpr.Lambda)
 	if err != nil {
-		return fmt.Errorf("error compiling lambda in map expression: %v", err)
+		return err
+	}
+	if err := c.calls(c.functionValue(mapExpr.Lambda)); err != nil {
+		return err
 	}
 
-	for _, arg := range mapExpr.Arguments {
-		err := c.compileNode(arg)
-		if err != nil {
-			return fmt.Errorf("error compiling argument in map expression: %v", err)
-		}
+	err = c.compileNode(mapExpr.List)
+	if err != nil {
+		return err
 	}
 
-	c.emit(MAP, len(mapExpr.Arguments))
+	if mapExpr.Parallel {
+		c.emit(PMAP)
+	} else {
+		c.emit(MAP)
+	}
 
 	return nil
 }
@@ -546,17 +1078,22 @@ func (c *Compiler) compileMapExpression(mapExpr parser.MapExpression) error {
 func (c *Compiler) compileFilterExpression(filterExpr parser.FilterExpression) error {
 	err := c.compileNode(filterExpr.Lambda)
 	if err != nil {
-		return fmt.Errorf("error compiling lambda in filter expression: %v", err)
+		return err
+	}
+	if err := c.calls(c.functionValue(filterExpr.Lambda)); err != nil {
+		return err
 	}
 
-	for _, arg := range filterExpr.Arguments {
-		err := c.compileNode(arg)
-		if err != nil {
-			return fmt.Errorf("error compiling argument in filter expression: %v", err)
-		}
+	err = c.compileNode(filterExpr.List)
+	if err != nil {
+		return err
 	}
 
-	c.emit(FILTER, len(filterExpr.Arguments))
+	if filterExpr.Parallel {
+		c.emit(PFILTER)
+	} else {
+		c.emit(FILTER)
+	}
 
 	return nil
 }
@@ -566,85 +1103,226 @@ func (c *Compiler) compileReduceExpression(reduceExpr parser.ReduceExpression) e
 	if err != nil {
 		return err
 	}
+	if err := c.calls(c.functionValue(reduceExpr.Lambda)); err != nil {
+		return err
+	}
 
 	err = c.compileNode(reduceExpr.InitialValue)
 	if err != nil {
 		return err
 	}
 
-	for _, arg := range reduceExpr.Arguments {
-		err = c.compileNode(arg)
-		if err != nil {
+	err = c.compileNode(reduceExpr.List)
+	if err != nil {
+		return err
+	}
+
+	c.emit(REDUCE)
+
+	return nil
+}
+
+// compileSpawnStatement pushes the function that a spawn runs, followed by
+// its arguments, for SPAWN. A def function is loaded as a value even when it
+// has no parameters and its bare name would call it.
+func (c *Compiler) compileSpawnStatement(n parser.SpawnStatement) error {
+	callee, args := n.Call, []parser.Node(nil)
+	if call, ok := n.Call.(parser.CallExpression); ok {
+		callee, args = call.Callee, call.Arguments
+	}
+
+	if ident, ok := callee.(parser.Identifier); ok && c.symbolTable.IsFunction(ident.Value) {
+		symbol, _ := c.symbolTable.Resolve(ident.Value)
+		c.emit(LOAD_FUNCTION, ident.Value, symbol.StartAddress)
+	} else if err := c.compileNode(callee); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		if err := c.compileNode(arg); err != nil {
 			return err
 		}
+	}
+	c.emit(SPAWN, len(args))
+	return nil
+}
 
-		//c.emit(CALL_LAMBDA, 2)
-		c.emit(REDUCE, 2)
+// compileSelectStatement pushes the channels of the cases of a select, and
+// the values of its send cases, for SELECT, which continues at the code of
+// the case it chooses. The code of a receive case starts by binding the
+// value received.
+func (c *Compiler) compileSelectStatement(n parser.SelectStatement, tail bool) error {
+	// a select without a value drops that of a case that has one
+	discard := valueless(n)
+
+	cases := make([]Case, len(n.Cases))
+	for i, selectCase := range n.Cases {
+		switch selectCase.Kind {
+		case "recv":
+			cases[i].Kind = RecvCase
+		case "send":
+			cases[i].Kind = SendCase
+		default:
+			cases[i].Kind = ElseCase
+			continue
+		}
+		if err := c.compileNode(selectCase.Channel); err != nil {
+			return err
+		}
+		if selectCase.Kind == "send" {
+			if err := c.compileNode(selectCase.Value); err != nil {
+				return err
+			}
+		}
 	}
+	selectIndex := len(c.bytecode)
+	c.emit(SELECT, cases)
+
+	var endJumps []int
+	for i, selectCase := range n.Cases {
+		// after the opcode and the number of cases, each case is a kind byte
+		// and an address
+		binary.LittleEndian.PutUint32(c.bytecode[selectIndex+1+4+i*5+1:], uint32(len(c.bytecode)))
+
+		endScope := func() {}
+		if selectCase.Kind == "recv" {
+			endScope = c.bindValue(selectCase.Binding)
+		}
+		if err := c.compileBranch(selectCase.Body, tail, discard); err != nil {
+			return err
+		}
+		endScope()
 
+		if i < len(n.Cases)-1 {
+			endJumps = append(endJumps, c.emitJump(JUMP))
+		}
+	}
+	for _, endJump := range endJumps {
+		c.patchJump(endJump)
+	}
+	return nil
+}
+
+// bindValue stores the value received by a receive case, or the error caught
+// by a catch, in the variable that binding names, and returns a function that
+// ends the variable's scope at the end of the case or catch. The variable gets
+// a slot of its own, so that cases binding the same name do not share one.
+func (c *Compiler) bindValue(binding parser.TypeAnnotation) func() {
+	name, dataType := binding.Variable, dataTypeOf(binding.Type)
+	table := c.symbolTable
+	for c.function == nil && table.Parent != nil {
+		table = table.Parent
+	}
+	previous, shadowed := table.Symbols[name]
+
+	if c.function == nil {
+		slot := c.globals
+		c.globals++
+		table.DefineVariable(name, dataType, slot)
+		c.emit(DEFINE_GLOBAL, slot, name)
+	} else {
+		slot := c.function.locals
+		c.function.locals++
+		table.DefineVariable(name, dataType, slot)
+		c.emit(STORE_LOCAL, slot, name)
+	}
+
+	return func() {
+		if shadowed {
+			table.Symbols[name] = previous
+		} else {
+			delete(table.Symbols, name)
+		}
+	}
+}
+
+// compileTryExpression runs the body of a try with a handler, which TRY
+// installs and END_TRY removes. An error raised while the body runs, in it or
+// in a function it calls, unwinds the stack to where it was at TRY and
+// continues at the catch with the error on it.
+func (c *Compiler) compileTryExpression(n parser.TryExpression, tail bool) error {
+	// a try without a value drops that of a body or catch that has one
+	discard := valueless(n)
+
+	tryJump := c.emitJump(TRY)
+	if c.function != nil {
+		c.function.tries++
+	}
+	err := c.compileTail(n.Body, false)
+	if c.function != nil {
+		c.function.tries--
+	}
+	if err != nil {
+		return err
+	}
+	if discard && !valueless(n.Body) {
+		c.emit(POP)
+	}
+	c.emit(END_TRY)
+	endJump := c.emitJump(JUMP)
+
+	c.patchJump(tryJump)
+	endScope := c.bindValue(n.Binding)
+	if err := c.compileTail(n.Catch, tail); err != nil {
+		return err
+	}
+	endScope()
+	if discard && !valueless(n.Catch) {
+		c.emit(POP)
+	}
+	c.patchJump(endJump)
 	return nil
 }
 
 func (c *Compiler) compileFunctionDefinition(fnDef parser.FunctionDefinition) error {
-	if *c.debugMode {
-		fmt.Println("Compiling function definition:", fnDef.Name)
+	if c.trace != nil {
+		fmt.Fprintln(c.trace, "Compiling function definition:", fnDef.Name)
 	}
+	jumpInstructionIndex := c.emitJump(JUMP)
 	startAddress := len(c.bytecode)
 
 	var paramNames []string
 	for _, param := range fnDef.Params {
 		paramNames = append(paramNames, param.Variable)
-		c.symbolTable.DefineVariable(param.Variable, ParseDataType(param.Type))
-		if *c.debugMode {
-			fmt.Printf("Defined variable: %s\n", param)
-		}
 	}
-	c.symbolTable.DefineFunction(fnDef.Name, startAddress, paramNames, ParseDataType(fnDef.ReturnType))
+	c.symbolTable.DefineFunction(fnDef.Name, startAddress, paramNames, dataTypeOf(fnDef.ReturnType))
+	body := c.definePurity(fnDef.Name, fnDef.Pure)
+	c.symbolTable.setPurity(fnDef.Name, c.names[fnDef.Name])
 
-	if *c.debugMode {
-		fmt.Println("Symbol table after defining parameters:")
-		c.symbolTable.Print()
-	}
+	c.enterFunction(body)
 
-	c.emit(JUMP, 0)
+	for _, param := range fnDef.Params {
+		c.defineLocal(param.Variable, dataTypeOf(param.Type))
+		if c.trace != nil {
+			fmt.Fprintf(c.trace, "Defined variable: %v\n", param)
+		}
+	}
 
-	c.enterScope()
-	c.setCurrentFunction(fnDef.Name)
+	if c.trace != nil {
+		fmt.Fprintln(c.trace, "Symbol table after defining parameters:")
+		c.symbolTable.Print(c.trace)
+	}
 
-	instructionCountBeforeBody := len(c.bytecode)
-	for _, expr := range fnDef.Body {
-		switch e := expr.(type) {
-		case parser.ReturnStatement:
-			if err := c.compileNode(e.ReturnValue); err != nil {
-				return err
-			}
-			c.emit(RETURN)
-		default:
-			if err := c.compileNode(expr); err != nil {
-				return err
-			}
-		}
+	if err := c.compileTail(fnDef.Body, true); err != nil {
+		return err
 	}
-	if !c.endsInReturn(fnDef.Body) {
-		c.emit(RETURN)
+	if !c.endsInReturn(fnDef.Body.Expressions) {
+		c.emitReturn(fnDef.Body.Expressions)
 	}
-	instructionCountAfterBody := len(c.bytecode)
-	jumpOffset := instructionCountAfterBody - instructionCountBeforeBody
-	correctOffset := calculateCorrectedOffset(c.bytecode, jumpOffset) - 1
-	updateJumpInstruction(c.bytecode, startAddress, correctOffset)
-	c.leaveScope()
+	c.patchJump(jumpInstructionIndex)
+	fn := c.leaveFunction()
 
-	if *c.debugMode {
-		fmt.Println("Symbol table after leaving scope:")
-		c.symbolTable.Print()
+	if c.trace != nil {
+		fmt.Fprintln(c.trace, "Symbol table after leaving scope:")
+		c.symbolTable.Print(c.trace)
 	}
 
-	c.setCurrentFunction("")
-	c.symbolTable.DefineFunction(fnDef.Name, startAddress, paramNames, ParseDataType(fnDef.ReturnType))
+	c.symbolTable.DefineFunction(fnDef.Name, startAddress, paramNames, dataTypeOf(fnDef.ReturnType))
+	c.symbolTable.setPurity(fnDef.Name, c.names[fnDef.Name])
 	paramCount := len(fnDef.Params)
-	c.emitDefineFunction(fnDef.Name, startAddress, paramCount, paramNames)
-	if *c.debugMode {
-		fmt.Println("Function compiled:", fnDef.Name)
+	c.emitDefineFunction(fnDef.Name, startAddress, paramCount, paramNames, fn)
+	c.functions = append(c.functions, FunctionInfo{Name: fnDef.Name, StartAddress: startAddress, ParamNames: paramNames})
+	if c.trace != nil {
+		fmt.Fprintln(c.trace, "Function compiled:", fnDef.Name)
 	}
 	return nil
 }
@@ -657,7 +1335,24 @@ func (c *Compiler) leaveScope() {
 	c.symbolTable = c.symbolTable.Parent
 }
 
-func (c *Compiler) endsInReturn(body []interface{}) bool {
+// enterFunction starts the scope and frame of a function or lambda body,
+// whose purity is p.
+func (c *Compiler) enterFunction(p *purity) {
+	c.enterScope()
+	c.function = &funcState{enclosing: c.function, purity: p}
+	c.symbolTable.function = c.function
+}
+
+// leaveFunction ends the body started by enterFunction and returns its
+// frame.
+func (c *Compiler) leaveFunction() *funcState {
+	fn := c.function
+	c.function = fn.enclosing
+	c.leaveScope()
+	return fn
+}
+
+func (c *Compiler) endsInReturn(body []parser.Node) bool {
 	if len(body) == 0 {
 		return false
 	}
@@ -666,19 +1361,96 @@ func (c *Compiler) endsInReturn(body []interface{}) bool {
 	return isRet
 }
 
-func (c *Compiler) emitDefineFunction(funcName string, startAddress, paramCount int, paramNames []string) {
-	c.emit(DEFINE_FUNCTION, funcName, startAddress, paramCount, paramNames)
+// emitReturn returns from a function or lambda at the end of body, with the
+// value of its last expression if that leaves one.
+func (c *Compiler) emitReturn(body []parser.Node) {
+	if len(body) == 0 || valueless(body[len(body)-1]) {
+		c.emit(RETURN, 0)
+	} else {
+		c.emit(RETURN, 1)
+	}
+}
+
+// valueless reports whether node is a statement that leaves no value on the
+// stack, such as let or print, or an if, select or try that has no value as
+// the type checker sees it. A call always leaves one, so a function without a
+// value returns nil for its caller to ignore.
+func valueless(node parser.Node) bool {
+	switch n := node.(type) {
+	case parser.LetStatement, parser.FunctionDefinition, parser.ReturnStatement,
+		parser.SpawnStatement, parser.SendStatement, parser.CloseStatement:
+		return true
+	case parser.CallExpression:
+		callee, ok := n.Callee.(parser.Identifier)
+		return ok && callee.Value == "print"
+	case parser.Block:
+		return len(n.Expressions) == 0 || valueless(n.Expressions[len(n.Expressions)-1])
+	case parser.IfStatement:
+		return n.ElseBlock == nil || valueless(n.ThenBlock) || valueless(n.ElseBlock)
+	case parser.SelectStatement:
+		for _, selectCase := range n.Cases {
+			if valueless(selectCase.Body) {
+				return true
+			}
+		}
+		return false
+	case parser.TryExpression:
+		return valueless(n.Body) || valueless(n.Catch)
+	}
+	return false
+}
+
+// compileBranch compiles a branch of an if or a case of a select, in tail
+// position if tail is set, popping its value if discard is set and it has
+// one. A branch whose value is dropped is not in tail position: the function
+// does not return it.
+func (c *Compiler) compileBranch(branch parser.Node, tail, discard bool) error {
+	drop := discard && !valueless(branch)
+	if err := c.compileTail(branch, tail && !drop); err != nil {
+		return err
+	}
+	if drop {
+		c.emit(POP)
+	}
+	return nil
+}
+
+// compileTail compiles node, in tail position if tail is set.
+func (c *Compiler) compileTail(node parser.Node, tail bool) error {
+	c.tail = tail
+	return c.compileNode(node)
+}
+
+// emitCall calls the def function name, with TAIL_CALL in tail position so
+// that the call reuses the caller's frame instead of returning to it. The
+// call records the start of the definition that name refers to here, whose
+// parameters it passes arguments for.
+func (c *Compiler) emitCall(name string, tail bool) {
+	symbol, _ := c.symbolTable.Resolve(name)
+	if tail {
+		c.emit(TAIL_CALL, name, symbol.StartAddress)
+	} else {
+		c.emit(CALL_FUNCTION, name, symbol.StartAddress)
+	}
+}
+
+func (c *Compiler) emitDefineFunction(funcName string, startAddress, paramCount int, paramNames []string, fn *funcState) {
+	c.emit(DEFINE_FUNCTION, funcName, startAddress, paramCount, paramNames, fn.locals, fn.captures(), fn.purity.pure())
+	c.markPure(fn)
 }
 
 func (c *Compiler) emit(opcode Opcode, operands ...interface{}) {
 	//fmt.Printf("Emitting opcode: %d with operands: %v\n", opcode, operands)
+	c.positions[len(c.bytecode)] = c.pos
 	opcodeBytes := []byte{byte(opcode)}
-	operandBytes := serializeOperands(operands)
+	operandBytes := c.serializeOperands(operands)
 	c.bytecode = append(c.bytecode, opcodeBytes...)
 	c.bytecode = append(c.bytecode, operandBytes...)
 }
 
-func serializeOperands(operands []interface{}) []byte {
+// serializeOperands encodes operands as they are laid out in the bytecode,
+// with strings replaced by their index in the constant pool.
+func (c *Compiler) serializeOperands(operands []interface{}) []byte {
 	var result []byte
 
 	for _, operand := range operands {
@@ -687,17 +1459,17 @@ func serializeOperands(operands []interface{}) []byte {
 			intBytes := make([]byte, 4)
 			binary.LittleEndian.PutUint32(intBytes, uint32(v))
 			result = append(result, intBytes...)
+		case int64:
+			buf := make([]byte, 8)
+			binary.LittleEndian.PutUint64(buf, uint64(v))
+			result = append(result, buf...)
 		case float64:
 			bits := math.Float64bits(v)
 			buf := make([]byte, 8)
 			binary.LittleEndian.PutUint64(buf, bits)
 			result = append(result, buf...)
 		case string:
-			strBytes := []byte(v)
-			lengthBuf := make([]byte, 4)
-			binary.LittleEndian.PutUint32(lengthBuf, uint32(len(strBytes)))
-			result = append(result, lengthBuf...)
-			result = append(result, strBytes...)
+			result = binary.LittleEndian.AppendUint32(result, uint32(c.constant(v)))
 		case bool:
 			if v {
 				result = append(result, 1)
@@ -710,406 +1482,96 @@ func serializeOperands(operands []interface{}) []byte {
 			result = append(result, sliceLenBytes...)
 
 			for _, str := range v {
-				strBytes := []byte(str)
-				lengthBuf := make([]byte, 4)
-				binary.LittleEndian.PutUint32(lengthBuf, uint32(len(strBytes)))
-				result = append(result, lengthBuf...)
-				result = append(result, strBytes...)
+				result = binary.LittleEndian.AppendUint32(result, uint32(c.constant(str)))
+			}
+		case []Capture:
+			countBytes := make([]byte, 4)
+			binary.LittleEndian.PutUint32(countBytes, uint32(len(v)))
+			result = append(result, countBytes...)
+
+			for _, capture := range v {
+				result = append(result, c.serializeOperands([]interface{}{capture.Name, capture.Local, capture.Index})...)
+			}
+		case []Case:
+			countBytes := make([]byte, 4)
+			binary.LittleEndian.PutUint32(countBytes, uint32(len(v)))
+			result = append(result, countBytes...)
+
+			for _, selectCase := range v {
+				result = append(result, byte(selectCase.Kind))
+				result = append(result, c.serializeOperands([]interface{}{selectCase.Address})...)
 			}
 		default:
-			fmt.Printf("Unsupported operand type: %T\n", v)
+			// only reachable through a bug in the compiler
+			panic(fmt.Sprintf("unsupported operand type %T", v))
 		}
 	}
 
 	return result
 }
 
-func calculateCorrectedOffset(bytecode []byte, targetOffset int) int {
-	instructionCount := 0
-	i := 0
-
-	for i < len(bytecode) && instructionCount < targetOffset {
-		opcode := Opcode(bytecode[i])
-		i++
-
-		switch opcode {
-		case PUSH_NUMBER:
-			i += 8
-		case PUSH_STRING, PUSH_VARIABLE, DEFINE_VARIABLE, CALL_FUNCTION:
-			if i+4 > len(bytecode) {
-				break
-			}
-			operandLength := int(binary.LittleEndian.Uint32(bytecode[i : i+4]))
-			i += 4 + operandLength
-		case PUSH_BOOL:
-			i++
-		case JUMP:
-			i += 4
-
-		default:
-
-		}
-
-		instructionCount++
-	}
+// emitJump emits a jump with a placeholder target and returns the offset of
+// the instruction so that patchJump can fill in the target later.
+func (c *Compiler) emitJump(opcode Opcode) int {
+	jumpIndex := len(c.bytecode)
+	c.emit(opcode, 0)
+	return jumpIndex
+}
 
-	return instructionCount
+// patchJump points the jump at jumpIndex to the next instruction emitted.
+func (c *Compiler) patchJump(jumpIndex int) {
+	updateJumpInstruction(c.bytecode, jumpIndex, len(c.bytecode))
 }
 
-func updateJumpInstruction(bytecode []byte, jumpIndex int, correctedOffset int) {
+func updateJumpInstruction(bytecode []byte, jumpIndex int, targetOffset int) {
 	offsetBytes := make([]byte, 4)
-	binary.LittleEndian.PutUint32(offsetBytes, uint32(correctedOffset))
+	binary.LittleEndian.PutUint32(offsetBytes, uint32(targetOffset))
 	copy(bytecode[jumpIndex+1:], offsetBytes)
 }
 
-func (c *Compiler) determineCapturedVariables(lambdaBody []interface{}, lambdaParams []parser.TypeAnnotation) ([]string, error) {
-	captured := make(map[string]bool)
-	var err error
-
-	paramNames := make(map[string]bool)
-	for _, param := range lambdaParams {
-		paramNames[param.Variable] = true
-	}
-
-	var visitNode func(node interface{})
-	visitNode = func(node interface{}) {
-		switch n := node.(type) {
-		case parser.Identifier:
-			symbol, found := c.symbolTable.Resolve(n.Value)
-			if found && symbol.Type == VariableSymbol && !paramNames[n.Value] {
-				captured[n.Value] = true
-			}
-		case []interface{}:
-			for _, elem := range n {
-				visitNode(elem)
-			}
-		}
-	}
-
-	for _, expr := range lambdaBody {
-		visitNode(expr)
-	}
-
-	var capturedVars []string
-	for varName := range captured {
-		capturedVars = append(capturedVars, varName)
-	}
-
-	return capturedVars, err
-}
-
-func convertBytecode(rawBytecode []byte, d *bool) ([]BytecodeInstruction, map[int]int, error) {
-	if *d {
-		fmt.Printf("Raw Bytecode: %v\n", rawBytecode)
+func convertBytecode(rawBytecode []byte, constants []string, positions map[int]lexer.Position, trace io.Writer) ([]BytecodeInstruction, map[int]int, error) {
+	if trace != nil {
+		fmt.Fprintf(trace, "Raw Bytecode: %v\n", rawBytecode)
 	}
 
 	var instructions []BytecodeInstruction
 	offsetToInstructionIndex := make(map[int]int)
-	i := 0
-	currentOffset := 0
-
-	for i < len(rawBytecode) {
-		offsetToInstructionIndex[currentOffset] = len(instructions)
-		opcode := Opcode(rawBytecode[i])
-		i++
-		currentOffset++
-
-		var operands []interface{}
-		switch opcode {
-		case PUSH_NUMBER:
-			if i+8 > len(rawBytecode) {
-				return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data")
-			}
-			numberBytes := rawBytecode[i : i+8]
-			operands = append(operands, numberBytes)
-			i += 8
-			currentOffset += 8
-		case PUSH_BOOL:
-			if i >= len(rawBytecode) {
-				return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data")
-			}
-			boolByte := rawBytecode[i]
-			operands = append(operands, boolByte)
-			i++
-			currentOffset++
-		case PUSH_STRING:
-			if i+4 > len(rawBytecode) {
-				return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data")
-			}
-			strLenBytes := rawBytecode[i : i+4]
-			operands = append(operands, strLenBytes)
-			i += 4
-			currentOffset += 4
-
-			strLen := int(binary.LittleEndian.Uint32(strLenBytes))
-
-			if i+strLen > len(rawBytecode) {
-				return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data")
-			}
-			strBytes := rawBytecode[i : i+strLen]
-			operands = append(operands, strBytes)
-			i += strLen
-			currentOffset += strLen
-		case PUSH_VARIABLE:
-			if i+4 > len(rawBytecode) {
-				return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data")
-			}
-			varNameLenBytes := rawBytecode[i : i+4]
-			operands = append(operands, varNameLenBytes)
-			i += 4
-			currentOffset += 4
-
-			varNameLen := int(binary.LittleEndian.Uint32(varNameLenBytes))
-			if i+varNameLen > len(rawBytecode) {
-				return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data")
-			}
-			varBytes := rawBytecode[i : i+varNameLen]
-			operands = append(operands, varBytes)
-			i += varNameLen
-			currentOffset += varNameLen
-		case DEFINE_VARIABLE:
-			if i+4 > len(rawBytecode) {
-				return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data")
-			}
-			varNameLenBytes := rawBytecode[i : i+4]
-			operands = append(operands, varNameLenBytes)
-			i += 4
-			currentOffset += 4
-
-			varNameLen := int(binary.LittleEndian.Uint32(varNameLenBytes))
-			if i+varNameLen > len(rawBytecode) {
-				return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data")
-			}
-			varBytes := rawBytecode[i : i+varNameLen]
-			operands = append(operands, varBytes)
-			i += varNameLen
-			currentOffset += varNameLen
-		case DEFINE_FUNCTION:
-			if i+4 > len(rawBytecode) {
-				return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data for function name length")
-			}
-			funcNameLen := int(binary.LittleEndian.Uint32(rawBytecode[i : i+4]))
-			i += 4
-			currentOffset += 4
-
-			if i+funcNameLen > len(rawBytecode) {
-				return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data for function name")
-			}
-			funcNameBytes := rawBytecode[i : i+funcNameLen]
-			i += funcNameLen
-			currentOffset += funcNameLen
-
-			if i+4 > len(rawBytecode) {
-				return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data for start address")
-			}
-			startAddressBytes := rawBytecode[i : i+4]
-			i += 4
-			currentOffset += 4
+	r := &bytecodeReader{data: rawBytecode, constants: constants}
 
-			if i+4 > len(rawBytecode) {
-				return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data for parameter count")
-			}
-			paramCountBytes := rawBytecode[i : i+4]
-			i += 4
-			currentOffset += 4
-			operands = append(operands, funcNameBytes, startAddressBytes, paramCountBytes)
-			//fmt.Printf("===appepnded funcName, startAddress, paramCount: %v\n", operands)
+	for r.pos < len(rawBytecode) {
+		offset := r.pos
+		offsetToInstructionIndex[offset] = len(instructions)
+		opcode := Opcode(rawBytecode[offset])
+		r.pos++
 
-			paramCount := binary.LittleEndian.Uint32(paramCountBytes)
+		operands := r.operands(opcode)
+		if r.err != nil {
+			return nil, nil, fmt.Errorf("%v at offset %d", r.err, offset)
+		}
+		instructions = append(instructions, BytecodeInstruction{Opcode: opcode, Operands: operands, Pos: positions[offset], Offset: offset})
+	}
+	offsetToInstructionIndex[r.pos] = len(instructions)
 
-			if i+4 > len(rawBytecode) {
-				return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data for parameter list length")
-			}
-			paramNamesLenBytes := rawBytecode[i : i+4]
-			paramNamesLen := binary.LittleEndian.Uint32(paramNamesLenBytes)
-			if paramNamesLen != paramCount {
-				return nil, nil, fmt.Errorf("invalid bytecode, parameter list must have the same length as parameter count")
-			}
-			operands = append(operands, paramNamesLenBytes)
-			//fmt.Printf("===appended param list len: %v\n", operands)
-			i += 4
-			currentOffset += 4
-			//var paramNamesBytes []interface{}
-			for j := uint32(0); j < paramCount; j++ {
-
-				if i+4 > len(rawBytecode) {
-					return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data for parameter name length")
-				}
-				paramNameLenBytes := rawBytecode[i : i+4]
-				paramNameLen := int(binary.LittleEndian.Uint32(paramNameLenBytes))
-				if i+paramNameLen > len(rawBytecode) {
-					return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data for parameter name")
-				}
-				operands = append(operands, paramNameLenBytes)
-				//fmt.Printf("===appended param name len: %v\n", operands)
-				i += 4
-				currentOffset += 4
-				paramNameBytes := rawBytecode[i : i+paramNameLen]
-				i += paramNameLen
-				currentOffset += paramNameLen
-
-				operands = append(operands, paramNameBytes)
-				//fmt.Printf("===appended param name bytes: %v\n", paramNameBytes)
-				//fmt.Printf("===after appending param name bytes: %v\n", operands)
-			}
-		case CALL_FUNCTION:
-			if i+4 > len(rawBytecode) {
-				return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data")
-			}
-			funcNameLenBytes := rawBytecode[i : i+4]
-			operands = append(operands, funcNameLenBytes)
-			i += 4
-			currentOffset += 4
-
-			funcNameLen := int(binary.LittleEndian.Uint32(funcNameLenBytes))
-			if i+funcNameLen > len(rawBytecode) {
-				return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data")
-			}
-			funcNameBytes := rawBytecode[i : i+funcNameLen]
-			operands = append(operands, funcNameBytes)
-			i += funcNameLen
-			currentOffset += funcNameLen
-		case JUMP:
-			if i+4 > len(rawBytecode) {
-				return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data for JUMP offset")
-			}
-			jumpOffsetBytes := rawBytecode[i : i+4]
-			operands = append(operands, jumpOffsetBytes)
-			i += 4
-			currentOffset += 4
+	// resolve addresses now, so that the VM does not look them up each time
+	target := func(offset int) int {
+		if index, ok := offsetToInstructionIndex[offset]; ok {
+			return index
+		}
+		return -1
+	}
+	for i := range instructions {
+		ops := &instructions[i].Operands
+		switch instructions[i].Opcode {
+		case JUMP, JUMP_IF_FALSE, TRY, DEFINE_FUNCTION, CALL_FUNCTION, LOAD_FUNCTION, TAIL_CALL:
+			ops.Target = target(ops.Address)
 		case CREATE_LAMBDA:
-			if i+4 > len(rawBytecode) {
-				return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data for lambda start address")
-			}
-			startAddressBytes := rawBytecode[i : i+4]
-			operands = append(operands, startAddressBytes)
-			i += 4
-			currentOffset += 4
-
-			if i+4 > len(rawBytecode) {
-				return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data for lambda end address")
+			ops.Target = target(ops.Address)
+			ops.EndTarget = target(ops.End)
+		case SELECT:
+			for j := range ops.Cases {
+				ops.Cases[j].Target = target(ops.Cases[j].Address)
 			}
-			endAddressBytes := rawBytecode[i : i+4]
-			operands = append(operands, endAddressBytes)
-			i += 4
-			currentOffset += 4
-
-			if i+4 > len(rawBytecode) {
-				return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data for number of lambda params")
-			}
-			numParamBytes := rawBytecode[i : i+4]
-			operands = append(operands, numParamBytes)
-			i += 4
-			currentOffset += 4
-
-			if i+4 > len(rawBytecode) {
-				return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data for slice length of lambda params")
-			}
-			paramSliceLenBytes := rawBytecode[i : i+4]
-			i += 4
-			currentOffset += 4
-
-			numParam := int(binary.LittleEndian.Uint32(numParamBytes))
-			paramSliceLen := int(binary.LittleEndian.Uint32(paramSliceLenBytes))
-			if paramSliceLen != numParam {
-				return nil, nil, fmt.Errorf("invalid bytecode, invalid data for slice length of lambda params")
-			}
-
-			for jj := 0; jj < numParam; jj++ {
-				if i+4 > len(rawBytecode) {
-					return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data for lambda param name length")
-				}
-				paramNameLenBytes := rawBytecode[i : i+4]
-				paramNameLen := int(binary.LittleEndian.Uint32(paramNameLenBytes))
-				operands = append(operands, paramNameLenBytes)
-				i += 4
-				currentOffset += 4
-
-				if i+paramNameLen > len(rawBytecode) {
-					return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data for lambda param name")
-				}
-				paramNameBytes := rawBytecode[i : i+paramNameLen]
-				operands = append(operands, paramNameBytes)
-				i += paramNameLen
-				currentOffset += paramNameLen
-			}
-
-			if i+4 > len(rawBytecode) {
-				return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data for number of captured variables")
-			}
-			numCapturedBytes := rawBytecode[i : i+4]
-			numCaptured := int(binary.LittleEndian.Uint32(numCapturedBytes))
-			operands = append(operands, numCapturedBytes)
-			i += 4
-			currentOffset += 4
-
-			if i+4 > len(rawBytecode) {
-				return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data for slice length of captured variables")
-			}
-			/*
-				numCapturedSliceLenBytes := rawBytecode[i : i+4]
-				numCapturedSliceLen := int(binary.LittleEndian.Uint32(numCapturedSliceLenBytes))
-				operands = append(operands, numCapturedBytes)
-			*/
-			i += 4
-			currentOffset += 4
-
-			for j := 0; j < numCaptured; j++ {
-				if i+4 > len(rawBytecode) {
-					return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data for captured variable name length")
-				}
-				varNameLenBytes := rawBytecode[i : i+4]
-				varNameLen := int(binary.LittleEndian.Uint32(varNameLenBytes))
-				operands = append(operands, varNameLenBytes)
-				i += 4
-				currentOffset += 4
-
-				if i+varNameLen > len(rawBytecode) {
-					return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data for captured variable name")
-				}
-				varNameBytes := rawBytecode[i : i+varNameLen]
-				operands = append(operands, varNameBytes)
-				i += varNameLen
-				currentOffset += varNameLen
-			}
-		case CALL_LAMBDA:
-			if i+4 > len(rawBytecode) {
-				return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data")
-			}
-			argLenBytes := rawBytecode[i : i+4]
-			operands = append(operands, argLenBytes)
-			i += 4
-			currentOffset += 4
-		case MAP:
-			if i+4 > len(rawBytecode) {
-				return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data")
-			}
-			argLenBytes := rawBytecode[i : i+4]
-			operands = append(operands, argLenBytes)
-			i += 4
-			currentOffset += 4
-		case FILTER:
-			if i+4 > len(rawBytecode) {
-				return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data")
-			}
-			argLenBytes := rawBytecode[i : i+4]
-			operands = append(operands, argLenBytes)
-			i += 4
-			currentOffset += 4
-		case REDUCE:
-			if i+4 > len(rawBytecode) {
-				return nil, nil, fmt.Errorf("invalid bytecode, unexpected end of data")
-			}
-			argLenBytes := rawBytecode[i : i+4]
-			operands = append(operands, argLenBytes)
-			i += 4
-			currentOffset += 4
-
-		default:
-			// Opcodes without operands
 		}
-
-		instructions = append(instructions, BytecodeInstruction{Opcode: opcode, Operands: operands})
 	}
 
 	return instructions, offsetToInstructionIndex, nil
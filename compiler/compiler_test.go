@@ -0,0 +1,96 @@
+package compiler
+
+import (
+	"teriyake/goo/lexer"
+	"teriyake/goo/parser"
+	"testing"
+)
+
+func compileSource(t *testing.T, src string) ([]BytecodeInstruction, map[int]int, error) {
+	t.Helper()
+	ast, err := parser.NewParser(lexer.NewFileLexer("m.goo", src)).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewCompiler(nil).CompileAST(ast)
+}
+
+func TestInstructionPositions(t *testing.T) {
+	code, _, err := compileSource(t, "(print\n  (+ 1 2))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, instruction := range code {
+		if instruction.Opcode == ADD {
+			if instruction.Pos.String() != "m.goo:2:3" {
+				t.Errorf("ADD at %v, want m.goo:2:3", instruction.Pos)
+			}
+			return
+		}
+	}
+	t.Error("no ADD instruction")
+}
+
+func TestErrorPositions(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"(def mul (x:int y:int)\n  (* x z))", "m.goo:2:8: undefined identifier: z"},
+		{"(print\n  y)", "m.goo:2:3: undefined identifier: y"},
+	}
+	for _, tt := range tests {
+		_, _, err := compileSource(t, tt.src)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%q: error = %v, want %q", tt.src, err, tt.want)
+		}
+	}
+}
+
+func TestIfJumps(t *testing.T) {
+	code, offsetMap, err := compileSource(t, "(if (> 1 0) (if (> 2 0) (print 1) else (print 2)) else (print 3))\n(print 4)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the jumps of each if skip to its else branch and past it
+	want := map[int]int{3: 14, 7: 11, 10: 13, 13: 16}
+	for i, instruction := range code {
+		if instruction.Opcode != JUMP && instruction.Opcode != JUMP_IF_FALSE {
+			continue
+		}
+		if target := instruction.Operands.Target; target != want[i] || offsetMap[instruction.Operands.Address] != target {
+			t.Errorf("%s at %d jumps to %d, want %d", OpcodeToString(instruction.Opcode), i, target, want[i])
+		}
+		delete(want, i)
+	}
+	for i := range want {
+		t.Errorf("instruction %d is %s, want a jump", i, OpcodeToString(code[i].Opcode))
+	}
+}
+
+func TestTailCalls(t *testing.T) {
+	tests := []struct {
+		src  string
+		tail bool
+	}{
+		{"(def f (n:int):int (if (= n 0) (0) else (f (- n 1))))", true},
+		{"(def f (n:int):int (if (= n 0) (ret 0)) (ret (f (- n 1))))", true},
+		{"(def f (n:int):int (if (= n 0) (0) else (+ 1 (f (- n 1)))))", false},
+		{"(def g (n:int):int n) (print (g 1))", false},
+		{"(def g (n:int):int n) (def f (xs:[int]):[int] (map ((x:int) -> (g x)) xs))", true},
+	}
+	for _, tt := range tests {
+		code, _, err := compileSource(t, tt.src)
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		tail := false
+		for _, instruction := range code {
+			tail = tail || instruction.Opcode == TAIL_CALL
+		}
+		if tail != tt.tail {
+			t.Errorf("%s: TAIL_CALL emitted = %v, want %v", tt.src, tail, tt.tail)
+		}
+	}
+}
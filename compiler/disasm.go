@@ -0,0 +1,221 @@
+package compiler
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type region struct {
+	title      string
+	start, end int
+}
+
+// Disassemble formats instructions as a readable listing. Operands are
+// decoded, jump targets are shown as labels, the bodies of functions and
+// lambdas are indented between header and end lines, and each instruction is
+// annotated with its source position.
+func Disassemble(instructions []BytecodeInstruction) string {
+	indexOf := make(map[int]int, len(instructions)+1)
+	for i, instruction := range instructions {
+		indexOf[instruction.Offset] = i
+	}
+	if n := len(instructions); n > 0 {
+		last := instructions[n-1]
+		indexOf[last.Offset+instructionSize(last)] = n
+	}
+
+	// first pass: find the jump targets and the function and lambda bodies
+	labels := make(map[int]string)
+	var jumpTargets []int
+	var regions []region
+	lambdas := 0
+	for i, instruction := range instructions {
+		ops := instruction.Operands
+		if instruction.Opcode == CREATE_LAMBDA {
+			lambdas++
+		}
+		switch instruction.Opcode {
+		case JUMP, JUMP_IF_FALSE, TRY:
+			if target, ok := indexOf[ops.Address]; ok {
+				jumpTargets = append(jumpTargets, target)
+			}
+		case SELECT:
+			for _, selectCase := range ops.Cases {
+				if target, ok := indexOf[selectCase.Address]; ok {
+					jumpTargets = append(jumpTargets, target)
+				}
+			}
+		case DEFINE_FUNCTION:
+			if start, ok := indexOf[ops.Address]; ok && start <= i {
+				regions = append(regions, region{fmt.Sprintf("func %s(%s)", ops.Name, strings.Join(ops.Params, " ")), start, i})
+			}
+		case CREATE_LAMBDA:
+			start, okStart := indexOf[ops.Address]
+			end, okEnd := indexOf[ops.End]
+			if okStart && okEnd && start <= end {
+				regions = append(regions, region{fmt.Sprintf("lambda#%d(%s)", lambdas, strings.Join(ops.Params, " ")), start, end})
+			}
+		}
+	}
+	sort.Ints(jumpTargets)
+	for _, target := range jumpTargets {
+		if _, ok := labels[target]; !ok {
+			labels[target] = fmt.Sprintf("L%d", len(labels))
+		}
+	}
+
+	var b strings.Builder
+	depth := 0
+	lambdas = 0
+	for i := 0; i <= len(instructions); i++ {
+		for _, reg := range regions {
+			if reg.end == i {
+				depth--
+				fmt.Fprintf(&b, "%s      end %s\n", indent(depth), reg.title[:strings.Index(reg.title, "(")])
+			}
+		}
+		if label, ok := labels[i]; ok {
+			fmt.Fprintf(&b, "%s:\n", label)
+		}
+		for _, reg := range regions {
+			if reg.start == i {
+				fmt.Fprintf(&b, "%s      %s:\n", indent(depth), reg.title)
+				depth++
+			}
+		}
+		if i == len(instructions) {
+			break
+		}
+
+		instruction := instructions[i]
+		var operands string
+		if instruction.Opcode == CREATE_LAMBDA {
+			lambdas++
+			operands = fmt.Sprintf("lambda#%d ", lambdas)
+		}
+		operands += formatOperands(instruction, indexOf, labels)
+		line := fmt.Sprintf("%04d  %s%-16s %s", i, indent(depth), OpcodeToString(instruction.Opcode), operands)
+		if instruction.Pos.IsValid() {
+			line = fmt.Sprintf("%-56s ; %d:%d", line, instruction.Pos.Line, instruction.Pos.Column)
+		}
+		b.WriteString(strings.TrimRight(line, " "))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func indent(depth int) string {
+	if depth <= 0 {
+		return ""
+	}
+	return strings.Repeat("  ", depth)
+}
+
+// formatOperands formats the operands of instruction for Disassemble.
+func formatOperands(instruction BytecodeInstruction, indexOf map[int]int, labels map[int]string) string {
+	ops := instruction.Operands
+	label := func(offset int) string {
+		if index, ok := indexOf[offset]; ok {
+			if label, ok := labels[index]; ok {
+				return label
+			}
+			return fmt.Sprintf("@%04d", index)
+		}
+		return fmt.Sprintf("<invalid offset %d>", offset)
+	}
+
+	switch instruction.Opcode {
+	case PUSH_INT, PUSH_BOOL:
+		return fmt.Sprint(ops.Constant)
+	case PUSH_FLOAT:
+		s := strconv.FormatFloat(ops.Constant.(float64), 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eEIN") {
+			// keep float constants distinguishable from ints
+			s += ".0"
+		}
+		return s
+	case PUSH_STRING:
+		return fmt.Sprintf("'%s'", ops.Constant)
+	case CALL_FUNCTION, LOAD_FUNCTION, TAIL_CALL:
+		return fmt.Sprintf("%s at %s", ops.Name, label(ops.Address))
+	case LOAD_GLOBAL, DEFINE_GLOBAL, LOAD_LOCAL, STORE_LOCAL, LOAD_UPVALUE:
+		return fmt.Sprintf("%d %s", ops.Index, ops.Name)
+	case CALL_NATIVE:
+		return fmt.Sprintf("%s %d", ops.Name, ops.Count)
+	case DEFINE_FUNCTION:
+		return fmt.Sprintf("%s(%s) at %s", ops.Name, strings.Join(ops.Params, " "), label(ops.Address)) + formatFrame(ops)
+	case JUMP, JUMP_IF_FALSE, TRY:
+		return label(ops.Address)
+	case CREATE_LAMBDA:
+		return fmt.Sprintf("(%s) %s..%s", strings.Join(ops.Params, " "), label(ops.Address), label(ops.End)) + formatFrame(ops)
+	case CALL_LAMBDA, BUILD_LIST, SPAWN, RETURN:
+		return fmt.Sprint(ops.Count)
+	case RECV:
+		if ops.Count > 0 {
+			return "else"
+		}
+	case SELECT:
+		cases := make([]string, len(ops.Cases))
+		for i, selectCase := range ops.Cases {
+			cases[i] = selectCase.Kind.String() + " " + label(selectCase.Address)
+		}
+		return strings.Join(cases, ", ")
+	}
+	return ""
+}
+
+// formatFrame formats the frame size and captured variables of a function or
+// lambda, and whether it is pure.
+func formatFrame(ops Operands) string {
+	s := fmt.Sprintf(" locals %d", ops.Locals)
+	if ops.Pure {
+		s = " pure" + s
+	}
+	for i, capture := range ops.Captures {
+		if i == 0 {
+			s += " captures"
+		}
+		from := "upvalue"
+		if capture.Local {
+			from = "local"
+		}
+		s += fmt.Sprintf(" %s=%s %d", capture.Name, from, capture.Index)
+	}
+	return s
+}
+
+// instructionSize returns how many bytes instruction takes in the raw
+// bytecode.
+func instructionSize(instruction BytecodeInstruction) int {
+	ops := instruction.Operands
+	// strings are indices into the constant pool
+	names := func(names []string) int {
+		return 4 + 4*len(names)
+	}
+	captures := func(captures []Capture) int {
+		return 4 + len(captures)*(4+1+4)
+	}
+
+	switch instruction.Opcode {
+	case PUSH_INT, PUSH_FLOAT:
+		return 1 + 8
+	case PUSH_BOOL:
+		return 1 + 1
+	case PUSH_STRING:
+		return 1 + 4
+	case LOAD_GLOBAL, DEFINE_GLOBAL, LOAD_LOCAL, STORE_LOCAL, LOAD_UPVALUE, CALL_NATIVE,
+		CALL_FUNCTION, LOAD_FUNCTION, TAIL_CALL:
+		return 1 + 4 + 4
+	case DEFINE_FUNCTION:
+		return 1 + 4 + 4 + 4 + names(ops.Params) + 4 + captures(ops.Captures) + 1
+	case JUMP, JUMP_IF_FALSE, TRY, CALL_LAMBDA, BUILD_LIST, SPAWN, RETURN, RECV:
+		return 1 + 4
+	case SELECT:
+		return 1 + 4 + len(ops.Cases)*(1+4)
+	case CREATE_LAMBDA:
+		return 1 + 4 + 4 + 4 + names(ops.Params) + 4 + captures(ops.Captures) + 1
+	}
+	return 1
+}
@@ -0,0 +1,25 @@
+package compiler
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDisassemble(t *testing.T) {
+	code, _, err := compileSource(t, "(def inc (x:int):int (+ x 1))\n(if (> (inc 1) 1) (print 'big') else (print 'small'))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listing := Disassemble(code)
+	for _, want := range []string{
+		"\n      func inc(x):\n",
+		"\n      end func inc\n",
+		"JUMP_IF_FALSE    L1 ",
+		"\nL1:\n",
+		"PUSH_STRING      'small'                           ; 2:45\n",
+	} {
+		if !strings.Contains(listing, want) {
+			t.Errorf("listing does not contain %q:\n%s", want, listing)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package compiler
+
+import (
+	"fmt"
+	"sort"
+	"teriyake/goo/lexer"
+	"teriyake/goo/parser"
+)
+
+// Value is a value as the VM represents it: an int64, float64, string, bool
+// or []interface{} list.
+type Value = interface{}
+
+// NativeFunc implements a native function. args holds one value per declared
+// parameter, already of the declared types.
+type NativeFunc func(args []Value) (Value, error)
+
+// Native is a Go function that goo code can call like a function defined
+// with def.
+type Native struct {
+	Name string
+	Type parser.FunctionType
+	Func NativeFunc
+	// Pure is set for a function registered with RegisterPure.
+	Pure bool
+}
+
+func (n *Native) ParamCount() int {
+	return len(n.Type.Params)
+}
+
+func (n *Native) ResultType() DataType {
+	return dataTypeOf(n.Type.Result)
+}
+
+// reservedNames are the builtins and keywords a native function cannot
+// replace.
+var reservedNames = map[string]bool{
+	"print": true, "int": true, "float": true, "message": true,
+	"let": true, "def": true, "pure": true, "if": true, "ret": true,
+	"map": true, "filter": true, "reduce": true, "pmap": true, "pfilter": true,
+	"spawn": true, "chan": true, "send": true, "recv": true, "close": true, "select": true,
+	"try": true, "catch": true, "raise": true,
+	"and": true, "or": true, "not": true,
+	"true": true, "false": true,
+}
+
+// Registry holds the native functions available to a program. The same
+// registry is given to the type checker, the compiler and the VM.
+type Registry struct {
+	natives map[string]*Native
+}
+
+func NewRegistry() *Registry {
+	return &Registry{natives: make(map[string]*Native)}
+}
+
+// Register adds a native function. signature is a function type in goo
+// syntax, such as "(string int) -> bool"; native functions cannot be generic.
+// The compiler takes the function to have effects, such as I/O, so that the
+// goo functions calling it are not pure.
+func (r *Registry) Register(name, signature string, fn NativeFunc) error {
+	return r.register(name, signature, fn, false)
+}
+
+// RegisterPure adds a native function like Register, for a function whose
+// result depends only on its arguments and which has no effects. Goo
+// functions calling it can be pure, and it may then be called concurrently
+// by pmap and pfilter, or not at all when a result is remembered.
+func (r *Registry) RegisterPure(name, signature string, fn NativeFunc) error {
+	return r.register(name, signature, fn, true)
+}
+
+func (r *Registry) register(name, signature string, fn NativeFunc, pure bool) error {
+	tok := lexer.NewLexer(name).NextToken()
+	if tok.Type != lexer.IDENT || tok.Literal != name {
+		return fmt.Errorf("invalid native function name %q", name)
+	}
+	if reservedNames[name] {
+		return fmt.Errorf("cannot register native function %s: name is reserved", name)
+	}
+	if _, exists := r.natives[name]; exists {
+		return fmt.Errorf("native function %s already registered", name)
+	}
+	if fn == nil {
+		return fmt.Errorf("native function %s has no implementation", name)
+	}
+
+	typeExpr, err := parser.ParseType(signature)
+	if err != nil {
+		return fmt.Errorf("native function %s: invalid signature: %v", name, err)
+	}
+	fnType, ok := typeExpr.(parser.FunctionType)
+	if !ok {
+		return fmt.Errorf("native function %s: signature %s is not a function type", name, signature)
+	}
+	for _, typeExpr := range append(append([]parser.TypeExpr{}, fnType.Params...), fnType.Result) {
+		if err := checkNativeType(typeExpr); err != nil {
+			return fmt.Errorf("native function %s: %v", name, err)
+		}
+	}
+
+	r.natives[name] = &Native{Name: name, Type: fnType, Func: fn, Pure: pure}
+	return nil
+}
+
+func checkNativeType(typeExpr parser.TypeExpr) error {
+	switch t := typeExpr.(type) {
+	case parser.NamedType:
+		dataType, ok := LookupDataType(t.Name)
+		if !ok {
+			return fmt.Errorf("unknown type %s", t.Name)
+		}
+		if dataType == ErrorType {
+			return fmt.Errorf("error type cannot be passed to or returned from Go")
+		}
+	case parser.ListType:
+		return checkNativeType(t.Elem)
+	case parser.FunctionType:
+		return fmt.Errorf("function type %s cannot be passed to or returned from Go", t)
+	case parser.ChanType:
+		return fmt.Errorf("channel type %s cannot be passed to or returned from Go", t)
+	}
+	return nil
+}
+
+func (r *Registry) Lookup(name string) (*Native, bool) {
+	native, ok := r.natives[name]
+	return native, ok
+}
+
+// Natives returns the registered functions sorted by name.
+func (r *Registry) Natives() []*Native {
+	natives := make([]*Native, 0, len(r.natives))
+	for _, native := range r.natives {
+		natives = append(natives, native)
+	}
+	sort.Slice(natives, func(i, j int) bool { return natives[i].Name < natives[j].Name })
+	return natives
+}
@@ -0,0 +1,32 @@
+package compiler
+
+import "testing"
+
+func TestRegister(t *testing.T) {
+	noop := func(args []Value) (Value, error) { return nil, nil }
+	tests := []struct {
+		name      string
+		signature string
+		fn        NativeFunc
+		want      string
+	}{
+		{"price", "(string) -> int", noop, ""},
+		{"price", "(string) -> int", noop, "native function price already registered"},
+		{"print", "(string) -> int", noop, "cannot register native function print: name is reserved"},
+		{"no-name", "(int) -> int", noop, `invalid native function name "no-name"`},
+		{"cost", "(string) -> int", nil, "native function cost has no implementation"},
+		{"cost", "int", noop, "native function cost: signature int is not a function type"},
+		{"cost", "(item) -> int", noop, "native function cost: unknown type item"},
+		{"apply", "((int) -> int) -> int", noop, "native function apply: function type (int) -> int cannot be passed to or returned from Go"},
+	}
+	registry := NewRegistry()
+	for _, tt := range tests {
+		err := registry.Register(tt.name, tt.signature, tt.fn)
+		if tt.want == "" && err != nil || tt.want != "" && (err == nil || err.Error() != tt.want) {
+			t.Errorf("Register(%s, %s) = %v, want %q", tt.name, tt.signature, err, tt.want)
+		}
+	}
+	if native, ok := registry.Lookup("price"); !ok || native.ParamCount() != 1 || native.ResultType() != IntType {
+		t.Errorf("price = %v, %v, want a native taking one argument and returning int", native, ok)
+	}
+}
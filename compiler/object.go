@@ -0,0 +1,315 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"teriyake/goo/lexer"
+	"teriyake/goo/parser"
+)
+
+// A .gooc file holds a compiled program so that it can be run without the
+// source. It is laid out as
+//
+//	magic    "GOOC"
+//	version  uint16
+//	sections each an id byte, a uint32 length and that many bytes
+//	checksum uint32 CRC-32 (IEEE) of everything before it
+//
+// with the sections, in this order:
+//
+//	constants  the strings that the other sections refer to by index
+//	functions  for each function, its name, start offset and parameter names
+//	code       the bytecode as produced by CompileASTByte, whose string
+//	           constants and names are indices into the constants
+//	sourcemap  for each instruction, its offset and source position
+//
+// All integers are little endian, like the operands in the bytecode.
+const objectMagic = "GOOC"
+
+// ObjectVersion is the version of the .gooc format written by this package,
+// which must change whenever the layout or the bytecode encoding changes.
+const ObjectVersion = 11
+
+const (
+	sectionConstants byte = iota + 1
+	sectionFunctions
+	sectionCode
+	sectionSourceMap
+)
+
+// FunctionInfo describes a function defined by a compiled program.
+type FunctionInfo struct {
+	Name         string
+	StartAddress int
+	ParamNames   []string
+}
+
+// Object is a compiled program, as stored in a .gooc file.
+type Object struct {
+	Code      []byte
+	Constants []string
+	Functions []FunctionInfo
+	Positions map[int]lexer.Position
+}
+
+// CompileObject compiles ast into an Object that can be saved with
+// MarshalBinary.
+func (c *Compiler) CompileObject(ast parser.Node) (*Object, error) {
+	code, err := c.CompileASTByte(ast)
+	if err != nil {
+		return nil, err
+	}
+
+	positions := make(map[int]lexer.Position, len(c.positions))
+	for offset, pos := range c.positions {
+		positions[offset] = pos
+	}
+	constants := make([]string, len(c.constants))
+	copy(constants, c.constants)
+	functions := make([]FunctionInfo, len(c.functions))
+	copy(functions, c.functions)
+
+	return &Object{Code: code, Constants: constants, Functions: functions, Positions: positions}, nil
+}
+
+// Instructions decodes the object's bytecode for the VM.
+func (o *Object) Instructions() ([]BytecodeInstruction, map[int]int, error) {
+	return convertBytecode(o.Code, o.Constants, o.Positions, nil)
+}
+
+func (o *Object) MarshalBinary() ([]byte, error) {
+	// the code's constants keep their indices, and the strings of the other
+	// sections are added after them
+	constants := append([]string(nil), o.Constants...)
+	constantIndex := make(map[string]uint32, len(constants))
+	for i := len(constants) - 1; i >= 0; i-- {
+		constantIndex[constants[i]] = uint32(i)
+	}
+	constant := func(s string) uint32 {
+		index, ok := constantIndex[s]
+		if !ok {
+			index = uint32(len(constants))
+			constants = append(constants, s)
+			constantIndex[s] = index
+		}
+		return index
+	}
+
+	var functions objectWriter
+	functions.uint32(uint32(len(o.Functions)))
+	for _, fn := range o.Functions {
+		functions.uint32(constant(fn.Name))
+		functions.uint32(uint32(fn.StartAddress))
+		functions.uint32(uint32(len(fn.ParamNames)))
+		for _, name := range fn.ParamNames {
+			functions.uint32(constant(name))
+		}
+	}
+
+	offsets := make([]int, 0, len(o.Positions))
+	for offset := range o.Positions {
+		offsets = append(offsets, offset)
+	}
+	sort.Ints(offsets)
+	var sourceMap objectWriter
+	sourceMap.uint32(uint32(len(offsets)))
+	for _, offset := range offsets {
+		pos := o.Positions[offset]
+		sourceMap.uint32(uint32(offset))
+		sourceMap.uint32(constant(pos.Filename))
+		sourceMap.uint32(uint32(pos.Offset))
+		sourceMap.uint32(uint32(pos.Line))
+		sourceMap.uint32(uint32(pos.Column))
+	}
+
+	var constantPool objectWriter
+	constantPool.uint32(uint32(len(constants)))
+	for _, s := range constants {
+		constantPool.string(s)
+	}
+
+	var w objectWriter
+	w.buf.WriteString(objectMagic)
+	w.uint16(ObjectVersion)
+	w.section(sectionConstants, constantPool.buf.Bytes())
+	w.section(sectionFunctions, functions.buf.Bytes())
+	w.section(sectionCode, o.Code)
+	w.section(sectionSourceMap, sourceMap.buf.Bytes())
+	w.uint32(crc32.ChecksumIEEE(w.buf.Bytes()))
+	return w.buf.Bytes(), nil
+}
+
+// IsObject reports whether data starts like a .gooc file.
+func IsObject(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(objectMagic))
+}
+
+// ReadObject decodes a .gooc file, checking its version and checksum.
+func ReadObject(data []byte) (*Object, error) {
+	if !IsObject(data) {
+		return nil, errors.New("not a goo bytecode file")
+	}
+	if len(data) < len(objectMagic)+2+4 {
+		return nil, errors.New("truncated goo bytecode file")
+	}
+	body, checksum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != checksum {
+		return nil, errors.New("goo bytecode file is corrupt: checksum mismatch")
+	}
+
+	r := &objectReader{data: body, pos: len(objectMagic)}
+	if version := r.uint16(); version != ObjectVersion {
+		return nil, fmt.Errorf("unsupported goo bytecode version %d, want %d", version, ObjectVersion)
+	}
+
+	var constants []string
+	object := &Object{Positions: make(map[int]lexer.Position)}
+	constant := func(section *objectReader) string {
+		index := section.uint32()
+		if section.err == nil && int(index) >= len(constants) {
+			section.err = fmt.Errorf("constant index %d out of range", index)
+		}
+		if section.err != nil {
+			return ""
+		}
+		return constants[index]
+	}
+
+	for _, id := range []byte{sectionConstants, sectionFunctions, sectionCode, sectionSourceMap} {
+		section := r.section(id)
+		if r.err != nil {
+			break
+		}
+		switch id {
+		case sectionConstants:
+			for n := section.count(); n > 0 && section.err == nil; n-- {
+				constants = append(constants, section.string())
+			}
+			object.Constants = constants
+		case sectionFunctions:
+			for n := section.count(); n > 0 && section.err == nil; n-- {
+				fn := FunctionInfo{Name: constant(section), StartAddress: int(section.uint32())}
+				for params := section.count(); params > 0 && section.err == nil; params-- {
+					fn.ParamNames = append(fn.ParamNames, constant(section))
+				}
+				object.Functions = append(object.Functions, fn)
+			}
+		case sectionCode:
+			object.Code = section.data
+			section.pos = len(section.data)
+		case sectionSourceMap:
+			for n := section.count(); n > 0 && section.err == nil; n-- {
+				offset := int(section.uint32())
+				object.Positions[offset] = lexer.Position{
+					Filename: constant(section),
+					Offset:   int(section.uint32()),
+					Line:     int(section.uint32()),
+					Column:   int(section.uint32()),
+				}
+			}
+		}
+		if section.err == nil && section.pos != len(section.data) {
+			section.err = errors.New("unexpected data at end of section")
+		}
+		if section.err != nil {
+			return nil, fmt.Errorf("invalid goo bytecode file: section %d: %v", id, section.err)
+		}
+	}
+	if r.err == nil && r.pos != len(r.data) {
+		r.err = errors.New("unexpected data after the last section")
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("invalid goo bytecode file: %v", r.err)
+	}
+
+	return object, nil
+}
+
+type objectWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *objectWriter) uint16(v uint16) {
+	w.buf.Write(binary.LittleEndian.AppendUint16(nil, v))
+}
+
+func (w *objectWriter) uint32(v uint32) {
+	w.buf.Write(binary.LittleEndian.AppendUint32(nil, v))
+}
+
+func (w *objectWriter) string(s string) {
+	w.uint32(uint32(len(s)))
+	w.buf.WriteString(s)
+}
+
+func (w *objectWriter) section(id byte, payload []byte) {
+	w.buf.WriteByte(id)
+	w.uint32(uint32(len(payload)))
+	w.buf.Write(payload)
+}
+
+// objectReader decodes the parts of a .gooc file. After the first error it
+// returns zero values and keeps the error in err.
+type objectReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *objectReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.pos+n > len(r.data) {
+		r.err = errors.New("unexpected end of data")
+		return nil
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *objectReader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *objectReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+// count reads the length of a list, which cannot be more than the remaining
+// bytes since every element takes at least one.
+func (r *objectReader) count() int {
+	n := int(r.uint32())
+	if r.err == nil && n > len(r.data)-r.pos {
+		r.err = fmt.Errorf("count %d exceeds the data", n)
+		return 0
+	}
+	return n
+}
+
+func (r *objectReader) string() string {
+	return string(r.next(int(r.uint32())))
+}
+
+func (r *objectReader) section(id byte) *objectReader {
+	header := r.next(1)
+	if header == nil {
+		return nil
+	}
+	if header[0] != id {
+		r.err = fmt.Errorf("expected section %d, got %d", id, header[0])
+		return nil
+	}
+	return &objectReader{data: r.next(int(r.uint32()))}
+}
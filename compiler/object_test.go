@@ -0,0 +1,134 @@
+package compiler
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"reflect"
+	"teriyake/goo/lexer"
+	"teriyake/goo/parser"
+	"testing"
+)
+
+const objectSrc = `(def greet (name:string):string (print 'a rather long greeting') name)
+(let greeting:string (greet 'goo'))
+(print (greet 'a rather long greeting'))
+(def adder (n:int):(int) -> int ((x:int) -> (+ x n)))
+(print (adder 1))`
+
+func compileObject(t *testing.T, src string) *Object {
+	t.Helper()
+	ast, err := parser.NewParser(lexer.NewFileLexer("test.goo", src)).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	object, err := NewCompiler(nil).CompileObject(ast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return object
+}
+
+func TestObjectRoundTrip(t *testing.T) {
+	object := compileObject(t, objectSrc)
+	want, wantOffsets, err := object.Instructions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := object.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadObject(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, gotOffsets, err := read.Instructions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) || !reflect.DeepEqual(gotOffsets, wantOffsets) {
+		t.Errorf("instructions read back differ:\n%s\nwant\n%s", Disassemble(got), Disassemble(want))
+	}
+	if !reflect.DeepEqual(read.Functions, object.Functions) {
+		t.Errorf("functions = %v, want %v", read.Functions, object.Functions)
+	}
+
+	data[len(data)-1] ^= 1
+	if _, err := ReadObject(data); err == nil {
+		t.Error("ReadObject accepted a file with a bad checksum")
+	}
+}
+
+func TestObjectConstantPool(t *testing.T) {
+	object := compileObject(t, objectSrc)
+
+	// strings and names are in the pool once, and the code only refers to
+	// them
+	for _, s := range []string{"a rather long greeting", "greeting", "greet"} {
+		if bytes.Contains(object.Code, []byte(s)) {
+			t.Errorf("code contains %q inline", s)
+		}
+		n := 0
+		for _, constant := range object.Constants {
+			if constant == s {
+				n++
+			}
+		}
+		if n != 1 {
+			t.Errorf("%q is in the constant pool %d times, want once", s, n)
+		}
+	}
+
+	object.Constants = object.Constants[:1]
+	if _, _, err := object.Instructions(); err == nil {
+		t.Error("Instructions accepted code referring to missing constants")
+	}
+}
+
+func TestObjectErrors(t *testing.T) {
+	data, err := compileObject(t, objectSrc).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"not an object", []byte("(print 1)"), "not a goo bytecode file"},
+		{"truncated", data[:6], "truncated goo bytecode file"},
+		{"other version", withVersion(data, ObjectVersion+1), fmt.Sprintf("unsupported goo bytecode version %d, want %d", ObjectVersion+1, ObjectVersion)},
+	}
+	for _, tt := range tests {
+		if _, err := ReadObject(tt.data); err == nil || err.Error() != tt.want {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+// withVersion returns a copy of the object file data with its version set
+// to version and its checksum updated to match.
+func withVersion(data []byte, version uint16) []byte {
+	w := &objectWriter{}
+	w.buf.Write(data[:len(objectMagic)])
+	w.uint16(version)
+	w.buf.Write(data[len(objectMagic)+2 : len(data)-4])
+	w.uint32(crc32.ChecksumIEEE(w.buf.Bytes()))
+	return w.buf.Bytes()
+}
+
+func TestInstructionSize(t *testing.T) {
+	instructions, offsetMap, err := compileObject(t, objectSrc).Instructions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, instruction := range instructions {
+		next := instruction.Offset + instructionSize(instruction)
+		if index, ok := offsetMap[next]; !ok || index != i+1 {
+			t.Errorf("%s at %d has size %d, but the next instruction is not at %d",
+				OpcodeToString(instruction.Opcode), instruction.Offset, instructionSize(instruction), next)
+		}
+	}
+}
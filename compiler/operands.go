@@ -0,0 +1,262 @@
+package compiler
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Operands are the decoded operands of an instruction. Which fields are set
+// depends on the opcode.
+type Operands struct {
+	// Constant is the value pushed by PUSH_INT, PUSH_FLOAT, PUSH_BOOL and
+	// PUSH_STRING. It is boxed once when the bytecode is decoded, so that
+	// pushing it does not allocate.
+	Constant interface{}
+	// Name is the variable or function name of other instructions. Equal
+	// names in a program share their storage.
+	Name string
+	// Index is the slot of the variable loaded or stored by LOAD_GLOBAL,
+	// DEFINE_GLOBAL, LOAD_LOCAL, STORE_LOCAL and LOAD_UPVALUE.
+	Index int
+	// Count is the number of parameters of DEFINE_FUNCTION and
+	// CREATE_LAMBDA, the number of arguments of CALL_NATIVE, CALL_LAMBDA and
+	// SPAWN, the number of elements of BUILD_LIST, the number of values, 0 or
+	// 1, returned by RETURN and the number of values, 0 or 1, that RECV gives
+	// for a closed channel.
+	Count int
+	// Address is the target of a jump, the start of the catch of TRY, the
+	// start of a function or lambda body, or, for CALL_FUNCTION,
+	// LOAD_FUNCTION and TAIL_CALL, the start of the definition of the
+	// function that the name referred to when it was compiled. End is the end
+	// of a lambda body. Both are bytecode offsets, and Target and EndTarget
+	// the indices of the instructions at those offsets, or -1 if there is no
+	// instruction there.
+	Address   int
+	End       int
+	Target    int
+	EndTarget int
+	Params    []string
+	// Locals is the number of local slots, including the parameters, of the
+	// frame of DEFINE_FUNCTION and CREATE_LAMBDA, and Captures the variables
+	// they capture from the frame that creates them.
+	Locals   int
+	Captures []Capture
+	// Pure is set on DEFINE_FUNCTION and CREATE_LAMBDA for a function or
+	// lambda that the compiler found to be pure.
+	Pure bool
+	// Cases are the cases of SELECT.
+	Cases []Case
+}
+
+// Capture is a variable captured by a function or lambda when it is created:
+// the local in slot Index of the creating frame, or, if Local is false, the
+// creating function's own upvalue Index.
+type Capture struct {
+	Name  string
+	Local bool
+	Index int
+}
+
+// CaseKind is the kind of a case of SELECT.
+type CaseKind byte
+
+const (
+	RecvCase CaseKind = iota
+	SendCase
+	ElseCase
+)
+
+func (k CaseKind) String() string {
+	switch k {
+	case RecvCase:
+		return "recv"
+	case SendCase:
+		return "send"
+	case ElseCase:
+		return "else"
+	default:
+		return fmt.Sprintf("CaseKind(%d)", byte(k))
+	}
+}
+
+// Case is a case of SELECT: a receive from or a send on a channel, or the
+// else case chosen when no other case can proceed. Address is where the code
+// of the case starts, as a bytecode offset, and Target the index of the
+// instruction there, or -1 if there is none.
+type Case struct {
+	Kind    CaseKind
+	Address int
+	Target  int
+}
+
+// bytecodeReader decodes raw bytecode, keeping the first problem it finds in
+// err. Strings are read from the constant pool, so that equal names share
+// their storage.
+type bytecodeReader struct {
+	data      []byte
+	pos       int
+	err       error
+	constants []string
+}
+
+func (r *bytecodeReader) next(n int, what string) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.pos+n > len(r.data) {
+		r.err = fmt.Errorf("invalid bytecode, unexpected end of data for %s", what)
+		return nil
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *bytecodeReader) uint32(what string) int {
+	if b := r.next(4, what); b != nil {
+		return int(binary.LittleEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *bytecodeReader) uint64(what string) uint64 {
+	if b := r.next(8, what); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+// name reads the index of a string in the constant pool and returns the
+// string.
+func (r *bytecodeReader) name(what string) string {
+	index := r.uint32(what)
+	if r.err != nil {
+		return ""
+	}
+	if index >= len(r.constants) {
+		r.err = fmt.Errorf("invalid bytecode, %s constant index %d out of range", what, index)
+		return ""
+	}
+	return r.constants[index]
+}
+
+// names reads a list of count names, preceded by its length, which must be
+// count too.
+func (r *bytecodeReader) names(what string, count int) []string {
+	if n := r.uint32(what + " list length"); r.err == nil && n != count {
+		r.err = fmt.Errorf("invalid bytecode, %s list length %d does not match count %d", what, n, count)
+	}
+	var names []string
+	for i := 0; i < count && r.err == nil; i++ {
+		names = append(names, r.name(what))
+	}
+	return names
+}
+
+func (r *bytecodeReader) bool(what string) bool {
+	b := r.next(1, what)
+	if b == nil {
+		return false
+	}
+	if b[0] > 1 {
+		r.err = fmt.Errorf("invalid bytecode, %s must be 0 or 1, got %d", what, b[0])
+	}
+	return b[0] == 1
+}
+
+// captures reads a list of captured variables.
+func (r *bytecodeReader) captures() []Capture {
+	var captures []Capture
+	for n := r.uint32("capture count"); n > 0 && r.err == nil; n-- {
+		capture := Capture{Name: r.name("captured variable name")}
+		if b := r.next(1, "capture kind"); b != nil {
+			if b[0] > 1 {
+				r.err = fmt.Errorf("invalid bytecode, capture kind must be 0 or 1, got %d", b[0])
+			}
+			capture.Local = b[0] == 1
+		}
+		capture.Index = r.uint32("capture index")
+		captures = append(captures, capture)
+	}
+	return captures
+}
+
+// cases reads the cases of SELECT.
+func (r *bytecodeReader) cases() []Case {
+	var cases []Case
+	for n := r.uint32("case count"); n > 0 && r.err == nil; n-- {
+		var selectCase Case
+		if b := r.next(1, "case kind"); b != nil {
+			if CaseKind(b[0]) > ElseCase {
+				r.err = fmt.Errorf("invalid bytecode, case kind must be 0, 1 or 2, got %d", b[0])
+			}
+			selectCase.Kind = CaseKind(b[0])
+		}
+		selectCase.Address = r.uint32("case address")
+		cases = append(cases, selectCase)
+	}
+	return cases
+}
+
+// operands decodes the operands of an instruction with the given opcode.
+func (r *bytecodeReader) operands(opcode Opcode) Operands {
+	var ops Operands
+	switch opcode {
+	case ADD, SUB, MUL, DIV, GRT, LESS, EQ, NEQ, MOD, GEQ, LEQ, NOT, TO_INT, TO_FLOAT,
+		PRINT, MAP, FILTER, REDUCE, PMAP, PFILTER, MAKE_CHANNEL, SEND, CLOSE,
+		END_TRY, RAISE, MESSAGE, POP:
+	case PUSH_INT:
+		ops.Constant = int64(r.uint64("integer"))
+	case PUSH_FLOAT:
+		ops.Constant = math.Float64frombits(r.uint64("float"))
+	case PUSH_BOOL:
+		if value := r.bool("bool operand"); r.err == nil {
+			ops.Constant = value
+		}
+	case PUSH_STRING:
+		ops.Constant = r.name("string")
+	case LOAD_GLOBAL, DEFINE_GLOBAL, LOAD_LOCAL, STORE_LOCAL, LOAD_UPVALUE:
+		ops.Index = r.uint32("variable slot")
+		ops.Name = r.name("variable name")
+	case CALL_FUNCTION, LOAD_FUNCTION, TAIL_CALL:
+		ops.Name = r.name("function name")
+		ops.Address = r.uint32("function start address")
+	case CALL_NATIVE:
+		ops.Name = r.name("function name")
+		ops.Count = r.uint32("argument count")
+	case DEFINE_FUNCTION:
+		ops.Name = r.name("function name")
+		ops.Address = r.uint32("start address")
+		ops.Count = r.uint32("parameter count")
+		ops.Params = r.names("parameter name", ops.Count)
+		ops.Locals = r.uint32("local count")
+		ops.Captures = r.captures()
+		ops.Pure = r.bool("pure flag")
+	case JUMP, JUMP_IF_FALSE, TRY:
+		ops.Address = r.uint32(OpcodeToString(opcode) + " offset")
+	case CREATE_LAMBDA:
+		ops.Address = r.uint32("lambda start address")
+		ops.End = r.uint32("lambda end address")
+		ops.Count = r.uint32("number of lambda params")
+		ops.Params = r.names("lambda param name", ops.Count)
+		ops.Locals = r.uint32("local count")
+		ops.Captures = r.captures()
+		ops.Pure = r.bool("pure flag")
+	case CALL_LAMBDA, SPAWN:
+		ops.Count = r.uint32("argument count")
+	case BUILD_LIST:
+		ops.Count = r.uint32("element count")
+	case RETURN:
+		ops.Count = r.uint32("return value count")
+	case RECV:
+		ops.Count = r.uint32("else value count")
+	case SELECT:
+		ops.Cases = r.cases()
+	default:
+		if r.err == nil {
+			r.err = fmt.Errorf("invalid bytecode, unknown opcode %d", opcode)
+		}
+	}
+	return ops
+}
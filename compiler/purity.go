@@ -0,0 +1,171 @@
+package compiler
+
+import (
+	"fmt"
+	"teriyake/goo/lexer"
+	"teriyake/goo/parser"
+)
+
+// purity is what the compiler knows about the effects of a def function or
+// lambda. It is pure until an effect is found in its body: printing, calling
+// a Go function that is not registered as pure, spawning a task, using a
+// channel, or calling something that is not pure. Once impure, it stays so.
+//
+// A def name has a purity of its own, since a call by name runs whichever
+// definition of the name is the latest when the call is made: it is pure
+// while every definition of the name is.
+type purity struct {
+	// effect is why it is not pure, or nil while it is.
+	effect *effect
+	// dependents are the functions that call it, which are not pure if it
+	// is not.
+	dependents []dependent
+	// flag is the offset of the pure operand of the DEFINE_FUNCTION or
+	// CREATE_LAMBDA of a function or lambda, or -1 until that is emitted.
+	flag int
+	// declared names a function or lambda declared pure, for the error
+	// reported if it is not.
+	declared string
+}
+
+type effect struct {
+	what string
+	pos  lexer.Position
+}
+
+// dependent is a function that calls another, with what that call does if
+// the callee is not pure, or nil if it has the callee's effect.
+type dependent struct {
+	purity *purity
+	effect *effect
+}
+
+func newPurity() *purity {
+	return &purity{flag: -1}
+}
+
+func (p *purity) pure() bool {
+	return p != nil && p.effect == nil
+}
+
+// impurify records that p has eff, making the functions that depend on it
+// impure too. It is an error for a function declared pure.
+func (c *Compiler) impurify(p *purity, eff *effect) error {
+	if !p.pure() {
+		return nil
+	}
+	p.effect = eff
+	c.undo = append(c.undo, func() { p.effect = nil })
+	if p.flag >= 0 {
+		flag := p.flag
+		c.bytecode[flag] = 0
+		c.undo = append(c.undo, func() { c.bytecode[flag] = 1 })
+	}
+	if p.declared != "" {
+		// reported where the effect was found, which is in a later
+		// definition if that made a function p calls impure
+		return c.errorf("%s is declared pure but %s", p.declared, eff.what)
+	}
+
+	for _, d := range p.dependents {
+		dependentEffect := d.effect
+		if dependentEffect == nil {
+			dependentEffect = eff
+		}
+		if err := c.impurify(d.purity, dependentEffect); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// depend makes caller impure whenever p is, with eff.
+func (c *Compiler) depend(p, caller *purity, eff *effect) error {
+	if !p.pure() {
+		return c.impurify(caller, eff)
+	}
+	n := len(p.dependents)
+	p.dependents = append(p.dependents, dependent{purity: caller, effect: eff})
+	c.undo = append(c.undo, func() { p.dependents = p.dependents[:n] })
+	return nil
+}
+
+// effect records that the function or lambda being compiled does what, so
+// that it is not pure. What the top level does does not matter.
+func (c *Compiler) effect(what string) error {
+	if c.function == nil {
+		return nil
+	}
+	return c.impurify(c.function.purity, &effect{what: what, pos: c.pos})
+}
+
+// calls records that the function or lambda being compiled calls callee,
+// described by name, whose purity is nil if it is not known.
+func (c *Compiler) calls(callee *purity, name string) error {
+	if c.function == nil {
+		return nil
+	}
+	if callee == nil {
+		return c.effect(fmt.Sprintf("calls %s, which may not be pure", name))
+	}
+	return c.depend(callee, c.function.purity, &effect{what: fmt.Sprintf("calls %s, which is not pure", name), pos: c.pos})
+}
+
+// functionValue returns the purity of the function value that node, just
+// compiled, evaluates to, and how to refer to it, or nil if it is not known.
+func (c *Compiler) functionValue(node parser.Node) (*purity, string) {
+	switch n := node.(type) {
+	case parser.LambdaExpression:
+		return c.lastLambda, "a lambda"
+	case parser.Identifier:
+		symbol, ok := c.symbolTable.Resolve(n.Value)
+		if !ok {
+			break
+		}
+		switch {
+		case symbol.Type == FunctionSymbol && len(symbol.ParamNames) > 0:
+			return c.names[n.Value], n.Value
+		case symbol.Type == VariableSymbol:
+			return symbol.purity, n.Value
+		}
+		return nil, n.Value
+	}
+	return nil, "a function"
+}
+
+// definePurity starts the purity of a definition of the def function name,
+// which becomes the purity of the name. The purity the name had until now
+// depends on it, so that the callers of earlier definitions are not pure if
+// this one is not.
+func (c *Compiler) definePurity(name string, declared bool) *purity {
+	body := newPurity()
+	if declared {
+		body.declared = "function " + name
+	}
+
+	previous, defined := c.names[name]
+	current := newPurity()
+	c.names[name] = current
+	c.undo = append(c.undo, func() {
+		if defined {
+			c.names[name] = previous
+		} else {
+			delete(c.names, name)
+		}
+	})
+	// body and current are new and pure, so these cannot fail
+	_ = c.depend(body, current, nil)
+	if previous != nil {
+		_ = c.depend(current, previous, nil)
+	}
+	return body
+}
+
+// markPure records where the pure operand of fn was emitted, at the end of
+// its DEFINE_FUNCTION or CREATE_LAMBDA, so that it can be cleared if fn turns
+// out not to be pure later, when a function it calls is redefined.
+func (c *Compiler) markPure(fn *funcState) {
+	if fn.purity.pure() {
+		fn.purity.flag = len(c.bytecode) - 1
+	}
+}
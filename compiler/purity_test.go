@@ -0,0 +1,22 @@
+package compiler
+
+import "testing"
+
+func TestPurityErrors(t *testing.T) {
+	tests := []struct {
+		src string
+		err string
+	}{
+		{"(def pure f (x:int):int ((print x) x))", "m.goo:1:26: function f is declared pure but calls print"},
+		{"(def g (x:int):int ((print x) x))\n(def pure f (x:int):int (g x))", "m.goo:2:25: function f is declared pure but calls g, which is not pure"},
+		{"(let c:chan int (chan int 1))\n(def pure f (x:int):int ((send c x) x))", "m.goo:2:26: function f is declared pure but sends on a channel"},
+		{"(let k:(int) -> int (pure (x:int) -> ((print x) x)))", "m.goo:1:39: lambda is declared pure but calls print"},
+		{"(def pure f (x:int):int (if (> x 0) (f (- x 1)) else (x)))", ""},
+	}
+	for _, tt := range tests {
+		_, _, err := compileSource(t, tt.src)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Errorf("%s: error = %v, want %q", tt.src, err, tt.err)
+		}
+	}
+}
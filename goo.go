@@ -1,124 +1,332 @@
-package main
+// Package goo embeds the goo language in Go programs.
+//
+// A program is compiled once with Compile and can then be run any number of
+// times with different globals:
+//
+//	program, err := goo.Compile("(* rate hours)", goo.Env(map[string]interface{}{
+//		"rate":  0.0,
+//		"hours": 0.0,
+//	}))
+//	...
+//	pay, err := program.Run(ctx, map[string]interface{}{"rate": 25.5, "hours": 8.0})
+package goo
 
 import (
-	"flag"
+	"context"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
+	"reflect"
+	"sort"
 	"teriyake/goo/compiler"
 	"teriyake/goo/lexer"
 	"teriyake/goo/parser"
+	"teriyake/goo/typecheck"
 	"teriyake/goo/vm"
 )
 
-type FileWriter struct {
-	file *os.File
+// Value is a goo value: an int64, float64, string, bool or []interface{}.
+type Value = compiler.Value
+
+type Program struct {
+	code        []compiler.BytecodeInstruction
+	offsetMap   map[int]int
+	globals     map[string]typecheck.Type
+	natives     *compiler.Registry
+	result      typecheck.Type
+	out         io.Writer
+	trace       io.Writer
+	parallelism int
+	memoize     bool
 }
 
-func NewFileWriter(fileName string) (*FileWriter, error) {
-	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if err != nil {
-		return nil, err
+type config struct {
+	filename    string
+	globals     map[string]typecheck.Type
+	natives     *compiler.Registry
+	out         io.Writer
+	trace       io.Writer
+	parallelism int
+	memoize     bool
+}
+
+type Option func(*config) error
+
+// Env declares the globals a program can use. Only the names and the types
+// of the values matter; the values themselves are passed to Program.Run.
+func Env(env map[string]interface{}) Option {
+	return func(cfg *config) error {
+		for name, value := range env {
+			_, t, err := toValue(value)
+			if err != nil {
+				return fmt.Errorf("global %s: %v", name, err)
+			}
+			cfg.globals[name] = t
+		}
+		return nil
 	}
-	return &FileWriter{file}, nil
 }
 
-func (fw *FileWriter) Write(p []byte) (n int, err error) {
-	return fw.file.Write(p)
+// Func registers a Go function that the program can call by name. signature
+// is its type in goo syntax, such as "(string int) -> bool". fn receives
+// arguments of the declared types and must return a value of the declared
+// result type, or an error that stops the program.
+func Func(name, signature string, fn func(args []Value) (Value, error)) Option {
+	return func(cfg *config) error {
+		return cfg.natives.Register(name, signature, fn)
+	}
 }
 
-func main() {
-	debugMode := flag.Bool("debug", false, "when enabled, the compiler and vm debug outputs will be piped to a log file")
-	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
-		fmt.Println("./goo [-debug path/to/log.log] path/to/src.goo")
-		fmt.Println("\nFlags:")
-		flag.PrintDefaults()
+// PureFunc registers a Go function like Func, for a function whose result
+// depends only on its arguments and which has no effects, such as I/O. The
+// goo functions that call it can then be pure.
+func PureFunc(name, signature string, fn func(args []Value) (Value, error)) Option {
+	return func(cfg *config) error {
+		return cfg.natives.RegisterPure(name, signature, fn)
 	}
-	flag.Parse()
+}
 
-	if flag.NArg() < 1 {
-		fmt.Println("Usage: ./goo [-debug path/to/log.log] path/to/src.goo")
-		os.Exit(1)
+// Output sets where the program's print calls write. It defaults to
+// os.Stdout.
+func Output(w io.Writer) Option {
+	return func(cfg *config) error {
+		cfg.out = w
+		return nil
 	}
+}
 
-	var logFilePath, srcFilePath string
-	if *debugMode {
-		if flag.NArg() < 2 {
-			fmt.Println("Usage: ./goo [-debug path/to/log.log] path/to/src.goo")
-			os.Exit(1)
+// Trace writes a trace of the compilation and of every run of the program to
+// w, for debugging.
+func Trace(w io.Writer) Option {
+	return func(cfg *config) error {
+		cfg.trace = w
+		return nil
+	}
+}
+
+// Parallelism sets how many goroutines pmap and pfilter call their function
+// on. It defaults to runtime.GOMAXPROCS(0). Go functions registered with
+// PureFunc that are called from pmap and pfilter must be safe for concurrent
+// use.
+func Parallelism(n int) Option {
+	return func(cfg *config) error {
+		if n < 1 {
+			return fmt.Errorf("parallelism must be at least 1, got %d", n)
 		}
-		logFilePath = flag.Arg(0)
-		srcFilePath = flag.Arg(1)
-	} else {
-		srcFilePath = flag.Arg(0)
+		cfg.parallelism = n
+		return nil
 	}
+}
 
-	srcCode, err := ioutil.ReadFile(srcFilePath)
-	if err != nil {
-		fmt.Printf("Error reading source file %s: %s\n", srcFilePath, err)
-		os.Exit(1)
+// Memoize makes each run of the program remember the results of calls of
+// pure functions, so that calling one again with the same arguments does not
+// run it again.
+func Memoize() Option {
+	return func(cfg *config) error {
+		cfg.memoize = true
+		return nil
 	}
+}
 
-	gooCode := string(srcCode)
+// Filename sets the file name used in the positions of error messages.
+func Filename(filename string) Option {
+	return func(cfg *config) error {
+		cfg.filename = filename
+		return nil
+	}
+}
 
-	if *debugMode && logFilePath != "" {
-		fw, err := NewFileWriter(logFilePath)
-		if err != nil {
-			fmt.Printf("Error opening log file %s: %s\n", logFilePath, err)
-			os.Exit(1)
+// Compile parses, type checks and compiles src, and verifies the bytecode
+// it compiles to.
+func Compile(src string, opts ...Option) (*Program, error) {
+	cfg := &config{
+		globals: make(map[string]typecheck.Type),
+		natives: compiler.NewRegistry(),
+		out:     os.Stdout,
+	}
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return nil, err
 		}
-		defer fw.file.Close()
+	}
 
-		originalStdout := os.Stdout
-		os.Stdout = fw.file
-		defer func() { os.Stdout = originalStdout }()
+	par := parser.NewParser(lexer.NewFileLexer(cfg.filename, src))
+	ast, err := par.Parse()
+	if err != nil {
+		return nil, err
 	}
 
-	if *debugMode {
-		fmt.Printf("DEBUG MODE ENABLED\n")
-		fmt.Println()
-		fmt.Printf("Input: %v\n", gooCode)
-		fmt.Println()
+	checker := typecheck.NewChecker()
+	comp := compiler.NewCompiler(cfg.trace)
+	checker.DefineNatives(cfg.natives)
+	comp.DefineNatives(cfg.natives)
+	for _, name := range sortedNames(cfg.globals) {
+		checker.Define(name, cfg.globals[name])
+		comp.DefineGlobal(name, dataType(cfg.globals[name]))
 	}
 
-	lexer := lexer.NewLexer(gooCode)
-	par := parser.NewParser(lexer)
-	ast, err := par.Parse()
+	result, err := checker.Check(ast)
 	if err != nil {
-		fmt.Printf("Error: %s\n", err)
-	} else if *debugMode {
-		fmt.Printf("AST: %#v\n", ast)
-		fmt.Println()
+		return nil, err
 	}
 
-	comp := compiler.NewCompiler(debugMode)
-	bytecodeInstructions, offsetMap, err := comp.CompileAST(ast)
+	code, offsetMap, err := comp.CompileAST(ast)
 	if err != nil {
-		fmt.Printf("Error compiling AST: %s\n", err)
-		return
+		return nil, err
 	}
-	if *debugMode {
-		for i, b := range bytecodeInstructions {
-			fmt.Printf("Pos: %v\tOpcode: %v %v\tOperands: %v\n", i, b.Opcode, compiler.OpcodeToString(b.Opcode), b.Operands)
+	if err := vm.Verify(code, offsetMap); err != nil {
+		return nil, err
+	}
+
+	return &Program{
+		code:        code,
+		offsetMap:   offsetMap,
+		globals:     cfg.globals,
+		natives:     cfg.natives,
+		result:      result,
+		out:         cfg.out,
+		trace:       cfg.trace,
+		parallelism: cfg.parallelism,
+		memoize:     cfg.memoize,
+	}, nil
+}
+
+// Run executes the program with the given values for the globals declared
+// when it was compiled. It returns the value of the program's last
+// expression, or nil if that expression has no value. Results are int64,
+// float64, string, bool, []interface{} or *vm.Error values; a function or a
+// channel, which cannot be used outside the program, is reported as an error
+// instead. An error the program does not catch is returned as a
+// *vm.RuntimeError.
+func (p *Program) Run(ctx context.Context, env map[string]interface{}) (interface{}, error) {
+	machine := vm.NewVM(p.code, p.offsetMap, p.out, p.trace)
+	machine.DefineNatives(p.natives)
+	machine.SetParallelism(p.parallelism)
+	machine.SetMemoize(p.memoize)
+
+	for _, name := range sortedNames(p.globals) {
+		value, ok := env[name]
+		if !ok {
+			return nil, fmt.Errorf("missing value for global %s", name)
+		}
+		converted, t, err := toValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("global %s: %v", name, err)
+		}
+		if !typecheck.AssignableTo(t, p.globals[name]) {
+			return nil, fmt.Errorf("global %s: cannot use %s value as %s", name, t, p.globals[name])
 		}
-		fmt.Println()
+		machine.SetGlobal(name, converted)
 	}
 
-	virtualMachine := vm.NewVM(bytecodeInstructions, offsetMap, debugMode)
-	if *debugMode {
-		fmt.Printf("Initial VM State: \n")
-		virtualMachine.Print()
-		fmt.Println()
+	if err := machine.RunContext(ctx); err != nil {
+		return nil, err
 	}
 
-	err = virtualMachine.Run()
+	if p.result == typecheck.Void {
+		return nil, nil
+	}
+	result, _ := machine.StackTop()
+	if !goValue(result) {
+		return nil, fmt.Errorf("cannot return a value of type %s from a program", p.result)
+	}
+	return result, nil
+}
+
+// Eval compiles and runs src, which cannot use any globals.
+func Eval(ctx context.Context, src string) (interface{}, error) {
+	program, err := Compile(src)
 	if err != nil {
-		fmt.Printf("Error executing Goo code: %s\n", err)
+		return nil, err
+	}
+	return program.Run(ctx, nil)
+}
+
+// toValue converts a Go value to the value the VM uses for it, along with
+// its goo type.
+func toValue(value interface{}) (interface{}, typecheck.Type, error) {
+	if value == nil {
+		return nil, nil, fmt.Errorf("nil has no goo type")
 	}
-	if *debugMode {
-		fmt.Printf("Final VM State: \n")
-		virtualMachine.Print()
-		fmt.Println()
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), typecheck.Int, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v.Uint() > 1<<63-1 {
+			return nil, nil, fmt.Errorf("%d overflows int", v.Uint())
+		}
+		return int64(v.Uint()), typecheck.Int, nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), typecheck.Float, nil
+	case reflect.String:
+		return v.String(), typecheck.String, nil
+	case reflect.Bool:
+		return v.Bool(), typecheck.Bool, nil
+	case reflect.Slice, reflect.Array:
+		list := make([]interface{}, v.Len())
+		var elem typecheck.Type = typecheck.Unknown
+		if v.Len() == 0 && v.Type().Elem().Kind() != reflect.Interface {
+			// an empty list still has the element type of its Go type
+			_, t, err := toValue(reflect.Zero(v.Type().Elem()).Interface())
+			if err != nil {
+				return nil, nil, err
+			}
+			elem = t
+		}
+		for i := range list {
+			element, t, err := toValue(v.Index(i).Interface())
+			if err != nil {
+				return nil, nil, err
+			}
+			if i > 0 && !typecheck.Identical(t, elem) {
+				return nil, nil, fmt.Errorf("list elements have mixed types %s and %s", elem, t)
+			}
+			list[i], elem = element, t
+		}
+		return list, &typecheck.List{Elem: elem}, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported Go type %T", value)
+}
+
+// goValue reports whether value is one of the values Program.Run returns,
+// or a list of them.
+func goValue(value interface{}) bool {
+	switch v := value.(type) {
+	case int64, float64, string, bool, *vm.Error:
+		return true
+	case []interface{}:
+		for _, elem := range v {
+			if !goValue(elem) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func dataType(t typecheck.Type) compiler.DataType {
+	switch t {
+	case typecheck.Float:
+		return compiler.FloatType
+	case typecheck.String:
+		return compiler.StringType
+	case typecheck.Bool:
+		return compiler.BoolType
+	}
+	if _, ok := t.(*typecheck.List); ok {
+		return compiler.ListType
+	}
+	return compiler.IntType
+}
+
+func sortedNames(globals map[string]typecheck.Type) []string {
+	names := make([]string, 0, len(globals))
+	for name := range globals {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
 }
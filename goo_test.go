@@ -0,0 +1,146 @@
+package goo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"teriyake/goo/vm"
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		src  string
+		want interface{}
+	}{
+		{"(+ 1 2)", int64(3)},
+		{"(/ 1.0 4)", 0.25},
+		{"'goo'", "goo"},
+		{"(< 1 2)", true},
+		{"(map ((x:int) -> (* x x)) [1 2 3])", []interface{}{int64(1), int64(4), int64(9)}},
+		{"(def f (x:int):int (* x 2)) (f 1) (f 2) (f 21)", int64(42)},
+		{"(let x:int 1)", nil},
+		{"(print 'x')", nil},
+	}
+	for _, tt := range tests {
+		program, err := Compile(tt.src, Output(io.Discard))
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		got, err := program.Run(context.Background(), nil)
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s = %#v, want %#v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestEvalError(t *testing.T) {
+	got, err := Eval(context.Background(), "(try (raise 'no') (catch e e))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gooErr, ok := got.(*vm.Error); !ok || gooErr.Message != "no" {
+		t.Errorf("result = %#v, want the caught error", got)
+	}
+}
+
+func TestRunRejectsFunctionsAndChannels(t *testing.T) {
+	for _, src := range []string{
+		"((x:int) -> (+ x 1))",
+		"(def inc (x:int):int (+ x 1)) inc",
+		"(chan int)",
+		"[((x:int) -> x) ((x:int) -> (- 0 x))]",
+	} {
+		got, err := Eval(context.Background(), src)
+		if err == nil || !strings.Contains(err.Error(), "cannot return a value of type") {
+			t.Errorf("%s = %v, %v, want an error", src, got, err)
+		}
+	}
+}
+
+func TestRunGlobals(t *testing.T) {
+	program, err := Compile("(* rate hours)", Env(map[string]interface{}{
+		"rate":  0.0,
+		"hours": 0.0,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hours := range []float64{8, 2} {
+		pay, err := program.Run(context.Background(), map[string]interface{}{"rate": 25.5, "hours": hours})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pay != 25.5*hours {
+			t.Errorf("pay for %v hours = %v, want %v", hours, pay, 25.5*hours)
+		}
+	}
+	if _, err := program.Run(context.Background(), map[string]interface{}{"rate": 25.5}); err == nil {
+		t.Error("Run accepted a missing global")
+	}
+	if _, err := program.Run(context.Background(), map[string]interface{}{"rate": 25.5, "hours": "8"}); err == nil {
+		t.Error("Run accepted a string for a float global")
+	}
+}
+
+func TestCompileErrorPosition(t *testing.T) {
+	_, err := Compile("(+ 1\n  'a')", Filename("pay.goo"))
+	want := "pay.goo:1:1: operator + not defined on int and string"
+	if err == nil || err.Error() != want {
+		t.Errorf("error = %v, want %s", err, want)
+	}
+}
+
+func TestFunc(t *testing.T) {
+	prices := map[string]int64{"pear": 3}
+	program, err := Compile("(* 2 (price item))", Env(map[string]interface{}{"item": ""}),
+		Func("price", "(string) -> int", func(args []Value) (Value, error) {
+			price, ok := prices[args[0].(string)]
+			if !ok {
+				return nil, fmt.Errorf("unknown item %s", args[0])
+			}
+			return price, nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := program.Run(context.Background(), map[string]interface{}{"item": "pear"})
+	if err != nil || got != int64(6) {
+		t.Errorf("pear = %v, %v, want 6", got, err)
+	}
+	_, err = program.Run(context.Background(), map[string]interface{}{"item": "plum"})
+	if err == nil || !strings.Contains(err.Error(), "unknown item plum") {
+		t.Errorf("plum: error = %v, want unknown item plum", err)
+	}
+
+	if _, err := Compile("(price 1)", Func("price", "(string) -> int", nil)); err == nil {
+		t.Error("Compile accepted a native function without an implementation")
+	}
+}
+
+func TestOutputAndTrace(t *testing.T) {
+	var out, trace strings.Builder
+	program, err := Compile("(print 'hi') (print (+ 1 2))", Output(&out), Trace(&trace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := program.Run(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "hi\n3\n" {
+		t.Errorf("output = %q, want %q", out.String(), "hi\n3\n")
+	}
+	if trace.Len() == 0 {
+		t.Error("nothing was traced")
+	}
+	if strings.Contains(trace.String(), "hi\n3\n") {
+		t.Error("program output was written to the trace")
+	}
+}
@@ -1,19 +1,102 @@
 package lexer
 
 import (
-	_ "fmt"
+	"fmt"
 	"regexp"
+	"sort"
+	"strings"
 	"unicode"
 )
 
+type Position struct {
+	Filename string
+	Offset   int
+	Line     int
+	Column   int
+}
+
+func (p Position) IsValid() bool {
+	return p.Line > 0
+}
+
+func (p Position) String() string {
+	s := p.Filename
+	if p.IsValid() {
+		if s != "" {
+			s += ":"
+		}
+		s += fmt.Sprintf("%d:%d", p.Line, p.Column)
+	}
+	if s == "" {
+		s = "-"
+	}
+	return s
+}
+
+type Error struct {
+	Pos Position
+	Msg string
+}
+
+func (e *Error) Error() string {
+	if !e.Pos.IsValid() && e.Pos.Filename == "" {
+		return e.Msg
+	}
+	return e.Pos.String() + ": " + e.Msg
+}
+
+func Errorf(pos Position, format string, args ...interface{}) *Error {
+	return &Error{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+type ErrorList []*Error
+
+func (l *ErrorList) Add(pos Position, msg string) {
+	*l = append(*l, &Error{Pos: pos, Msg: msg})
+}
+
+func (l ErrorList) Sort() {
+	sort.SliceStable(l, func(i, j int) bool {
+		if l[i].Pos.Filename != l[j].Pos.Filename {
+			return l[i].Pos.Filename < l[j].Pos.Filename
+		}
+		return l[i].Pos.Offset < l[j].Pos.Offset
+	})
+}
+
+func (l ErrorList) Error() string {
+	switch len(l) {
+	case 0:
+		return "no errors"
+	case 1:
+		return l[0].Error()
+	}
+	msgs := make([]string, len(l))
+	for i, err := range l {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (l ErrorList) Err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
 type Token struct {
 	Type    string
 	Literal string
+	Pos     Position
+	End     Position
 }
 
 const (
 	LPAREN     = "LPAREN"
 	RPAREN     = "RPAREN"
+	LBRACKET   = "LBRACKET"
+	RBRACKET   = "RBRACKET"
 	COLON      = "COLON"
 	LAMBDA     = "LAMBDA"
 	IDENT      = "IDENT"
@@ -35,12 +118,14 @@ var tokenTypes = []struct {
 }{
 	{LPAREN, `^\(`},
 	{RPAREN, `^\)`},
+	{LBRACKET, `^\[`},
+	{RBRACKET, `^\]`},
 	{COLON, `^:`},
 	{LAMBDA, `^->`},
 	{BOOL, `^true|^false`},
 	{COMMA, `^,`},
 	{NUMBER, `^-?\d+(\.\d+)?`},
-	{OPERATOR, `^[-><=+?*]+`},
+	{OPERATOR, `^[-><=+*/%!]+`},
 	{IDENT, `^[a-zA-Z_][a-zA-Z0-9_]*`},
 	{STRING, `^'[^']*'`},
 	{SPACE, `^\s`},
@@ -48,20 +133,52 @@ var tokenTypes = []struct {
 	{COMMENT, `^;[^\n]*`},
 }
 
+var tokenRegexps = func() []*regexp.Regexp {
+	regexps := make([]*regexp.Regexp, len(tokenTypes))
+	for i, tt := range tokenTypes {
+		regexps[i] = regexp.MustCompile(tt.regex)
+	}
+	return regexps
+}()
+
 type Lexer struct {
+	filename     string
 	input        string
+	lineStarts   []int
 	position     int
 	readPosition int
 	ch           rune
 	currentToken Token
+	// peeked holds the tokens read by PeekAhead and not yet returned by
+	// NextToken.
+	peeked []Token
 }
 
 func NewLexer(input string) *Lexer {
-	l := &Lexer{input: input}
+	return NewFileLexer("", input)
+}
+
+func NewFileLexer(filename, input string) *Lexer {
+	l := &Lexer{filename: filename, input: input, lineStarts: []int{0}}
+	for i := 0; i < len(input); i++ {
+		if input[i] == '\n' {
+			l.lineStarts = append(l.lineStarts, i+1)
+		}
+	}
 	l.readChar()
 	return l
 }
 
+func (l *Lexer) PositionFor(offset int) Position {
+	line := sort.Search(len(l.lineStarts), func(i int) bool { return l.lineStarts[i] > offset }) - 1
+	return Position{
+		Filename: l.filename,
+		Offset:   offset,
+		Line:     line + 1,
+		Column:   offset - l.lineStarts[line] + 1,
+	}
+}
+
 func (l *Lexer) readChar() {
 	if l.readPosition >= len(l.input) {
 		l.ch = 0
@@ -74,17 +191,25 @@ func (l *Lexer) readChar() {
 }
 
 func (l *Lexer) NextToken() Token {
+	if len(l.peeked) > 0 {
+		tok := l.peeked[0]
+		l.peeked = l.peeked[1:]
+		return tok
+	}
+	return l.scan()
+}
+
+func (l *Lexer) scan() Token {
 	var tok Token
 
 	for unicode.IsSpace(l.ch) {
 		l.readChar()
 	}
 
-	for _, tt := range tokenTypes {
-		regex := regexp.MustCompile(tt.regex)
-		if matches := regex.FindString(l.input[l.position:]); matches != "" {
+	for i, tt := range tokenTypes {
+		if matches := tokenRegexps[i].FindString(l.input[l.position:]); matches != "" {
 			literal := matches
-			tok = Token{Type: tt.token, Literal: literal}
+			tok = Token{Type: tt.token, Literal: literal, Pos: l.PositionFor(l.position), End: l.PositionFor(l.position + len(matches))}
 			l.position += len(matches)
 			l.readPosition = l.position
 			l.readChar()
@@ -92,32 +217,32 @@ func (l *Lexer) NextToken() Token {
 		}
 	}
 
+	pos := l.PositionFor(l.position)
 	if l.ch == 0 {
-		return Token{Type: EOF, Literal: ""}
+		return Token{Type: EOF, Literal: "", Pos: pos, End: pos}
 	}
 
-	tok = Token{Type: ILLEGAL, Literal: string(l.ch)}
+	tok = Token{Type: ILLEGAL, Literal: string(l.ch), Pos: pos, End: l.PositionFor(l.readPosition)}
 	l.readChar()
 	return tok
 }
 
+// PeekAhead returns the next n tokens, leaving out comments, without
+// consuming them; it returns fewer if the input ends first. The tokens are
+// kept for NextToken, so peeking again does not read them again.
 func (l *Lexer) PeekAhead(n int) ([]Token, error) {
-	savedPosition := l.position
-	savedReadPosition := l.readPosition
-	savedChar := l.ch
-
-	var tokens []Token
-	for i := 0; i < n; i++ {
-		token := l.NextToken()
-		tokens = append(tokens, token)
-		if token.Type == EOF {
+	for len(l.peeked) < n {
+		if len(l.peeked) > 0 && l.peeked[len(l.peeked)-1].Type == EOF {
 			break
 		}
+		token := l.scan()
+		if token.Type == COMMENT {
+			continue
+		}
+		l.peeked = append(l.peeked, token)
 	}
-
-	l.position = savedPosition
-	l.readPosition = savedReadPosition
-	l.ch = savedChar
-
-	return tokens, nil
+	if len(l.peeked) < n {
+		n = len(l.peeked)
+	}
+	return l.peeked[:n], nil
 }
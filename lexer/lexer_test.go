@@ -0,0 +1,104 @@
+package lexer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenPositions(t *testing.T) {
+	l := NewFileLexer("main.goo", "(let x:int 1)\n; a comment\n  (print x)")
+	tests := []struct {
+		typ, literal string
+		pos, end     string
+		offset       int
+	}{
+		{LPAREN, "(", "main.goo:1:1", "main.goo:1:2", 0},
+		{IDENT, "let", "main.goo:1:2", "main.goo:1:5", 1},
+		{IDENT, "x", "main.goo:1:6", "main.goo:1:7", 5},
+		{COLON, ":", "main.goo:1:7", "main.goo:1:8", 6},
+		{IDENT, "int", "main.goo:1:8", "main.goo:1:11", 7},
+		{NUMBER, "1", "main.goo:1:12", "main.goo:1:13", 11},
+		{RPAREN, ")", "main.goo:1:13", "main.goo:1:14", 12},
+		{COMMENT, "; a comment", "main.goo:2:1", "main.goo:2:12", 14},
+		{LPAREN, "(", "main.goo:3:3", "main.goo:3:4", 28},
+		{IDENT, "print", "main.goo:3:4", "main.goo:3:9", 29},
+		{IDENT, "x", "main.goo:3:10", "main.goo:3:11", 35},
+		{RPAREN, ")", "main.goo:3:11", "main.goo:3:12", 36},
+		{EOF, "", "main.goo:3:12", "main.goo:3:12", 37},
+	}
+	for _, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.typ || tok.Literal != tt.literal {
+			t.Fatalf("token = %s %q, want %s %q", tok.Type, tok.Literal, tt.typ, tt.literal)
+		}
+		if tok.Pos.String() != tt.pos || tok.End.String() != tt.end || tok.Pos.Offset != tt.offset {
+			t.Errorf("%q at %v (offset %d) to %v, want %s (offset %d) to %s",
+				tok.Literal, tok.Pos, tok.Pos.Offset, tok.End, tt.pos, tt.offset, tt.end)
+		}
+	}
+}
+
+func TestErrorString(t *testing.T) {
+	tests := []struct {
+		pos  Position
+		want string
+	}{
+		{Position{Filename: "a.goo", Offset: 4, Line: 2, Column: 3}, "a.goo:2:3: bad"},
+		{Position{Offset: 4, Line: 2, Column: 3}, "2:3: bad"},
+		{Position{Filename: "a.goo"}, "a.goo: bad"},
+		{Position{}, "bad"},
+	}
+	for _, tt := range tests {
+		if got := Errorf(tt.pos, "bad").Error(); got != tt.want {
+			t.Errorf("error at %#v = %q, want %q", tt.pos, got, tt.want)
+		}
+	}
+}
+
+func literals(tokens []Token) []string {
+	var s []string
+	for _, tok := range tokens {
+		s = append(s, tok.Type+" "+tok.Literal)
+	}
+	return s
+}
+
+func TestPeekAhead(t *testing.T) {
+	l := NewLexer("(f ; first\n<int> ; second\n 1)")
+	if tok := l.NextToken(); tok.Type != LPAREN {
+		t.Fatalf("first token = %v, want (", tok)
+	}
+
+	// comments are left out, and peeking again returns the same tokens
+	want := []string{"IDENT f", "OPERATOR <", "IDENT int", "OPERATOR >"}
+	for i := 0; i < 2; i++ {
+		peeked, err := l.PeekAhead(4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := literals(peeked); !reflect.DeepEqual(got, want) {
+			t.Fatalf("PeekAhead(4) = %q, want %q", got, want)
+		}
+	}
+
+	// NextToken returns the peeked tokens and carries on after them
+	var tokens []Token
+	for tok := l.NextToken(); tok.Type != EOF; tok = l.NextToken() {
+		tokens = append(tokens, tok)
+	}
+	want = append(want, "COMMENT ; second", "NUMBER 1", "RPAREN )")
+	if got := literals(tokens); !reflect.DeepEqual(got, want) {
+		t.Fatalf("tokens = %q, want %q", got, want)
+	}
+	if pos := tokens[5].Pos; pos.Line != 3 || pos.Column != 2 {
+		t.Errorf("1 at %v, want 3:2", pos)
+	}
+}
+
+func TestPeekAheadAtEnd(t *testing.T) {
+	l := NewLexer("a ; done")
+	peeked, _ := l.PeekAhead(5)
+	if got, want := literals(peeked), []string{"IDENT a", "EOF "}; !reflect.DeepEqual(got, want) {
+		t.Errorf("PeekAhead(5) = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,404 @@
+package parser
+
+import (
+	"strings"
+	"teriyake/goo/lexer"
+)
+
+type Node interface {
+	Pos() lexer.Position
+	End() lexer.Position
+}
+
+type Span struct {
+	StartPos lexer.Position
+	EndPos   lexer.Position
+}
+
+func (s Span) Pos() lexer.Position {
+	return s.StartPos
+}
+
+func (s Span) End() lexer.Position {
+	return s.EndPos
+}
+
+func tokenSpan(tok lexer.Token) Span {
+	return Span{StartPos: tok.Pos, EndPos: tok.End}
+}
+
+type Program struct {
+	Span
+	Expressions []Node
+}
+
+type Block struct {
+	Span
+	Expressions []Node
+}
+
+type Identifier struct {
+	Span
+	Value string
+}
+
+type Integer struct {
+	Span
+	Literal string
+	Value   int64
+}
+
+type Float struct {
+	Span
+	Literal string
+	Value   float64
+}
+
+type Boolean struct {
+	Span
+	Value bool
+}
+
+type String struct {
+	Span
+	Value string
+}
+
+type ListLiteral struct {
+	Span
+	Elements []Node
+}
+
+type BinaryExpression struct {
+	Span
+	Operator string
+	Left     Node
+	Right    Node
+}
+
+type UnaryExpression struct {
+	Span
+	Operator string
+	Operand  Node
+}
+
+type CallExpression struct {
+	Span
+	Callee        Node
+	TypeArguments []TypeExpr
+	Arguments     []Node
+}
+
+type LetStatement struct {
+	Span
+	Binding TypeAnnotation
+	Value   Node
+}
+
+type IfStatement struct {
+	Span
+	Condition Node
+	ThenBlock Node
+	ElseBlock Node
+}
+
+type TypeAnnotation struct {
+	Span
+	Variable string
+	Type     TypeExpr // nil if the type was omitted
+}
+
+// TypeExpr is a type as written in the source, e.g. int, T or (T) -> int.
+type TypeExpr interface {
+	Node
+	String() string
+}
+
+type NamedType struct {
+	Span
+	Name string
+}
+
+func (t NamedType) String() string {
+	return t.Name
+}
+
+type ListType struct {
+	Span
+	Elem TypeExpr
+}
+
+func (t ListType) String() string {
+	return "[" + t.Elem.String() + "]"
+}
+
+type ChanType struct {
+	Span
+	Elem TypeExpr
+}
+
+func (t ChanType) String() string {
+	return "chan " + t.Elem.String()
+}
+
+type FunctionType struct {
+	Span
+	Params []TypeExpr
+	Result TypeExpr
+}
+
+func (t FunctionType) String() string {
+	params := make([]string, len(t.Params))
+	for i, param := range t.Params {
+		params[i] = param.String()
+	}
+	return "(" + strings.Join(params, " ") + ") -> " + t.Result.String()
+}
+
+type FunctionDefinition struct {
+	Span
+	Name       string
+	TypeParams []NamedType
+	Params     []TypeAnnotation
+	ReturnType TypeExpr // nil if the return type is inferred
+	Body       Block
+	Pure       bool // declared with def pure
+}
+
+type ReturnStatement struct {
+	Span
+	ReturnValue Node
+}
+
+type LambdaExpression struct {
+	Span
+	TypeParams []NamedType
+	Params     []TypeAnnotation
+	Body       Node
+	Pure       bool // declared with (pure ...)
+}
+
+// MapExpression is map, or pmap if Parallel is set.
+type MapExpression struct {
+	Span
+	Lambda   Node
+	List     Node
+	Parallel bool
+}
+
+// FilterExpression is filter, or pfilter if Parallel is set.
+type FilterExpression struct {
+	Span
+	Lambda   Node
+	List     Node
+	Parallel bool
+}
+
+type ReduceExpression struct {
+	Span
+	Lambda       Node
+	InitialValue Node
+	List         Node
+}
+
+// SpawnStatement runs Call, a call or a function without parameters, in a
+// task of its own.
+type SpawnStatement struct {
+	Span
+	Call Node
+}
+
+type ChannelExpression struct {
+	Span
+	Elem     TypeExpr
+	Capacity Node // nil for an unbuffered channel
+}
+
+type SendStatement struct {
+	Span
+	Channel Node
+	Value   Node
+}
+
+type ReceiveExpression struct {
+	Span
+	Channel Node
+	Else    Node // nil if receiving from a closed channel is an error
+}
+
+type CloseStatement struct {
+	Span
+	Channel Node
+}
+
+type SelectStatement struct {
+	Span
+	Cases []SelectCase
+}
+
+// SelectCase is a case of a select: a receive from Channel into Binding, a
+// send of Value on Channel, or the else case, with the body run when it is
+// chosen.
+type SelectCase struct {
+	Span
+	Kind    string // "recv", "send" or "else"
+	Channel Node
+	Value   Node
+	Binding TypeAnnotation
+	Body    Block
+}
+
+// TryExpression evaluates Body, or, if an error is raised while it runs,
+// Catch with the error bound to Binding.
+type TryExpression struct {
+	Span
+	Body    Block
+	Binding TypeAnnotation
+	Catch   Block
+}
+
+// RaiseStatement raises Value, an error or the message of a new one.
+type RaiseStatement struct {
+	Span
+	Value Node
+}
+
+// A Visitor's Visit method is invoked for each node encountered by Walk.
+// If the result visitor w is not nil, Walk visits each of the children
+// of node with the visitor w, followed by a call of w.Visit(nil).
+type Visitor interface {
+	Visit(node Node) (w Visitor)
+}
+
+func walkList(v Visitor, nodes []Node) {
+	for _, node := range nodes {
+		Walk(v, node)
+	}
+}
+
+// Walk traverses an AST in depth-first order, in the same way as go/ast.Walk.
+func Walk(v Visitor, node Node) {
+	if node == nil {
+		return
+	}
+	if v = v.Visit(node); v == nil {
+		return
+	}
+
+	switch n := node.(type) {
+	case Program:
+		walkList(v, n.Expressions)
+	case Block:
+		walkList(v, n.Expressions)
+	case Identifier, Integer, Float, Boolean, String, NamedType:
+		// leaves
+	case TypeAnnotation:
+		Walk(v, n.Type)
+	case ListType:
+		Walk(v, n.Elem)
+	case ChanType:
+		Walk(v, n.Elem)
+	case FunctionType:
+		for _, param := range n.Params {
+			Walk(v, param)
+		}
+		Walk(v, n.Result)
+	case ListLiteral:
+		walkList(v, n.Elements)
+	case BinaryExpression:
+		Walk(v, n.Left)
+		Walk(v, n.Right)
+	case UnaryExpression:
+		Walk(v, n.Operand)
+	case CallExpression:
+		Walk(v, n.Callee)
+		for _, typeArg := range n.TypeArguments {
+			Walk(v, typeArg)
+		}
+		walkList(v, n.Arguments)
+	case LetStatement:
+		Walk(v, n.Binding)
+		Walk(v, n.Value)
+	case IfStatement:
+		Walk(v, n.Condition)
+		Walk(v, n.ThenBlock)
+		Walk(v, n.ElseBlock)
+	case FunctionDefinition:
+		for _, typeParam := range n.TypeParams {
+			Walk(v, typeParam)
+		}
+		for _, param := range n.Params {
+			Walk(v, param)
+		}
+		Walk(v, n.ReturnType)
+		Walk(v, n.Body)
+	case ReturnStatement:
+		Walk(v, n.ReturnValue)
+	case LambdaExpression:
+		for _, typeParam := range n.TypeParams {
+			Walk(v, typeParam)
+		}
+		for _, param := range n.Params {
+			Walk(v, param)
+		}
+		Walk(v, n.Body)
+	case MapExpression:
+		Walk(v, n.Lambda)
+		Walk(v, n.List)
+	case FilterExpression:
+		Walk(v, n.Lambda)
+		Walk(v, n.List)
+	case ReduceExpression:
+		Walk(v, n.Lambda)
+		Walk(v, n.InitialValue)
+		Walk(v, n.List)
+	case SpawnStatement:
+		Walk(v, n.Call)
+	case ChannelExpression:
+		Walk(v, n.Elem)
+		Walk(v, n.Capacity)
+	case SendStatement:
+		Walk(v, n.Channel)
+		Walk(v, n.Value)
+	case ReceiveExpression:
+		Walk(v, n.Channel)
+		Walk(v, n.Else)
+	case CloseStatement:
+		Walk(v, n.Channel)
+	case SelectStatement:
+		for _, selectCase := range n.Cases {
+			Walk(v, selectCase)
+		}
+	case SelectCase:
+		Walk(v, n.Channel)
+		Walk(v, n.Value)
+		if n.Kind == "recv" {
+			Walk(v, n.Binding)
+		}
+		Walk(v, n.Body)
+	case TryExpression:
+		Walk(v, n.Body)
+		Walk(v, n.Binding)
+		Walk(v, n.Catch)
+	case RaiseStatement:
+		Walk(v, n.Value)
+	}
+
+	v.Visit(nil)
+}
+
+type inspector func(Node) bool
+
+func (f inspector) Visit(node Node) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses an AST in depth-first order, calling f for each node.
+// If f returns true, Inspect invokes f for the children of node, followed
+// by a call of f(nil).
+func Inspect(node Node, f func(Node) bool) {
+	Walk(inspector(f), node)
+}
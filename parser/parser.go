@@ -1,331 +1,845 @@
 package parser
 
 import (
-	"fmt"
 	"strconv"
+	"strings"
 	"teriyake/goo/lexer"
 )
 
-type Identifier struct {
-	Value string
+type Parser struct {
+	lexer        *lexer.Lexer
+	currentToken lexer.Token
+	peekToken    lexer.Token
 }
 
-type Number struct {
-	Value float64
+func NewParser(lexer *lexer.Lexer) *Parser {
+	p := &Parser{lexer: lexer}
+	p.nextToken()
+	p.nextToken()
+	return p
 }
 
-type Boolean struct {
-	Value bool
+func (p *Parser) errorf(format string, args ...interface{}) error {
+	return lexer.Errorf(p.currentToken.Pos, format, args...)
 }
 
-type String struct {
-	Value string
+func (p *Parser) spanFrom(start lexer.Token) Span {
+	end := p.currentToken.End
+	if end.Offset < start.End.Offset {
+		end = start.End
+	}
+	return Span{StartPos: start.Pos, EndPos: end}
 }
 
-type Operator struct {
-	Value string
+func (p *Parser) nextToken() {
+	p.currentToken = p.peekToken
+	p.peekToken = p.lexer.NextToken()
+	for p.peekToken.Type == lexer.COMMENT {
+		p.peekToken = p.lexer.NextToken()
+	}
+	//fmt.Printf("nextToken - Current token: %s, Literal: %s\n", p.currentToken.Type, p.currentToken.Literal)
 }
 
-type IfStatement struct {
-	Condition interface{}
-	ThenBlock interface{}
-	ElseBlock interface{}
+// lookAhead returns the token n places after the peek token, skipping
+// comments, or an EOF token if the input ends before it. lookAhead(0) is the
+// peek token.
+func (p *Parser) lookAhead(n int) lexer.Token {
+	if n == 0 {
+		return p.peekToken
+	}
+	next, _ := p.lexer.PeekAhead(n)
+	if len(next) < n {
+		return lexer.Token{Type: lexer.EOF, Pos: p.peekToken.End, End: p.peekToken.End}
+	}
+	return next[n-1]
 }
 
-type TypeAnnotation struct {
-	Variable string
-	Type     string
+func (p *Parser) currentTokenIs(t string) bool {
+	return p.currentToken.Type == t
 }
 
-type FunctionDefinition struct {
-	Name       string
-	Params     []TypeAnnotation
-	ReturnType string
-	Body       []interface{}
+func (p *Parser) peekTokenIs(t string) bool {
+	return p.peekToken.Type == t
 }
 
-type ReturnStatement struct {
-	ReturnValue interface{}
+func (p *Parser) expectPeek(t string) bool {
+	if p.peekToken.Type == t {
+		p.nextToken()
+		return true
+	}
+	return false
 }
 
-type LambdaExpression struct {
-	Params []TypeAnnotation
-	Body   []interface{}
+func (p *Parser) expectClose(what string) error {
+	if !p.currentTokenIs(lexer.RPAREN) {
+		if p.currentTokenIs(lexer.EOF) {
+			return p.errorf("unexpected end of input, expected ')' to close %s", what)
+		}
+		return p.errorf("expected ')' to close %s, got %s", what, p.currentToken.Literal)
+	}
+	return nil
 }
 
-type LambdaCall struct {
-	Lambda    interface{}
-	Arguments []interface{}
+func (p *Parser) Parse() (Program, error) {
+	//fmt.Println("Parse - Start")
+	var program Program
+	start := p.currentToken
+
+	for !p.currentTokenIs(lexer.EOF) {
+		expression, err := p.parseExpression()
+		if err != nil {
+			return Program{}, err
+		}
+		program.Expressions = append(program.Expressions, expression)
+		//fmt.Printf("Parsed expression: %v\n", expression)
+		p.nextToken()
+	}
+
+	program.Span = p.spanFrom(start)
+	//fmt.Println("Parse - End")
+	return program, nil
 }
 
-type MapExpression struct {
-	Lambda    interface{}
-	Arguments []interface{}
+// ParseType parses src as a single type, such as "int", "[string]" or
+// "(int [int]) -> bool".
+func ParseType(src string) (TypeExpr, error) {
+	p := NewParser(lexer.NewLexer(src))
+	typeExpr, err := p.parseType()
+	if err != nil {
+		return nil, err
+	}
+	if !p.peekTokenIs(lexer.EOF) {
+		return nil, lexer.Errorf(p.peekToken.Pos, "unexpected %s after type", p.peekToken.Literal)
+	}
+	return typeExpr, nil
 }
 
-type FilterExpression struct {
-	Lambda    interface{}
-	Arguments []interface{}
+// parseExpression parses a single expression starting at the current token
+// and leaves the parser on the last token of that expression.
+func (p *Parser) parseExpression() (Node, error) {
+	//fmt.Printf("parseExpression - Start, Current token: %s, Literal: %s\n", p.currentToken.Type, p.currentToken.Literal)
+
+	switch p.currentToken.Type {
+	case lexer.IDENT:
+		return Identifier{Span: tokenSpan(p.currentToken), Value: p.currentToken.Literal}, nil
+	case lexer.NUMBER:
+		literal := p.currentToken.Literal
+		if !strings.Contains(literal, ".") {
+			intValue, err := strconv.ParseInt(literal, 10, 64)
+			if err != nil {
+				return nil, p.errorf("integer literal %s out of range", literal)
+			}
+			return Integer{Span: tokenSpan(p.currentToken), Literal: literal, Value: intValue}, nil
+		}
+		floatValue, err := strconv.ParseFloat(literal, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number literal %s", literal)
+		}
+		return Float{Span: tokenSpan(p.currentToken), Literal: literal, Value: floatValue}, nil
+	case lexer.BOOL:
+		return Boolean{Span: tokenSpan(p.currentToken), Value: p.currentToken.Literal == "true"}, nil
+	case lexer.STRING:
+		return String{Span: tokenSpan(p.currentToken), Value: p.currentToken.Literal}, nil
+	case lexer.LPAREN:
+		return p.parseForm()
+	case lexer.LBRACKET:
+		return p.parseListLiteral()
+	case lexer.EOF:
+		return nil, p.errorf("unexpected end of input")
+	default:
+		return nil, p.errorf("Unexpected token: %s", p.currentToken.Literal)
+	}
 }
 
-type ReduceExpression struct {
-	Lambda       interface{}
-	InitialValue interface{}
-	Arguments    []interface{}
+func (p *Parser) parseListLiteral() (Node, error) {
+	start := p.currentToken
+	var elements []Node
+
+	p.nextToken()
+	for !p.currentTokenIs(lexer.RBRACKET) {
+		if p.currentTokenIs(lexer.EOF) {
+			return nil, p.errorf("unexpected end of input, expected ']' to close list")
+		}
+		if p.currentTokenIs(lexer.COMMA) {
+			p.nextToken()
+			continue
+		}
+		element, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, element)
+		p.nextToken()
+	}
+
+	return ListLiteral{Span: p.spanFrom(start), Elements: elements}, nil
 }
 
-type Parser struct {
-	lexer        *lexer.Lexer
-	currentToken lexer.Token
-	peekToken    lexer.Token
+func (p *Parser) parseForm() (Node, error) {
+	start := p.currentToken
+	p.nextToken()
+
+	switch {
+	case p.currentTokenIs(lexer.RPAREN):
+		return nil, p.errorf("empty expression")
+	case p.isLambdaStart():
+		return p.parseLambdaForm(start, false)
+	case p.currentTokenIs(lexer.OPERATOR):
+		return p.parseBinaryExpression(start)
+	case p.currentTokenIs(lexer.IDENT):
+		switch p.currentToken.Literal {
+		case "let":
+			return p.parseLetStatement(start)
+		case "def":
+			return p.parseFunctionDefinition(start)
+		case "pure":
+			return p.parsePureLambda(start)
+		case "if":
+			return p.parseIfStatement(start)
+		case "ret":
+			return p.parseReturnStatement(start)
+		case "map", "pmap":
+			return p.parseMapExpression(start)
+		case "filter", "pfilter":
+			return p.parseFilterExpression(start)
+		case "reduce":
+			return p.parseReduceExpression(start)
+		case "spawn":
+			return p.parseSpawnStatement(start)
+		case "chan":
+			return p.parseChannelExpression(start)
+		case "send":
+			return p.parseSendStatement(start)
+		case "recv":
+			return p.parseReceiveExpression(start)
+		case "close":
+			return p.parseCloseStatement(start)
+		case "select":
+			return p.parseSelectStatement(start)
+		case "try":
+			return p.parseTryExpression(start)
+		case "raise":
+			return p.parseRaiseStatement(start)
+		case "and", "or":
+			return p.parseBinaryExpression(start)
+		case "not":
+			return p.parseUnaryExpression(start)
+		}
+	}
+
+	return p.parseGroup(start)
 }
 
-func NewParser(lexer *lexer.Lexer) *Parser {
-	p := &Parser{lexer: lexer}
+func (p *Parser) parseGroup(start lexer.Token) (Node, error) {
+	var elements []Node
+	var typeArgs []TypeExpr
+	for !p.currentTokenIs(lexer.RPAREN) {
+		if p.currentTokenIs(lexer.EOF) {
+			return nil, p.expectClose("expression")
+		}
+		if len(elements) == 1 && typeArgs == nil && p.isTypeArgumentsStart() {
+			var err error
+			if typeArgs, err = p.parseTypeArguments(); err != nil {
+				return nil, err
+			}
+			p.nextToken()
+			continue
+		}
+		expr, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, expr)
+		p.nextToken()
+	}
+	span := p.spanFrom(start)
+
+	if len(elements) == 1 && typeArgs == nil {
+		return elements[0], nil
+	}
+
+	switch elements[0].(type) {
+	case Identifier, LambdaExpression:
+		args := elements[1:]
+		// (f (1 2)) passes the elements of a plain group as the arguments
+		if len(args) == 1 {
+			if block, ok := args[0].(Block); ok {
+				args = block.Expressions
+			}
+		}
+		return CallExpression{Span: span, Callee: elements[0], TypeArguments: typeArgs, Arguments: args}, nil
+	}
+
+	if typeArgs != nil {
+		return nil, lexer.Errorf(elements[0].Pos(), "type arguments given to an expression that is not a function")
+	}
+	return Block{Span: span, Expressions: elements}, nil
+}
+
+func (p *Parser) parseBinaryExpression(start lexer.Token) (Node, error) {
+	operator := p.currentToken.Literal
 	p.nextToken()
+
+	var operands []Node
+	for !p.currentTokenIs(lexer.RPAREN) {
+		if p.currentTokenIs(lexer.EOF) {
+			return nil, p.expectClose("operator " + operator)
+		}
+		operand, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, operand)
+		p.nextToken()
+	}
+
+	// (+ (1 2)) takes both operands from a single group; a group that
+	// starts with a name, like (- (f x)), is a call and stays one operand
+	if len(operands) == 1 {
+		if block, ok := operands[0].(Block); ok {
+			operands = block.Expressions
+		}
+	}
+
+	if len(operands) != 2 {
+		return nil, lexer.Errorf(start.Pos, "operator %s expects 2 operands, got %d", operator, len(operands))
+	}
+
+	return BinaryExpression{
+		Span:     p.spanFrom(start),
+		Operator: operator,
+		Left:     operands[0],
+		Right:    operands[1],
+	}, nil
+}
+
+func (p *Parser) parseUnaryExpression(start lexer.Token) (Node, error) {
+	operator := p.currentToken.Literal
 	p.nextToken()
-	return p
+
+	operand, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+
+	p.nextToken()
+	if !p.currentTokenIs(lexer.RPAREN) {
+		return nil, lexer.Errorf(start.Pos, "operator %s expects 1 operand", operator)
+	}
+
+	return UnaryExpression{
+		Span:     p.spanFrom(start),
+		Operator: operator,
+		Operand:  operand,
+	}, nil
 }
 
-func (p *Parser) nextToken() {
-	p.currentToken = p.peekToken
-	p.peekToken = p.lexer.NextToken()
-	//fmt.Printf("nextToken - Current token: %s, Literal: %s\n", p.currentToken.Type, p.currentToken.Literal)
+func (p *Parser) isLambdaStart() bool {
+	if p.isTypeParamsStart() {
+		return true
+	}
+	if !p.currentTokenIs(lexer.LPAREN) {
+		return false
+	}
+
+	next := p.lookAhead(1)
+	if p.peekTokenIs(lexer.RPAREN) {
+		return next.Type == lexer.LAMBDA
+	}
+	return p.peekTokenIs(lexer.IDENT) && next.Type == lexer.COLON
 }
 
-func (p *Parser) parseExpression() (interface{}, error) {
-	//fmt.Printf("parseExpression - Start, Current token: %s, Literal: %s\n", p.currentToken.Type, p.currentToken.Literal)
+// parsePureLambda parses a lambda declared pure, such as
+// (pure (x:int) -> (* x x)), which may be called at once like any lambda.
+func (p *Parser) parsePureLambda(start lexer.Token) (Node, error) {
+	p.nextToken()
+	if !p.isLambdaStart() {
+		return nil, p.errorf("expected a lambda after pure, got %s", p.currentToken.Literal)
+	}
+	return p.parseLambdaForm(start, true)
+}
 
-	if p.currentToken.Type == lexer.ILLEGAL {
-		return nil, fmt.Errorf("Unexpected token: %s", p.currentToken.Literal)
+func (p *Parser) parseLambdaForm(start lexer.Token, pure bool) (Node, error) {
+	lambdaExpr, err := p.parseLambdaExpression(start)
+	if err != nil {
+		return nil, err
 	}
+	lambdaExpr.Pure = pure
+	p.nextToken()
 
-	var result interface{}
-	var err error
-	switch p.currentToken.Type {
-	case lexer.IDENT:
-		if p.currentToken.Literal == "if" {
-			result, err = p.parseIfStatement()
-		} else if p.currentToken.Literal == "ret" {
-			result, err = p.parseReturnStatement()
-		} else if p.currentToken.Literal == "let" {
-			p.nextToken()
-			return p.parseVariableDefinition()
-		} else if p.currentToken.Literal == "map" {
-			return p.parseMapExpression()
-		} else if p.currentToken.Literal == "filter" {
-			return p.parseFilterExpression()
-		} else if p.currentToken.Literal == "reduce" {
-			return p.parseReduceExpression()
-		} else if p.peekTokenIs(lexer.LPAREN) {
-			return p.parseFunctionCall()
-		} else {
-			result = Identifier{Value: p.currentToken.Literal}
-		}
-		if p.currentToken.Literal == "def" {
-			return p.parseFunctionDefinition()
+	var typeArgs []TypeExpr
+	if p.isTypeArgumentsStart() {
+		if typeArgs, err = p.parseTypeArguments(); err != nil {
+			return nil, err
 		}
-	case lexer.NUMBER:
-		literal := p.currentToken.Literal
-		floatValue, err := strconv.ParseFloat(literal, 64)
+		p.nextToken()
+	}
+
+	var args []Node
+	for !p.currentTokenIs(lexer.RPAREN) {
+		if p.currentTokenIs(lexer.EOF) {
+			return nil, p.expectClose("lambda expression")
+		}
+		arg, err := p.parseExpression()
 		if err != nil {
 			return nil, err
 		}
-		result = Number{Value: floatValue}
-	case lexer.BOOL:
-		if p.currentToken.Literal == "true" {
-			result = Boolean{Value: true}
-		} else {
-			result = Boolean{Value: false}
+		args = append(args, arg)
+		p.nextToken()
+	}
+
+	if len(args) == 0 && typeArgs == nil {
+		lambdaExpr.Span = p.spanFrom(start)
+		return lambdaExpr, nil
+	}
+	return CallExpression{Span: p.spanFrom(start), Callee: lambdaExpr, TypeArguments: typeArgs, Arguments: args}, nil
+}
+
+func (p *Parser) parseLambdaExpression(start lexer.Token) (LambdaExpression, error) {
+	var typeParams []NamedType
+	if p.isTypeParamsStart() {
+		var err error
+		if typeParams, err = p.parseTypeParameters(); err != nil {
+			return LambdaExpression{}, err
 		}
-	case lexer.STRING:
-		result = String{Value: p.currentToken.Literal}
-	case lexer.OPERATOR:
-		operator := Operator{Value: p.currentToken.Literal}
 		p.nextToken()
+	}
 
-		//var operands []interface{}
-		firstOperand, err := p.parseOperand()
-		if err != nil {
-			return nil, err
+	if !p.currentTokenIs(lexer.LPAREN) {
+		return LambdaExpression{}, p.errorf("expected '(' at the beginning of lambda parameters")
+	}
+
+	params, err := p.parseParameters()
+	if err != nil {
+		return LambdaExpression{}, err
+	}
+
+	if !p.expectPeek(lexer.LAMBDA) {
+		return LambdaExpression{}, lexer.Errorf(p.peekToken.Pos, "expected '->' after lambda parameters, got %s", p.peekToken.Literal)
+	}
+	p.nextToken()
+
+	body, err := p.parseExpression()
+	if err != nil {
+		return LambdaExpression{}, err
+	}
+
+	return LambdaExpression{Span: p.spanFrom(start), TypeParams: typeParams, Params: params, Body: body}, nil
+}
+
+func (p *Parser) isOperator(literal string) bool {
+	return p.currentTokenIs(lexer.OPERATOR) && p.currentToken.Literal == literal
+}
+
+// isTypeParamsStart reports whether the current '<' opens a type parameter
+// list such as <T U> rather than a less-than expression.
+func (p *Parser) isTypeParamsStart() bool {
+	if !p.isOperator("<") || !p.peekTokenIs(lexer.IDENT) {
+		return false
+	}
+
+	for n := 1; ; n++ {
+		switch tok := p.lookAhead(n); {
+		case tok.Type == lexer.IDENT || tok.Type == lexer.COMMA:
+			continue
+		case tok.Type == lexer.OPERATOR && tok.Literal == ">":
+			return true
+		default:
+			return false
 		}
-		//operands = append(operands, firstOperand)
-		//fmt.Printf("first operand: %v\n", firstOperand)
+	}
+}
 
-		var secondOperand []interface{}
-		if !p.peekTokenIs(lexer.RPAREN) && p.peekToken.Type != lexer.EOF {
-			p.nextToken()
-			operand, err := p.parseOperand()
-			if err != nil {
-				return nil, err
+// isTypeArgumentsStart reports whether the current '<' opens explicit type
+// arguments after a callee, such as <int> or <[T], (T) -> bool>: it must be
+// closed by a '>' with only the tokens of types in between, and be followed
+// by an argument or the end of the call.
+func (p *Parser) isTypeArgumentsStart() bool {
+	if !p.isOperator("<") {
+		return false
+	}
+
+	depth := 0
+	for n := 0; ; n++ {
+		switch tok := p.lookAhead(n); tok.Type {
+		case lexer.IDENT, lexer.COMMA, lexer.LAMBDA:
+		case lexer.LPAREN, lexer.LBRACKET:
+			depth++
+		case lexer.RPAREN, lexer.RBRACKET:
+			if depth == 0 {
+				return false
+			}
+			depth--
+		case lexer.OPERATOR:
+			if tok.Literal != ">" || depth > 0 {
+				return false
 			}
-			//operands = append(operands, secondOperand)
-			secondOperand = append(secondOperand, operand)
+			switch p.lookAhead(n + 1).Type {
+			case lexer.RPAREN, lexer.LPAREN, lexer.LBRACKET, lexer.IDENT, lexer.NUMBER, lexer.BOOL, lexer.STRING:
+				return true
+			}
+			return false
+		default:
+			return false
 		}
-		//fmt.Printf("second operand: %v\n", secondOperand)
+	}
+}
 
-		result = append([]interface{}{operator}, []interface{}{firstOperand}, []interface{}{secondOperand})
-	case lexer.LPAREN:
+// parseTypeParameters parses "<T U>" starting at the '<' and leaves the parser
+// on the closing '>'.
+func (p *Parser) parseTypeParameters() ([]NamedType, error) {
+	var typeParams []NamedType
+
+	p.nextToken()
+	for !p.isOperator(">") {
+		if p.currentTokenIs(lexer.COMMA) {
+			p.nextToken()
+			continue
+		}
+		if !p.currentTokenIs(lexer.IDENT) {
+			return nil, p.errorf("expected type parameter name, got %s", p.currentToken.Literal)
+		}
+		typeParams = append(typeParams, NamedType{Span: tokenSpan(p.currentToken), Name: p.currentToken.Literal})
 		p.nextToken()
-		if p.currentToken.Literal == "map" {
-			return p.parseMapExpression()
+	}
+
+	return typeParams, nil
+}
+
+// parseTypeArguments parses "<int (T) -> T>" starting at the '<' and leaves
+// the parser on the closing '>'.
+func (p *Parser) parseTypeArguments() ([]TypeExpr, error) {
+	typeArgs := []TypeExpr{}
+
+	p.nextToken()
+	for !p.isOperator(">") {
+		if p.currentTokenIs(lexer.EOF) {
+			return nil, p.errorf("unexpected end of input, expected '>' to close type arguments")
 		}
-		if p.currentToken.Literal == "filter" {
-			return p.parseFilterExpression()
+		if p.currentTokenIs(lexer.COMMA) {
+			p.nextToken()
+			continue
 		}
-		if p.currentToken.Literal == "reduce" {
-			return p.parseReduceExpression()
+		typeArg, err := p.parseType()
+		if err != nil {
+			return nil, err
 		}
-		if p.isLambdaExpression() {
-			lambdaExpr, err := p.parseLambdaExpression()
-			if err != nil {
-				return nil, err
-			}
+		typeArgs = append(typeArgs, typeArg)
+		p.nextToken()
+	}
 
-			p.nextToken()
+	if len(typeArgs) == 0 {
+		return nil, p.errorf("empty type argument list")
+	}
+	return typeArgs, nil
+}
 
-			var args []interface{}
-			for p.peekTokenIs(lexer.NUMBER) || p.peekTokenIs(lexer.IDENT) {
+// parseType parses a type name, a list type "[T]", a channel type "chan T"
+// or a function type "(int T) -> T" and leaves the parser on its last token.
+func (p *Parser) parseType() (TypeExpr, error) {
+	start := p.currentToken
+
+	switch {
+	case p.currentTokenIs(lexer.IDENT) && start.Literal == "chan":
+		p.nextToken()
+		elem, err := p.parseType()
+		if err != nil {
+			return nil, err
+		}
+		return ChanType{Span: p.spanFrom(start), Elem: elem}, nil
+	case p.currentTokenIs(lexer.IDENT):
+		return NamedType{Span: tokenSpan(start), Name: start.Literal}, nil
+	case p.currentTokenIs(lexer.LBRACKET):
+		p.nextToken()
+		elem, err := p.parseType()
+		if err != nil {
+			return nil, err
+		}
+		if !p.expectPeek(lexer.RBRACKET) {
+			return nil, lexer.Errorf(p.peekToken.Pos, "expected ']' to close list type, got %s", p.peekToken.Literal)
+		}
+		return ListType{Span: p.spanFrom(start), Elem: elem}, nil
+	case p.currentTokenIs(lexer.LPAREN):
+		var params []TypeExpr
+		p.nextToken()
+		for !p.currentTokenIs(lexer.RPAREN) {
+			if p.currentTokenIs(lexer.EOF) {
+				return nil, p.expectClose("function type")
+			}
+			if p.currentTokenIs(lexer.COMMA) {
 				p.nextToken()
-				arg, err := p.parseExpression()
-				if err != nil {
-					return nil, err
-				}
-				args = append(args, arg)
+				continue
+			}
+			param, err := p.parseType()
+			if err != nil {
+				return nil, err
 			}
+			params = append(params, param)
+			p.nextToken()
+		}
 
-			return LambdaCall{Lambda: lambdaExpr, Arguments: args}, nil
-		} else {
-			return p.parseParenExpression()
+		if !p.expectPeek(lexer.LAMBDA) {
+			return nil, lexer.Errorf(p.peekToken.Pos, "expected '->' after function type parameters, got %s", p.peekToken.Literal)
 		}
-	case lexer.RPAREN:
 		p.nextToken()
-		return nil, nil
+		result, err := p.parseType()
+		if err != nil {
+			return nil, err
+		}
+		return FunctionType{Span: p.spanFrom(start), Params: params, Result: result}, nil
 	default:
-		err = fmt.Errorf("Unexpected token: %s", p.currentToken.Literal)
+		return nil, p.errorf("expected type, got %s", p.currentToken.Literal)
 	}
+}
+
+// parseParameters parses "(name:type ...)" starting at the opening paren and
+// leaves the parser on the closing paren.
+func (p *Parser) parseParameters() ([]TypeAnnotation, error) {
+	var params []TypeAnnotation
+
+	p.nextToken()
+	for !p.currentTokenIs(lexer.RPAREN) {
+		if p.currentTokenIs(lexer.EOF) {
+			return nil, p.errorf("unexpected end of input while parsing parameters")
+		}
 
-	//fmt.Printf("parseExpression - End, Parsed: %+v\n", result)
-	return result, err
+		if p.currentTokenIs(lexer.COMMA) {
+			p.nextToken()
+			continue
+		}
+
+		param, err := p.parseTypeAnnotation(false)
+		if err != nil {
+			return nil, err
+		}
+		params = append(params, param)
+		p.nextToken()
+	}
+
+	return params, nil
 }
 
-func (p *Parser) isLambdaExpression() bool {
-	nextTwoTokens, _ := p.lexer.PeekAhead(2)
+func (p *Parser) parseTypeAnnotation(typeRequired bool) (TypeAnnotation, error) {
+	if !p.currentTokenIs(lexer.IDENT) {
+		return TypeAnnotation{}, p.errorf("expected variable name, got %s", p.currentToken.Literal)
+	}
 
-	if len(nextTwoTokens) >= 2 {
-		return nextTwoTokens[0].Type == lexer.COLON && nextTwoTokens[1].Type == lexer.IDENT
+	start := p.currentToken
+	varName := p.currentToken.Literal
+
+	var varType TypeExpr
+	if p.peekTokenIs(lexer.COLON) {
+		p.nextToken()
+		p.nextToken()
+		var err error
+		if varType, err = p.parseType(); err != nil {
+			return TypeAnnotation{}, err
+		}
+	} else if typeRequired {
+		return TypeAnnotation{}, lexer.Errorf(p.peekToken.Pos, "expected ':' after variable name, got %s", p.peekToken.Literal)
 	}
 
-	return false
+	return TypeAnnotation{
+		Span:     p.spanFrom(start),
+		Variable: varName,
+		Type:     varType,
+	}, nil
 }
 
-func (p *Parser) parseLambdaExpression() (interface{}, error) {
-	if p.currentToken.Type != lexer.LPAREN {
-		return nil, fmt.Errorf("expected '(' at the beginning of lambda parameters")
+func (p *Parser) parseLetStatement(start lexer.Token) (Node, error) {
+	p.nextToken()
+	binding, err := p.parseTypeAnnotation(true)
+	if err != nil {
+		return nil, err
+	}
+
+	p.nextToken()
+	value, err := p.parseExpression()
+	if err != nil {
+		return nil, err
 	}
 
-	var params []TypeAnnotation
 	p.nextToken()
-	for !p.currentTokenIs(lexer.RPAREN) && !p.peekTokenIs(lexer.EOF) {
-		param, err := p.parseLambdaParams()
-		if err != nil {
+	if err := p.expectClose("let"); err != nil {
+		return nil, err
+	}
+
+	return LetStatement{Span: p.spanFrom(start), Binding: binding, Value: value}, nil
+}
+
+func (p *Parser) parseFunctionDefinition(start lexer.Token) (Node, error) {
+	p.nextToken()
+	// (def pure name ...) declares the function pure, while a function
+	// named pure is followed by its parameters
+	pure := p.currentTokenIs(lexer.IDENT) && p.currentToken.Literal == "pure" && p.peekTokenIs(lexer.IDENT)
+	if pure {
+		p.nextToken()
+	}
+	if !p.currentTokenIs(lexer.IDENT) {
+		return nil, p.errorf("expected function name, got %s", p.currentToken.Literal)
+	}
+	functionName := p.currentToken.Literal
+
+	var typeParams []NamedType
+	p.nextToken()
+	if p.isTypeParamsStart() {
+		var err error
+		if typeParams, err = p.parseTypeParameters(); err != nil {
 			return nil, err
 		}
-		params = append(params, param)
+		p.nextToken()
+	}
+
+	if !p.currentTokenIs(lexer.LPAREN) {
+		return nil, p.errorf("expected '(' before function parameters, got %s", p.currentToken.Literal)
+	}
+
+	params, err := p.parseParameters()
+	if err != nil {
+		return nil, err
+	}
 
+	var returnType TypeExpr
+	if p.peekTokenIs(lexer.COLON) {
+		p.nextToken()
+		p.nextToken()
+		if returnType, err = p.parseType(); err != nil {
+			return nil, err
+		}
+	}
+	p.nextToken()
+
+	body, err := p.parseBody("function " + functionName)
+	if err != nil {
+		return nil, err
+	}
+
+	return FunctionDefinition{
+		Span:       p.spanFrom(start),
+		Name:       functionName,
+		TypeParams: typeParams,
+		Params:     params,
+		ReturnType: returnType,
+		Body:       body,
+		Pure:       pure,
+	}, nil
+}
+
+// parseBody collects expressions up to the closing paren of the enclosing form.
+func (p *Parser) parseBody(what string) (Block, error) {
+	var body Block
+	bodyStart := p.currentToken
+	var bodyEnd lexer.Position
+
+	for !p.currentTokenIs(lexer.RPAREN) {
+		if p.currentTokenIs(lexer.EOF) {
+			return Block{}, p.expectClose(what)
+		}
+		expr, err := p.parseExpression()
+		if err != nil {
+			return Block{}, err
+		}
+		body.Expressions = append(body.Expressions, expr)
+		bodyEnd = p.currentToken.End
 		p.nextToken()
 	}
 
-	if !p.currentTokenIs(lexer.RPAREN) {
-		return nil, fmt.Errorf("expected ')' after lambda parameters")
+	if len(body.Expressions) > 0 {
+		body.Span = Span{StartPos: bodyStart.Pos, EndPos: bodyEnd}
 	}
+	return body, nil
+}
 
-	if !p.expectPeek(lexer.LAMBDA) {
-		return nil, fmt.Errorf("expected '->' after lambda parameters")
-	}
+func (p *Parser) parseIfStatement(start lexer.Token) (Node, error) {
+	var ifStmt IfStatement
 
-	var body []interface{}
 	p.nextToken()
-	b, err := p.parseExpression()
+	condition, err := p.parseExpression()
 	if err != nil {
 		return nil, err
 	}
-	body = append(body, b)
-	p.nextToken()
-
-	return LambdaExpression{Params: params, Body: body}, nil
-}
-
-func (p *Parser) parseLambdaParams() (TypeAnnotation, error) {
-	if p.currentToken.Type != lexer.IDENT {
-		return TypeAnnotation{}, fmt.Errorf("expected variable name, got %s", p.currentToken.Literal)
-	}
-
-	varName := p.currentToken.Literal
+	ifStmt.Condition = condition
 
 	p.nextToken()
-	if p.currentToken.Type != lexer.COLON {
-		return TypeAnnotation{}, fmt.Errorf("expected ':' after variable name, got %s", p.currentToken.Literal)
+	thenBlock, err := p.parseExpression()
+	if err != nil {
+		return nil, err
 	}
+	ifStmt.ThenBlock = thenBlock
 
 	p.nextToken()
-	if p.currentToken.Type != lexer.IDENT {
-		return TypeAnnotation{}, fmt.Errorf("expected variable type identifier after ':', got %s", p.currentToken.Literal)
+	if p.currentTokenIs(lexer.IDENT) && p.currentToken.Literal == "else" {
+		p.nextToken()
+		elseBlock, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		ifStmt.ElseBlock = elseBlock
+		p.nextToken()
 	}
 
-	varType := p.currentToken.Literal
+	if err := p.expectClose("if"); err != nil {
+		return nil, err
+	}
 
-	return TypeAnnotation{
-		Variable: varName,
-		Type:     varType,
-	}, nil
+	ifStmt.Span = p.spanFrom(start)
+	return ifStmt, nil
 }
 
-func (p *Parser) parseMapExpression() (interface{}, error) {
-	p.nextToken()
+func (p *Parser) parseReturnStatement(start lexer.Token) (Node, error) {
+	var ret ReturnStatement
 	p.nextToken()
 
-	lambdaExpr, err := p.parseLambdaExpression()
-	if err != nil {
-		return nil, err
+	if !p.currentTokenIs(lexer.RPAREN) {
+		returnValue, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		ret.ReturnValue = returnValue
+		p.nextToken()
 	}
 
-	args, err := p.parseExpressionList()
-	if err != nil {
+	if err := p.expectClose("ret"); err != nil {
 		return nil, err
 	}
 
-	return MapExpression{
-		Lambda:    lambdaExpr,
-		Arguments: args,
-	}, nil
+	ret.Span = p.spanFrom(start)
+	return ret, nil
 }
 
-func (p *Parser) parseFilterExpression() (interface{}, error) {
-	p.nextToken()
-	p.nextToken()
-
-	lambdaExpr, err := p.parseLambdaExpression()
+func (p *Parser) parseMapExpression(start lexer.Token) (Node, error) {
+	name := p.currentToken.Literal
+	lambdaExpr, list, err := p.parseHigherOrderArguments(name)
 	if err != nil {
 		return nil, err
 	}
 
-	args, err := p.parseExpressionList()
+	return MapExpression{
+		Span:     p.spanFrom(start),
+		Lambda:   lambdaExpr,
+		List:     list,
+		Parallel: name == "pmap",
+	}, nil
+}
+
+func (p *Parser) parseFilterExpression(start lexer.Token) (Node, error) {
+	name := p.currentToken.Literal
+	lambdaExpr, list, err := p.parseHigherOrderArguments(name)
 	if err != nil {
 		return nil, err
 	}
 
 	return FilterExpression{
-		Lambda:    lambdaExpr,
-		Arguments: args,
+		Span:     p.spanFrom(start),
+		Lambda:   lambdaExpr,
+		List:     list,
+		Parallel: name == "pfilter",
 	}, nil
 }
 
-func (p *Parser) parseReduceExpression() (interface{}, error) {
-	p.nextToken()
+func (p *Parser) parseReduceExpression(start lexer.Token) (Node, error) {
 	p.nextToken()
-
-	lambdaExpr, err := p.parseLambdaExpression()
+	lambdaExpr, err := p.parseExpression()
 	if err != nil {
 		return nil, err
 	}
@@ -336,372 +850,293 @@ func (p *Parser) parseReduceExpression() (interface{}, error) {
 		return nil, err
 	}
 
-	args, err := p.parseExpressionList()
+	p.nextToken()
+	list, err := p.parseListArgument()
 	if err != nil {
 		return nil, err
 	}
 
+	p.nextToken()
+	if err := p.expectClose("reduce"); err != nil {
+		return nil, err
+	}
+
 	return ReduceExpression{
+		Span:         p.spanFrom(start),
 		Lambda:       lambdaExpr,
 		InitialValue: initialValue,
-		Arguments:    args,
+		List:         list,
 	}, nil
 }
 
-func (p *Parser) parseExpressionList() ([]interface{}, error) {
-	var expressions []interface{}
-
-	if !p.expectPeek(lexer.LPAREN) {
-		return nil, fmt.Errorf("expected '(' to start an expression list, got %s", p.peekToken.Literal)
+func (p *Parser) parseHigherOrderArguments(what string) (Node, Node, error) {
+	p.nextToken()
+	lambdaExpr, err := p.parseExpression()
+	if err != nil {
+		return nil, nil, err
 	}
 
 	p.nextToken()
-
-	for !p.currentTokenIs(lexer.RPAREN) && !p.currentTokenIs(lexer.EOF) {
-		expr, err := p.parseExpression()
-		if err != nil {
-			return nil, err
-		}
-
-		if expr != nil {
-			expressions = append(expressions, expr)
-		}
-
-		p.nextToken()
+	list, err := p.parseListArgument()
+	if err != nil {
+		return nil, nil, err
 	}
 
-	if !p.expectPeek(lexer.RPAREN) {
-		return nil, fmt.Errorf("expected ')' at the end of expression list, got %s", p.currentToken.Literal)
+	p.nextToken()
+	if err := p.expectClose(what); err != nil {
+		return nil, nil, err
 	}
 
-	return expressions, nil
-}
-
-func (p *Parser) parseOperand() (interface{}, error) {
-	if p.currentToken.Type == lexer.LPAREN {
-		p.nextToken()
-
-		var nestedExpressions []interface{}
-		for p.currentToken.Type != lexer.RPAREN && p.currentToken.Type != lexer.EOF {
-			expr, err := p.parseExpression()
-			if err != nil {
-				return nil, err
-			}
-			nestedExpressions = append(nestedExpressions, expr)
-			if p.peekToken.Type == lexer.RPAREN {
-				break
-			}
-			p.nextToken()
-		}
-
-		if p.peekToken.Type != lexer.RPAREN {
-			return nil, fmt.Errorf("expected ')' after nested expression, got %s", p.currentToken.Literal)
-		}
-		p.nextToken()
-
-		return nestedExpressions, nil
-	} else {
-		return p.parseExpression()
-	}
+	return lambdaExpr, list, nil
 }
 
-func (p *Parser) parseParenExpression() (interface{}, error) {
-	var expressions []interface{}
-
-	for p.currentToken.Type != lexer.RPAREN && p.currentToken.Type != lexer.EOF {
-		expr, err := p.parseExpression()
-		if err != nil {
-			return nil, err
-		}
-		expressions = append(expressions, expr)
-
-		if p.peekToken.Type == lexer.RPAREN {
-			break
-		}
-		p.nextToken()
-	}
-
-	if !p.expectPeek(lexer.RPAREN) {
-		return nil, fmt.Errorf("expected ')' after expression, got %s", p.currentToken.Literal)
+// parseListArgument parses the list operand of map, filter and reduce. Any
+// expression is allowed, and a plain group such as (1 2 3) is read as a list
+// literal.
+func (p *Parser) parseListArgument() (Node, error) {
+	list, err := p.parseExpression()
+	if err != nil {
+		return nil, err
 	}
-
-	if len(expressions) == 1 {
-		return expressions[0], nil
+	if block, ok := list.(Block); ok {
+		return ListLiteral{Span: block.Span, Elements: block.Expressions}, nil
 	}
-	return expressions, nil
+	return list, nil
 }
 
-func (p *Parser) parseIfStatement() (IfStatement, error) {
-	var ifStmt IfStatement
-
-	if !p.expectPeek(lexer.LPAREN) {
-		return IfStatement{}, fmt.Errorf("expected '(' after 'if'")
-	}
-
+func (p *Parser) parseSpawnStatement(start lexer.Token) (Node, error) {
 	p.nextToken()
-	condition, err := p.parseExpression()
+	if p.currentTokenIs(lexer.RPAREN) {
+		return nil, p.errorf("spawn expects a call")
+	}
+	call, err := p.parseExpression()
 	if err != nil {
-		return IfStatement{}, err
+		return nil, err
 	}
-	ifStmt.Condition = condition
 
-	if !p.expectPeek(lexer.RPAREN) {
-		return IfStatement{}, fmt.Errorf("expected ')' after if condition")
+	p.nextToken()
+	if err := p.expectClose("spawn"); err != nil {
+		return nil, err
 	}
 
+	return SpawnStatement{Span: p.spanFrom(start), Call: call}, nil
+}
+
+// parseChannelExpression parses "(chan T)" or "(chan T capacity)".
+func (p *Parser) parseChannelExpression(start lexer.Token) (Node, error) {
 	p.nextToken()
-	thenBlock, err := p.parseExpression()
+	elem, err := p.parseType()
 	if err != nil {
-		return IfStatement{}, err
+		return nil, err
 	}
-	ifStmt.ThenBlock = thenBlock
-
-	if p.peekTokenIs(lexer.IDENT) && p.peekToken.Literal == "else" {
-		p.nextToken()
-
-		p.nextToken()
-		elseBlock, err := p.parseExpression()
-		if err != nil {
-			return IfStatement{}, err
-		}
 
-		if elseExpr, ok := elseBlock.([]interface{}); ok {
-			ifStmt.ElseBlock = elseExpr
-		} else {
-			ifStmt.ElseBlock = []interface{}{elseBlock}
+	var capacity Node
+	p.nextToken()
+	if !p.currentTokenIs(lexer.RPAREN) {
+		if capacity, err = p.parseExpression(); err != nil {
+			return nil, err
 		}
-	}
-
-	return ifStmt, nil
-}
-
-func (p *Parser) expectPeek(t string) bool {
-	if p.peekToken.Type == t || (t == lexer.RPAREN && p.peekToken.Type == lexer.EOF) {
 		p.nextToken()
-		return true
-	} else {
-		//fmt.Printf("expectPeek - Failed, Current token: %s, Expected: %s\n", p.peekToken.Type, t)
-		return false
 	}
-}
+	if err := p.expectClose("chan"); err != nil {
+		return nil, err
+	}
 
-func (p *Parser) peekTokenIs(t string) bool {
-	return p.peekToken.Type == t
+	return ChannelExpression{Span: p.spanFrom(start), Elem: elem, Capacity: capacity}, nil
 }
 
-func (p *Parser) parseLambdaExpression2() (LambdaExpression, error) {
+func (p *Parser) parseSendStatement(start lexer.Token) (Node, error) {
 	p.nextToken()
-
-	params, err := p.parseFunctionParameters()
+	channel, err := p.parseExpression()
 	if err != nil {
-		return LambdaExpression{}, err
+		return nil, err
 	}
 
 	p.nextToken()
-	var body []interface{}
-	b, err := p.parseExpression()
+	value, err := p.parseExpression()
 	if err != nil {
-		return LambdaExpression{}, err
+		return nil, err
 	}
-	body = append(body, b)
-
-	return LambdaExpression{Params: params, Body: body}, nil
-}
 
-func (p *Parser) parseFunctionDefinition() (interface{}, error) {
 	p.nextToken()
-
-	if p.currentToken.Type != lexer.IDENT {
-		return nil, fmt.Errorf("expected function name, got %s", p.currentToken.Literal)
-	}
-	functionName := p.currentToken.Literal
-
-	if !p.expectPeek(lexer.LPAREN) {
-		return nil, fmt.Errorf("expected '(' before function parameters, got %s", p.peekToken.Literal)
-	}
-
-	params, err := p.parseFunctionParameters()
-	if err != nil {
+	if err := p.expectClose("send"); err != nil {
 		return nil, err
 	}
 
-	if p.currentToken.Type != lexer.LPAREN {
-		return nil, fmt.Errorf("expected '(' before function body, got %s", p.peekToken.Literal)
-	}
+	return SendStatement{Span: p.spanFrom(start), Channel: channel, Value: value}, nil
+}
 
-	body, err := p.parseFunctionBody()
+// parseReceiveExpression parses "(recv ch)" or "(recv ch else value)".
+func (p *Parser) parseReceiveExpression(start lexer.Token) (Node, error) {
+	p.nextToken()
+	channel, err := p.parseExpression()
 	if err != nil {
-		return FunctionDefinition{}, err
+		return nil, err
 	}
 
-	var returnType string
-	if returnType == "" && len(body) > 0 {
-		if lastExpr, ok := body[len(body)-1].(Identifier); ok {
-			returnType = lastExpr.Value
+	var elseValue Node
+	p.nextToken()
+	if p.currentTokenIs(lexer.IDENT) && p.currentToken.Literal == "else" {
+		p.nextToken()
+		if elseValue, err = p.parseExpression(); err != nil {
+			return nil, err
 		}
+		p.nextToken()
 	}
-
-	return FunctionDefinition{
-		Name:       functionName,
-		Params:     params,
-		ReturnType: returnType,
-		Body:       body,
-	}, nil
-}
-
-func (p *Parser) parseVariableDefinition() (TypeAnnotation, error) {
-	if p.currentToken.Type != lexer.IDENT {
-		return TypeAnnotation{}, fmt.Errorf("expected variable name, got %s", p.currentToken.Literal)
+	if err := p.expectClose("recv"); err != nil {
+		return nil, err
 	}
 
-	varName := p.currentToken.Literal
+	return ReceiveExpression{Span: p.spanFrom(start), Channel: channel, Else: elseValue}, nil
+}
 
+func (p *Parser) parseCloseStatement(start lexer.Token) (Node, error) {
 	p.nextToken()
-	if p.currentToken.Type != lexer.COLON {
-		return TypeAnnotation{}, fmt.Errorf("expected ':' after variable name, got %s", p.currentToken.Literal)
+	channel, err := p.parseExpression()
+	if err != nil {
+		return nil, err
 	}
 
 	p.nextToken()
-	if p.currentToken.Type != lexer.IDENT {
-		return TypeAnnotation{}, fmt.Errorf("expected variable type identifier after ':', got %s", p.currentToken.Literal)
+	if err := p.expectClose("close"); err != nil {
+		return nil, err
 	}
 
-	varType := p.currentToken.Literal
-
-	return TypeAnnotation{
-		Variable: varName,
-		Type:     varType,
-	}, nil
+	return CloseStatement{Span: p.spanFrom(start), Channel: channel}, nil
 }
 
-func (p *Parser) parseFunctionParameters() ([]TypeAnnotation, error) {
-	var params []TypeAnnotation
+// parseSelectStatement parses a select and its cases:
+//
+//	(select
+//	  (recv ch x body...)
+//	  (send ch value body...)
+//	  (else body...))
+func (p *Parser) parseSelectStatement(start lexer.Token) (Node, error) {
+	var selectStmt SelectStatement
+	hasElse := false
 
 	p.nextToken()
-
-	for p.currentToken.Type != lexer.RPAREN {
-		if p.currentToken.Type == lexer.EOF {
-			return nil, fmt.Errorf("unexpected end of file while parsing function parameters")
+	for !p.currentTokenIs(lexer.RPAREN) {
+		if p.currentTokenIs(lexer.EOF) {
+			return nil, p.expectClose("select")
 		}
-
-		if p.currentToken.Type != lexer.IDENT {
-			return nil, fmt.Errorf("expected parameter name, got %s", p.currentToken.Literal)
+		if !p.currentTokenIs(lexer.LPAREN) || !p.peekTokenIs(lexer.IDENT) {
+			return nil, p.errorf("expected recv, send or else case in select, got %s", p.currentToken.Literal)
 		}
+		caseStart := p.currentToken
+		p.nextToken()
 
-		paramName := p.currentToken.Literal
-
-		var paramType string
-		if p.peekTokenIs(lexer.COLON) {
-			p.nextToken()
+		selectCase := SelectCase{Kind: p.currentToken.Literal}
+		switch selectCase.Kind {
+		case "recv", "send":
 			p.nextToken()
-			if p.currentToken.Type != lexer.IDENT {
-				return nil, fmt.Errorf("expected parameter type identifier after ':', got %s", p.currentToken.Literal)
+			channel, err := p.parseExpression()
+			if err != nil {
+				return nil, err
 			}
-			paramType = p.currentToken.Literal
+			selectCase.Channel = channel
 			p.nextToken()
-		}
-
-		params = append(params, TypeAnnotation{
-			Variable: paramName,
-			Type:     paramType,
-		})
 
-		if p.currentToken.Type == lexer.COMMA {
-			p.nextToken()
+			if selectCase.Kind == "recv" {
+				if selectCase.Binding, err = p.parseTypeAnnotation(false); err != nil {
+					return nil, err
+				}
+			} else if selectCase.Value, err = p.parseExpression(); err != nil {
+				return nil, err
+			}
+		case "else":
+			if hasElse {
+				return nil, p.errorf("select has more than one else case")
+			}
+			hasElse = true
+		default:
+			return nil, p.errorf("expected recv, send or else case in select, got %s", selectCase.Kind)
 		}
-	}
+		p.nextToken()
 
-	if p.currentToken.Type != lexer.RPAREN {
-		return nil, fmt.Errorf("expected ')' after function parameters, got %s", p.currentToken.Literal)
+		body, err := p.parseBody(selectCase.Kind + " case")
+		if err != nil {
+			return nil, err
+		}
+		selectCase.Body = body
+		selectCase.Span = p.spanFrom(caseStart)
+		selectStmt.Cases = append(selectStmt.Cases, selectCase)
+		p.nextToken()
 	}
-	p.nextToken()
 
-	return params, nil
+	selectStmt.Span = p.spanFrom(start)
+	return selectStmt, nil
 }
 
-func (p *Parser) parseFunctionBody() ([]interface{}, error) {
-	var body []interface{}
+// parseTryExpression parses a try and its catch, which comes last:
+//
+//	(try body...
+//	  (catch e body...))
+func (p *Parser) parseTryExpression(start lexer.Token) (Node, error) {
+	var tryExpr TryExpression
 
-	for !p.currentTokenIs(lexer.RPAREN) && !p.currentTokenIs(lexer.EOF) {
+	p.nextToken()
+	bodyStart := p.currentToken
+	var bodyEnd lexer.Position
+	for !p.isCatchStart() {
+		if p.currentTokenIs(lexer.RPAREN) || p.currentTokenIs(lexer.EOF) {
+			return nil, p.errorf("try expects a catch, got %s", p.currentToken.Literal)
+		}
 		expr, err := p.parseExpression()
 		if err != nil {
 			return nil, err
 		}
-
-		if expr != nil {
-			body = append(body, expr)
-		}
-
-		if !p.peekTokenIs(lexer.RPAREN) {
-			p.nextToken()
-		}
+		tryExpr.Body.Expressions = append(tryExpr.Body.Expressions, expr)
+		bodyEnd = p.currentToken.End
+		p.nextToken()
 	}
-
-	if !p.currentTokenIs(lexer.RPAREN) {
-		return nil, fmt.Errorf("expected ')' at the end of function body, got %s", p.currentToken.Literal)
+	if len(tryExpr.Body.Expressions) == 0 {
+		return nil, p.errorf("try expects a body before its catch")
 	}
+	tryExpr.Body.Span = Span{StartPos: bodyStart.Pos, EndPos: bodyEnd}
 
-	return body, nil
-}
-
-func (p *Parser) currentTokenIs(t string) bool {
-	return p.currentToken.Type == t
-}
-
-func (p *Parser) parseReturnStatement() (ReturnStatement, error) {
-	var ret []interface{}
+	p.nextToken()
+	p.nextToken()
+	binding, err := p.parseTypeAnnotation(false)
+	if err != nil {
+		return nil, err
+	}
+	tryExpr.Binding = binding
 	p.nextToken()
 
-	returnValue, err := p.parseExpression()
+	catch, err := p.parseBody("catch")
 	if err != nil {
-		return ReturnStatement{}, err
+		return nil, err
 	}
-	if returnValue != nil {
-		ret = append(ret, returnValue)
+	tryExpr.Catch = catch
+	p.nextToken()
+	if err := p.expectClose("try"); err != nil {
+		return nil, err
 	}
 
-	return ReturnStatement{ReturnValue: ret}, nil
+	tryExpr.Span = p.spanFrom(start)
+	return tryExpr, nil
 }
 
-func (p *Parser) parseFunctionCall() (interface{}, error) {
-	funcName := p.currentToken.Literal
-	p.nextToken()
+// isCatchStart reports whether the current token starts the catch of a try.
+func (p *Parser) isCatchStart() bool {
+	return p.currentTokenIs(lexer.LPAREN) && p.peekTokenIs(lexer.IDENT) && p.peekToken.Literal == "catch"
+}
 
+func (p *Parser) parseRaiseStatement(start lexer.Token) (Node, error) {
 	p.nextToken()
-	var args []interface{}
-	for !p.currentTokenIs(lexer.RPAREN) && !p.currentTokenIs(lexer.EOF) {
-		arg, err := p.parseExpression()
-		if err != nil {
-			return nil, err
-		}
-		args = append(args, arg)
-		p.nextToken()
+	if p.currentTokenIs(lexer.RPAREN) {
+		return nil, p.errorf("raise expects an error or a message")
 	}
-
-	if !p.currentTokenIs(lexer.RPAREN) {
-		return nil, fmt.Errorf("expected ')' at the end of function arguments, got %s", p.currentToken.Literal)
+	value, err := p.parseExpression()
+	if err != nil {
+		return nil, err
 	}
 
-	return []interface{}{Identifier{Value: funcName}, args}, nil
-}
-
-func (p *Parser) Parse() (interface{}, error) {
-	//fmt.Println("Parse - Start")
-	var ast []interface{}
-
-	for p.currentToken.Type != lexer.EOF {
-		expression, err := p.parseExpression()
-		if err != nil {
-			return nil, err
-		}
-
-		if expression != nil {
-			ast = append(ast, expression)
-		}
-		//fmt.Printf("Parsed expression: %v\n", expression)
-		p.nextToken()
+	p.nextToken()
+	if err := p.expectClose("raise"); err != nil {
+		return nil, err
 	}
 
-	//fmt.Println("Parse - End")
-	return ast, nil
+	return RaiseStatement{Span: p.spanFrom(start), Value: value}, nil
 }
@@ -0,0 +1,270 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+	"teriyake/goo/lexer"
+	"testing"
+)
+
+func parse(t *testing.T, src string) (Node, error) {
+	t.Helper()
+	program, err := NewParser(lexer.NewFileLexer("m.goo", src)).Parse()
+	if err != nil {
+		return nil, err
+	}
+	if len(program.Expressions) != 1 {
+		t.Fatalf("%s: parsed %d expressions, want 1", src, len(program.Expressions))
+	}
+	return program.Expressions[0], nil
+}
+
+// kinds returns the types of the nodes of the tree at node, in the order
+// Inspect visits them.
+func kinds(node Node) string {
+	var kinds []string
+	Inspect(node, func(n Node) bool {
+		if n != nil {
+			kinds = append(kinds, strings.TrimPrefix(fmt.Sprintf("%T", n), "parser."))
+		}
+		return true
+	})
+	return strings.Join(kinds, " ")
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"x", "Identifier"},
+		{"(+ 1 2)", "BinaryExpression Integer Integer"},
+		{"(and (>= x 1) (!= x 2))", "BinaryExpression BinaryExpression Identifier Integer BinaryExpression Identifier Integer"},
+		{"(not (% x 2))", "UnaryExpression BinaryExpression Identifier Integer"},
+		{"(f 1 2)", "CallExpression Identifier Integer Integer"},
+		{"(print (mul (9 8)))", "CallExpression Identifier CallExpression Identifier Integer Integer"},
+		{"(let x:int 1)", "LetStatement TypeAnnotation NamedType Integer"},
+		{"(def f (x:int) (+ x 1))", "FunctionDefinition TypeAnnotation NamedType Block BinaryExpression Identifier Integer"},
+		{"(ret 1)", "ReturnStatement Integer"},
+		{"((x:int) -> x)", "LambdaExpression TypeAnnotation NamedType Identifier"},
+		{"(map ((x:int) -> (* x 2)) [1 2])", "MapExpression LambdaExpression TypeAnnotation NamedType BinaryExpression Identifier Integer ListLiteral Integer Integer"},
+		{"[1 [2, x] []]", "ListLiteral Integer ListLiteral Integer Identifier ListLiteral"},
+		{"(let xs:[[int]] [])", "LetStatement TypeAnnotation ListType ListType NamedType ListLiteral"},
+		{"(1 2)", "Block Integer Integer"},
+		{"(* 2.5 -1.0)", "BinaryExpression Float Float"},
+	}
+	for _, tt := range tests {
+		node, err := parse(t, tt.src)
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		if got := kinds(node); got != tt.want {
+			t.Errorf("%s parsed as %s, want %s", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestInspect(t *testing.T) {
+	program, err := NewParser(lexer.NewLexer("(def f (x:int) (+ x 1)) (print (f 2))")).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the children of a node are skipped when f returns false for it, and
+	// f(nil) follows the children of every node whose children are visited
+	var visits []string
+	Inspect(program, func(n Node) bool {
+		switch n.(type) {
+		case nil:
+			visits = append(visits, "end")
+		case FunctionDefinition:
+			visits = append(visits, "def")
+			return false
+		default:
+			visits = append(visits, strings.TrimPrefix(fmt.Sprintf("%T", n), "parser."))
+		}
+		return true
+	})
+	want := "Program def CallExpression Identifier end CallExpression Identifier end Integer end end end end"
+	if got := strings.Join(visits, " "); got != want {
+		t.Errorf("visits = %s, want %s", got, want)
+	}
+}
+
+func TestSpans(t *testing.T) {
+	program, err := NewParser(lexer.NewFileLexer("m.goo", "(def mul (x:int y:int)\n  (* x y))\n(print (mul (9 8)))")).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	def := program.Expressions[0].(FunctionDefinition)
+	if def.Pos().String() != "m.goo:1:1" || def.End().String() != "m.goo:2:11" {
+		t.Errorf("mul spans %v to %v, want m.goo:1:1 to m.goo:2:11", def.Pos(), def.End())
+	}
+	call := program.Expressions[1].(CallExpression)
+	if callee := call.Callee; callee.Pos().String() != "m.goo:3:2" || callee.End().String() != "m.goo:3:7" {
+		t.Errorf("print spans %v to %v, want m.goo:3:2 to m.goo:3:7", callee.Pos(), callee.End())
+	}
+}
+
+func TestErrorPositions(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"(def mul x)", "m.goo:1:10: expected '(' before function parameters, got x"},
+		{"(print\n  #)", "m.goo:2:3: Unexpected token: #"},
+		{"(print 9223372036854775808)", "m.goo:1:8: integer literal 9223372036854775808 out of range"},
+		{"(+ 1 2", "m.goo:1:7: unexpected end of input, expected ')' to close operator +"},
+	}
+	for _, tt := range tests {
+		_, err := parse(t, tt.src)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%q: error = %v, want %q", tt.src, err, tt.want)
+		}
+	}
+}
+
+func TestGenericSyntax(t *testing.T) {
+	node, err := parse(t, "(def pick <T U> (a:T b:U):T a)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if def := node.(FunctionDefinition); len(def.TypeParams) != 2 || def.TypeParams[1].Name != "U" || def.ReturnType.String() != "T" {
+		t.Errorf("pick has type parameters %v and returns %v, want T and U, and T", def.TypeParams, def.ReturnType)
+	}
+
+	node, err = parse(t, "((<T> (x:T) -> x) <string> 'a')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	call, ok := node.(CallExpression)
+	if !ok {
+		t.Fatalf("lambda call parsed as %T", node)
+	}
+	if lambda := call.Callee.(LambdaExpression); len(lambda.TypeParams) != 1 || lambda.TypeParams[0].Name != "T" {
+		t.Errorf("lambda has type parameters %v, want T", lambda.TypeParams)
+	}
+	if len(call.TypeArguments) != 1 || call.TypeArguments[0].String() != "string" || len(call.Arguments) != 1 {
+		t.Errorf("call has type arguments %v and %d arguments, want string and 1", call.TypeArguments, len(call.Arguments))
+	}
+
+	node, err = parse(t, "(f <[int] (int) -> bool> x)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if call := node.(CallExpression); len(call.TypeArguments) != 2 || call.TypeArguments[1].String() != "(int) -> bool" {
+		t.Errorf("call has type arguments %v, want [int] and (int) -> bool", call.TypeArguments)
+	}
+}
+
+func TestBinaryOperands(t *testing.T) {
+	tests := []struct {
+		src         string
+		left, right string
+	}{
+		{"(+ 1 2)", "parser.Integer", "parser.Integer"},
+		{"(+ (1 2))", "parser.Integer", "parser.Integer"},
+		{"(+ x y)", "parser.Identifier", "parser.Identifier"},
+		{"(- (f x) 1)", "parser.CallExpression", "parser.Integer"},
+		{"(* 2 (f x y))", "parser.Integer", "parser.CallExpression"},
+	}
+	for _, tt := range tests {
+		node, err := parse(t, tt.src)
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		binary, ok := node.(BinaryExpression)
+		if !ok {
+			t.Errorf("%s parsed as %T, want a BinaryExpression", tt.src, node)
+			continue
+		}
+		if left, right := fmt.Sprintf("%T", binary.Left), fmt.Sprintf("%T", binary.Right); left != tt.left || right != tt.right {
+			t.Errorf("%s has operands %s and %s, want %s and %s", tt.src, left, right, tt.left, tt.right)
+		}
+	}
+}
+
+func TestBinaryArity(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		// a call is a single operand, even with a single argument
+		{"(- (f x))", "operator - expects 2 operands, got 1"},
+		{"(+ (f 1))", "operator + expects 2 operands, got 1"},
+		{"(+ 1)", "operator + expects 2 operands, got 1"},
+		{"(+ 1 2 3)", "operator + expects 2 operands, got 3"},
+		{"(+ (1 2 3))", "operator + expects 2 operands, got 3"},
+	}
+	for _, tt := range tests {
+		_, err := parse(t, tt.src)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error = %v, want %q", tt.src, err, tt.want)
+		}
+	}
+}
+
+func TestTypeArguments(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []string
+		args int
+	}{
+		{"(id <int> 1)", []string{"int"}, 1},
+		{"(id <int>)", []string{"int"}, 0},
+		{"(pair <int, [string]> 1 ['a'])", []string{"int", "[string]"}, 2},
+		{"(apply <(int) -> bool> even)", []string{"(int) -> bool"}, 1},
+		{"(id <int> ; a comment\n 1)", []string{"int"}, 1},
+		{"(id <int ; a comment\n > 1)", []string{"int"}, 1},
+		{"(id 1)", nil, 1},
+	}
+	for _, tt := range tests {
+		node, err := parse(t, tt.src)
+		if err != nil {
+			t.Errorf("%q: %v", tt.src, err)
+			continue
+		}
+		call, ok := node.(CallExpression)
+		if !ok {
+			t.Errorf("%q parsed as %T, want a CallExpression", tt.src, node)
+			continue
+		}
+		var got []string
+		for _, typeArg := range call.TypeArguments {
+			got = append(got, typeArg.String())
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") || len(call.Arguments) != tt.args {
+			t.Errorf("%q has type arguments %q and %d arguments, want %q and %d", tt.src, got, len(call.Arguments), tt.want, tt.args)
+		}
+	}
+}
+
+func TestNotTypeArguments(t *testing.T) {
+	// a '<' without a matching '>', or with something other than types
+	// before it, is not taken for type arguments
+	for _, src := range []string{"(id < 1 2)", "(id < x)", "(id <int 1> 2)", "(id <int> >)"} {
+		_, err := parse(t, src)
+		if err == nil || !strings.Contains(err.Error(), "Unexpected token: <") {
+			t.Errorf("%q: error = %v, want an unexpected '<'", src, err)
+		}
+	}
+}
+
+func TestTypeParameters(t *testing.T) {
+	for _, src := range []string{
+		"(def id <T> (x:T):T x)",
+		"(def pair <T, U> (x:T y:U):T x)",
+		"(def id <T ; the element type\n> (x:T):T x)",
+	} {
+		node, err := parse(t, src)
+		if err != nil {
+			t.Errorf("%q: %v", src, err)
+			continue
+		}
+		if def, ok := node.(FunctionDefinition); !ok || len(def.TypeParams) == 0 {
+			t.Errorf("%q parsed as %#v, want a generic function definition", src, node)
+		}
+	}
+}
@@ -0,0 +1,827 @@
+package typecheck
+
+import (
+	"fmt"
+	"teriyake/goo/compiler"
+	"teriyake/goo/lexer"
+	"teriyake/goo/parser"
+)
+
+type object struct {
+	typ      Type
+	function bool
+	native   bool
+}
+
+type Scope struct {
+	objects map[string]object
+	types   map[string]Type
+	parent  *Scope
+}
+
+func NewScope(parent *Scope) *Scope {
+	return &Scope{
+		objects: make(map[string]object),
+		types:   make(map[string]Type),
+		parent:  parent,
+	}
+}
+
+func (s *Scope) define(name string, obj object) {
+	s.objects[name] = obj
+}
+
+func (s *Scope) lookup(name string) (object, bool) {
+	obj, ok := s.objects[name]
+	if !ok && s.parent != nil {
+		return s.parent.lookup(name)
+	}
+	return obj, ok
+}
+
+func (s *Scope) lookupType(name string) (Type, bool) {
+	t, ok := s.types[name]
+	if !ok && s.parent != nil {
+		return s.parent.lookupType(name)
+	}
+	return t, ok
+}
+
+type functionContext struct {
+	result  Type
+	returns []Type
+}
+
+type Checker struct {
+	scope    *Scope
+	function *functionContext
+	errors   lexer.ErrorList
+}
+
+func NewChecker() *Checker {
+	return &Checker{scope: NewScope(nil)}
+}
+
+// Define declares a variable of type t in the checker's outermost scope, for
+// values that are provided by the host rather than the program.
+func (c *Checker) Define(name string, t Type) {
+	c.universe().define(name, object{typ: t})
+}
+
+// DefineNatives declares the native functions in r so that the program can
+// call them.
+func (c *Checker) DefineNatives(r *compiler.Registry) {
+	for _, native := range r.Natives() {
+		c.universe().define(native.Name, object{typ: c.lookupType(native.Type), function: true, native: true})
+	}
+}
+
+// Globals returns the types of everything defined in the checker's outermost
+// scope.
+func (c *Checker) Globals() map[string]Type {
+	globals := make(map[string]Type)
+	for name, obj := range c.universe().objects {
+		globals[name] = obj.typ
+	}
+	return globals
+}
+
+// Checkpoint records the checker's definitions so that Restore can undo
+// later calls to Check.
+type Checkpoint struct {
+	scope   *Scope
+	objects map[string]object
+}
+
+func (c *Checker) Checkpoint() Checkpoint {
+	objects := make(map[string]object, len(c.scope.objects))
+	for name, obj := range c.scope.objects {
+		objects[name] = obj
+	}
+	return Checkpoint{scope: c.scope, objects: objects}
+}
+
+func (c *Checker) Restore(cp Checkpoint) {
+	c.scope = cp.scope
+	c.scope.objects = make(map[string]object, len(cp.objects))
+	for name, obj := range cp.objects {
+		c.scope.objects[name] = obj
+	}
+	c.function = nil
+}
+
+func (c *Checker) universe() *Scope {
+	scope := c.scope
+	for scope.parent != nil {
+		scope = scope.parent
+	}
+	return scope
+}
+
+// Check type checks a whole program in a fresh scope.
+func Check(program parser.Program) error {
+	_, err := NewChecker().Check(program)
+	return err
+}
+
+// Check type checks node in the checker's scope, keeping any definitions it
+// makes, and returns the type of the value it produces.
+func (c *Checker) Check(node parser.Node) (Type, error) {
+	c.errors = nil
+	t := c.expr(node)
+	c.errors.Sort()
+	return t, c.errors.Err()
+}
+
+func (c *Checker) errorf(node parser.Node, format string, args ...interface{}) {
+	c.errors.Add(node.Pos(), fmt.Sprintf(format, args...))
+}
+
+func (c *Checker) enterScope() {
+	c.scope = NewScope(c.scope)
+}
+
+func (c *Checker) leaveScope() {
+	c.scope = c.scope.parent
+}
+
+func (c *Checker) lookupType(typeExpr parser.TypeExpr) Type {
+	switch t := typeExpr.(type) {
+	case parser.NamedType:
+		if typeParam, ok := c.scope.lookupType(t.Name); ok {
+			return typeParam
+		}
+		dataType, ok := compiler.LookupDataType(t.Name)
+		if !ok {
+			c.errorf(t, "unknown type %s", t.Name)
+			return Unknown
+		}
+		return FromDataType(dataType)
+	case parser.FunctionType:
+		params := make([]Type, len(t.Params))
+		for i, param := range t.Params {
+			params[i] = c.lookupType(param)
+		}
+		return &Func{Params: params, Result: c.lookupType(t.Result)}
+	case parser.ListType:
+		return &List{Elem: c.lookupType(t.Elem)}
+	case parser.ChanType:
+		return &Chan{Elem: c.lookupType(t.Elem)}
+	default:
+		c.errorf(typeExpr, "unknown type expression: %T", t)
+		return Unknown
+	}
+}
+
+// declareTypeParams defines the type parameters of a generic function in the
+// current scope.
+func (c *Checker) declareTypeParams(names []parser.NamedType) []*TypeParam {
+	typeParams := make([]*TypeParam, len(names))
+	for i, name := range names {
+		if _, ok := c.scope.types[name.Name]; ok {
+			c.errorf(name, "duplicate type parameter %s", name.Name)
+		}
+		typeParams[i] = &TypeParam{Name: name.Name}
+		c.scope.types[name.Name] = typeParams[i]
+	}
+	return typeParams
+}
+
+func (c *Checker) paramTypes(params []parser.TypeAnnotation) []Type {
+	types := make([]Type, len(params))
+	for i, param := range params {
+		if param.Type == nil {
+			c.errorf(param, "missing type for parameter %s", param.Variable)
+			types[i] = Unknown
+			continue
+		}
+		types[i] = c.lookupType(param.Type)
+	}
+	return types
+}
+
+// value checks an expression that must produce a value.
+func (c *Checker) value(node parser.Node) Type {
+	t := c.expr(node)
+	if t == Void {
+		c.errorf(node, "expression does not produce a value")
+		return Unknown
+	}
+	return t
+}
+
+func (c *Checker) expr(node parser.Node) Type {
+	switch n := node.(type) {
+	case parser.Program:
+		return c.sequence(n.Expressions)
+	case parser.Block:
+		return c.sequence(n.Expressions)
+	case parser.Integer:
+		return Int
+	case parser.Float:
+		return Float
+	case parser.Boolean:
+		return Bool
+	case parser.String:
+		return String
+	case parser.ListLiteral:
+		return c.listLiteral(n)
+	case parser.Identifier:
+		obj, ok := c.scope.lookup(n.Value)
+		if !ok {
+			c.errorf(n, "undefined identifier: %s", n.Value)
+			return Unknown
+		}
+		if fn, ok := obj.typ.(*Func); ok && obj.function && len(fn.Params) > 0 {
+			// the name of a function that takes arguments is the function
+			// itself, as a value
+			if obj.native {
+				c.errorf(n, "native function %s cannot be used as a value", n.Value)
+				return Unknown
+			}
+			return fn
+		}
+		if obj.function {
+			// a bare function name is a call without arguments
+			return c.checkCall(n, n.Value, obj.typ, nil, nil)
+		}
+		return obj.typ
+	case parser.LetStatement:
+		valueType := c.value(n.Value)
+		declared := c.lookupType(n.Binding.Type)
+		if !AssignableTo(valueType, declared) {
+			c.errorf(n.Value, "cannot use %s value as %s in let %s", valueType, declared, n.Binding.Variable)
+		}
+		c.scope.define(n.Binding.Variable, object{typ: declared})
+		return Void
+	case parser.BinaryExpression:
+		return c.binary(n)
+	case parser.UnaryExpression:
+		return c.unary(n)
+	case parser.CallExpression:
+		return c.call(n)
+	case parser.IfStatement:
+		return c.ifStatement(n)
+	case parser.FunctionDefinition:
+		c.functionDefinition(n)
+		return Void
+	case parser.ReturnStatement:
+		var t Type = Void
+		if n.ReturnValue != nil {
+			t = c.value(n.ReturnValue)
+		}
+		if c.function == nil {
+			c.errorf(n, "ret outside of a function")
+		} else {
+			c.function.returns = append(c.function.returns, t)
+			if c.function.result != nil && !AssignableTo(t, c.function.result) {
+				c.errorf(n, "cannot return %s value from function returning %s", t, c.function.result)
+			}
+		}
+		return Void
+	case parser.LambdaExpression:
+		return c.lambda(n)
+	case parser.MapExpression:
+		name := "map"
+		if n.Parallel {
+			name = "pmap"
+		}
+		elem := c.listElem(name, n.List)
+		fn := c.lambdaArgument(name, n.Lambda, []Type{elem})
+		c.checkElem(name, n.List, elem, fn.Params[0])
+		if fn.Result == Void {
+			c.errorf(n.Lambda, "%s lambda must return a value", name)
+		}
+		return &List{Elem: fn.Result}
+	case parser.FilterExpression:
+		name := "filter"
+		if n.Parallel {
+			name = "pfilter"
+		}
+		elem := c.listElem(name, n.List)
+		fn := c.lambdaArgument(name, n.Lambda, []Type{elem})
+		c.checkElem(name, n.List, elem, fn.Params[0])
+		if !AssignableTo(fn.Result, Bool) {
+			c.errorf(n.Lambda, "%s lambda must return bool, not %s", name, fn.Result)
+		}
+		return &List{Elem: fn.Params[0]}
+	case parser.ReduceExpression:
+		initial := c.value(n.InitialValue)
+		elem := c.listElem("reduce", n.List)
+		fn := c.lambdaArgument("reduce", n.Lambda, []Type{initial, elem})
+		if !AssignableTo(initial, fn.Params[0]) {
+			c.errorf(n.InitialValue, "cannot use %s value as initial %s accumulator in reduce", initial, fn.Params[0])
+		}
+		c.checkElem("reduce", n.List, elem, fn.Params[1])
+		if !AssignableTo(fn.Result, fn.Params[0]) {
+			c.errorf(n.Lambda, "reduce lambda returns %s, which does not match its %s accumulator", fn.Result, fn.Params[0])
+		}
+		return fn.Params[0]
+	case parser.SpawnStatement:
+		c.spawn(n)
+		return Void
+	case parser.ChannelExpression:
+		if n.Capacity != nil {
+			if t := c.value(n.Capacity); !AssignableTo(t, Int) {
+				c.errorf(n.Capacity, "channel capacity must be int, not %s", t)
+			}
+		}
+		return &Chan{Elem: c.lookupType(n.Elem)}
+	case parser.SendStatement:
+		c.send(n.Value, c.channelElem("send", n.Channel))
+		return Void
+	case parser.ReceiveExpression:
+		elem := c.channelElem("recv", n.Channel)
+		if n.Else != nil {
+			if t := c.value(n.Else); !AssignableTo(t, elem) {
+				c.errorf(n.Else, "cannot use %s value as %s in recv else", t, elem)
+			}
+		}
+		return elem
+	case parser.CloseStatement:
+		c.channelElem("close", n.Channel)
+		return Void
+	case parser.SelectStatement:
+		return c.selectStatement(n)
+	case parser.TryExpression:
+		return c.tryExpression(n)
+	case parser.RaiseStatement:
+		if t := c.value(n.Value); !AssignableTo(t, String) && !AssignableTo(t, Error) {
+			c.errorf(n.Value, "raise expects an error or a string, not %s", t)
+		}
+		return Unknown
+	default:
+		c.errorf(node, "unknown node type: %T", n)
+		return Unknown
+	}
+}
+
+func (c *Checker) sequence(nodes []parser.Node) Type {
+	var t Type = Void
+	for _, node := range nodes {
+		t = c.expr(node)
+	}
+	return t
+}
+
+// listLiteral types a list literal by the element type its elements have in
+// common. The empty list has unknown elements and can be used as any list.
+func (c *Checker) listLiteral(n parser.ListLiteral) Type {
+	var elem Type = Unknown
+	for i, t := range c.argumentTypes(n.Elements) {
+		joined, ok := join(elem, t)
+		if !ok {
+			c.errorf(n.Elements[i], "cannot use %s value as %s list element", t, elem)
+			continue
+		}
+		elem = joined
+	}
+	return &List{Elem: elem}
+}
+
+// listElem checks the list operand of map, filter and reduce and returns its
+// element type.
+func (c *Checker) listElem(what string, node parser.Node) Type {
+	t := c.value(node)
+	if list, ok := t.(*List); ok {
+		return list.Elem
+	}
+	if t != Unknown {
+		c.errorf(node, "%s expects a list, got %s", what, t)
+	}
+	return Unknown
+}
+
+func (c *Checker) checkElem(what string, node parser.Node, elem, param Type) {
+	if !AssignableTo(elem, param) {
+		c.errorf(node, "cannot use %s elements with %s lambda taking %s", elem, what, param)
+	}
+}
+
+func (c *Checker) binary(n parser.BinaryExpression) Type {
+	left := c.value(n.Left)
+	right := c.value(n.Right)
+	unknown := left == Unknown || right == Unknown
+
+	switch n.Operator {
+	case "+", "-", "*", "/", "%":
+		if unknown {
+			return Unknown
+		}
+		if isNumeric(left) && isNumeric(right) {
+			if left == Int && right == Int {
+				return Int
+			}
+			return Float
+		}
+	case ">", "<", ">=", "<=":
+		if unknown || (isNumeric(left) && isNumeric(right)) {
+			return Bool
+		}
+	case "=", "!=":
+		if unknown || (isNumeric(left) && isNumeric(right)) || (left == right && (left == String || left == Bool)) {
+			return Bool
+		}
+	case "and", "or":
+		if AssignableTo(left, Bool) && AssignableTo(right, Bool) {
+			return Bool
+		}
+	default:
+		c.errorf(n, "unknown operator: %s", n.Operator)
+		return Unknown
+	}
+
+	c.errorf(n, "operator %s not defined on %s and %s", n.Operator, left, right)
+	return Unknown
+}
+
+func (c *Checker) unary(n parser.UnaryExpression) Type {
+	operand := c.value(n.Operand)
+	switch n.Operator {
+	case "not":
+		if !AssignableTo(operand, Bool) {
+			c.errorf(n, "operator not not defined on %s", operand)
+		}
+		return Bool
+	default:
+		c.errorf(n, "unknown operator: %s", n.Operator)
+		return Unknown
+	}
+}
+
+func (c *Checker) call(n parser.CallExpression) Type {
+	switch callee := n.Callee.(type) {
+	case parser.Identifier:
+		if callee.Value == "print" {
+			if len(n.Arguments) != 1 {
+				c.errorf(n, "print expects one argument")
+			}
+			for _, arg := range n.Arguments {
+				c.value(arg)
+			}
+			return Void
+		}
+		if callee.Value == "message" {
+			if len(n.Arguments) != 1 {
+				c.errorf(n, "message expects one argument")
+			}
+			for _, arg := range n.Arguments {
+				if t := c.value(arg); !AssignableTo(t, Error) {
+					c.errorf(arg, "message expects an error, not %s", t)
+				}
+			}
+			return String
+		}
+		if conversion, ok := conversions[callee.Value]; ok {
+			if len(n.Arguments) != 1 {
+				c.errorf(n, "%s expects one argument", callee.Value)
+			}
+			for _, arg := range n.Arguments {
+				if t := c.value(arg); t != Unknown && !isNumeric(t) {
+					c.errorf(arg, "cannot convert %s value to %s", t, conversion)
+				}
+			}
+			return conversion
+		}
+
+		obj, ok := c.scope.lookup(callee.Value)
+		if !ok {
+			c.errorf(callee, "undefined function: %s", callee.Value)
+			c.argumentTypes(n.Arguments)
+			return Unknown
+		}
+		return c.checkCall(n, callee.Value, obj.typ, n.TypeArguments, n.Arguments)
+	case parser.LambdaExpression:
+		return c.checkCall(n, "lambda", c.lambda(callee), n.TypeArguments, n.Arguments)
+	default:
+		c.errorf(n.Callee, "expression is not callable")
+		c.argumentTypes(n.Arguments)
+		return Unknown
+	}
+}
+
+// conversions are the builtins that convert between numeric types.
+var conversions = map[string]Type{
+	"int":   Int,
+	"float": Float,
+}
+
+func (c *Checker) argumentTypes(args []parser.Node) []Type {
+	types := make([]Type, len(args))
+	for i, arg := range args {
+		types[i] = c.value(arg)
+	}
+	return types
+}
+
+func (c *Checker) checkCall(node parser.Node, name string, calleeType Type, typeArgs []parser.TypeExpr, args []parser.Node) Type {
+	argTypes := c.argumentTypes(args)
+
+	fn, ok := calleeType.(*Func)
+	if !ok {
+		if calleeType != Unknown {
+			c.errorf(node, "%s of type %s is not a function", name, calleeType)
+		}
+		return Unknown
+	}
+	fn = c.instantiate(node, name, fn, typeArgs, argTypes)
+
+	if len(args) != len(fn.Params) {
+		c.errorf(node, "function %s expects %d arguments, got %d", name, len(fn.Params), len(args))
+		return fn.Result
+	}
+
+	for i, argType := range argTypes {
+		if !AssignableTo(argType, fn.Params[i]) {
+			c.errorf(args[i], "cannot use %s value as %s argument %d of %s", argType, fn.Params[i], i+1, name)
+		}
+	}
+	return fn.Result
+}
+
+// instantiate substitutes the type parameters of a generic function, either
+// with the explicit type arguments or with types inferred from the arguments.
+func (c *Checker) instantiate(node parser.Node, name string, fn *Func, typeArgs []parser.TypeExpr, argTypes []Type) *Func {
+	if len(fn.TypeParams) == 0 {
+		if typeArgs != nil {
+			c.errorf(node, "%s is not generic but was given type arguments", name)
+		}
+		return fn
+	}
+
+	bindings := make(map[*TypeParam]Type)
+	for _, typeParam := range fn.TypeParams {
+		bindings[typeParam] = nil
+	}
+
+	if typeArgs != nil {
+		if len(typeArgs) != len(fn.TypeParams) {
+			c.errorf(node, "%s expects %d type arguments, got %d", name, len(fn.TypeParams), len(typeArgs))
+		}
+		for i, typeArg := range typeArgs {
+			t := c.lookupType(typeArg)
+			if i < len(fn.TypeParams) {
+				bindings[fn.TypeParams[i]] = t
+			}
+		}
+	} else {
+		for i, argType := range argTypes {
+			if i < len(fn.Params) {
+				infer(fn.Params[i], argType, bindings)
+			}
+		}
+	}
+
+	for _, typeParam := range fn.TypeParams {
+		if bindings[typeParam] == nil {
+			// an arity mismatch is reported by the caller instead
+			if typeArgs == nil && len(argTypes) == len(fn.Params) {
+				c.errorf(node, "cannot infer type argument %s of %s", typeParam, name)
+			}
+			bindings[typeParam] = Unknown
+		}
+	}
+
+	instance := substitute(fn, bindings).(*Func)
+	instance.TypeParams = nil
+	return instance
+}
+
+func (c *Checker) ifStatement(n parser.IfStatement) Type {
+	condition := c.value(n.Condition)
+	if !AssignableTo(condition, Bool) {
+		c.errorf(n.Condition, "if condition must be bool, not %s", condition)
+	}
+
+	thenType := c.expr(n.ThenBlock)
+	if n.ElseBlock == nil {
+		return Void
+	}
+	elseType := c.expr(n.ElseBlock)
+
+	if thenType == Void || elseType == Void {
+		return Void
+	}
+	t, ok := join(thenType, elseType)
+	if !ok {
+		c.errorf(n, "if branches have mismatched types %s and %s", thenType, elseType)
+		return Unknown
+	}
+	return t
+}
+
+func (c *Checker) functionDefinition(n parser.FunctionDefinition) {
+	// the type parameters get a scope of their own around the signature and body
+	c.enterScope()
+	defer c.leaveScope()
+
+	sig := &Func{TypeParams: c.declareTypeParams(n.TypeParams), Params: c.paramTypes(n.Params), Result: Unknown}
+	var declared Type
+	if n.ReturnType != nil {
+		declared = c.lookupType(n.ReturnType)
+		sig.Result = declared
+	}
+	c.scope.parent.define(n.Name, object{typ: sig, function: true})
+
+	sig.Result = c.functionBody(n.Params, sig.Params, declared, n.Body)
+}
+
+func (c *Checker) lambda(n parser.LambdaExpression) *Func {
+	c.enterScope()
+	defer c.leaveScope()
+
+	fn := &Func{TypeParams: c.declareTypeParams(n.TypeParams), Params: c.paramTypes(n.Params)}
+	fn.Result = c.functionBody(n.Params, fn.Params, nil, n.Body)
+	return fn
+}
+
+// functionBody checks a def or lambda body in its own scope and returns its
+// result type, which is either the declared type or inferred from the final
+// expression and any ret statements.
+func (c *Checker) functionBody(params []parser.TypeAnnotation, paramTypes []Type, declared Type, body parser.Node) Type {
+	savedFunction := c.function
+	c.function = &functionContext{result: declared}
+	c.enterScope()
+	defer func() {
+		c.leaveScope()
+		c.function = savedFunction
+	}()
+
+	for i, param := range params {
+		c.scope.define(param.Variable, object{typ: paramTypes[i]})
+	}
+
+	last := body
+	if block, ok := body.(parser.Block); ok && len(block.Expressions) > 0 {
+		last = block.Expressions[len(block.Expressions)-1]
+	}
+	bodyType := c.expr(body)
+
+	returns := c.function.returns
+	if _, isRet := last.(parser.ReturnStatement); !isRet {
+		returns = append(returns, bodyType)
+		if declared != nil && !AssignableTo(bodyType, declared) {
+			c.errorf(last, "cannot return %s value from function returning %s", bodyType, declared)
+		}
+	}
+
+	if declared != nil {
+		return declared
+	}
+
+	var result Type = Unknown
+	for _, t := range returns {
+		joined, ok := join(result, t)
+		if !ok {
+			c.errorf(body, "function returns mismatched types %s and %s", result, t)
+			return Unknown
+		}
+		result = joined
+	}
+	return result
+}
+
+// lambdaArgument checks the function argument of map, filter and reduce, a
+// lambda or any other function value, instantiating a generic function for
+// the types it will be called with.
+func (c *Checker) lambdaArgument(what string, node parser.Node, argTypes []Type) *Func {
+	arity := len(argTypes)
+	unknown := &Func{Params: make([]Type, arity), Result: Unknown}
+	for i := range unknown.Params {
+		unknown.Params[i] = Unknown
+	}
+
+	var fn *Func
+	if lambdaExpr, ok := node.(parser.LambdaExpression); ok {
+		fn = c.lambda(lambdaExpr)
+	} else {
+		t := c.value(node)
+		if fn, ok = t.(*Func); !ok {
+			if t != Unknown {
+				c.errorf(node, "%s expects a function, not %s", what, t)
+			}
+			return unknown
+		}
+	}
+	if len(fn.Params) != arity {
+		c.errorf(node, "%s lambda must take %d parameters, not %d", what, arity, len(fn.Params))
+		return unknown
+	}
+	return c.instantiate(node, what+" lambda", fn, nil, argTypes)
+}
+
+// spawn checks what a spawn runs: a call, or a function without parameters,
+// which is called without arguments.
+func (c *Checker) spawn(n parser.SpawnStatement) {
+	call, ok := n.Call.(parser.CallExpression)
+	if !ok {
+		call = parser.CallExpression{Span: parser.Span{StartPos: n.Call.Pos(), EndPos: n.Call.End()}, Callee: n.Call}
+	}
+	if callee, ok := call.Callee.(parser.Identifier); ok {
+		if _, isConversion := conversions[callee.Value]; callee.Value == "print" || callee.Value == "message" || isConversion {
+			c.errorf(callee, "cannot spawn builtin %s", callee.Value)
+			return
+		}
+		if obj, ok := c.scope.lookup(callee.Value); ok && obj.native {
+			c.errorf(callee, "cannot spawn native function %s", callee.Value)
+			return
+		}
+	}
+	c.call(call)
+}
+
+// channelElem checks the channel operand of send, recv and close and returns
+// its element type.
+func (c *Checker) channelElem(what string, node parser.Node) Type {
+	t := c.value(node)
+	if ch, ok := t.(*Chan); ok {
+		return ch.Elem
+	}
+	if t != Unknown {
+		c.errorf(node, "%s expects a channel, got %s", what, t)
+	}
+	return Unknown
+}
+
+func (c *Checker) send(value parser.Node, elem Type) {
+	if t := c.value(value); !AssignableTo(t, elem) {
+		c.errorf(value, "cannot send %s value on chan %s", t, elem)
+	}
+}
+
+// selectStatement checks the cases of a select, each in a scope of its own,
+// and returns the type they have in common, like the branches of an if.
+func (c *Checker) selectStatement(n parser.SelectStatement) Type {
+	types := make([]Type, len(n.Cases))
+	for i, selectCase := range n.Cases {
+		types[i] = c.selectCase(selectCase)
+	}
+
+	var result Type = Void
+	for i, t := range types {
+		if t == Void {
+			return Void
+		}
+		if i == 0 {
+			result = t
+			continue
+		}
+		joined, ok := join(result, t)
+		if !ok {
+			c.errorf(n, "select cases have mismatched types %s and %s", result, t)
+			return Unknown
+		}
+		result = joined
+	}
+	return result
+}
+
+func (c *Checker) selectCase(n parser.SelectCase) Type {
+	c.enterScope()
+	defer c.leaveScope()
+
+	switch n.Kind {
+	case "recv":
+		elem := c.channelElem("recv", n.Channel)
+		t := elem
+		if n.Binding.Type != nil {
+			t = c.lookupType(n.Binding.Type)
+			if !AssignableTo(elem, t) {
+				c.errorf(n.Binding, "cannot use %s value as %s in recv %s", elem, t, n.Binding.Variable)
+			}
+		}
+		c.scope.define(n.Binding.Variable, object{typ: t})
+	case "send":
+		c.send(n.Value, c.channelElem("send", n.Channel))
+	}
+	return c.expr(n.Body)
+}
+
+// tryExpression checks the body of a try, and its catch in a scope of its own
+// with the error bound, and returns the type they have in common, like the
+// branches of an if.
+func (c *Checker) tryExpression(n parser.TryExpression) Type {
+	bodyType := c.expr(n.Body)
+
+	c.enterScope()
+	defer c.leaveScope()
+	var t Type = Error
+	if n.Binding.Type != nil {
+		t = c.lookupType(n.Binding.Type)
+		if !AssignableTo(Error, t) {
+			c.errorf(n.Binding, "cannot use error value as %s in catch %s", t, n.Binding.Variable)
+		}
+	}
+	c.scope.define(n.Binding.Variable, object{typ: t})
+	catchType := c.expr(n.Catch)
+
+	if bodyType == Void || catchType == Void {
+		return Void
+	}
+	joined, ok := join(bodyType, catchType)
+	if !ok {
+		c.errorf(n, "try and catch have mismatched types %s and %s", bodyType, catchType)
+		return Unknown
+	}
+	return joined
+}
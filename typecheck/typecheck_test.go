@@ -0,0 +1,106 @@
+package typecheck
+
+import (
+	"teriyake/goo/lexer"
+	"teriyake/goo/parser"
+	"testing"
+)
+
+func check(t *testing.T, src string) (Type, error) {
+	t.Helper()
+	ast, err := parser.NewParser(lexer.NewLexer(src)).Parse()
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	return NewChecker().Check(ast)
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		src  string
+		want Type
+	}{
+		{"(+ 1 2)", Int},
+		{"(+ 1 2.5)", Float},
+		{"(< 1 2.5)", Bool},
+		{"(or (>= 1 2) (not (!= 'a' 'b')))", Bool},
+		{"(let x:int 1)", Void},
+		{"(def f (x:int):int (* x 2)) (f 3)", Int},
+		{"(def f <T> (x:T):T x) (f 'a')", String},
+		{"(map ((x:int) -> (> x 0)) [1 2])", &List{Elem: Bool}},
+		{"(if true (1) else (2))", Int},
+		{"(try (raise 'x') (catch e 0))", Int},
+		{"(def d (x:int):int x) (map d [1])", &List{Elem: Int}},
+		{"(def d (x:int):int x) (let f:(int) -> int d) f", &Func{Params: []Type{Int}, Result: Int}},
+	}
+	for _, tt := range tests {
+		got, err := check(t, tt.src)
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		if !Identical(got, tt.want) {
+			t.Errorf("%s has type %s, want %s", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestCheckErrors(t *testing.T) {
+	tests := []struct {
+		src string
+		err string
+	}{
+		{"(+ 1 'a')", "1:1: operator + not defined on int and string"},
+		{"(and 1 true)", "1:1: operator and not defined on int and bool"},
+		{"(not 1)", "1:1: operator not not defined on int"},
+		{"x", "1:1: undefined identifier: x"},
+		{"(f 1)", "1:2: undefined function: f"},
+		{"(let x:int 'a')", "1:12: cannot use string value as int in let x"},
+		{"(let x:number 1)", "1:8: unknown type number"},
+		{"(def f (x:int):int x) (f 'a')", "1:26: cannot use string value as int argument 1 of f"},
+		{"(def f (x:int):int x) (f 1 2)", "1:23: function f expects 1 arguments, got 2"},
+		{"(def f (x:int):string x)", "1:23: cannot return int value from function returning string"},
+		{"(def f (x:int):int (if (> x 0) (ret 'a')) x)", "1:32: cannot return string value from function returning int"},
+		{"(ret 1)", "1:1: ret outside of a function"},
+		{"(if 1 (2) else (3))", "1:5: if condition must be bool, not int"},
+		{"(if true (2) else ('a'))", "1:1: if branches have mismatched types int and string"},
+		{"(let x:int (print 1))", "1:12: expression does not produce a value"},
+		{"(map ((x:int) -> (* x 2)) ['a'])", "1:27: cannot use string elements with map lambda taking int"},
+		{"(map ((x:int) -> (* x 2)) 1)", "1:27: map expects a list, got int"},
+		{"(map 1 [1])", "1:6: map expects a function, not int"},
+		{"(filter ((x:int) -> x) [1])", "1:9: filter lambda must return bool, not int"},
+		{"(reduce ((a:int b:int) -> (+ a b)) 'a' [1])", "1:36: cannot use string value as initial int accumulator in reduce"},
+		{"[1 'a']", "1:4: cannot use string value as int list element"},
+		{"(def f <T> (x:T):T x) (f <int> 'a')", "1:32: cannot use string value as int argument 1 of f"},
+		{"(def f <T> (x:T):T x) (f <int string> 1)", "1:23: f expects 1 type arguments, got 2"},
+		{"(def f (x:int):int x) (f <int> 1)", "1:23: f is not generic but was given type arguments"},
+		{"(def f <T T> (x:T):T x)", "1:11: duplicate type parameter T"},
+		{"(let c:chan int (chan int)) (send c 'a')", "1:37: cannot send string value on chan int"},
+		{"(recv 1)", "1:7: recv expects a channel, got int"},
+		{"(raise 1)", "1:8: raise expects an error or a string, not int"},
+		{"(message 'a')", "1:10: message expects an error, not string"},
+		{"(try (1) (catch e 'a'))", "1:1: try and catch have mismatched types int and string"},
+		{"(spawn (print 1))", "1:9: cannot spawn builtin print"},
+	}
+	for _, tt := range tests {
+		_, err := check(t, tt.src)
+		if err == nil {
+			t.Errorf("%s: no error, want %q", tt.src, tt.err)
+			continue
+		}
+		if err.Error() != tt.err {
+			t.Errorf("%s: error = %q, want %q", tt.src, err, tt.err)
+		}
+	}
+}
+
+func TestCheckReportsEveryError(t *testing.T) {
+	_, err := check(t, "(+ 1 'a')\n(let y:int 'b')\n(print y)")
+	errs, ok := err.(lexer.ErrorList)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("error = %v, want two errors", err)
+	}
+	if errs[0].Pos.Line != 1 || errs[1].Pos.Line != 2 {
+		t.Errorf("errors at lines %d and %d, want 1 and 2", errs[0].Pos.Line, errs[1].Pos.Line)
+	}
+}
@@ -0,0 +1,242 @@
+package typecheck
+
+import (
+	"strings"
+	"teriyake/goo/compiler"
+)
+
+type Type interface {
+	String() string
+}
+
+type Basic int
+
+const (
+	// Unknown is used for types that could not be inferred, either because of
+	// an earlier error or because a recursive function's result is not known
+	// yet. It is compatible with every type so that errors do not cascade. It
+	// is also the type of raise, which never produces a value, so that it can
+	// be used where a value of any type is expected.
+	Unknown Basic = iota
+	Void
+	Int
+	Float
+	String
+	Bool
+	Error
+)
+
+func (b Basic) String() string {
+	switch b {
+	case Unknown:
+		return "unknown"
+	case Void:
+		return "void"
+	case Int:
+		return "int"
+	case Float:
+		return "float"
+	case String:
+		return "string"
+	case Bool:
+		return "bool"
+	case Error:
+		return "error"
+	default:
+		return "invalid"
+	}
+}
+
+// TypeParam is a type parameter of a generic function. Each declaration is a
+// distinct *TypeParam, so two parameters named T are not identical.
+type TypeParam struct {
+	Name string
+}
+
+func (t *TypeParam) String() string {
+	return t.Name
+}
+
+type Func struct {
+	TypeParams []*TypeParam
+	Params     []Type
+	Result     Type
+}
+
+func (f *Func) String() string {
+	params := make([]string, len(f.Params))
+	for i, param := range f.Params {
+		params[i] = param.String()
+	}
+	s := "(" + strings.Join(params, " ") + ") -> " + f.Result.String()
+	if len(f.TypeParams) > 0 {
+		names := make([]string, len(f.TypeParams))
+		for i, typeParam := range f.TypeParams {
+			names[i] = typeParam.Name
+		}
+		s = "<" + strings.Join(names, " ") + "> " + s
+	}
+	return s
+}
+
+type List struct {
+	Elem Type
+}
+
+func (l *List) String() string {
+	return "[" + l.Elem.String() + "]"
+}
+
+type Chan struct {
+	Elem Type
+}
+
+func (c *Chan) String() string {
+	return "chan " + c.Elem.String()
+}
+
+func FromDataType(dataType compiler.DataType) Type {
+	switch dataType {
+	case compiler.IntType:
+		return Int
+	case compiler.FloatType:
+		return Float
+	case compiler.StringType:
+		return String
+	case compiler.BoolType:
+		return Bool
+	case compiler.ErrorType:
+		return Error
+	default:
+		return Unknown
+	}
+}
+
+func isNumeric(t Type) bool {
+	return t == Int || t == Float
+}
+
+func Identical(a, b Type) bool {
+	switch a := a.(type) {
+	case Basic, *TypeParam:
+		return a == b
+	case *Func:
+		b, ok := b.(*Func)
+		if !ok || len(a.Params) != len(b.Params) {
+			return false
+		}
+		for i := range a.Params {
+			if !Identical(a.Params[i], b.Params[i]) {
+				return false
+			}
+		}
+		return Identical(a.Result, b.Result)
+	case *List:
+		b, ok := b.(*List)
+		return ok && Identical(a.Elem, b.Elem)
+	case *Chan:
+		b, ok := b.(*Chan)
+		return ok && Identical(a.Elem, b.Elem)
+	}
+	return false
+}
+
+// AssignableTo reports whether a value of type from can be used where a value
+// of type to is expected. Unknown matches anything. Ints and floats are
+// distinct at runtime, so an int must be converted with float explicitly.
+func AssignableTo(from, to Type) bool {
+	if from == Unknown || to == Unknown {
+		return true
+	}
+	switch to := to.(type) {
+	case *List:
+		from, ok := from.(*List)
+		return ok && AssignableTo(from.Elem, to.Elem)
+	case *Chan:
+		// values go both into and out of a channel
+		from, ok := from.(*Chan)
+		return ok && AssignableTo(from.Elem, to.Elem) && AssignableTo(to.Elem, from.Elem)
+	case *Func:
+		from, ok := from.(*Func)
+		if !ok || len(from.Params) != len(to.Params) {
+			return false
+		}
+		for i := range to.Params {
+			if !AssignableTo(to.Params[i], from.Params[i]) {
+				return false
+			}
+		}
+		return AssignableTo(from.Result, to.Result)
+	}
+	return Identical(from, to)
+}
+
+// join returns the type that can hold values of both a and b, if any.
+func join(a, b Type) (Type, bool) {
+	switch {
+	case a == Unknown:
+		return b, true
+	case b == Unknown:
+		return a, true
+	case Identical(a, b):
+		return a, true
+	}
+	return nil, false
+}
+
+// infer matches the parameter type param against the argument type arg and
+// records what each type parameter in bindings must be. Type parameters that
+// are not keys of bindings are left alone.
+func infer(param, arg Type, bindings map[*TypeParam]Type) {
+	switch param := param.(type) {
+	case *TypeParam:
+		bound, ok := bindings[param]
+		if !ok {
+			return
+		}
+		if bound == nil || bound == Unknown {
+			bindings[param] = arg
+		} else if joined, ok := join(bound, arg); ok {
+			bindings[param] = joined
+		}
+	case *Func:
+		arg, ok := arg.(*Func)
+		if !ok || len(arg.Params) != len(param.Params) {
+			return
+		}
+		for i := range param.Params {
+			infer(param.Params[i], arg.Params[i], bindings)
+		}
+		infer(param.Result, arg.Result, bindings)
+	case *List:
+		if arg, ok := arg.(*List); ok {
+			infer(param.Elem, arg.Elem, bindings)
+		}
+	case *Chan:
+		if arg, ok := arg.(*Chan); ok {
+			infer(param.Elem, arg.Elem, bindings)
+		}
+	}
+}
+
+// substitute replaces the type parameters bound in bindings throughout t.
+func substitute(t Type, bindings map[*TypeParam]Type) Type {
+	switch t := t.(type) {
+	case *TypeParam:
+		if bound := bindings[t]; bound != nil {
+			return bound
+		}
+		return t
+	case *Func:
+		params := make([]Type, len(t.Params))
+		for i, param := range t.Params {
+			params[i] = substitute(param, bindings)
+		}
+		return &Func{TypeParams: t.TypeParams, Params: params, Result: substitute(t.Result, bindings)}
+	case *List:
+		return &List{Elem: substitute(t.Elem, bindings)}
+	case *Chan:
+		return &Chan{Elem: substitute(t.Elem, bindings)}
+	}
+	return t
+}
@@ -0,0 +1,37 @@
+package vm
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// benchmark runs one of the programs in tests/bench, compiled once, b.N
+// times.
+func benchmark(b *testing.B, name string) {
+	path := filepath.Join("..", "tests", "bench", name)
+	src, err := os.ReadFile(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	code, offsetMap := compile(b, path, string(src), nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := NewVM(code, offsetMap, io.Discard, nil).Run(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkFib makes recursive calls: the naive Fibonacci function.
+func BenchmarkFib(b *testing.B) {
+	benchmark(b, "fib.goo")
+}
+
+// BenchmarkMap calls lambdas from map, filter and reduce over lists.
+func BenchmarkMap(b *testing.B) {
+	benchmark(b, "map.goo")
+}
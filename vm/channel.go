@@ -0,0 +1,320 @@
+package vm
+
+import (
+	"fmt"
+	"teriyake/goo/compiler"
+)
+
+// Channel is a goo channel. A send completes when a receiver takes the value
+// or there is room for it in the buffer of capacity values, and a receive
+// when there is a value in the buffer or a sender waiting to give one.
+type Channel struct {
+	capacity  int
+	buffer    []interface{}
+	closed    bool
+	receivers []*waiter
+	senders   []*waiter
+}
+
+// blocking is what a blocked task waits for: one of the waiters sharing it
+// to complete. The task keeps the operands of the blocking instruction on
+// its stack until then.
+type blocking struct {
+	task     *task
+	operands int
+}
+
+// waiter is a blocked send or receive on a channel. Completing it pops the
+// operands of the instruction, pushes the received value for a receive, and
+// continues the task at target. A waiter is only valid while its task is
+// blocked on it: once one of the cases of SELECT completes, the waiters of
+// the others are stale and are skipped.
+type waiter struct {
+	*blocking
+	recv   bool
+	value  interface{}
+	target int
+}
+
+func (w *waiter) valid() bool {
+	return w.task.blocking == w.blocking
+}
+
+// complete wakes the task of w, which then continues after receiving value
+// or having its value sent.
+func (vm *VM) complete(w *waiter, value interface{}) {
+	t := w.task
+	clear(t.stack[len(t.stack)-w.operands:])
+	t.stack = t.stack[:len(t.stack)-w.operands]
+	if w.recv {
+		t.stack = append(t.stack, value)
+	}
+	t.pc = w.target
+	t.blocking = nil
+	vm.ready = append(vm.ready, t)
+}
+
+// dequeue removes the first valid waiter from queue, or returns nil if there
+// is none.
+func dequeue(queue *[]*waiter) *waiter {
+	for len(*queue) > 0 {
+		w := (*queue)[0]
+		(*queue)[0] = nil
+		*queue = (*queue)[1:]
+		if w.valid() {
+			return w
+		}
+	}
+	return nil
+}
+
+// enqueue adds w to queue, dropping the stale waiters in it.
+func enqueue(queue []*waiter, w *waiter) []*waiter {
+	valid := queue[:0]
+	for _, waiting := range queue {
+		if waiting.valid() {
+			valid = append(valid, waiting)
+		}
+	}
+	clear(queue[len(valid):])
+	return append(valid, w)
+}
+
+// trySend sends value on ch if that does not block, reporting whether it
+// did.
+func (vm *VM) trySend(ch *Channel, value interface{}) (bool, error) {
+	if ch.closed {
+		return false, fmt.Errorf("send on closed channel")
+	}
+	if w := dequeue(&ch.receivers); w != nil {
+		vm.complete(w, value)
+		return true, nil
+	}
+	if len(ch.buffer) < ch.capacity {
+		ch.buffer = append(ch.buffer, value)
+		return true, nil
+	}
+	return false, nil
+}
+
+// tryRecv receives a value from ch if that does not block. It does not
+// receive from a closed channel with nothing left in its buffer.
+func (vm *VM) tryRecv(ch *Channel) (interface{}, bool) {
+	if len(ch.buffer) > 0 {
+		value := ch.buffer[0]
+		ch.buffer[0] = nil
+		ch.buffer = ch.buffer[1:]
+		// a waiting sender takes the place freed in the buffer
+		if w := dequeue(&ch.senders); w != nil {
+			ch.buffer = append(ch.buffer, w.value)
+			vm.complete(w, nil)
+		}
+		return value, true
+	}
+	if w := dequeue(&ch.senders); w != nil {
+		vm.complete(w, nil)
+		return w.value, true
+	}
+	return nil, false
+}
+
+func channelOperand(opcode compiler.Opcode, value interface{}) (*Channel, error) {
+	ch, ok := value.(*Channel)
+	if !ok {
+		return nil, fmt.Errorf("%s instruction requires a channel, got %T", compiler.OpcodeToString(opcode), value)
+	}
+	return ch, nil
+}
+
+// makeChannel executes MAKE_CHANNEL, creating a channel with the capacity on
+// top of the stack.
+func (vm *VM) makeChannel() error {
+	if len(vm.stack) < 1 {
+		return fmt.Errorf("MAKE_CHANNEL instruction requires a capacity on the stack")
+	}
+	capacity, ok := vm.stack[len(vm.stack)-1].(int64)
+	if !ok {
+		return fmt.Errorf("MAKE_CHANNEL instruction requires an int capacity, got %T", vm.stack[len(vm.stack)-1])
+	}
+	if capacity < 0 {
+		return fmt.Errorf("negative channel capacity %d", capacity)
+	}
+	vm.stack[len(vm.stack)-1] = &Channel{capacity: int(capacity)}
+	return nil
+}
+
+// send executes SEND, blocking the running task until the value on top of
+// the stack is sent on the channel below it.
+func (vm *VM) send() error {
+	if vm.parallel {
+		return errParallel("send")
+	}
+	if len(vm.stack) < 2 {
+		return fmt.Errorf("SEND instruction requires a channel and a value on the stack")
+	}
+	value := vm.stack[len(vm.stack)-1]
+	ch, err := channelOperand(compiler.SEND, vm.stack[len(vm.stack)-2])
+	if err != nil {
+		return err
+	}
+	sent, err := vm.trySend(ch, value)
+	if err != nil {
+		return err
+	}
+	if sent {
+		vm.stack = vm.stack[:len(vm.stack)-2]
+		return nil
+	}
+	b := &blocking{task: vm.current, operands: 2}
+	ch.senders = enqueue(ch.senders, &waiter{blocking: b, value: value, target: vm.pc + 1})
+	return vm.park(b)
+}
+
+// recv executes RECV, blocking the running task until it receives a value
+// from the channel on the stack. With an else value above the channel, a
+// closed channel gives that value instead of being an error.
+func (vm *VM) recv(elseValues int) error {
+	if vm.parallel {
+		return errParallel("recv")
+	}
+	if len(vm.stack) < 1+elseValues {
+		return fmt.Errorf("RECV instruction requires a channel and %d else values on the stack", elseValues)
+	}
+	ch, err := channelOperand(compiler.RECV, vm.stack[len(vm.stack)-1-elseValues])
+	if err != nil {
+		return err
+	}
+	if value, ok := vm.tryRecv(ch); ok {
+		vm.stack = vm.stack[:len(vm.stack)-1-elseValues]
+		vm.push(value)
+		return nil
+	}
+	if ch.closed {
+		if elseValues == 0 {
+			return fmt.Errorf("receive from closed channel")
+		}
+		value := vm.stack[len(vm.stack)-1]
+		vm.stack = vm.stack[:len(vm.stack)-2]
+		vm.push(value)
+		return nil
+	}
+	b := &blocking{task: vm.current, operands: 1 + elseValues}
+	ch.receivers = enqueue(ch.receivers, &waiter{blocking: b, recv: true, target: vm.pc + 1})
+	return vm.park(b)
+}
+
+// closeChannel executes CLOSE. The tasks blocked on the channel run their
+// blocking instruction again, which now finds it closed.
+func (vm *VM) closeChannel() error {
+	if vm.parallel {
+		return errParallel("close")
+	}
+	value, err := vm.pop()
+	if err != nil {
+		return fmt.Errorf("CLOSE instruction requires a channel on the stack")
+	}
+	ch, err := channelOperand(compiler.CLOSE, value)
+	if err != nil {
+		return err
+	}
+	if ch.closed {
+		return fmt.Errorf("close of closed channel")
+	}
+	ch.closed = true
+	for _, queue := range [][]*waiter{ch.receivers, ch.senders} {
+		for _, w := range queue {
+			if w.valid() {
+				w.task.blocking = nil
+				vm.ready = append(vm.ready, w.task)
+			}
+		}
+	}
+	ch.receivers, ch.senders = nil, nil
+	return nil
+}
+
+// selectCase executes SELECT. The first case, in order, that can proceed
+// without blocking is chosen, or the else case if none can. Without an else
+// case the running task blocks until one of them can.
+func (vm *VM) selectCase(cases []compiler.Case) error {
+	if vm.parallel {
+		return errParallel("select")
+	}
+	operands := 0
+	for _, selectCase := range cases {
+		switch selectCase.Kind {
+		case compiler.RecvCase:
+			operands++
+		case compiler.SendCase:
+			operands += 2
+		}
+	}
+	if len(vm.stack) < operands {
+		return fmt.Errorf("SELECT instruction requires %d values on the stack", operands)
+	}
+	base := len(vm.stack) - operands
+
+	choose := func(target int, value interface{}, recv bool) error {
+		clear(vm.stack[base:])
+		vm.stack = vm.stack[:base]
+		if recv {
+			vm.push(value)
+		}
+		return vm.jumpTo(target)
+	}
+
+	// the channels and values of the cases, in order
+	chans := make([]*Channel, len(cases))
+	values := make([]interface{}, len(cases))
+	elseCase := -1
+	pos := base
+	for i, selectCase := range cases {
+		switch selectCase.Kind {
+		case compiler.RecvCase:
+			ch, err := channelOperand(compiler.SELECT, vm.stack[pos])
+			if err != nil {
+				return err
+			}
+			pos++
+			if value, ok := vm.tryRecv(ch); ok {
+				return choose(selectCase.Target, value, true)
+			}
+			if ch.closed {
+				return fmt.Errorf("receive from closed channel")
+			}
+			chans[i] = ch
+		case compiler.SendCase:
+			ch, err := channelOperand(compiler.SELECT, vm.stack[pos])
+			if err != nil {
+				return err
+			}
+			value := vm.stack[pos+1]
+			pos += 2
+			sent, err := vm.trySend(ch, value)
+			if err != nil {
+				return err
+			}
+			if sent {
+				return choose(selectCase.Target, nil, false)
+			}
+			chans[i], values[i] = ch, value
+		case compiler.ElseCase:
+			elseCase = i
+		}
+	}
+	if elseCase >= 0 {
+		return choose(cases[elseCase].Target, nil, false)
+	}
+
+	b := &blocking{task: vm.current, operands: operands}
+	for i, selectCase := range cases {
+		w := &waiter{blocking: b, value: values[i], target: selectCase.Target}
+		if selectCase.Kind == compiler.RecvCase {
+			w.recv = true
+			chans[i].receivers = enqueue(chans[i].receivers, w)
+		} else {
+			chans[i].senders = enqueue(chans[i].senders, w)
+		}
+	}
+	return vm.park(b)
+}
@@ -0,0 +1,121 @@
+package vm
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestChannelProgram(t *testing.T) {
+	out, err := runFile(t, "channels.goo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "1\n-1\n2\n-2\n3\n-3\n4\n" + // ping-pong
+		"385\n" + // fan-out
+		"a\nb\nc\nclosed\n" +
+		"hello \ngoo\n" +
+		"nothing\nb neg\na pos\nb pos\n" +
+		"101\nsent\n2\n" +
+		"quick\nslow\n"
+	if out != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+}
+
+func TestChannels(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			name: "ping-pong",
+			src: `(let ping:chan int (chan int))
+				(let pong:chan int (chan int))
+				(def ponger ()
+					(let v:int (recv ping))
+					(if (< v 3) ((send pong (* v 10)) (ponger)) else (send pong 0)))
+				(def pinger (v:int)
+					(send ping v)
+					(let reply:int (recv pong))
+					(print reply)
+					(if (> reply 0) (pinger (+ v 1))))
+				(spawn ponger)
+				(pinger 1)`,
+			want: "10\n20\n0\n",
+		},
+		{
+			// whichever worker squares a job, every result reaches the sum
+			name: "fan-out",
+			src: `(let jobs:chan int (chan int))
+				(let results:chan int (chan int))
+				(def worker ()
+					(let job:int (recv jobs else 0))
+					(if (> job 0) ((send results (* job job)) (worker))))
+				(spawn worker)
+				(spawn worker)
+				(def feed (n:int) (if (> n 4) (close jobs) else ((send jobs n) (feed (+ n 1)))))
+				(spawn (feed 1))
+				(def sum (n:int acc:int):int (if (= n 0) (acc) else (sum (- n 1) (+ acc (recv results)))))
+				(print (sum 4 0))`,
+			want: "30\n",
+		},
+		{
+			name: "buffered",
+			src: `(let c:chan int (chan int 2))
+				(send c 1)
+				(send c 2)
+				(close c)
+				(print (recv c))
+				(print (recv c))
+				(print (recv c else -1))`,
+			want: "1\n2\n-1\n",
+		},
+		{
+			// a select with a case without a value drops the values of
+			// the others
+			name: "select without a value",
+			src: `(let c:chan int (chan int 1))
+				(def poll () (select (recv c v (+ v 1)) (else (print 0))))
+				(def drain (n:int) (if (> n 0) ((select (recv c v (print v) (* v 2)) (send c n (print 'sent'))) (drain (- n 1)))))
+				(poll)
+				(send c 5)
+				(poll)
+				(drain 2)
+				(select (recv c v v) (else (print 'empty')))`,
+			want: "0\nsent\n2\nempty\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := run(t, tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out != tt.want {
+				t.Errorf("output = %q, want %q", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeadlock(t *testing.T) {
+	out, err := runFile(t, "deadlock.goo")
+	if !errors.Is(err, errDeadlock) {
+		t.Fatalf("error = %v, want %v", err, errDeadlock)
+	}
+	var runtimeErr *RuntimeError
+	if !errors.As(err, &runtimeErr) || runtimeErr.Pos.Line != 13 || runtimeErr.Pos.Column != 8 {
+		t.Errorf("error = %v, want it at the recv on line 13, column 8", err)
+	}
+	if out != "42\n" {
+		t.Errorf("output = %q, want %q", out, "42\n")
+	}
+
+	// a deadlock is not an error that try can catch
+	_, err = run(t, `(let c:chan int (chan int))
+		(print (try (recv c) (catch e 0)))`)
+	if !errors.Is(err, errDeadlock) {
+		t.Errorf("error = %v, want %v", err, errDeadlock)
+	}
+}
@@ -0,0 +1,182 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"teriyake/goo/lexer"
+)
+
+// Error is a goo error value: one raised by raise, or a runtime error, such
+// as a division by zero, caught by a catch.
+type Error struct {
+	Message string
+	Pos     lexer.Position
+}
+
+func (e *Error) Error() string {
+	if !e.Pos.IsValid() {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %s", e.Pos, e.Message)
+}
+
+// Frame is a call in progress when an error stopped the program: the
+// function or lambda called, or "" for the top level of the program, and the
+// position it was at.
+type Frame struct {
+	Function string
+	Pos      lexer.Position
+}
+
+// handler is a try whose body is running: where its catch starts, and the
+// state of the task at TRY, which an error raised in the body returns to.
+type handler struct {
+	catch  int
+	stack  int
+	calls  int
+	locals int
+	frame  frame
+}
+
+// try executes TRY, installing a handler for the body that follows. The
+// catch must start at an instruction of the code, or at its end.
+func (vm *VM) try(catch int) error {
+	if catch < 0 || catch > len(vm.code) {
+		return fmt.Errorf("Invalid catch address %d for TRY", catch)
+	}
+	vm.handlers = append(vm.handlers, handler{
+		catch:  catch,
+		stack:  len(vm.stack),
+		calls:  len(vm.callStack),
+		locals: len(vm.locals),
+		frame:  vm.frame,
+	})
+	return nil
+}
+
+// endTry executes END_TRY, removing the handler of the body that has ended.
+func (vm *VM) endTry() error {
+	if len(vm.handlers) == 0 {
+		return fmt.Errorf("END_TRY without a try")
+	}
+	vm.handlers = vm.handlers[:len(vm.handlers)-1]
+	return nil
+}
+
+// dropHandlers removes the handlers installed by calls that have ended, once
+// only the first calls entries of the call stack are left.
+func (vm *VM) dropHandlers(calls int) {
+	for len(vm.handlers) > 0 && vm.handlers[len(vm.handlers)-1].calls > calls {
+		vm.handlers = vm.handlers[:len(vm.handlers)-1]
+	}
+}
+
+// raise executes RAISE, raising the error on top of the stack, or a new one
+// with the string there as its message.
+func (vm *VM) raise() error {
+	value, err := vm.pop()
+	if err != nil {
+		return fmt.Errorf("RAISE instruction requires an error on the stack")
+	}
+	switch value := value.(type) {
+	case *Error:
+		return value
+	case string:
+		return &Error{Message: value, Pos: vm.position(vm.pc)}
+	}
+	return fmt.Errorf("RAISE instruction requires an error or a string, got %T", value)
+}
+
+// message executes MESSAGE, replacing the error on top of the stack with its
+// message.
+func (vm *VM) message() error {
+	if len(vm.stack) < 1 {
+		return fmt.Errorf("MESSAGE instruction requires an error on the stack")
+	}
+	gooErr, ok := vm.stack[len(vm.stack)-1].(*Error)
+	if !ok {
+		return fmt.Errorf("MESSAGE instruction requires an error, got %T", vm.stack[len(vm.stack)-1])
+	}
+	vm.stack[len(vm.stack)-1] = gooErr.Message
+	return nil
+}
+
+// catch handles err with the handler of the innermost try of the running
+// task, returning the task to the state it had at TRY and continuing at the
+// catch with the error on the stack. It reports false if there is no handler,
+// or if err cannot be caught: a deadlock, or the VM's context being done.
+// The catch address was checked by try when it installed the handler.
+func (vm *VM) catch(err error) bool {
+	if len(vm.handlers) == 0 || errors.Is(err, errDeadlock) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	gooErr := vm.errorValue(err)
+
+	h := vm.handlers[len(vm.handlers)-1]
+	vm.handlers = vm.handlers[:len(vm.handlers)-1]
+	clear(vm.callStack[h.calls:])
+	vm.callStack = vm.callStack[:h.calls]
+	clear(vm.locals[h.locals:])
+	vm.locals = vm.locals[:h.locals]
+	vm.frame = h.frame
+	clear(vm.stack[h.stack:])
+	vm.stack = vm.stack[:h.stack]
+	vm.push(gooErr)
+	vm.pc = h.catch
+
+	if vm.trace != nil {
+		fmt.Fprintf(vm.trace, "Caught %v, continuing at PC %d\n", gooErr, vm.pc)
+	}
+	return true
+}
+
+// errorValue returns the goo error for err, which failed the current
+// instruction or, for an error from a worker of PMAP or PFILTER, the
+// instruction the worker was at.
+func (vm *VM) errorValue(err error) *Error {
+	var gooErr *Error
+	if errors.As(err, &gooErr) {
+		return gooErr
+	}
+	var runtimeErr *RuntimeError
+	if errors.As(err, &runtimeErr) {
+		return &Error{Message: runtimeErr.Err.Error(), Pos: runtimeErr.Pos}
+	}
+	return &Error{Message: err.Error(), Pos: vm.position(vm.pc)}
+}
+
+// stackTrace returns the calls of the running task, innermost first, each
+// with the position of the instruction it is at: the current one for the
+// innermost, and the call it made for the others.
+func (vm *VM) stackTrace() []Frame {
+	var trace []Frame
+	pos := vm.position(vm.pc)
+	for i := len(vm.callStack) - 1; i >= 0; i-- {
+		entry := vm.callStack[i]
+		trace = append(trace, Frame{Function: vm.functionName(entry.function), Pos: pos})
+		if entry.returnAddress < 0 {
+			// the function a task was spawned for, or a worker called
+			return trace
+		}
+		pos = vm.position(entry.returnAddress)
+	}
+	return append(trace, Frame{Pos: pos})
+}
+
+// functionName returns the name of the def function, or "lambda" for the
+// lambda, starting at start.
+func (vm *VM) functionName(start int) string {
+	if name, ok := vm.names[start]; ok {
+		return name
+	}
+	return "lambda"
+}
+
+func (vm *VM) position(pc int) lexer.Position {
+	if pc >= 0 && pc < len(vm.code) {
+		return vm.code[pc].Pos
+	}
+	return lexer.Position{}
+}
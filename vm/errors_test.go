@@ -0,0 +1,146 @@
+package vm
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestErrorsProgram(t *testing.T) {
+	out, err := runFile(t, "errors.goo")
+	file := "../tests/input/errors.goo"
+	want := "30\nnegative age\n0\n0\n" +
+		file + ":7:26: division by zero\n-1\n" +
+		"receive from closed channel\n" +
+		file + ":16:22: kept\n" +
+		file + ":2:40: negative age\n0\n" +
+		"division by zero\n-2\n" +
+		"1\n0\n" +
+		file + ":32:31: division by zero\n[0]\n[12 6 0 4]\n-1\n"
+	if out != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+	if !errors.Is(err, errDivisionByZero) {
+		t.Errorf("error = %v, want %v", err, errDivisionByZero)
+	}
+}
+
+func TestTryCatch(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			name: "raise",
+			src: `(def check (n:int):int (if (< n 0) (raise 'negative') else (n)))
+				(print (try (check 1) (catch e -1)))
+				(print (try (check -1) (catch e (print (message e)) -1)))
+				(try (check -1) (catch e:error (print e) 0))`,
+			want: "1\nnegative\n-1\ntest.goo:1:36: negative\n",
+		},
+		{
+			name: "runtime error",
+			src: `(def div (a:int b:int):int (/ a b))
+				(def half_of (n:int):int (div n 2))
+				(print (try (div 1 0) (catch e (print (message e)) -1)))
+				(print (try (+ (half_of 8) (div 1 0)) (catch e 0)))
+				(print (try (+ (half_of 8) (div 1 1)) (catch e 0)))`,
+			want: "division by zero\n-1\n0\n5\n",
+		},
+		{
+			// an error raised again is caught by the try around the catch,
+			// with the position where it was first raised
+			name: "rethrow",
+			src: `(def inner ():int (raise 'first'))
+				(def outer ():int (try (inner) (catch e (raise e))))
+				(try (outer) (catch e (print e) 0))
+				(try (try (raise 'a') (catch e (raise 'b'))) (catch e (print (message e))))`,
+			want: "test.goo:1:19: first\nb\n",
+		},
+		{
+			name: "nested try",
+			src: `(print (try (try (/ 1 0) (catch e 1)) (catch e 2)))
+				(print (try ((try (3) (catch e 1)) (raise 'x')) (catch e 2)))`,
+			want: "1\n2\n",
+		},
+		{
+			// the stack and calls of the try body are gone in the catch
+			name: "unwinds calls",
+			src: `(def deep (n:int stop:int):int
+					(if (= n stop) (raise 'bottom') else (if (= n 0) (0) else (+ 1 (deep (- n 1) stop)))))
+				(print (try (deep 50 10) (catch e (print (message e)) -1)))
+				(print (deep 5 -1))`,
+			want: "bottom\n-1\n5\n",
+		},
+		{
+			// the value of a try or catch body is that of its last
+			// expression
+			name: "several expressions",
+			src: `(def g (x:int):int (try (+ x 1) (* x 2) (catch e 0)))
+				(def h (x:int):int (try (/ 1 x) (catch e (+ x 1) (print (message e)) (- x 1))))
+				(print (+ (g 1) (g 2)))
+				(print (h 0))`,
+			want: "6\ndivision by zero\n-1\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := run(t, tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out != tt.want {
+				t.Errorf("output = %q, want %q", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestUncaughtError(t *testing.T) {
+	src := `(def ratio (a:int b:int):int (/ a b))
+(def percent (a:int b:int):int (* 100 (ratio a b)))
+(def report (a:int b:int) (print (percent a b)))
+(report 1 0)
+(print 'not reached')`
+	out, err := run(t, src)
+	if out != "" {
+		t.Errorf("output = %q, want none", out)
+	}
+	var runtimeErr *RuntimeError
+	if !errors.As(err, &runtimeErr) {
+		t.Fatalf("error = %v, want a RuntimeError", err)
+	}
+	if !errors.Is(err, errDivisionByZero) {
+		t.Errorf("error = %v, want %v", err, errDivisionByZero)
+	}
+	var trace []string
+	for _, frame := range runtimeErr.Trace {
+		trace = append(trace, frame.Function+" "+frame.Pos.String())
+	}
+	want := []string{"ratio test.goo:1:30", "percent test.goo:2:39", "report test.goo:3:34", " test.goo:4:1"}
+	if !reflect.DeepEqual(trace, want) {
+		t.Errorf("trace = %q, want %q", trace, want)
+	}
+	wantMsg := "test.goo:1:30: division by zero\n" +
+		"\tin ratio at test.goo:1:30\n" +
+		"\tin percent at test.goo:2:39\n" +
+		"\tin report at test.goo:3:34\n" +
+		"\tat test.goo:4:1"
+	if err.Error() != wantMsg {
+		t.Errorf("error = %q, want %q", err, wantMsg)
+	}
+}
+
+func TestUncaughtRaise(t *testing.T) {
+	_, err := run(t, `(def fail ():int (raise 'no'))
+(let f:(int) -> int ((x:int) -> (+ x fail)))
+(print (f 1))`)
+	var gooErr *Error
+	if !errors.As(err, &gooErr) || gooErr.Message != "no" {
+		t.Fatalf("error = %v, want the raised error", err)
+	}
+	if gooErr.Pos.String() != "test.goo:1:18" {
+		t.Errorf("error at %v, want test.goo:1:18", gooErr.Pos)
+	}
+}
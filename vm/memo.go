@@ -0,0 +1,53 @@
+package vm
+
+import "math"
+
+// maxMemoArgs is the most arguments a call can have for its result to be
+// remembered.
+const maxMemoArgs = 4
+
+// memoKey identifies a call of the function starting at start by its
+// arguments. Floats are kept by their bits, so that a NaN argument finds the
+// result remembered for it, and -0 does not find the one for 0.
+type memoKey struct {
+	start int
+	args  [maxMemoArgs]interface{}
+}
+
+// SetMemoize makes the VM remember the results of calls of pure def
+// functions by their arguments, so that a call with the same arguments again
+// returns the remembered result without running the function. Only calls of
+// functions that capture no variables, with at most 4 int, float, string or
+// bool arguments, are remembered, and none made by the workers of pmap and
+// pfilter.
+func (vm *VM) SetMemoize(memoize bool) {
+	if memoize {
+		vm.memo = make(map[memoKey]interface{})
+	} else {
+		vm.memo = nil
+	}
+}
+
+// remembered looks up the result of calling the function of fm with args.
+// If there is none, it returns the key to remember the result under, or nil
+// if it is not to be remembered.
+func (vm *VM) remembered(fm FunctionMetadata, args []interface{}) (*memoKey, interface{}, bool) {
+	if vm.memo == nil || !vm.pure[fm.StartAddress] || len(fm.Upvalues) > 0 || len(args) > maxMemoArgs {
+		return nil, nil, false
+	}
+	key := memoKey{start: fm.StartAddress}
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case int64, string, bool:
+			key.args[i] = v
+		case float64:
+			key.args[i] = math.Float64bits(v)
+		default:
+			return nil, nil, false
+		}
+	}
+	if result, ok := vm.memo[key]; ok {
+		return nil, result, true
+	}
+	return &key, nil, false
+}
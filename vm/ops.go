@@ -0,0 +1,234 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"teriyake/goo/compiler"
+)
+
+var (
+	errDivisionByZero  = errors.New("division by zero")
+	errIntegerOverflow = errors.New("integer overflow")
+)
+
+// popOperands pops the two operands of a binary instruction, returning them
+// in source order.
+func (vm *VM) popOperands(opcode compiler.Opcode) (interface{}, interface{}, error) {
+	if len(vm.stack) < 2 {
+		return nil, nil, fmt.Errorf("%s instruction requires at least 2 values on the stack", compiler.OpcodeToString(opcode))
+	}
+	left := vm.stack[len(vm.stack)-2]
+	right := vm.stack[len(vm.stack)-1]
+	vm.stack = vm.stack[:len(vm.stack)-2]
+	return left, right, nil
+}
+
+func operandTypeError(opcode compiler.Opcode, want string, left, right interface{}) error {
+	return fmt.Errorf("%s instruction requires %s operands, got %T and %T", compiler.OpcodeToString(opcode), want, left, right)
+}
+
+// numericOperands returns the operands as int64s if both are ints, and
+// otherwise as float64s, converting an int operand if the other is a float.
+func numericOperands(left, right interface{}) (a, b int64, x, y float64, isInt, ok bool) {
+	switch l := left.(type) {
+	case int64:
+		switch r := right.(type) {
+		case int64:
+			return l, r, 0, 0, true, true
+		case float64:
+			return 0, 0, float64(l), r, false, true
+		}
+	case float64:
+		switch r := right.(type) {
+		case int64:
+			return 0, 0, l, float64(r), false, true
+		case float64:
+			return 0, 0, l, r, false, true
+		}
+	}
+	return 0, 0, 0, 0, false, false
+}
+
+// arithmetic executes ADD, SUB, MUL, DIV and MOD. Two ints give an int, with
+// division truncating toward zero; anything else gives a float. Division and
+// modulo by zero and int results that do not fit in 64 bits are runtime
+// errors rather than producing Inf, NaN or a wrapped value.
+func (vm *VM) arithmetic(opcode compiler.Opcode) error {
+	left, right, err := vm.popOperands(opcode)
+	if err != nil {
+		return err
+	}
+	a, b, x, y, isInt, ok := numericOperands(left, right)
+	if !ok {
+		return operandTypeError(opcode, "numeric", left, right)
+	}
+
+	if isInt {
+		result, err := intArithmetic(opcode, a, b)
+		if err != nil {
+			return err
+		}
+		vm.push(result)
+		return nil
+	}
+
+	var result float64
+	switch opcode {
+	case compiler.ADD:
+		result = x + y
+	case compiler.SUB:
+		result = x - y
+	case compiler.MUL:
+		result = x * y
+	case compiler.DIV:
+		if y == 0 {
+			return errDivisionByZero
+		}
+		result = x / y
+	case compiler.MOD:
+		if y == 0 {
+			return errDivisionByZero
+		}
+		result = math.Mod(x, y)
+	}
+
+	vm.push(result)
+	return nil
+}
+
+func intArithmetic(opcode compiler.Opcode, a, b int64) (int64, error) {
+	switch opcode {
+	case compiler.ADD:
+		result := a + b
+		if (a^result)&(b^result) < 0 {
+			return 0, errIntegerOverflow
+		}
+		return result, nil
+	case compiler.SUB:
+		result := a - b
+		if (a^b)&(a^result) < 0 {
+			return 0, errIntegerOverflow
+		}
+		return result, nil
+	case compiler.MUL:
+		if a == 0 || b == 0 {
+			return 0, nil
+		}
+		result := a * b
+		if result/b != a || (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+			return 0, errIntegerOverflow
+		}
+		return result, nil
+	case compiler.DIV:
+		if b == 0 {
+			return 0, errDivisionByZero
+		}
+		if a == math.MinInt64 && b == -1 {
+			return 0, errIntegerOverflow
+		}
+		return a / b, nil
+	case compiler.MOD:
+		if b == 0 {
+			return 0, errDivisionByZero
+		}
+		return a % b, nil
+	}
+	return 0, fmt.Errorf("%s is not an arithmetic instruction", compiler.OpcodeToString(opcode))
+}
+
+// compare executes GRT, LESS, GEQ and LEQ on numbers.
+func (vm *VM) compare(opcode compiler.Opcode) error {
+	left, right, err := vm.popOperands(opcode)
+	if err != nil {
+		return err
+	}
+	a, b, x, y, isInt, ok := numericOperands(left, right)
+	if !ok {
+		return operandTypeError(opcode, "numeric", left, right)
+	}
+
+	// ints are compared directly to keep precision a float64 cannot hold
+	var result bool
+	switch opcode {
+	case compiler.GRT:
+		result = (isInt && a > b) || (!isInt && x > y)
+	case compiler.LESS:
+		result = (isInt && a < b) || (!isInt && x < y)
+	case compiler.GEQ:
+		result = (isInt && a >= b) || (!isInt && x >= y)
+	case compiler.LEQ:
+		result = (isInt && a <= b) || (!isInt && x <= y)
+	}
+
+	vm.push(result)
+	return nil
+}
+
+// equality executes EQ and NEQ. Both operands must be numbers, strings or
+// bools; an int equals a float with the same value.
+func (vm *VM) equality(opcode compiler.Opcode) error {
+	left, right, err := vm.popOperands(opcode)
+	if err != nil {
+		return err
+	}
+
+	var equal bool
+	if a, b, x, y, isInt, ok := numericOperands(left, right); ok {
+		equal = (isInt && a == b) || (!isInt && x == y)
+	} else {
+		switch a := left.(type) {
+		case string:
+			b, ok := right.(string)
+			if !ok {
+				return operandTypeError(opcode, "same type", left, right)
+			}
+			equal = a == b
+		case bool:
+			b, ok := right.(bool)
+			if !ok {
+				return operandTypeError(opcode, "same type", left, right)
+			}
+			equal = a == b
+		default:
+			return operandTypeError(opcode, "number, string or bool", left, right)
+		}
+	}
+
+	vm.push(equal == (opcode == compiler.EQ))
+	return nil
+}
+
+// convert executes TO_INT and TO_FLOAT. Floats are truncated toward zero when
+// converted to int, and NaN, infinities and values outside the int64 range
+// are runtime errors.
+func (vm *VM) convert(opcode compiler.Opcode) error {
+	if len(vm.stack) < 1 {
+		return fmt.Errorf("%s instruction requires a value on the stack", compiler.OpcodeToString(opcode))
+	}
+	value := vm.stack[len(vm.stack)-1]
+
+	var result interface{}
+	switch v := value.(type) {
+	case int64:
+		if opcode == compiler.TO_INT {
+			result = v
+		} else {
+			result = float64(v)
+		}
+	case float64:
+		if opcode == compiler.TO_FLOAT {
+			result = v
+		} else {
+			if math.IsNaN(v) || v < math.MinInt64 || v >= math.MaxInt64 {
+				return fmt.Errorf("cannot convert %v to int: %w", v, errIntegerOverflow)
+			}
+			result = int64(v)
+		}
+	default:
+		return fmt.Errorf("%s instruction requires a numeric operand, got %T", compiler.OpcodeToString(opcode), value)
+	}
+
+	vm.stack[len(vm.stack)-1] = result
+	return nil
+}
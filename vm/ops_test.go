@@ -0,0 +1,91 @@
+package vm
+
+import (
+	"errors"
+	"io"
+	"math"
+	"teriyake/goo/compiler"
+	"testing"
+)
+
+func TestArithmetic(t *testing.T) {
+	tests := []struct {
+		opcode      compiler.Opcode
+		left, right interface{}
+		want        interface{}
+		err         error
+	}{
+		{compiler.ADD, int64(2), int64(3), int64(5), nil},
+		{compiler.ADD, int64(math.MaxInt64), int64(1), nil, errIntegerOverflow},
+		{compiler.ADD, int64(math.MinInt64), int64(-1), nil, errIntegerOverflow},
+		{compiler.ADD, int64(math.MaxInt64), int64(math.MinInt64), int64(-1), nil},
+		{compiler.SUB, int64(math.MinInt64), int64(1), nil, errIntegerOverflow},
+		{compiler.SUB, int64(0), int64(math.MinInt64), nil, errIntegerOverflow},
+		{compiler.SUB, int64(-1), int64(math.MinInt64), int64(math.MaxInt64), nil},
+		{compiler.MUL, int64(math.MaxInt64), int64(2), nil, errIntegerOverflow},
+		{compiler.MUL, int64(math.MinInt64), int64(-1), nil, errIntegerOverflow},
+		{compiler.MUL, int64(-1), int64(math.MinInt64), nil, errIntegerOverflow},
+		{compiler.MUL, int64(math.MinInt64), int64(1), int64(math.MinInt64), nil},
+		{compiler.MUL, int64(math.MinInt64), int64(0), int64(0), nil},
+		{compiler.DIV, int64(7), int64(2), int64(3), nil},
+		{compiler.DIV, int64(-7), int64(2), int64(-3), nil},
+		{compiler.DIV, int64(math.MinInt64), int64(-1), nil, errIntegerOverflow},
+		{compiler.DIV, int64(math.MinInt64), int64(1), int64(math.MinInt64), nil},
+		{compiler.DIV, int64(1), int64(0), nil, errDivisionByZero},
+		{compiler.MOD, int64(-7), int64(2), int64(-1), nil},
+		{compiler.MOD, int64(math.MinInt64), int64(-1), int64(0), nil},
+		{compiler.MOD, int64(1), int64(0), nil, errDivisionByZero},
+
+		// an int operand is converted when the other is a float
+		{compiler.ADD, int64(1), 2.5, 3.5, nil},
+		{compiler.SUB, 2.5, int64(1), 1.5, nil},
+		{compiler.MUL, int64(3), 0.5, 1.5, nil},
+		{compiler.DIV, int64(7), 2.0, 3.5, nil},
+		{compiler.MOD, 7.5, int64(2), 1.5, nil},
+		{compiler.ADD, int64(math.MaxInt64), 1.0, float64(math.MaxInt64) + 1, nil},
+		{compiler.DIV, 1.0, 0.0, nil, errDivisionByZero},
+		{compiler.DIV, int64(1), 0.0, nil, errDivisionByZero},
+		{compiler.DIV, 1.0, int64(0), nil, errDivisionByZero},
+		{compiler.MOD, 1.5, 0.0, nil, errDivisionByZero},
+	}
+	for _, tt := range tests {
+		vm := NewVM(nil, nil, io.Discard, nil)
+		vm.push(tt.left)
+		vm.push(tt.right)
+		name := compiler.OpcodeToString(tt.opcode)
+
+		err := vm.arithmetic(tt.opcode)
+		if tt.err != nil {
+			if !errors.Is(err, tt.err) {
+				t.Errorf("%s %v %v: error = %v, want %v", name, tt.left, tt.right, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %v %v: %v", name, tt.left, tt.right, err)
+			continue
+		}
+		if got, _ := vm.StackTop(); got != tt.want || len(vm.stack) != 1 {
+			t.Errorf("%s %v %v = %#v, want %#v", name, tt.left, tt.right, got, tt.want)
+		}
+	}
+}
+
+func TestArithmeticTypeError(t *testing.T) {
+	vm := NewVM(nil, nil, io.Discard, nil)
+	vm.push("a")
+	vm.push(int64(1))
+	if err := vm.arithmetic(compiler.ADD); err == nil {
+		t.Error("ADD of a string and an int succeeded")
+	}
+}
+
+func TestOverflowProgram(t *testing.T) {
+	out, err := runFile(t, "overflow.goo")
+	if !errors.Is(err, errIntegerOverflow) {
+		t.Errorf("error = %v, want %v", err, errIntegerOverflow)
+	}
+	if want := "9223372036854775807\n"; out != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+}
@@ -0,0 +1,172 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"teriyake/goo/compiler"
+)
+
+// workerExit is the return address of a call made by a worker of PMAP or
+// PFILTER: Run stops when the call returns, leaving its result on the stack.
+const workerExit = -2
+
+// SetParallelism sets how many goroutines PMAP and PFILTER call their
+// function on. It defaults to runtime.GOMAXPROCS(0).
+func (vm *VM) SetParallelism(n int) {
+	vm.parallelism = n
+}
+
+// lockedWriter serializes the writes of the workers of a pool to a writer
+// that they share.
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (lw lockedWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(p)
+}
+
+// worker returns a VM that runs calls of the program's functions on a
+// goroutine of its own. It has its own stack, locals and calls, and shares
+// the code, globals and natives of vm, which do not change while it runs.
+func (vm *VM) worker(ctx context.Context, out, trace io.Writer) *VM {
+	w := &VM{
+		code:        vm.code,
+		offsetMap:   vm.offsetMap,
+		globals:     vm.globals,
+		globalSlots: vm.globalSlots,
+		functions:   maps.Clone(vm.functions),
+		natives:     vm.natives,
+		pure:        vm.pure,
+		names:       vm.names,
+		params:      vm.params,
+		ctx:         ctx,
+		out:         out,
+		trace:       trace,
+		tasks:       make(map[*task]struct{}),
+		parallel:    true,
+	}
+	w.main = &task{}
+	w.current = w.main
+	return w
+}
+
+// apply calls function with args and returns its result.
+func (vm *VM) apply(function interface{}, args []interface{}) (interface{}, error) {
+	vm.stack = vm.stack[:0]
+	vm.pc = workerExit
+	if err := vm.call(function, args, nil); err != nil {
+		return nil, err
+	}
+	if err := vm.Run(vm.pc + 1); err != nil {
+		return nil, err
+	}
+	return vm.pop()
+}
+
+// sequential are the opcodes that PMAP and PFILTER run as for a function
+// that is not pure.
+var sequential = map[compiler.Opcode]compiler.Opcode{
+	compiler.PMAP:    compiler.MAP,
+	compiler.PFILTER: compiler.FILTER,
+}
+
+// parallelIterate executes PMAP and PFILTER. The function is called for the
+// elements by a pool of workers, and the results are collected in the order
+// of the list. The first call to fail stops the others, and its error is
+// returned. A PMAP or PFILTER inside a worker uses a single worker, running
+// on the goroutine of the one it is in. A function that is not pure is
+// called for one element after the other instead, like MAP and FILTER do.
+func (vm *VM) parallelIterate(opcode compiler.Opcode) error {
+	list, function, err := vm.popListAndFunction(compiler.OpcodeToString(opcode))
+	if err != nil {
+		return err
+	}
+	if !vm.isPure(function) {
+		it := &iteration{opcode: sequential[opcode], function: function, list: list, results: make([]interface{}, 0, len(list))}
+		return vm.iterate(it)
+	}
+	workers := vm.parallelism
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if vm.parallel {
+		workers = 1
+	}
+	workers = max(min(workers, len(list)), 1)
+
+	ctx, cancel := context.WithCancel(vm.ctx)
+	defer cancel()
+	var mu sync.Mutex
+	out := lockedWriter{&mu, vm.out}
+	var trace io.Writer
+	if vm.trace != nil {
+		trace = lockedWriter{&mu, vm.trace}
+	}
+
+	results := make([]interface{}, len(list))
+	var next atomic.Int64
+	var firstErr error
+	var once sync.Once
+	work := func(w *VM) {
+		for ctx.Err() == nil {
+			index := int(next.Add(1)) - 1
+			if index >= len(list) {
+				return
+			}
+			result, err := w.apply(function, list[index:index+1])
+			if err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+				return
+			}
+			results[index] = result
+		}
+	}
+	if workers == 1 {
+		work(vm.worker(ctx, out, trace))
+	} else {
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(w *VM) {
+				defer wg.Done()
+				work(w)
+			}(vm.worker(ctx, out, trace))
+		}
+		wg.Wait()
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := vm.ctx.Err(); err != nil {
+		return err
+	}
+
+	if opcode == compiler.PMAP {
+		vm.push(results)
+		return nil
+	}
+	kept := make([]interface{}, 0, len(list))
+	for i, result := range results {
+		keep, ok := result.(bool)
+		if !ok {
+			return fmt.Errorf("error executing PFILTER: lambda returned %v instead of a bool", result)
+		}
+		if keep {
+			kept = append(kept, list[i])
+		}
+	}
+	vm.push(kept)
+	return nil
+}
@@ -0,0 +1,141 @@
+package vm
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"teriyake/goo/compiler"
+	"testing"
+	"time"
+)
+
+// runParallel runs src like run, with n workers for PMAP and PFILTER.
+func runParallel(t *testing.T, src string, n int, natives *compiler.Registry) (string, error) {
+	t.Helper()
+	code, offsetMap := compile(t, "test.goo", src, natives)
+	var out strings.Builder
+	machine := NewVM(code, offsetMap, &out, nil)
+	machine.SetParallelism(n)
+	if natives != nil {
+		machine.DefineNatives(natives)
+	}
+	err := machine.Run()
+	return out.String(), err
+}
+
+func TestPmapProgram(t *testing.T) {
+	out, err := runFile(t, "pmap.goo")
+	if !errors.Is(err, errDivisionByZero) {
+		t.Errorf("error = %v, want %v", err, errDivisionByZero)
+	}
+	want := "[6765 5 2584 1 610 55 0 4181]\n[6765 5 2584 1 610 55 0 4181]\n[18 15 0]\n" +
+		"[3 6 9 12 15]\n[9 9 45]\n[[1 1 2] [3 5] [8]]\n[a c]\n[]\n"
+	if out != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+}
+
+func TestPmap(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			// the calls for the small elements end long before those for
+			// the large ones, but their results keep their places
+			name: "keeps order",
+			src: `(def fib (n:int):int (if (< n 2) (n) else (+ (fib (- n 1)) (fib (- n 2)))))
+				(print (pmap fib [22 1 20 2 18 3 16 4 0]))
+				(print (pfilter ((n:int) -> (> (fib n) 100)) [22 1 20 2 18 3 16 4 0]))`,
+			want: "[17711 1 6765 1 2584 2 987 3 0]\n[22 20 18 16]\n",
+		},
+		{
+			name: "nested",
+			src: `(def square (n:int):int (* n n))
+				(print (pmap ((row:[int]) -> (pmap square row)) [[1 2 3] [4 5] [6]]))
+				(print (pmap ((row:[int]) -> (reduce ((a:int b:int) -> (+ a b)) 0 (pfilter ((n:int) -> (> n 2)) row))) [[1 2 3] [4 5]]))`,
+			want: "[[1 4 9] [16 25] [36]]\n[3 9]\n",
+		},
+		{
+			name: "one element",
+			src:  `(print (pmap ((n:int) -> (* n 2)) [1])) (print (pfilter ((n:int) -> (> n 0)) [0 -1]))`,
+			want: "[2]\n[]\n",
+		},
+	}
+	for _, tt := range tests {
+		for _, workers := range []int{1, 4} {
+			out, err := runParallel(t, tt.src, workers, nil)
+			if err != nil {
+				t.Errorf("%s, %d workers: %v", tt.name, workers, err)
+				continue
+			}
+			if out != tt.want {
+				t.Errorf("%s, %d workers: output = %q, want %q", tt.name, workers, out, tt.want)
+			}
+		}
+	}
+}
+
+func TestPmapFirstErrorStopsOthers(t *testing.T) {
+	// tick is slow enough that the error of the first element stops the
+	// workers long before they get through the list
+	var calls atomic.Int64
+	natives := compiler.NewRegistry()
+	err := natives.RegisterPure("tick", "(int) -> int", func(args []compiler.Value) (compiler.Value, error) {
+		calls.Add(1)
+		time.Sleep(time.Millisecond)
+		return args[0], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	elements := make([]string, 200)
+	for i := range elements {
+		elements[i] = "1"
+	}
+	elements[0] = "0"
+	src := "(print (pmap ((n:int) -> (/ 100 (tick n))) [" + strings.Join(elements, " ") + "]))"
+
+	out, err := runParallel(t, src, 4, natives)
+	if !errors.Is(err, errDivisionByZero) {
+		t.Fatalf("error = %v, want %v", err, errDivisionByZero)
+	}
+	if out != "" {
+		t.Errorf("output = %q, want none", out)
+	}
+	if n := calls.Load(); n >= int64(len(elements))/2 {
+		t.Errorf("tick was called %d times for %d elements after the first failed", n, len(elements))
+	}
+}
+
+func TestPmapReturnsAnError(t *testing.T) {
+	// every element fails, in a nested pmap too: one of the errors is
+	// returned, wrapped with the position of the call that raised it
+	for _, src := range []string{
+		"(pmap ((n:int) -> (/ 1 n)) [0 0 0 0 0 0 0 0])",
+		"(pmap ((row:[int]) -> (pmap ((n:int) -> (/ 1 n)) row)) [[1 0] [0 1] [0]])",
+	} {
+		_, err := runParallel(t, src, 4, nil)
+		var runtimeErr *RuntimeError
+		if !errors.As(err, &runtimeErr) || !errors.Is(err, errDivisionByZero) {
+			t.Errorf("%s: error = %v, want a division by zero", src, err)
+			continue
+		}
+		if runtimeErr.Pos.Column == 0 {
+			t.Errorf("%s: error %v has no position", src, err)
+		}
+	}
+}
+
+func TestPmapOfImpureFunction(t *testing.T) {
+	// the calls print, so they are made one after the other
+	src := "(print (pmap ((n:int) -> ((print n) (* n 2))) [1 2 3 4 5 6]))"
+	out, err := runParallel(t, src, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "1\n2\n3\n4\n5\n6\n[2 4 6 8 10 12]\n"; out != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+}
@@ -0,0 +1,138 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// task is a thread of goo code: the main program or a function started by
+// SPAWN. The tasks share the VM's globals and functions, and each has its
+// own stack, locals, calls and tries. The state of the running task is kept
+// in the VM's fields, and saved into its task when another task runs.
+//
+// Tasks are scheduled by the VM itself, in the order they become ready, and
+// a running task yields to the next ready one every ctxCheckInterval
+// instructions, so the interleaving of tasks does not depend on the Go
+// scheduler and a program always runs the same way.
+type task struct {
+	stack     []interface{}
+	locals    []interface{}
+	frame     frame
+	callStack []CallStackEntry
+	handlers  []handler
+	// pc is the instruction the task continues with when it runs again.
+	pc int
+	// blocking is what the task waits for while it is blocked, or nil.
+	blocking *blocking
+}
+
+// taskExit is the return address of the function a task was spawned for:
+// the task ends when that function returns.
+const taskExit = -1
+
+var errDeadlock = errors.New("deadlock: all tasks are blocked")
+
+// errParallel is the error for using what is shared between tasks in a
+// function called by PMAP or PFILTER, which runs on a goroutine of its own.
+// Only functions marked pure are called there, and the compiler never marks
+// one using these pure.
+func errParallel(what string) error {
+	return fmt.Errorf("%s cannot be used in a function called by pmap or pfilter", what)
+}
+
+// save stores the state of the running task, which continues at pc.
+func (vm *VM) save(pc int) {
+	t := vm.current
+	t.stack, t.locals, t.frame, t.callStack, t.handlers = vm.stack, vm.locals, vm.frame, vm.callStack, vm.handlers
+	t.pc = pc
+}
+
+// load makes t the running task.
+func (vm *VM) load(t *task) {
+	vm.stack, vm.locals, vm.frame, vm.callStack, vm.handlers = t.stack, t.locals, t.frame, t.callStack, t.handlers
+	vm.current = t
+}
+
+// runNext switches to the next ready task, after the running one has been
+// saved or has ended. If no task is ready, every task is blocked, and the
+// VM returns to the main task to report the deadlock there.
+func (vm *VM) runNext() error {
+	if len(vm.ready) == 0 {
+		vm.load(vm.main)
+		vm.pc = vm.main.pc
+		return errDeadlock
+	}
+	next := vm.ready[0]
+	vm.ready[0] = nil
+	vm.ready = vm.ready[1:]
+	vm.load(next)
+	// the loop increments pc before the next instruction
+	vm.pc = next.pc - 1
+	if vm.trace != nil {
+		fmt.Fprintf(vm.trace, "Switching to task at PC %d, %d tasks ready\n", next.pc, len(vm.ready))
+	}
+	return nil
+}
+
+// yield lets the next ready task run, continuing the running one at the
+// current instruction after the tasks ahead of it.
+func (vm *VM) yield() {
+	vm.save(vm.pc)
+	vm.ready = append(vm.ready, vm.current)
+	// there is a task to run, since the running one is ready
+	_ = vm.runNext()
+}
+
+// park blocks the running task on b at the current instruction and runs the
+// next ready task.
+func (vm *VM) park(b *blocking) error {
+	vm.current.blocking = b
+	vm.save(vm.pc)
+	return vm.runNext()
+}
+
+// spawn starts a task calling callee with args. It runs once the tasks
+// ready before it have had their turn.
+func (vm *VM) spawn(callee interface{}, args []interface{}) error {
+	if vm.parallel {
+		return errParallel("spawn")
+	}
+	fm, err := functionMetadata(callee, len(args))
+	if err != nil {
+		return err
+	}
+	locals := make([]interface{}, max(len(args), fm.LocalCount))
+	copy(locals, args)
+	t := &task{
+		locals:    locals,
+		frame:     frame{upvalues: fm.Upvalues},
+		callStack: []CallStackEntry{{returnAddress: taskExit, function: fm.StartAddress}},
+		pc:        fm.StartAddress,
+	}
+	vm.tasks[t] = struct{}{}
+	vm.ready = append(vm.ready, t)
+	return nil
+}
+
+// exit ends the running task, whose function has returned, and runs the
+// next ready task.
+func (vm *VM) exit() error {
+	delete(vm.tasks, vm.current)
+	return vm.runNext()
+}
+
+// stopTasks abandons the spawned tasks after an error, returning to the
+// main task.
+func (vm *VM) stopTasks() {
+	// waiters of the abandoned tasks on channels are no longer valid
+	for t := range vm.tasks {
+		t.blocking = nil
+	}
+	vm.main.blocking = nil
+	clear(vm.tasks)
+	clear(vm.ready)
+	vm.ready = vm.ready[:0]
+	if vm.current != vm.main {
+		vm.load(vm.main)
+	}
+}
@@ -0,0 +1,424 @@
+package vm
+
+import (
+	"fmt"
+	"sort"
+	"teriyake/goo/compiler"
+	"teriyake/goo/lexer"
+)
+
+// VerifyError reports why Verify rejected an instruction.
+type VerifyError struct {
+	Index  int
+	Opcode compiler.Opcode
+	Pos    lexer.Position
+	Msg    string
+}
+
+func (e *VerifyError) Error() string {
+	s := fmt.Sprintf("invalid bytecode at instruction %d", e.Index)
+	if name := compiler.OpcodeToString(e.Opcode); name != "" {
+		s += " (" + name + ")"
+	}
+	if e.Pos.IsValid() {
+		s += " from " + e.Pos.String()
+	}
+	return s + ": " + e.Msg
+}
+
+// body is the code of the program's top level, a function or a lambda. Each
+// is entered with an empty stack of its own. The program is left at its end,
+// and a function or lambda by a RETURN or TAIL_CALL. Its frame has locals
+// slots and an upvalue for each variable it captures.
+type body struct {
+	what       string
+	start, end int
+	function   bool
+	lambda     bool
+	locals     int
+	upvalues   int
+}
+
+type functionDef struct {
+	name       string
+	paramCount int
+}
+
+type verifier struct {
+	code      []compiler.BytecodeInstruction
+	offsetMap map[int]int
+	bodies    []body
+	owner     []int
+	depth     []int
+	// functions are the definitions of def functions by the index of the
+	// start of their body.
+	functions map[int]functionDef
+}
+
+// Verify checks code before it runs, so that malformed bytecode, such as a
+// corrupted .gooc file, is rejected with an error instead of making the VM
+// misbehave. It checks that every instruction has the operands its opcode
+// needs, that jumps and function and lambda addresses point at instructions
+// of the right body, and that every path through a body finds the values
+// each instruction pops on the stack, reaches each instruction with the
+// same stack depth and leaves a function or lambda with nothing on the stack
+// but its result or the arguments of its tail call.
+func Verify(code []compiler.BytecodeInstruction, offsetMap map[int]int) error {
+	v := &verifier{
+		code:      code,
+		offsetMap: offsetMap,
+		owner:     make([]int, len(code)),
+		depth:     make([]int, len(code)+1),
+		functions: make(map[int]functionDef),
+	}
+	for i := range code {
+		if err := v.checkOperands(i); err != nil {
+			return err
+		}
+	}
+	if err := v.findBodies(); err != nil {
+		return err
+	}
+	for i := range v.depth {
+		v.depth[i] = -1
+	}
+	for b := range v.bodies {
+		if err := v.checkBody(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *verifier) errorf(index int, format string, args ...interface{}) error {
+	err := &VerifyError{Index: index, Msg: fmt.Sprintf(format, args...)}
+	if index < len(v.code) {
+		err.Opcode = v.code[index].Opcode
+		err.Pos = v.code[index].Pos
+	}
+	return err
+}
+
+// checkOperands checks that the operands of instruction i have the types
+// and sizes its opcode needs.
+func (v *verifier) checkOperands(i int) error {
+	operands := v.code[i].Operands
+	var constantType string
+	switch v.code[i].Opcode {
+	case compiler.PUSH_INT:
+		constantType = "int64"
+	case compiler.PUSH_FLOAT:
+		constantType = "float64"
+	case compiler.PUSH_BOOL:
+		constantType = "bool"
+	case compiler.PUSH_STRING:
+		constantType = "string"
+	case compiler.DEFINE_FUNCTION, compiler.CREATE_LAMBDA:
+		if len(operands.Params) != operands.Count {
+			return v.errorf(i, "%d parameter names for %d parameters", len(operands.Params), operands.Count)
+		}
+		if operands.Locals < operands.Count {
+			return v.errorf(i, "%d local slots for %d parameters", operands.Locals, operands.Count)
+		}
+	case compiler.RETURN, compiler.RECV:
+		if operands.Count > 1 {
+			return v.errorf(i, "count %d is not 0 or 1", operands.Count)
+		}
+	}
+	if constantType != "" && fmt.Sprintf("%T", operands.Constant) != constantType {
+		return v.errorf(i, "constant %v is a %T, want %s", operands.Constant, operands.Constant, constantType)
+	}
+	if operands.Count < 0 {
+		return v.errorf(i, "negative count %d", operands.Count)
+	}
+	return nil
+}
+
+// target checks that target is the index of the instruction at a bytecode
+// offset, where the offset just past the last instruction is valid and has
+// the index len(v.code).
+func (v *verifier) target(index, offset, target int, what string) (int, error) {
+	if resolved, ok := v.offsetMap[offset]; !ok || resolved != target || target < 0 || target > len(v.code) {
+		return 0, v.errorf(index, "%s %d is not the offset of an instruction", what, offset)
+	}
+	return target, nil
+}
+
+// findBodies finds the bodies of the program's functions and lambdas, checks
+// that they nest, and records for each instruction the innermost body that
+// contains it.
+func (v *verifier) findBodies() error {
+	v.bodies = []body{{what: "program", start: 0, end: len(v.code)}}
+
+	for i, instruction := range v.code {
+		operands := v.code[i].Operands
+		switch instruction.Opcode {
+		case compiler.DEFINE_FUNCTION:
+			start, err := v.target(i, operands.Address, operands.Target, "function start address")
+			if err != nil {
+				return err
+			}
+			// the body is compiled just before the definition
+			if start >= i {
+				return v.errorf(i, "function %s starts at instruction %d, after its definition", operands.Name, start)
+			}
+			v.bodies = append(v.bodies, body{what: "function " + operands.Name, start: start, end: i, function: true, locals: operands.Locals, upvalues: len(operands.Captures)})
+			if _, ok := v.functions[start]; ok {
+				return v.errorf(i, "function %s starts where another function does", operands.Name)
+			}
+			v.functions[start] = functionDef{name: operands.Name, paramCount: operands.Count}
+		case compiler.CREATE_LAMBDA:
+			start, err := v.target(i, operands.Address, operands.Target, "lambda start address")
+			if err != nil {
+				return err
+			}
+			end, err := v.target(i, operands.End, operands.EndTarget, "lambda end address")
+			if err != nil {
+				return err
+			}
+			if start >= end || end > i {
+				return v.errorf(i, "lambda body from instruction %d to %d is not before the lambda", start, end)
+			}
+			v.bodies = append(v.bodies, body{what: "lambda", start: start, end: end, lambda: true, locals: operands.Locals, upvalues: len(operands.Captures)})
+		}
+	}
+
+	// sorted by start and then by decreasing end, a body can only be inside
+	// the bodies before it
+	order := make([]int, len(v.bodies))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := v.bodies[order[i]], v.bodies[order[j]]
+		if a.start != b.start {
+			return a.start < b.start
+		}
+		return a.end > b.end
+	})
+	var open []int
+	for _, b := range order {
+		current := v.bodies[b]
+		for len(open) > 0 && v.bodies[open[len(open)-1]].end <= current.start {
+			open = open[:len(open)-1]
+		}
+		if len(open) > 0 {
+			if outer := v.bodies[open[len(open)-1]]; current.end > outer.end {
+				return v.errorf(current.start, "%s overlaps %s", current.what, outer.what)
+			}
+		}
+		for i := current.start; i < current.end; i++ {
+			v.owner[i] = b
+		}
+		open = append(open, b)
+	}
+	return nil
+}
+
+// checkBody follows every path through body b, tracking the depth of the
+// stack.
+func (v *verifier) checkBody(b int) error {
+	current := v.bodies[b]
+	type state struct{ index, depth int }
+	work := []state{{current.start, 0}}
+
+	for len(work) > 0 {
+		s := work[len(work)-1]
+		work = work[:len(work)-1]
+		i, depth := s.index, s.depth
+
+		if i == current.end {
+			if current.function || current.lambda {
+				return v.errorf(i-1, "%s ends without RETURN", current.what)
+			}
+			continue
+		}
+		if v.owner[i] != b {
+			return v.errorf(i, "control reaches instruction %d of %s from %s", i, v.bodies[v.owner[i]].what, current.what)
+		}
+		if err := v.checkSlots(i, current); err != nil {
+			return err
+		}
+		if v.depth[i] >= 0 {
+			if v.depth[i] != depth {
+				return v.errorf(i, "stack depth is %d on one path and %d on another", v.depth[i], depth)
+			}
+			continue
+		}
+		v.depth[i] = depth
+
+		pops, pushes, err := v.stackEffect(i)
+		if err != nil {
+			return err
+		}
+		if depth < pops {
+			return v.errorf(i, "needs %d values on the stack, but there are only %d", pops, depth)
+		}
+		next := depth - pops + pushes
+
+		operands := v.code[i].Operands
+		switch v.code[i].Opcode {
+		case compiler.RETURN, compiler.TAIL_CALL:
+			if !current.function && !current.lambda {
+				return v.errorf(i, "%s outside of a function", compiler.OpcodeToString(v.code[i].Opcode))
+			}
+			// the frame is left with exactly its results, or the arguments
+			// of the call that replaces it, on the stack
+			if depth != pops {
+				return v.errorf(i, "%s with %d values on the stack, want %d", compiler.OpcodeToString(v.code[i].Opcode), depth, pops)
+			}
+		case compiler.JUMP:
+			target, err := v.target(i, operands.Address, operands.Target, "jump target")
+			if err != nil {
+				return err
+			}
+			work = append(work, state{target, next})
+		case compiler.JUMP_IF_FALSE:
+			target, err := v.target(i, operands.Address, operands.Target, "jump target")
+			if err != nil {
+				return err
+			}
+			work = append(work, state{target, next}, state{i + 1, next})
+		case compiler.TRY:
+			// the catch starts with the error on the stack
+			target, err := v.target(i, operands.Address, operands.Target, "catch address")
+			if err != nil {
+				return err
+			}
+			if target <= i || target > current.end {
+				return v.errorf(i, "catch address %d is not after the TRY in %s", operands.Address, current.what)
+			}
+			work = append(work, state{target, next + 1}, state{i + 1, next})
+		case compiler.RAISE:
+			// control does not go on after it
+		case compiler.SELECT:
+			// the chosen case continues with the value received, if any
+			for _, selectCase := range operands.Cases {
+				target, err := v.target(i, selectCase.Address, selectCase.Target, selectCase.Kind.String()+" case address")
+				if err != nil {
+					return err
+				}
+				depth := next
+				if selectCase.Kind == compiler.RecvCase {
+					depth++
+				}
+				work = append(work, state{target, depth})
+			}
+		default:
+			work = append(work, state{i + 1, next})
+		}
+	}
+	return nil
+}
+
+// checkSlots checks that the local and upvalue slots that instruction i of
+// body b uses, including those of the variables captured by a function or
+// lambda it creates, are in b's frame.
+func (v *verifier) checkSlots(i int, b body) error {
+	operands := v.code[i].Operands
+	switch v.code[i].Opcode {
+	case compiler.LOAD_LOCAL, compiler.STORE_LOCAL:
+		if operands.Index >= b.locals {
+			return v.errorf(i, "local slot %d of %s is not in its %d slots", operands.Index, operands.Name, b.locals)
+		}
+	case compiler.LOAD_UPVALUE:
+		if operands.Index >= b.upvalues {
+			return v.errorf(i, "upvalue %d of %s is not in its %d upvalues", operands.Index, operands.Name, b.upvalues)
+		}
+	case compiler.DEFINE_FUNCTION, compiler.CREATE_LAMBDA:
+		for _, capture := range operands.Captures {
+			if capture.Local && capture.Index >= b.locals {
+				return v.errorf(i, "captured local slot %d of %s is not in its %d slots", capture.Index, capture.Name, b.locals)
+			}
+			if !capture.Local && capture.Index >= b.upvalues {
+				return v.errorf(i, "captured upvalue %d of %s is not in its %d upvalues", capture.Index, capture.Name, b.upvalues)
+			}
+		}
+	}
+	return nil
+}
+
+// stackEffect returns how many values instruction i pops and pushes.
+func (v *verifier) stackEffect(i int) (pops, pushes int, err error) {
+	operands := v.code[i].Operands
+	switch opcode := v.code[i].Opcode; opcode {
+	case compiler.ADD, compiler.SUB, compiler.MUL, compiler.DIV, compiler.MOD,
+		compiler.GRT, compiler.LESS, compiler.GEQ, compiler.LEQ, compiler.EQ, compiler.NEQ:
+		return 2, 1, nil
+	case compiler.NOT, compiler.TO_INT, compiler.TO_FLOAT, compiler.MESSAGE:
+		return 1, 1, nil
+	case compiler.PUSH_INT, compiler.PUSH_FLOAT, compiler.PUSH_BOOL, compiler.PUSH_STRING,
+		compiler.LOAD_GLOBAL, compiler.LOAD_LOCAL, compiler.LOAD_UPVALUE, compiler.CREATE_LAMBDA:
+		return 0, 1, nil
+	case compiler.DEFINE_GLOBAL, compiler.STORE_LOCAL, compiler.PRINT, compiler.JUMP_IF_FALSE,
+		compiler.RAISE, compiler.POP:
+		return 1, 0, nil
+	case compiler.RETURN:
+		return operands.Count, 0, nil
+	case compiler.DEFINE_FUNCTION, compiler.JUMP, compiler.TRY, compiler.END_TRY:
+		return 0, 0, nil
+	case compiler.CALL_FUNCTION:
+		def, err := v.function(i)
+		if err != nil {
+			return 0, 0, err
+		}
+		return def.paramCount, 1, nil
+	case compiler.TAIL_CALL:
+		def, err := v.function(i)
+		if err != nil {
+			return 0, 0, err
+		}
+		return def.paramCount, 0, nil
+	case compiler.LOAD_FUNCTION:
+		if _, err := v.function(i); err != nil {
+			return 0, 0, err
+		}
+		return 0, 1, nil
+	case compiler.CALL_NATIVE, compiler.BUILD_LIST:
+		return operands.Count, 1, nil
+	case compiler.CALL_LAMBDA:
+		return operands.Count + 1, 1, nil
+	case compiler.MAP, compiler.FILTER, compiler.PMAP, compiler.PFILTER:
+		return 2, 1, nil
+	case compiler.REDUCE:
+		return 3, 1, nil
+	case compiler.SPAWN:
+		return operands.Count + 1, 0, nil
+	case compiler.MAKE_CHANNEL:
+		return 1, 1, nil
+	case compiler.SEND:
+		return 2, 0, nil
+	case compiler.RECV:
+		return operands.Count + 1, 1, nil
+	case compiler.CLOSE:
+		return 1, 0, nil
+	case compiler.SELECT:
+		// what each case pushes is added where it continues
+		for _, selectCase := range operands.Cases {
+			switch selectCase.Kind {
+			case compiler.RecvCase:
+				pops++
+			case compiler.SendCase:
+				pops += 2
+			}
+		}
+		return pops, 0, nil
+	default:
+		return 0, 0, v.errorf(i, "unknown opcode %d", opcode)
+	}
+}
+
+// function returns the definition that instruction i, a call of or a
+// reference to a def function, records the start of.
+func (v *verifier) function(i int) (functionDef, error) {
+	operands := v.code[i].Operands
+	start, err := v.target(i, operands.Address, operands.Target, "function start address")
+	if err != nil {
+		return functionDef{}, err
+	}
+	def, ok := v.functions[start]
+	if !ok || def.name != operands.Name {
+		return functionDef{}, v.errorf(i, "instruction %d is not the start of a definition of function %s", start, operands.Name)
+	}
+	return def, nil
+}
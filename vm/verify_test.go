@@ -0,0 +1,160 @@
+package vm
+
+import (
+	"io"
+	"strings"
+	"teriyake/goo/compiler"
+	"testing"
+)
+
+// find returns the index of the first instruction with opcode and, if name
+// is not empty, that name.
+func find(t *testing.T, code []compiler.BytecodeInstruction, opcode compiler.Opcode, name string) int {
+	t.Helper()
+	for i, instruction := range code {
+		if instruction.Opcode == opcode && (name == "" || instruction.Operands.Name == name) {
+			return i
+		}
+	}
+	t.Fatalf("no %s %s instruction", compiler.OpcodeToString(opcode), name)
+	return -1
+}
+
+func TestVerifyRedefinedFunction(t *testing.T) {
+	// each call passes the arguments of the definition it was compiled
+	// against, whichever definition comes last
+	src := `(def f (x:int):int x)
+(def one ():int (f 1))
+(def f (x:int y:int):int (+ x y))
+(print (f 1 2))
+(def two ():int (f 3 4))
+(print two)`
+	out, err := run(t, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "3\n7\n" {
+		t.Errorf("output = %q, want %q", out, "3\n7\n")
+	}
+
+	// one still calls f with one argument, which the definition that
+	// replaced its f does not take
+	_, err = run(t, src+"\n(print one)")
+	if err == nil || !strings.Contains(err.Error(), "function f expects 2 arguments, got 1") {
+		t.Errorf("error = %v, want f to expect 2 arguments", err)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	src := `(def f (x:int):int x)
+(def g (x:int y:int):int (+ x y))
+(def h (x:int):int (f (- x 1)))
+(print (try (f (g 1 2)) (catch e 0)))
+(print (map ((x:int) -> (* x 2)) [1]))`
+	tests := []struct {
+		name   string
+		tamper func(code []compiler.BytecodeInstruction)
+		err    string
+	}{
+		{
+			name: "call of another function's definition",
+			tamper: func(code []compiler.BytecodeInstruction) {
+				call := &code[find(t, code, compiler.CALL_FUNCTION, "f")].Operands
+				def := code[find(t, code, compiler.DEFINE_FUNCTION, "g")].Operands
+				call.Address, call.Target = def.Address, def.Target
+			},
+			err: "is not the start of a definition of function f",
+		},
+		{
+			name: "call of an instruction that starts no function",
+			tamper: func(code []compiler.BytecodeInstruction) {
+				call := &code[find(t, code, compiler.CALL_FUNCTION, "g")].Operands
+				call.Address, call.Target = code[0].Offset, 0
+			},
+			err: "instruction 0 is not the start of a definition of function g",
+		},
+		{
+			name: "jump into a function",
+			tamper: func(code []compiler.BytecodeInstruction) {
+				jump := &code[find(t, code, compiler.JUMP, "")].Operands
+				jump.Address, jump.Target = code[1].Offset, 1
+			},
+			err: "control reaches instruction 1 of function f from program",
+		},
+		{
+			name: "catch before its try",
+			tamper: func(code []compiler.BytecodeInstruction) {
+				try := &code[find(t, code, compiler.TRY, "")].Operands
+				start := find(t, code, compiler.DEFINE_FUNCTION, "g") + 1
+				try.Address, try.Target = code[start].Offset, start
+			},
+			err: "is not after the TRY",
+		},
+		{
+			name: "catch past the end of the code",
+			tamper: func(code []compiler.BytecodeInstruction) {
+				code[find(t, code, compiler.TRY, "")].Operands.Target = len(code) + 1
+			},
+			err: "catch address",
+		},
+		{
+			name: "unknown opcode",
+			tamper: func(code []compiler.BytecodeInstruction) {
+				code[find(t, code, compiler.PRINT, "")].Opcode = 200
+			},
+			err: "unknown opcode 200",
+		},
+		{
+			name: "wrong constant",
+			tamper: func(code []compiler.BytecodeInstruction) {
+				code[find(t, code, compiler.PUSH_INT, "")].Operands.Constant = "1"
+			},
+			err: "constant 1 is a string, want int64",
+		},
+		{
+			name: "stack underflow",
+			tamper: func(code []compiler.BytecodeInstruction) {
+				push := &code[find(t, code, compiler.PUSH_INT, "")]
+				push.Opcode, push.Operands = compiler.ADD, compiler.Operands{}
+			},
+			err: "needs 2 values on the stack",
+		},
+		{
+			name: "return with extra values on the stack",
+			tamper: func(code []compiler.BytecodeInstruction) {
+				add := &code[find(t, code, compiler.ADD, "")]
+				add.Opcode, add.Operands = compiler.LOAD_LOCAL, compiler.Operands{Name: "y", Index: 1}
+			},
+			err: "RETURN with 3 values on the stack, want 1",
+		},
+		{
+			name: "tail call with extra values on the stack",
+			tamper: func(code []compiler.BytecodeInstruction) {
+				sub := &code[find(t, code, compiler.SUB, "")]
+				sub.Opcode, sub.Operands = compiler.LOAD_LOCAL, compiler.Operands{Name: "x"}
+			},
+			err: "TAIL_CALL with 3 values on the stack, want 1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, offsetMap := compile(t, "test.goo", src, nil)
+			tt.tamper(code)
+			err := Verify(code, offsetMap)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error = %v, want one containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestTryChecksCatchAddress(t *testing.T) {
+	// unverified code with a catch past its end fails at TRY rather than
+	// jumping there when an error is caught
+	code, offsetMap := compile(t, "test.goo", "(print (try (/ 1 0) (catch e 0)))", nil)
+	code[find(t, code, compiler.TRY, "")].Operands.Target = len(code) + 5
+	err := NewVM(code, offsetMap, io.Discard, nil).Run()
+	if err == nil || !strings.Contains(err.Error(), "Invalid catch address") {
+		t.Errorf("error = %v, want an invalid catch address", err)
+	}
+}
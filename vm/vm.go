@@ -1,62 +1,61 @@
 package vm
 
 import (
-	"encoding/binary"
+	"context"
+	"errors"
 	"fmt"
-	"math"
+	"io"
 	"strings"
 	"teriyake/goo/compiler"
+	"teriyake/goo/lexer"
 )
 
-type RuntimeSymbolTable struct {
-	symbols map[string]interface{}
-	parent  *RuntimeSymbolTable
+// RuntimeError is an error that stopped a program, raised at Pos. Trace
+// holds the calls that were in progress, innermost first, and is shown
+// after the error unless it failed at the top level of the program.
+type RuntimeError struct {
+	Pos   lexer.Position
+	Err   error
+	Trace []Frame
 }
 
-func NewRuntimeSymbolTable(parent *RuntimeSymbolTable) *RuntimeSymbolTable {
-	return &RuntimeSymbolTable{
-		symbols: make(map[string]interface{}),
-		parent:  parent,
+func (e *RuntimeError) Error() string {
+	msg := e.Err.Error()
+	if gooErr, ok := e.Err.(*Error); ok {
+		msg = gooErr.Message
 	}
-}
-
-func (rst *RuntimeSymbolTable) Print(indent string) {
-	if rst == nil {
-		fmt.Println(indent + "Symbol Table: nil")
-		return
+	var b strings.Builder
+	if e.Pos.IsValid() {
+		fmt.Fprintf(&b, "%s: ", e.Pos)
 	}
-
-	fmt.Println(indent + "Symbol Table:")
-	for name, value := range rst.symbols {
-		fmt.Printf("%s  %s: %v\n", indent, name, value)
+	b.WriteString(msg)
+	if len(e.Trace) == 0 || e.Trace[0].Function == "" {
+		return b.String()
 	}
-
-	if rst.parent != nil {
-		fmt.Println(indent + "Parent:")
-		rst.parent.Print(indent + "  ")
+	for _, frame := range e.Trace {
+		if frame.Function == "" {
+			fmt.Fprintf(&b, "\n\tat %s", frame.Pos)
+		} else {
+			fmt.Fprintf(&b, "\n\tin %s at %s", frame.Function, frame.Pos)
+		}
 	}
+	return b.String()
 }
 
-func (rst *RuntimeSymbolTable) Set(name string, value interface{}) {
-	rst.symbols[name] = value
-}
-
-func (rst *RuntimeSymbolTable) Get(name string) (interface{}, bool) {
-	value, exists := rst.symbols[name]
-	if !exists && rst.parent != nil {
-		value, exists = rst.parent.Get(name)
-	}
-	return value, exists
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
 }
 
 type FunctionMetadata struct {
 	StartAddress int
 	ParamCount   int
 	ParamNames   []string
+	LocalCount   int
+	Upvalues     []interface{}
 }
 
-func (fm FunctionMetadata) Print() {
-	fmt.Printf("FunctionMetadata - Start Address: %d, Param Count: %d, Param Names: %v\n", fm.StartAddress, fm.ParamCount, fm.ParamNames)
+func (fm FunctionMetadata) Print(w io.Writer) {
+	fmt.Fprintf(w, "FunctionMetadata - Start Address: %d, Param Count: %d, Param Names: %v, Local Count: %d, Upvalues: %v\n", fm.StartAddress, fm.ParamCount, fm.ParamNames, fm.LocalCount, fm.Upvalues)
 }
 
 type LambdaFunction struct {
@@ -64,138 +63,332 @@ type LambdaFunction struct {
 	EndAddress   int
 	ParamCount   int
 	ParamNames   []string
+	LocalCount   int
 	CapturedVars []string
-	SymbolTable  *RuntimeSymbolTable
+	// Upvalues are the values of CapturedVars when the lambda was created.
+	Upvalues []interface{}
 }
 
-func NewLambdaFunction(startAddress, endAddress, paramCount int, paramNames []string, capturedVars []string, symbolTable *RuntimeSymbolTable) *LambdaFunction {
+func NewLambdaFunction(startAddress, endAddress, paramCount int, paramNames []string, localCount int, capturedVars []string, upvalues []interface{}) *LambdaFunction {
 	return &LambdaFunction{
 		StartAddress: startAddress,
 		EndAddress:   endAddress,
 		ParamCount:   paramCount,
 		ParamNames:   paramNames,
+		LocalCount:   localCount,
 		CapturedVars: capturedVars,
-		SymbolTable:  symbolTable,
+		Upvalues:     upvalues,
 	}
 }
 
-func (lf *LambdaFunction) Print(indent string) {
-	fmt.Printf("%sLambdaFunction:\n", indent)
-	fmt.Printf("%s  Start Address: %d\n", indent, lf.StartAddress)
-	fmt.Printf("%s  End Address: %d\n", indent, lf.EndAddress)
-	fmt.Printf("%s  Param Count: %d\n", indent, lf.ParamCount)
-	fmt.Printf("%s  Param Names: %d\n", indent, lf.ParamNames)
-	fmt.Printf("%s  Captured Vars: %v\n", indent, lf.CapturedVars)
-	fmt.Printf("%s  SymbolTable:\n", indent)
-	lf.SymbolTable.Print(indent + "    ")
+func (lf *LambdaFunction) Print(w io.Writer, indent string) {
+	fmt.Fprintf(w, "%sLambdaFunction:\n", indent)
+	fmt.Fprintf(w, "%s  Start Address: %d\n", indent, lf.StartAddress)
+	fmt.Fprintf(w, "%s  End Address: %d\n", indent, lf.EndAddress)
+	fmt.Fprintf(w, "%s  Param Count: %d\n", indent, lf.ParamCount)
+	fmt.Fprintf(w, "%s  Param Names: %v\n", indent, lf.ParamNames)
+	fmt.Fprintf(w, "%s  Local Count: %d\n", indent, lf.LocalCount)
+	fmt.Fprintf(w, "%s  Captured Vars: %v\n", indent, lf.CapturedVars)
+	fmt.Fprintf(w, "%s  Upvalues: %v\n", indent, lf.Upvalues)
+}
+
+// Function is a def function used as a value.
+type Function struct {
+	Name string
+	FunctionMetadata
+}
+
+// frame locates the variables of a running function or lambda: its locals
+// start at base in the VM's locals, and upvalues holds what it captured.
+// stack is the height of the operand stack when it was called, without its
+// arguments, to which RETURN brings the stack back.
+type frame struct {
+	base     int
+	stack    int
+	upvalues []interface{}
+}
+
+// CallStackEntry is a call of a function or lambda in progress: where it
+// returns to, the frame of its caller, and for a call made by MAP, FILTER or
+// REDUCE, the iteration to continue when it returns.
+type CallStackEntry struct {
+	returnAddress int
+	frame         frame
+	iteration     *iteration
+	// function is the start of the function or lambda called, for stack
+	// traces.
+	function int
+	// memo is the key under which the result of the call is remembered, or
+	// nil.
+	memo *memoKey
+}
+
+func (cse CallStackEntry) Print(w io.Writer) {
+	fmt.Fprintf(w, "CallStackEntry - Return Address: %d, Frame Base: %d, Upvalues: %v\n", cse.returnAddress, cse.frame.base, cse.frame.upvalues)
+}
+
+type VM struct {
+	stack     []interface{}
+	pc        int
+	code      []compiler.BytecodeInstruction
+	offsetMap map[int]int
+	// globals holds the global variables by slot, with globalSlots mapping
+	// their names to slots, and locals the local variables of every active
+	// frame, the current one being frame.
+	globals     []interface{}
+	globalSlots map[string]int
+	locals      []interface{}
+	frame       frame
+	functions   map[string]FunctionMetadata
+	natives     *compiler.Registry
+	callStack   []CallStackEntry
+	ctx         context.Context
+	steps       int
+	out         io.Writer
+	trace       io.Writer
+	// current is the running task, main the task of the program itself,
+	// ready the tasks waiting for their turn to run and tasks the spawned
+	// tasks that have not ended.
+	current *task
+	main    *task
+	ready   []*task
+	tasks   map[*task]struct{}
+	// parallelism is how many goroutines PMAP and PFILTER use, or 0 for
+	// GOMAXPROCS, and parallel is set for the VMs of those goroutines.
+	parallelism int
+	parallel    bool
+	// pure holds the start of every function and lambda that the compiler
+	// found to be pure, and memo the remembered results of calls of pure
+	// functions, or nil unless SetMemoize turned that on.
+	pure map[int]bool
+	memo map[memoKey]interface{}
+	// names and params hold the name and parameter count of every def
+	// function by its start, and handlers those of the tries the running
+	// task is in.
+	names    map[int]string
+	params   map[int]int
+	handlers []handler
+}
+
+// iteration is the progress of MAP, FILTER or REDUCE through its list. Its
+// function is called for one element at a time, each call returning to the
+// instruction, which then calls it for the next element.
+type iteration struct {
+	opcode      compiler.Opcode
+	function    interface{}
+	list        []interface{}
+	index       int
+	results     []interface{}
+	accumulator interface{}
+	args        [2]interface{}
 }
 
-func (lf *LambdaFunction) Call(vm *VM, args []interface{}) (interface{}, error) {
-	if len(args) != lf.ParamCount {
-		return nil, fmt.Errorf("lambda function expects %d arguments, got %d", lf.ParamCount, len(args))
+// next returns the arguments of the call for the next element, or false if
+// the list is done.
+func (it *iteration) next() ([]interface{}, bool) {
+	if it.index >= len(it.list) {
+		return nil, false
+	}
+	element := it.list[it.index]
+	it.index++
+	if it.opcode == compiler.REDUCE {
+		it.args[0], it.args[1] = it.accumulator, element
+		return it.args[:2], true
 	}
+	it.args[0] = element
+	return it.args[:1], true
+}
 
-	lambdaSymbolTable := NewRuntimeSymbolTable(lf.SymbolTable)
-	for i, paramName := range lf.CapturedVars {
-		lambdaSymbolTable.Set(paramName, args[i])
+// collect records what the call for the last element returned.
+func (it *iteration) collect(result interface{}) error {
+	switch it.opcode {
+	case compiler.MAP:
+		it.results = append(it.results, result)
+	case compiler.FILTER:
+		keep, ok := result.(bool)
+		if !ok {
+			return fmt.Errorf("error executing FILTER: lambda returned %v instead of a bool", result)
+		}
+		if keep {
+			it.results = append(it.results, it.list[it.index-1])
+		}
+	case compiler.REDUCE:
+		it.accumulator = result
 	}
+	return nil
+}
 
-	savedPC := vm.pc
-	//savedSymbolTable := vm.symbolTableStack[len(vm.symbolTableStack)-1]
+func (it *iteration) result() interface{} {
+	if it.opcode == compiler.REDUCE {
+		return it.accumulator
+	}
+	return it.results
+}
 
-	vm.symbolTableStack = append(vm.symbolTableStack, lambdaSymbolTable)
-	err := vm.Run(lf.StartAddress)
-	if err != nil {
-		return nil, err
+// ctxCheckInterval is how many instructions run between checks for
+// cancellation of the VM's context, and how many a task runs before it
+// yields to the next ready task.
+const ctxCheckInterval = 1024
+
+// NewVM creates a VM for code. Program output is written to out, or discarded
+// if out is nil. If trace is not nil, a trace of the execution is written to
+// it.
+func NewVM(code []compiler.BytecodeInstruction, offsetMap map[int]int, out, trace io.Writer) *VM {
+	if out == nil {
+		out = io.Discard
 	}
+	vm := &VM{
+		stack:       make([]interface{}, 0),
+		pc:          0,
+		code:        code,
+		offsetMap:   offsetMap,
+		globalSlots: make(map[string]int),
+		functions:   make(map[string]FunctionMetadata),
+		natives:     compiler.NewRegistry(),
+		callStack:   make([]CallStackEntry, 0),
+		tasks:       make(map[*task]struct{}),
+		ctx:         context.Background(),
+		out:         out,
+		trace:       trace,
+	}
+	vm.main = &task{}
+	vm.current = vm.main
+	vm.indexGlobals()
+	vm.indexFunctions()
+	return vm
+}
 
-	vm.pc = savedPC
-	vm.symbolTableStack = vm.symbolTableStack[:len(vm.symbolTableStack)-1]
+// indexGlobals records the slots of the global variables that the code
+// refers to, so that SetGlobal and Globals can find them by name.
+func (vm *VM) indexGlobals() {
+	for i := range vm.code {
+		instruction := &vm.code[i]
+		if instruction.Opcode != compiler.LOAD_GLOBAL && instruction.Opcode != compiler.DEFINE_GLOBAL {
+			continue
+		}
+		vm.globalSlots[instruction.Operands.Name] = instruction.Operands.Index
+		vm.growGlobals(instruction.Operands.Index)
+	}
+}
 
-	if len(vm.stack) == 0 {
-		return nil, fmt.Errorf("lambda function did not return a value")
+// indexFunctions records the name of every def function, for stack traces,
+// its parameter count, for the calls of a function that is redefined, and
+// which functions and lambdas are pure. The compiler can find a function
+// impure after its definition, when a function it calls is redefined, so
+// Continue records them again.
+func (vm *VM) indexFunctions() {
+	vm.names = make(map[int]string)
+	vm.params = make(map[int]int)
+	vm.pure = make(map[int]bool)
+	for i := range vm.code {
+		ops := &vm.code[i].Operands
+		switch vm.code[i].Opcode {
+		case compiler.DEFINE_FUNCTION:
+			vm.names[ops.Target] = ops.Name
+			vm.params[ops.Target] = ops.Count
+			vm.pure[ops.Target] = ops.Pure
+		case compiler.CREATE_LAMBDA:
+			vm.pure[ops.Target] = ops.Pure
+		}
 	}
-	result := vm.stack[len(vm.stack)-1]
-	vm.stack = vm.stack[:len(vm.stack)-1]
+}
 
-	return result, nil
+// growGlobals makes room for the global variable in slot.
+func (vm *VM) growGlobals(slot int) {
+	for len(vm.globals) <= slot {
+		vm.globals = append(vm.globals, nil)
+	}
 }
 
-type CallStackEntry struct {
-	returnAddress int
-	symbolTable   *RuntimeSymbolTable
+// SetGlobal defines a global variable before the program runs.
+func (vm *VM) SetGlobal(name string, value interface{}) {
+	slot, ok := vm.globalSlots[name]
+	if !ok {
+		slot = len(vm.globals)
+		vm.globalSlots[name] = slot
+	}
+	vm.growGlobals(slot)
+	vm.globals[slot] = value
 }
 
-func (cse CallStackEntry) Print() {
-	fmt.Printf("CallStackEntry - Return Address: %d\n", cse.returnAddress)
-	fmt.Println("Symbol Table at this level:")
-	cse.symbolTable.Print("  ")
+// DefineNatives makes the native functions in r available to CALL_NATIVE. It
+// must be the registry the program was compiled with.
+func (vm *VM) DefineNatives(r *compiler.Registry) {
+	vm.natives = r
 }
 
-type VM struct {
-	stack            []interface{}
-	pc               int
-	code             []compiler.BytecodeInstruction
-	offsetMap        map[int]int
-	symbolTableStack []*RuntimeSymbolTable
-	functions        map[string]FunctionMetadata
-	callStack        []CallStackEntry
-	debugMode        *bool
+// RunContext runs the program like Run, stopping with ctx's error if ctx is
+// cancelled first.
+func (vm *VM) RunContext(ctx context.Context) error {
+	vm.ctx = ctx
+	defer func() { vm.ctx = context.Background() }()
+	return vm.Run()
 }
 
-func NewVM(code []compiler.BytecodeInstruction, offsetMap map[int]int, d *bool) *VM {
-	globalSymbolTable := NewRuntimeSymbolTable(nil)
-	return &VM{
-		stack:            make([]interface{}, 0),
-		pc:               0,
-		code:             code,
-		offsetMap:        offsetMap,
-		symbolTableStack: []*RuntimeSymbolTable{globalSymbolTable},
-		functions:        make(map[string]FunctionMetadata),
-		callStack:        make([]CallStackEntry, 0),
-		debugMode:        d,
+// Continue replaces the VM's code with code, which must keep the
+// instructions before start that the VM has already run, and runs it from
+// start. Globals and functions defined by earlier code stay defined. If the
+// new code fails, the VM is returned to the top level so that it can continue
+// with other code.
+func (vm *VM) Continue(code []compiler.BytecodeInstruction, offsetMap map[int]int, start int) error {
+	vm.code = code
+	vm.offsetMap = offsetMap
+	vm.stack = vm.stack[:0]
+	vm.indexGlobals()
+	vm.indexFunctions()
+
+	return vm.Run(start)
+}
+
+// Globals returns the values of the global variables.
+func (vm *VM) Globals() map[string]interface{} {
+	globals := make(map[string]interface{})
+	for name, slot := range vm.globalSlots {
+		if value := vm.globals[slot]; value != nil {
+			globals[name] = value
+		}
 	}
+	return globals
 }
 
-func (vm *VM) Print() {
-	fmt.Println("VM State:")
-	fmt.Printf("  Program Counter: %d\n", vm.pc)
-	fmt.Printf("  Stack: %v\n", vm.stack)
+// StackTop returns the value on top of the stack, which after Run is the
+// value of the program's last expression if it has one.
+func (vm *VM) StackTop() (interface{}, bool) {
+	if len(vm.stack) == 0 {
+		return nil, false
+	}
+	return vm.stack[len(vm.stack)-1], true
+}
+
+func (vm *VM) Print(w io.Writer) {
+	fmt.Fprintln(w, "VM State:")
+	fmt.Fprintf(w, "  Program Counter: %d\n", vm.pc)
+	fmt.Fprintf(w, "  Stack: %v\n", vm.stack)
 
-	fmt.Println("  Symbol Table Stack:")
-	for _, st := range vm.symbolTableStack {
-		st.Print("    ")
+	fmt.Fprintln(w, "  Globals:")
+	for name, value := range vm.Globals() {
+		fmt.Fprintf(w, "    %s: %v\n", name, value)
 	}
+	fmt.Fprintf(w, "  Locals: %v\n", vm.locals[vm.frame.base:])
+	fmt.Fprintf(w, "  Upvalues: %v\n", vm.frame.upvalues)
+	fmt.Fprintf(w, "  Tasks: %d spawned, %d ready\n", len(vm.tasks), len(vm.ready))
 
-	fmt.Println("  Function Metadata:")
+	fmt.Fprintln(w, "  Function Metadata:")
 	for name, fm := range vm.functions {
-		fmt.Printf("    %s: ", name)
-		fm.Print()
+		fmt.Fprintf(w, "    %s: ", name)
+		fm.Print(w)
 	}
 
-	fmt.Println("  Call Stack:")
+	fmt.Fprintln(w, "  Call Stack:")
 	if len(vm.callStack) == 0 {
-		fmt.Println("    EMPTY")
+		fmt.Fprintln(w, "    EMPTY")
 	} else {
 		for _, cse := range vm.callStack {
-			cse.Print()
+			cse.Print(w)
 		}
 	}
 }
 
-func (vm *VM) ResolveParamName(funcName string, index int) (string, error) {
-	funcMetadata, exists := vm.functions[funcName]
-	if !exists {
-		return "", fmt.Errorf("function %s not found", funcName)
-	}
-
-	if index < 0 || index >= len(funcMetadata.ParamNames) {
-		return "", fmt.Errorf("parameter index out of range for function %s", funcName)
-	}
-
-	return funcMetadata.ParamNames[index], nil
-}
-
 func (vm *VM) push(value interface{}) {
 	vm.stack = append(vm.stack, value)
 }
@@ -213,7 +406,30 @@ func (vm *VM) pop() (interface{}, error) {
 	return topElement, nil
 }
 
-func (vm *VM) Run(optionalStartEndAddress ...int) error {
+// runtimeError reports err, which the running task did not catch, with the
+// calls in progress. An error from a worker of PMAP or PFILTER already has
+// the worker's calls, which continue with those of the task.
+func (vm *VM) runtimeError(err error) error {
+	var runtimeErr *RuntimeError
+	if errors.As(err, &runtimeErr) {
+		trace := append(runtimeErr.Trace[:len(runtimeErr.Trace):len(runtimeErr.Trace)], vm.stackTrace()...)
+		return &RuntimeError{Pos: runtimeErr.Pos, Err: runtimeErr.Err, Trace: trace}
+	}
+	pos := vm.position(vm.pc)
+	if gooErr, ok := err.(*Error); ok {
+		pos = gooErr.Pos
+	}
+	return &RuntimeError{Pos: pos, Err: err, Trace: vm.stackTrace()}
+}
+
+func (vm *VM) Run(optionalStartEndAddress ...int) (err error) {
+	defer func() {
+		if err != nil {
+			err = vm.runtimeError(err)
+			vm.unwind()
+		}
+	}()
+
 	start := 0
 	end := len(vm.code)
 	if len(optionalStartEndAddress) == 2 {
@@ -223,758 +439,710 @@ func (vm *VM) Run(optionalStartEndAddress ...int) error {
 		start = optionalStartEndAddress[0]
 	}
 
+	for {
+		err := vm.run(start, end)
+		if err == nil || !vm.catch(err) {
+			return err
+		}
+		start = vm.pc
+	}
+}
+
+// run executes the instructions from start until end is reached or one of
+// them fails.
+func (vm *VM) run(start, end int) error {
 	for vm.pc = start; vm.pc < end; vm.pc++ {
-		instruction := vm.code[vm.pc]
-		if *vm.debugMode {
-			fmt.Printf("Executing Instruction at PC %v: Opcode %d, Operands %v\n", vm.pc, instruction.Opcode, instruction.Operands)
-			vm.Print()
+		vm.steps++
+		if vm.steps%ctxCheckInterval == 0 {
+			if err := vm.ctx.Err(); err != nil {
+				return err
+			}
+			if len(vm.ready) > 0 {
+				vm.yield()
+				continue
+			}
+		}
+
+		instruction := &vm.code[vm.pc]
+		if vm.trace != nil {
+			fmt.Fprintf(vm.trace, "Executing Instruction at PC %v: Opcode %d, Operands %v\n", vm.pc, instruction.Opcode, instruction.Operands)
+			vm.Print(vm.trace)
 		}
 
 		switch instruction.Opcode {
-		case compiler.PUSH_NUMBER:
-			if len(instruction.Operands) < 1 {
-				return fmt.Errorf("PUSH_NUMBER instruction requires an operand")
+		case compiler.PUSH_INT, compiler.PUSH_FLOAT, compiler.PUSH_BOOL, compiler.PUSH_STRING:
+			vm.stack = append(vm.stack, instruction.Operands.Constant)
+			if vm.trace != nil {
+				fmt.Fprintf(vm.trace, "Stack after %s: %v\n", compiler.OpcodeToString(instruction.Opcode), vm.stack)
 			}
-			operandBytes, ok := instruction.Operands[0].([]byte)
-			if !ok || len(operandBytes) != 8 {
-				return fmt.Errorf("Invalid operand for PUSH_NUMBER instruction")
+		case compiler.ADD, compiler.SUB, compiler.MUL, compiler.DIV, compiler.MOD:
+			if err := vm.arithmetic(instruction.Opcode); err != nil {
+				return err
 			}
-			bits := binary.LittleEndian.Uint64(operandBytes)
-			floatValue := math.Float64frombits(bits)
-			vm.stack = append(vm.stack, floatValue)
-			if *vm.debugMode {
-				fmt.Printf("Stack after PUSH_NUMBER: %v\n", vm.stack)
+			if vm.trace != nil {
+				fmt.Fprintf(vm.trace, "Stack after %s: %v\n", compiler.OpcodeToString(instruction.Opcode), vm.stack)
 			}
-		case compiler.PUSH_BOOL:
-			if len(instruction.Operands) < 1 {
-				return fmt.Errorf("PUSH_BOOL instruction requires an operand")
+		case compiler.GRT, compiler.LESS, compiler.GEQ, compiler.LEQ:
+			if err := vm.compare(instruction.Opcode); err != nil {
+				return err
 			}
-			operandByte, ok := instruction.Operands[0].(byte)
-			if !ok {
-				return fmt.Errorf("Invalid operand for PUSH_BOOL instruction")
-			}
-			boolValue := operandByte != 0
-			vm.stack = append(vm.stack, boolValue)
-			if *vm.debugMode {
-				fmt.Printf("Stack after PUSH_BOOL: %v\n", vm.stack)
-			}
-		case compiler.PUSH_STRING:
-			strLenBytes, ok := instruction.Operands[0].([]byte)
-			if !ok || len(strLenBytes) != 4 {
-				return fmt.Errorf("Invalid or missing length for string in PUSH_STRING instruction")
-			}
-			strLen := int(binary.LittleEndian.Uint32(strLenBytes))
-
-			strBytes, ok := instruction.Operands[1].([]byte)
-			if !ok || len(strBytes) != strLen {
-				return fmt.Errorf("Invalid or missing string in PUSH_STRING instruction")
-			}
-			strVal := string(strBytes)
-			vm.stack = append(vm.stack, strVal)
-			if *vm.debugMode {
-				fmt.Printf("Stack after PUSH_STRING: %v\n", vm.stack)
-			}
-		case compiler.ADD:
-			if len(vm.stack) < 2 {
-				return fmt.Errorf("ADD instruction requires at least 2 values on the stack")
-			}
-			operand2, ok1 := vm.stack[len(vm.stack)-1].(float64)
-			operand1, ok2 := vm.stack[len(vm.stack)-2].(float64)
-			if !ok1 || !ok2 {
-				return fmt.Errorf("ADD instruction requires float operands")
-			}
-			result := operand1 + operand2
-			vm.stack = vm.stack[:len(vm.stack)-2]
-			vm.stack = append(vm.stack, result)
-			if *vm.debugMode {
-				fmt.Printf("Stack after ADD: %v\n", vm.stack)
-			}
-		case compiler.SUB:
-			if len(vm.stack) < 2 {
-				return fmt.Errorf("SUB instruction requires at least 2 values on the stack")
-			}
-			operand2, ok1 := vm.stack[len(vm.stack)-1].(float64)
-			operand1, ok2 := vm.stack[len(vm.stack)-2].(float64)
-			if !ok1 || !ok2 {
-				return fmt.Errorf("SUB instruction requires float operands")
-			}
-			result := operand1 - operand2
-			vm.stack = vm.stack[:len(vm.stack)-2]
-			vm.stack = append(vm.stack, result)
-			if *vm.debugMode {
-				fmt.Printf("Stack after SUB: %v\n", vm.stack)
-			}
-		case compiler.MUL:
-			if len(vm.stack) < 2 {
-				return fmt.Errorf("MUL instruction requires at least 2 values on the stack")
-			}
-			operand2, ok1 := vm.stack[len(vm.stack)-1].(float64)
-			operand1, ok2 := vm.stack[len(vm.stack)-2].(float64)
-			if !ok1 || !ok2 {
-				return fmt.Errorf("MUL instruction requires float operands")
-			}
-			result := operand1 * operand2
-			vm.stack = vm.stack[:len(vm.stack)-2]
-			vm.stack = append(vm.stack, result)
-			if *vm.debugMode {
-				fmt.Printf("Stack after MUL: %v\n", vm.stack)
-			}
-		case compiler.GRT:
-			if len(vm.stack) < 2 {
-				return fmt.Errorf("GRT instruction requires at least 2 values on the stack")
-			}
-			operand2, ok1 := vm.stack[len(vm.stack)-1].(float64)
-			operand1, ok2 := vm.stack[len(vm.stack)-2].(float64)
-			if !ok1 || !ok2 {
-				return fmt.Errorf("GRT instruction requires float operands")
-			}
-			result := operand1 > operand2
-			vm.stack = vm.stack[:len(vm.stack)-2]
-			vm.stack = append(vm.stack, result)
-			if *vm.debugMode {
-				fmt.Printf("Stack after GRT: %v\n", vm.stack)
-			}
-		case compiler.LESS:
-			if len(vm.stack) < 2 {
-				return fmt.Errorf("LESS instruction requires at least 2 values on the stack")
-			}
-			operand2, ok1 := vm.stack[len(vm.stack)-1].(float64)
-			operand1, ok2 := vm.stack[len(vm.stack)-2].(float64)
-			if !ok1 || !ok2 {
-				return fmt.Errorf("LESS instruction requires float operands")
-			}
-			result := operand1 < operand2
-			vm.stack = vm.stack[:len(vm.stack)-2]
-			vm.stack = append(vm.stack, result)
-			if *vm.debugMode {
-				fmt.Printf("Stack after LESS: %v\n", vm.stack)
-			}
-		case compiler.EQ:
-			if len(vm.stack) < 2 {
-				return fmt.Errorf("EQ instruction requires at least 2 values on the stack")
-			}
-
-			operand2 := vm.stack[len(vm.stack)-1]
-			operand1 := vm.stack[len(vm.stack)-2]
-
-			if _, ok1 := operand1.(float64); ok1 {
-				if _, ok2 := operand2.(float64); ok2 {
-					result := operand1.(float64) == operand2.(float64)
-					vm.stack = vm.stack[:len(vm.stack)-2]
-					vm.stack = append(vm.stack, result)
-					if *vm.debugMode {
-						fmt.Printf("Stack after EQ: %v\n", vm.stack)
-					}
-				} else {
-					return fmt.Errorf("EQ instruction requires operands of the same type")
-				}
-			} else if _, ok1 := operand1.(string); ok1 {
-				if _, ok2 := operand2.(string); ok2 {
-					result := operand1.(string) == operand2.(string)
-					vm.stack = vm.stack[:len(vm.stack)-2]
-					vm.stack = append(vm.stack, result)
-					if *vm.debugMode {
-						fmt.Printf("Stack after EQ: %v\n", vm.stack)
-					}
-				} else {
-					return fmt.Errorf("EQ instruction requires operands of the same type")
-				}
-			} else {
-				return fmt.Errorf("EQ instruction requires operands of the same type")
+			if vm.trace != nil {
+				fmt.Fprintf(vm.trace, "Stack after %s: %v\n", compiler.OpcodeToString(instruction.Opcode), vm.stack)
 			}
-
-		case compiler.NEQ:
-			if len(vm.stack) < 2 {
-				return fmt.Errorf("NEQ instruction requires at least 2 values on the stack")
+		case compiler.EQ, compiler.NEQ:
+			if err := vm.equality(instruction.Opcode); err != nil {
+				return err
 			}
-
-			operand2 := vm.stack[len(vm.stack)-1]
-			operand1 := vm.stack[len(vm.stack)-2]
-
-			if _, ok1 := operand1.(float64); ok1 {
-				if _, ok2 := operand2.(float64); ok2 {
-					result := operand1.(float64) != operand2.(float64)
-					vm.stack = vm.stack[:len(vm.stack)-2]
-					vm.stack = append(vm.stack, result)
-					if *vm.debugMode {
-						fmt.Printf("Stack after NEQ: %v\n", vm.stack)
-					}
-				} else {
-					return fmt.Errorf("NEQ instruction requires operands of the same type")
-				}
-			} else if _, ok1 := operand1.(string); ok1 {
-				if _, ok2 := operand2.(string); ok2 {
-					result := operand1.(string) != operand2.(string)
-					vm.stack = vm.stack[:len(vm.stack)-2]
-					vm.stack = append(vm.stack, result)
-					if *vm.debugMode {
-						fmt.Printf("Stack after NEQ: %v\n", vm.stack)
-					}
-				} else {
-					return fmt.Errorf("NEQ instruction requires operands of the same type")
-				}
-			} else {
-				return fmt.Errorf("NEQ instruction requires operands of the same type")
+			if vm.trace != nil {
+				fmt.Fprintf(vm.trace, "Stack after %s: %v\n", compiler.OpcodeToString(instruction.Opcode), vm.stack)
 			}
+		case compiler.TO_INT, compiler.TO_FLOAT:
+			if err := vm.convert(instruction.Opcode); err != nil {
+				return err
+			}
+		case compiler.NOT:
+			if len(vm.stack) < 1 {
+				return fmt.Errorf("NOT instruction requires a value on the stack")
+			}
+			operand, ok := vm.stack[len(vm.stack)-1].(bool)
+			if !ok {
+				return fmt.Errorf("NOT instruction requires a bool operand, got %T", vm.stack[len(vm.stack)-1])
+			}
+			vm.stack[len(vm.stack)-1] = !operand
 		case compiler.PRINT:
 			if len(vm.stack) < 1 {
 				return fmt.Errorf("PRINT instruction requires a value on the stack")
 			}
 			value := vm.stack[len(vm.stack)-1]
-			if *vm.debugMode {
-				fmt.Println()
-				vmPrint(value)
-				fmt.Println()
-			} else {
-				fmt.Println(value)
+			fmt.Fprintln(vm.out, value)
+			if vm.trace != nil {
+				fmt.Fprintln(vm.trace)
+				vmPrint(vm.trace, value)
+				fmt.Fprintln(vm.trace)
 			}
 			vm.stack = vm.stack[:len(vm.stack)-1]
-		case compiler.DEFINE_VARIABLE:
-			if len(instruction.Operands) < 1 {
-				return fmt.Errorf("DEFINE_VARIABLE instruction requires a variable name as operand")
-			}
-
-			varBytes, ok := instruction.Operands[1].([]byte)
-			if !ok {
-				return fmt.Errorf("Invalid operand type for DEFINE_VARIABLE instruction")
-			}
-			varName := string(varBytes)
-
+		case compiler.DEFINE_GLOBAL:
+			ops := &instruction.Operands
 			if len(vm.stack) == 0 {
-				return fmt.Errorf("No value on stack to assign to variable %s", varName)
+				return fmt.Errorf("No value on stack to assign to variable %s", ops.Name)
 			}
-
 			value := vm.stack[len(vm.stack)-1]
 			vm.stack = vm.stack[:len(vm.stack)-1]
 
-			currentSymbolTable := vm.symbolTableStack[len(vm.symbolTableStack)-1]
-			if _, exists := currentSymbolTable.Get(varName); exists {
-				return fmt.Errorf("Variable %s is immutable and has already been defined", varName)
-			}
-			currentSymbolTable.Set(varName, value)
-
-			fmt.Printf("Variable %s defined with value: %v\n", varName, value)
-		case compiler.CREATE_LAMBDA:
-			if len(instruction.Operands) < 4 {
-				return fmt.Errorf("CREATE_LAMBDA instruction requires at least 4 operands")
+			vm.growGlobals(ops.Index)
+			if vm.globals[ops.Index] != nil {
+				return fmt.Errorf("Variable %s is immutable and has already been defined", ops.Name)
 			}
-
-			startAddressBytes, ok := instruction.Operands[0].([]byte)
-			if !ok {
-				return fmt.Errorf("Invalid operand type for lambda start address")
+			vm.globals[ops.Index] = value
+			if vm.trace != nil {
+				fmt.Fprintf(vm.trace, "Variable %s defined with value: %v\n", ops.Name, value)
 			}
-			startAddress := int(binary.LittleEndian.Uint32(startAddressBytes))
-
-			endAddressBytes, ok := instruction.Operands[1].([]byte)
-			if !ok {
-				return fmt.Errorf("Invalid operand type for lambda end address")
-			}
-			endAddress := int(binary.LittleEndian.Uint32(endAddressBytes))
-
-			var start int
-			if startIdx, ok := vm.offsetMap[startAddress]; ok {
-				start = startIdx
-			} else {
-				return fmt.Errorf("Invalid start address for lambda")
-			}
-
-			var end int
-			if endIdx, ok := vm.offsetMap[endAddress]; ok {
-				end = endIdx
-			} else {
-				return fmt.Errorf("Invalid end address for lambda")
+		case compiler.STORE_LOCAL:
+			ops := &instruction.Operands
+			if len(vm.stack) == 0 {
+				return fmt.Errorf("No value on stack to assign to variable %s", ops.Name)
 			}
+			value := vm.stack[len(vm.stack)-1]
+			vm.stack = vm.stack[:len(vm.stack)-1]
 
-			paramCountBytes, ok := instruction.Operands[2].([]byte)
-			if !ok {
-				return fmt.Errorf("Invalid operand type for lambda parameter count")
+			slot := vm.frame.base + ops.Index
+			if slot >= len(vm.locals) {
+				return fmt.Errorf("Invalid local slot %d for variable %s", ops.Index, ops.Name)
 			}
-			paramCount := int(binary.LittleEndian.Uint32(paramCountBytes))
-			var paramNames []string
-			ii := 0
-
-			for ii < paramCount {
-				paramNameLenBytes, ok := instruction.Operands[3+ii*2].([]byte)
-				if !ok || len(paramNameLenBytes) != 4 {
-					return fmt.Errorf("Invalid or missing length for param name in CREATE_LAMBDA instruction")
-				}
-				paramNameLen := int(binary.LittleEndian.Uint32(paramNameLenBytes))
-
-				paramNameBytes, ok := instruction.Operands[4+ii*2].([]byte)
-				if !ok || len(paramNameBytes) != paramNameLen {
-					return fmt.Errorf("Invalid or missing param name in CREATE_LAMBDA instruction")
-				}
-				paramName := string(paramNameBytes)
-				paramNames = append(paramNames, paramName)
-				ii++
+			if vm.locals[slot] != nil {
+				return fmt.Errorf("Variable %s is immutable and has already been defined", ops.Name)
 			}
-			//fmt.Printf("----lambda params: %v\n", paramNames)
-			iii := 4 + (ii-1)*2 + 1
-
-			capturedVarCountBytes, ok := instruction.Operands[iii].([]byte)
-			if !ok {
-				return fmt.Errorf("Invalid operand type for number of captured variables")
+			vm.locals[slot] = value
+			if vm.trace != nil {
+				fmt.Fprintf(vm.trace, "Variable %s defined with value: %v\n", ops.Name, value)
 			}
-			capturedVarCount := int(binary.LittleEndian.Uint32(capturedVarCountBytes))
-
-			var capturedVars []string
-
-			for i := 0; i < capturedVarCount; i++ {
-				varNameLenBytes, ok := instruction.Operands[(iii+1)+i*2].([]byte)
-				if !ok || len(varNameLenBytes) != 4 {
-					return fmt.Errorf("Invalid or missing length for captured var name in CREATE_LAMBDA instruction")
-				}
-				varNameLen := int(binary.LittleEndian.Uint32(varNameLenBytes))
-
-				varNameBytes, ok := instruction.Operands[(iii+2)+i*2].([]byte)
-				if !ok || len(varNameBytes) != varNameLen {
-					return fmt.Errorf("Invalid or missing captured var name in CREATE_LAMBDA instruction")
-				}
-				varName := string(varNameBytes)
-				capturedVars = append(capturedVars, varName)
+		case compiler.CREATE_LAMBDA:
+			ops := &instruction.Operands
+			if ops.Target < 0 || ops.EndTarget < 0 {
+				return fmt.Errorf("Invalid start or end address for lambda")
 			}
-
-			lambdaSymbolTable := NewRuntimeSymbolTable(nil)
-
-			currentSymbolTable := vm.symbolTableStack[len(vm.symbolTableStack)-1]
-			for _, varName := range capturedVars {
-				if value, exists := currentSymbolTable.Get(varName); exists {
-					lambdaSymbolTable.Set(varName, value)
-				} else {
-					return fmt.Errorf("Captured variable not found in the current scope: %s", varName)
-				}
+			upvalues, err := vm.capture(ops.Captures)
+			if err != nil {
+				return err
 			}
 
-			lambdaFunction := &LambdaFunction{
-				StartAddress: start,
-				EndAddress:   end,
-				SymbolTable:  lambdaSymbolTable,
-				ParamCount:   paramCount,
-				ParamNames:   paramNames,
-				CapturedVars: capturedVars,
+			capturedVars := make([]string, len(ops.Captures))
+			for i, capture := range ops.Captures {
+				capturedVars[i] = capture.Name
 			}
-
-			vm.push(lambdaFunction)
-			//fmt.Printf("current stack after pushing lambda: %v\n", vm.stack)
-			//fmt.Printf("Lambda created with start address %d and end address %d\n", startAddress, endAddress)
-			//lambdaFunction.Print("----")
+			vm.push(NewLambdaFunction(ops.Target, ops.EndTarget, ops.Count, ops.Params, ops.Locals, capturedVars, upvalues))
 		case compiler.CALL_LAMBDA:
-			numArgsBytes, ok := instruction.Operands[0].([]byte)
-			if !ok {
-				return fmt.Errorf("Invalid operand for CALL_LAMBDA instruction")
-			}
-			numArgs := int(binary.LittleEndian.Uint32(numArgsBytes))
-			//fmt.Printf("number of args for lambda: %v\n", numArgs)
-			//fmt.Printf("current vm stack before popping lambda args: %v\n", vm.stack)
-			args := make([]interface{}, numArgs)
-			for i := numArgs - 1; i >= 0; i-- {
-				arg, err := vm.pop()
-				if err != nil {
-					return err
-				}
-				args[i] = arg
+			numArgs := instruction.Operands.Count
+			if len(vm.stack) < numArgs+1 {
+				return fmt.Errorf("Expected a lambda function and %d arguments on the stack", numArgs)
+			}
+			// the arguments are above the function, and copied into its frame
+			callee, args := vm.stack[len(vm.stack)-numArgs-1], vm.stack[len(vm.stack)-numArgs:]
+			vm.stack = vm.stack[:len(vm.stack)-numArgs-1]
+			if err := vm.call(callee, args, nil); err != nil {
+				return err
 			}
-
-			//fmt.Printf("current vm stack before popping lambda function: %v\n", vm.stack)
-			popped, err1 := vm.pop()
-			lambdaFunc, ok2 := popped.(*LambdaFunction)
-			if (err1 != nil) || !ok2 {
-				return fmt.Errorf("Expected a lambda function on the stack: %v\n", err1)
+		case compiler.LOAD_GLOBAL:
+			ops := &instruction.Operands
+			if ops.Index >= len(vm.globals) || vm.globals[ops.Index] == nil {
+				return fmt.Errorf("Variable not found: %s", ops.Name)
 			}
-			//fmt.Printf("popped lambda: %v\n", lambdaFunc)
-
-			// captured vars???
-			lambdaSymbolTable := NewRuntimeSymbolTable(lambdaFunc.SymbolTable)
-			for i, paramName := range lambdaFunc.ParamNames {
-				lambdaSymbolTable.Set(paramName, args[i])
+			vm.stack = append(vm.stack, vm.globals[ops.Index])
+			if vm.trace != nil {
+				fmt.Fprintf(vm.trace, "Stack after LOAD_GLOBAL (%s): %v\n", ops.Name, vm.stack)
 			}
-			//fmt.Printf("lambda symbol table set: \n")
-			//lambdaSymbolTable.Print("----")
-
-			//currentSymbolTable := vm.symbolTableStack[len(vm.symbolTableStack)-1]
-
-			returnAddress := vm.pc
-
-			vm.symbolTableStack = append(vm.symbolTableStack, lambdaSymbolTable)
-
-			//fmt.Printf("----lambda start: %v\tlambda end: %v\n", lambdaFunc.StartAddress, lambdaFunc.EndAddress)
-			err := vm.Run(lambdaFunc.StartAddress, lambdaFunc.EndAddress)
-			if err != nil {
-				return err
-			}
-
-			returnValue := vm.stack[len(vm.stack)-1]
-
-			vm.pc = returnAddress
-			vm.symbolTableStack = vm.symbolTableStack[:len(vm.symbolTableStack)-1]
-
-			vm.push(returnValue)
-
-			//return nil
-		case compiler.PUSH_VARIABLE:
-			varNameLenBytes, ok := instruction.Operands[0].([]byte)
-			if !ok || len(varNameLenBytes) != 4 {
-				return fmt.Errorf("Invalid or missing length for variable name in PUSH_VARIABLE instruction")
+		case compiler.LOAD_LOCAL:
+			ops := &instruction.Operands
+			slot := vm.frame.base + ops.Index
+			if slot >= len(vm.locals) || vm.locals[slot] == nil {
+				return fmt.Errorf("Variable not found: %s", ops.Name)
 			}
-			varNameLen := int(binary.LittleEndian.Uint32(varNameLenBytes))
-
-			varNameBytes, ok := instruction.Operands[1].([]byte)
-			if !ok || len(varNameBytes) != varNameLen {
-				return fmt.Errorf("Invalid or missing variable name in PUSH_VARIABLE instruction")
+			vm.stack = append(vm.stack, vm.locals[slot])
+			if vm.trace != nil {
+				fmt.Fprintf(vm.trace, "Stack after LOAD_LOCAL (%s): %v\n", ops.Name, vm.stack)
 			}
-			varName := string(varNameBytes)
-
-			var value interface{}
-			found := false
-			for i := len(vm.symbolTableStack) - 1; i >= 0; i-- {
-				symbolTable := vm.symbolTableStack[i]
-				if val, exists := symbolTable.symbols[varName]; exists {
-					value = val
-					found = true
-					break
-				}
+		case compiler.LOAD_FUNCTION:
+			funcName := instruction.Operands.Name
+			functionMetadata, ok := vm.functions[funcName]
+			if !ok {
+				return fmt.Errorf("Function %s not defined", funcName)
 			}
-
-			if !found {
-				return fmt.Errorf("Variable not found: %s", varName)
+			vm.push(&Function{Name: funcName, FunctionMetadata: functionMetadata})
+		case compiler.LOAD_UPVALUE:
+			ops := &instruction.Operands
+			if ops.Index >= len(vm.frame.upvalues) || vm.frame.upvalues[ops.Index] == nil {
+				return fmt.Errorf("Variable not found: %s", ops.Name)
 			}
-
-			vm.stack = append(vm.stack, value)
-			if *vm.debugMode {
-				fmt.Printf("Stack after PUSH_VARIABLE (%s): %v\n", varName, vm.stack)
+			vm.stack = append(vm.stack, vm.frame.upvalues[ops.Index])
+			if vm.trace != nil {
+				fmt.Fprintf(vm.trace, "Stack after LOAD_UPVALUE (%s): %v\n", ops.Name, vm.stack)
 			}
 		case compiler.DEFINE_FUNCTION:
-			funcNameBytes, ok := instruction.Operands[0].([]byte)
-			if !ok {
-				return fmt.Errorf("Invalid operand for function name in DEFINE_FUNCTION instruction")
-			}
-			funcName := string(funcNameBytes)
-
-			startAddressBytes, ok := instruction.Operands[1].([]byte)
-			if !ok || len(startAddressBytes) != 4 {
-				return fmt.Errorf("Invalid or missing start address in DEFINE_FUNCTION instruction")
+			ops := &instruction.Operands
+			funcName := ops.Name
+			if ops.Target < 0 {
+				return fmt.Errorf("Invalid start address for function %s", funcName)
 			}
-			startAddress := int(binary.LittleEndian.Uint32(startAddressBytes)) + 1
-
-			paramCountBytes, ok := instruction.Operands[2].([]byte)
-			if !ok || len(paramCountBytes) != 4 {
-				return fmt.Errorf("Invalid or missing parameter count in DEFINE_FUNCTION instruction")
+			startAddress, paramCount, paramNames := ops.Target, ops.Count, ops.Params
+			upvalues, err := vm.capture(ops.Captures)
+			if err != nil {
+				return err
 			}
-			paramCount := int(binary.LittleEndian.Uint32(paramCountBytes))
-			var paramNames []string
-			if len(instruction.Operands) > 3 {
-				listLenBytes, ok := instruction.Operands[3].([]byte)
-				if !ok || len(listLenBytes) != 4 {
-					return fmt.Errorf("Invalid or missing length of parameter list in DEFINE_FUNCTION instruction")
-				}
-				listLen := int(binary.LittleEndian.Uint32(listLenBytes))
 
-				for i := 0; i < listLen; i++ {
-					paramNameLenBytes, ok := instruction.Operands[4+i*2].([]byte)
-					if !ok || len(paramNameLenBytes) != 4 {
-						return fmt.Errorf("Invalid or missing length for parameter name in DEFINE_FUNCTION instruction")
-					}
-					paramNameLen := int(binary.LittleEndian.Uint32(paramNameLenBytes))
-
-					paramNameBytes, ok := instruction.Operands[5+i*2].([]byte)
-					if !ok || len(paramNameBytes) != paramNameLen {
-						return fmt.Errorf("Invalid or missing parameter name in DEFINE_FUNCTION instruction")
-					}
-					paramName := string(paramNameBytes)
-					paramNames = append(paramNames, paramName)
-				}
+			// the functions calling the one redefined may now return
+			// something else
+			if previous, ok := vm.functions[funcName]; ok && previous.StartAddress != startAddress && vm.memo != nil {
+				clear(vm.memo)
 			}
-
 			vm.functions[funcName] = FunctionMetadata{
 				StartAddress: startAddress,
 				ParamCount:   paramCount,
 				ParamNames:   paramNames,
+				LocalCount:   ops.Locals,
+				Upvalues:     upvalues,
 			}
 
-			if *vm.debugMode {
-				fmt.Printf("Function %s defined with param count: %v and params: %v\n", funcName, paramCount, paramNames)
-				fmt.Printf("Function %s starts at: %v\n", funcName, startAddress)
-				fmt.Printf("Current PC: %v\n", vm.pc)
+			if vm.trace != nil {
+				fmt.Fprintf(vm.trace, "Function %s defined with param count: %v and params: %v\n", funcName, paramCount, paramNames)
+				fmt.Fprintf(vm.trace, "Function %s starts at: %v\n", funcName, startAddress)
+				fmt.Fprintf(vm.trace, "Current PC: %v\n", vm.pc)
 			}
 		case compiler.CALL_FUNCTION:
-			funcNameLenBytes, ok := instruction.Operands[0].([]byte)
-			if !ok || len(funcNameLenBytes) != 4 {
-				return fmt.Errorf("Invalid length for function name length in CALL_FUNCTION instruction")
+			funcName := instruction.Operands.Name
+			if vm.trace != nil {
+				fmt.Fprintf(vm.trace, "CALL_FUNCTION for %s\n", funcName)
 			}
 
-			funcNameLen := int(binary.LittleEndian.Uint32(funcNameLenBytes))
-
-			funcNameBytes, ok := instruction.Operands[1].([]byte)
-			if !ok || len(funcNameBytes) != funcNameLen {
-				return fmt.Errorf("Invalid or missing function name in CALL_FUNCTION instruction")
-			}
-
-			funcName := string(funcNameBytes)
-			if *vm.debugMode {
-				fmt.Printf("CALL_FUNCTION for %s\n", funcName)
-			}
-
-			functionMetadata, ok := vm.functions[funcName]
-			if !ok {
-				return fmt.Errorf("Function %s not defined", funcName)
+			functionMetadata, err := vm.calledFunction(instruction)
+			if err != nil {
+				return err
 			}
 
 			argCount := functionMetadata.ParamCount
-			if len(vm.stack) < argCount {
-				return fmt.Errorf("Not enough arguments on stack for function %s", funcName)
+			args := vm.stack[len(vm.stack)-argCount:]
+			key, result, remembered := vm.remembered(functionMetadata, args)
+			if remembered {
+				vm.stack = vm.stack[:len(vm.stack)-argCount]
+				vm.push(result)
+				continue
 			}
+			// the arguments are taken off the stack before the call, so that
+			// its frame starts at the caller's height; they are copied into
+			// the frame before anything else is pushed
+			vm.stack = vm.stack[:len(vm.stack)-argCount]
+			vm.enter(functionMetadata.StartAddress, args, functionMetadata.LocalCount, functionMetadata.Upvalues, nil)
+			vm.callStack[len(vm.callStack)-1].memo = key
 
-			args := make([]interface{}, argCount)
-			for i := argCount - 1; i >= 0; i-- {
-				arg, err := vm.pop()
-				if err != nil {
-					return err
-				}
-				args[i] = arg
+			if vm.trace != nil {
+				fmt.Fprintln(vm.trace, "Jumping to function start address:", functionMetadata.StartAddress)
 			}
-
-			newSymbolTable := NewRuntimeSymbolTable(vm.symbolTableStack[len(vm.symbolTableStack)-1])
-			for i, paramName := range functionMetadata.ParamNames {
-				newSymbolTable.Set(paramName, args[i])
+			continue
+		case compiler.TAIL_CALL:
+			functionMetadata, err := vm.calledFunction(instruction)
+			if err != nil {
+				return err
+			}
+			if len(vm.callStack) == 0 {
+				return fmt.Errorf("TAIL_CALL outside of a function")
 			}
-			vm.callStack = append(vm.callStack, CallStackEntry{returnAddress: vm.pc, symbolTable: vm.symbolTableStack[len(vm.symbolTableStack)-1]})
-			vm.symbolTableStack = append(vm.symbolTableStack, newSymbolTable)
-			vm.pc = functionMetadata.StartAddress
 
-			if *vm.debugMode {
-				fmt.Println("Jumping to function start address:", vm.pc)
+			argCount := functionMetadata.ParamCount
+			// the callee takes over the caller's frame and returns where the
+			// caller would have
+			vm.reuseFrame(vm.stack[len(vm.stack)-argCount:], functionMetadata.LocalCount, functionMetadata.Upvalues)
+			clear(vm.stack[vm.frame.stack:])
+			vm.stack = vm.stack[:vm.frame.stack]
+			vm.callStack[len(vm.callStack)-1].function = functionMetadata.StartAddress
+			vm.dropHandlers(len(vm.callStack) - 1)
+			vm.pc = functionMetadata.StartAddress - 1
+
+			if vm.trace != nil {
+				fmt.Fprintln(vm.trace, "Tail call to function start address:", functionMetadata.StartAddress)
 			}
 			continue
+		case compiler.CALL_NATIVE:
+			if err := vm.callNative(instruction); err != nil {
+				return err
+			}
 		case compiler.RETURN:
 			if len(vm.callStack) == 0 {
 				return fmt.Errorf("Call stack is empty on return")
 			}
 
-			returnValue, err := vm.pop()
-			if err != nil {
-				return fmt.Errorf("No return value found on the stack")
+			var returnValue interface{}
+			if instruction.Operands.Count > 0 {
+				if len(vm.stack) <= vm.frame.stack {
+					return fmt.Errorf("No return value found on the stack")
+				}
+				returnValue, _ = vm.pop()
 			}
+			// whatever the body left on the stack goes with its frame
+			clear(vm.stack[vm.frame.stack:])
+			vm.stack = vm.stack[:vm.frame.stack]
 
 			callStackEntry := vm.callStack[len(vm.callStack)-1]
 			vm.callStack = vm.callStack[:len(vm.callStack)-1]
+			vm.dropHandlers(len(vm.callStack))
+			if callStackEntry.memo != nil {
+				vm.memo[*callStackEntry.memo] = returnValue
+			}
 
+			vm.popFrame(callStackEntry.frame)
+			if callStackEntry.returnAddress == taskExit {
+				if vm.trace != nil {
+					fmt.Fprintf(vm.trace, "Task returned %v and ended\n", returnValue)
+				}
+				if err := vm.exit(); err != nil {
+					return err
+				}
+				continue
+			}
+			if callStackEntry.returnAddress == workerExit {
+				vm.push(returnValue)
+				return nil
+			}
 			vm.pc = callStackEntry.returnAddress
-			vm.symbolTableStack = vm.symbolTableStack[:len(vm.symbolTableStack)-1]
 
+			if it := callStackEntry.iteration; it != nil {
+				if err := it.collect(returnValue); err != nil {
+					return err
+				}
+				if args, ok := it.next(); ok {
+					if err := vm.call(it.function, args, it); err != nil {
+						return err
+					}
+					continue
+				}
+				returnValue = it.result()
+			}
 			vm.push(returnValue)
 
-			if *vm.debugMode {
-				fmt.Printf("Returning to address %d with value %v\n", vm.pc, returnValue)
+			if vm.trace != nil {
+				fmt.Fprintf(vm.trace, "Returning to address %d with value %v\n", vm.pc, returnValue)
 			}
 			continue
-		case compiler.MAP:
-			numArgs := int(binary.LittleEndian.Uint32(instruction.Operands[0].([]byte)))
-
-			args := make([]interface{}, numArgs)
-			for i := numArgs - 1; i >= 0; i-- {
-				arg, err := vm.pop()
-				if err != nil {
-					return fmt.Errorf("error executing MAP: %v", err)
-				}
-				args[i] = arg
+		case compiler.BUILD_LIST:
+			count := instruction.Operands.Count
+			if len(vm.stack) < count {
+				return fmt.Errorf("BUILD_LIST instruction requires %d values on the stack", count)
 			}
 
-			poppedLambda, err := vm.pop()
+			list := make([]interface{}, count)
+			copy(list, vm.stack[len(vm.stack)-count:])
+			vm.stack = vm.stack[:len(vm.stack)-count]
+			vm.push(list)
+			if vm.trace != nil {
+				fmt.Fprintf(vm.trace, "Stack after BUILD_LIST: %v\n", vm.stack)
+			}
+		case compiler.PMAP, compiler.PFILTER:
+			if err := vm.parallelIterate(instruction.Opcode); err != nil {
+				return err
+			}
+		case compiler.MAP, compiler.FILTER:
+			opcode := compiler.OpcodeToString(instruction.Opcode)
+			list, function, err := vm.popListAndFunction(opcode)
 			if err != nil {
-				return fmt.Errorf("error executing MAP: %v", err)
+				return err
 			}
-			lambdaFunc, ok := poppedLambda.(*LambdaFunction)
-			if !ok {
-				return fmt.Errorf("error executing MAP: expected a lambda function")
+			it := &iteration{opcode: instruction.Opcode, function: function, list: list, results: make([]interface{}, 0, len(list))}
+			if err := vm.iterate(it); err != nil {
+				return err
 			}
-
-			results := make([]interface{}, numArgs)
-			for i, arg := range args {
-				result, err := vm.executeLambda(lambdaFunc, []interface{}{arg})
-				if err != nil {
-					return fmt.Errorf("error executing MAP with lambda: %v", err)
-				}
-				results[i] = result
+		case compiler.REDUCE:
+			if len(vm.stack) < 3 {
+				return fmt.Errorf("REDUCE operation requires three values on the stack (lambda, accumulator and list)")
 			}
-
-			vm.push(results)
-
-			//return nil
-		case compiler.FILTER:
-			numArgsBytes, ok := instruction.Operands[0].([]byte)
+			list, ok := vm.stack[len(vm.stack)-1].([]interface{})
 			if !ok {
-				return fmt.Errorf("Invalid operand for FILTER instruction")
+				return fmt.Errorf("error executing REDUCE: expected a list")
 			}
-			numArgs := int(binary.LittleEndian.Uint32(numArgsBytes))
-
-			var args []interface{}
-			for i := 0; i < numArgs; i++ {
-				arg, err := vm.pop()
-				if err != nil {
-					return err
-				}
-				args = append(args, arg)
+			accumulator := vm.stack[len(vm.stack)-2]
+			function := vm.stack[len(vm.stack)-3]
+			if !isFunction(function) {
+				return fmt.Errorf("Expected a function on the stack for REDUCE operation")
 			}
+			vm.stack = vm.stack[:len(vm.stack)-3]
 
-			poppedLambda, err := vm.pop()
-			if err != nil {
-				return fmt.Errorf("error executing FILTER: %v", err)
+			it := &iteration{opcode: compiler.REDUCE, function: function, list: list, accumulator: accumulator}
+			if err := vm.iterate(it); err != nil {
+				return err
 			}
-			lambdaFunc, ok := poppedLambda.(*LambdaFunction)
-			if !ok {
-				return fmt.Errorf("error executing FILTER: expected a lambda function")
+		case compiler.SPAWN:
+			numArgs := instruction.Operands.Count
+			if len(vm.stack) < numArgs+1 {
+				return fmt.Errorf("Expected a function and %d arguments on the stack", numArgs)
 			}
-
-			var filteredResults []interface{}
-			for i := len(args) - 1; i >= 0; i-- {
-				result, err := vm.executeLambda(lambdaFunc, []interface{}{args[i]})
-				if err != nil {
-					return err
-				}
-
-				if resultBool, ok := result.(bool); ok && resultBool {
-					filteredResults = append(filteredResults, args[i])
-				}
+			if err := vm.spawn(vm.stack[len(vm.stack)-numArgs-1], vm.stack[len(vm.stack)-numArgs:]); err != nil {
+				return err
 			}
-
-			vm.push(filteredResults)
-			//return nil
-		case compiler.REDUCE:
-			if len(vm.stack) < 3 {
-				return fmt.Errorf("REDUCE operation requires at least three values on the stack (lambda, accumulator, and an element)")
+			clear(vm.stack[len(vm.stack)-numArgs-1:])
+			vm.stack = vm.stack[:len(vm.stack)-numArgs-1]
+		case compiler.MAKE_CHANNEL:
+			if err := vm.makeChannel(); err != nil {
+				return err
 			}
-
-			numArgsBytes, ok := instruction.Operands[0].([]byte)
-			if !ok {
-				return fmt.Errorf("Invalid operand for REDUCE instruction")
+		case compiler.SEND:
+			if err := vm.send(); err != nil {
+				return err
 			}
-			numArgs := int(binary.LittleEndian.Uint32(numArgsBytes))
-
-			lambdaFunc, ok := vm.stack[len(vm.stack)-3].(*LambdaFunction)
-			if !ok {
-				return fmt.Errorf("Expected a lambda function on the stack for REDUCE operation")
+		case compiler.RECV:
+			if err := vm.recv(instruction.Operands.Count); err != nil {
+				return err
 			}
-
-			accumulator := vm.stack[len(vm.stack)-2]
-			nextElement := vm.stack[len(vm.stack)-1]
-
-			args := make([]interface{}, 0, numArgs)
-			args = append(args, accumulator, nextElement)
-
-			result, err := vm.executeLambda(lambdaFunc, args)
-			if err != nil {
+		case compiler.CLOSE:
+			if err := vm.closeChannel(); err != nil {
 				return err
 			}
-
-			vm.stack[len(vm.stack)-2] = result
-
-			vm.stack = vm.stack[:len(vm.stack)-1]
-
-			if len(vm.stack) == 3 {
-				vm.stack = vm.stack[:len(vm.stack)-3]
-				vm.push(result)
-				return nil
+		case compiler.SELECT:
+			if err := vm.selectCase(instruction.Operands.Cases); err != nil {
+				return err
 			}
-
-			//return nil
-		case compiler.JUMP:
-			if len(instruction.Operands) < 1 {
-				return fmt.Errorf("JUMP instruction requires an operand")
+		case compiler.TRY:
+			if err := vm.try(instruction.Operands.Target); err != nil {
+				return err
 			}
-			jumpOffsetBytes, ok := instruction.Operands[0].([]byte)
-			if !ok || len(jumpOffsetBytes) != 4 {
-				return fmt.Errorf("Invalid operand for JUMP instruction")
+		case compiler.END_TRY:
+			if err := vm.endTry(); err != nil {
+				return err
 			}
-			jumpOffset := binary.LittleEndian.Uint32(jumpOffsetBytes)
-
-			if *vm.debugMode {
-				fmt.Printf("Current PC: %v\tJump offset: %v\n", vm.pc, jumpOffset)
+		case compiler.RAISE:
+			return vm.raise()
+		case compiler.MESSAGE:
+			if err := vm.message(); err != nil {
+				return err
 			}
-			vm.pc += int(jumpOffset)
-			if *vm.debugMode {
-				fmt.Printf("Updated PC: %v\n", vm.pc)
+		case compiler.POP:
+			if _, err := vm.pop(); err != nil {
+				return err
 			}
-			if vm.pc >= len(vm.code) {
-				return fmt.Errorf("Jump leads to invalid instruction index")
+		case compiler.JUMP:
+			target := instruction.Operands.Target
+			if vm.trace != nil {
+				fmt.Fprintf(vm.trace, "Current PC: %v\tJump target: %v\n", vm.pc, target)
+			}
+			if err := vm.jumpTo(target); err != nil {
+				return err
 			}
-		case compiler.IF:
+		case compiler.JUMP_IF_FALSE:
+			target := instruction.Operands.Target
 			if len(vm.stack) < 1 {
-				return fmt.Errorf("IF instruction requires a condition value on the stack")
+				return fmt.Errorf("JUMP_IF_FALSE instruction requires a condition value on the stack")
 			}
 			condition, ok := vm.stack[len(vm.stack)-1].(bool)
 			if !ok {
-				return fmt.Errorf("IF instruction requires a boolean condition value on the stack")
+				return fmt.Errorf("JUMP_IF_FALSE instruction requires a boolean condition value on the stack")
 			}
 			vm.stack = vm.stack[:len(vm.stack)-1]
 
 			if !condition {
-				vm.jumpToOpcode(compiler.ELSE)
+				if err := vm.jumpTo(target); err != nil {
+					return err
+				}
 			}
-		case compiler.ELSE:
-			vm.jumpToOpcode(compiler.ENDIF)
-
-		case compiler.ENDIF:
 
 		default:
 			return fmt.Errorf("Unknown instruction: %v", instruction.Opcode)
 		}
 	}
 
-	if *vm.debugMode {
-		fmt.Println()
-		fmt.Printf("All instructions executed. Last executed instruction PC: %v\n", vm.pc)
-		fmt.Printf("Exiting VM...\n")
-		fmt.Println()
+	if vm.trace != nil {
+		fmt.Fprintln(vm.trace)
+		fmt.Fprintf(vm.trace, "All instructions executed. Last executed instruction PC: %v\n", vm.pc)
+		fmt.Fprintf(vm.trace, "Exiting VM...\n")
+		fmt.Fprintln(vm.trace)
 	}
 	return nil
 }
 
-func (vm *VM) executeLambda(lambdaFunc *LambdaFunction, args []interface{}) (interface{}, error) {
-	if len(args) != lambdaFunc.ParamCount {
-		return nil, fmt.Errorf("lambda function expected %d arguments, got %d", lambdaFunc.ParamCount, len(args))
+// call calls a function value with args, returning to the current
+// instruction. it is the iteration that the call is for, if any.
+func (vm *VM) call(callee interface{}, args []interface{}, it *iteration) error {
+	fm, err := functionMetadata(callee, len(args))
+	if err != nil {
+		return err
 	}
+	vm.enter(fm.StartAddress, args, fm.LocalCount, fm.Upvalues, it)
+	return nil
+}
 
-	savedPC := vm.pc
+// functionMetadata returns what is needed to call a function value with
+// argCount arguments.
+func functionMetadata(callee interface{}, argCount int) (FunctionMetadata, error) {
+	switch fn := callee.(type) {
+	case *LambdaFunction:
+		if argCount != fn.ParamCount {
+			return FunctionMetadata{}, fmt.Errorf("lambda function expects %d arguments, got %d", fn.ParamCount, argCount)
+		}
+		return FunctionMetadata{
+			StartAddress: fn.StartAddress,
+			ParamCount:   fn.ParamCount,
+			ParamNames:   fn.ParamNames,
+			LocalCount:   fn.LocalCount,
+			Upvalues:     fn.Upvalues,
+		}, nil
+	case *Function:
+		if argCount != fn.ParamCount {
+			return FunctionMetadata{}, fmt.Errorf("function %s expects %d arguments, got %d", fn.Name, fn.ParamCount, argCount)
+		}
+		return fn.FunctionMetadata, nil
+	}
+	return FunctionMetadata{}, fmt.Errorf("Expected a function on the stack")
+}
 
-	lambdaSymbolTable := NewRuntimeSymbolTable(lambdaFunc.SymbolTable)
-	for i, paramName := range lambdaFunc.ParamNames {
-		lambdaSymbolTable.Set(paramName, args[i])
+// calledFunction returns the current definition of the def function that
+// CALL_FUNCTION or TAIL_CALL calls. It may have been redefined since the call
+// was compiled, but it must still take the arguments the call passes for the
+// definition it was compiled against.
+func (vm *VM) calledFunction(instruction *compiler.BytecodeInstruction) (FunctionMetadata, error) {
+	ops := &instruction.Operands
+	functionMetadata, ok := vm.functions[ops.Name]
+	if !ok {
+		return FunctionMetadata{}, fmt.Errorf("Function %s not defined", ops.Name)
+	}
+	if argCount := vm.params[ops.Target]; functionMetadata.ParamCount != argCount {
+		return FunctionMetadata{}, fmt.Errorf("function %s expects %d arguments, got %d", ops.Name, functionMetadata.ParamCount, argCount)
 	}
-	vm.symbolTableStack = append(vm.symbolTableStack, lambdaSymbolTable)
+	if len(vm.stack) < functionMetadata.ParamCount {
+		return FunctionMetadata{}, fmt.Errorf("Not enough arguments on stack for function %s", ops.Name)
+	}
+	return functionMetadata, nil
+}
 
-	vm.pc = lambdaFunc.StartAddress
-	err := vm.Run(lambdaFunc.StartAddress, lambdaFunc.EndAddress)
-	if err != nil {
-		return nil, err
+// enter starts a call of the function or lambda at start, whose RETURN
+// comes back to the current instruction.
+func (vm *VM) enter(start int, args []interface{}, localCount int, upvalues []interface{}, it *iteration) {
+	caller := vm.pushFrame(args, localCount, upvalues)
+	vm.callStack = append(vm.callStack, CallStackEntry{returnAddress: vm.pc, frame: caller, iteration: it, function: start})
+	// the loop increments pc before the next instruction
+	vm.pc = start - 1
+}
+
+// iterate starts it by calling its function for the first element, or
+// pushes its result at once if the list is empty.
+func (vm *VM) iterate(it *iteration) error {
+	args, ok := it.next()
+	if !ok {
+		vm.push(it.result())
+		return nil
 	}
+	return vm.call(it.function, args, it)
+}
 
-	var returnValue interface{}
-	if len(vm.stack) > 0 {
-		returnValue = vm.stack[len(vm.stack)-1]
-		vm.stack = vm.stack[:len(vm.stack)-1]
+func isFunction(value interface{}) bool {
+	switch value.(type) {
+	case *LambdaFunction, *Function:
+		return true
 	}
+	return false
+}
 
-	vm.pc = savedPC
-	vm.symbolTableStack = vm.symbolTableStack[:len(vm.symbolTableStack)-1]
+// isPure reports whether a function value is a function or lambda that the
+// compiler found to be pure.
+func (vm *VM) isPure(value interface{}) bool {
+	switch fn := value.(type) {
+	case *LambdaFunction:
+		return vm.pure[fn.StartAddress]
+	case *Function:
+		return vm.pure[fn.StartAddress]
+	}
+	return false
+}
 
-	return returnValue, nil
+// unwind abandons the calls and tasks in progress after an error, returning
+// the VM to the top level.
+func (vm *VM) unwind() {
+	vm.stopTasks()
+	vm.callStack = vm.callStack[:0]
+	vm.handlers = vm.handlers[:0]
+	clear(vm.locals)
+	vm.locals = vm.locals[:0]
+	vm.frame = frame{}
 }
 
-func (vm *VM) jumpToOpcode(targetOpcode compiler.Opcode) {
-	for i := vm.pc + 1; i < len(vm.code); i++ {
-		if vm.code[i].Opcode == targetOpcode {
-			vm.pc = i
-			return
+// pushFrame enters a frame of localCount slots whose first slots hold args,
+// and returns the frame of the caller for popFrame.
+func (vm *VM) pushFrame(args []interface{}, localCount int, upvalues []interface{}) frame {
+	caller := vm.frame
+	vm.frame = frame{base: len(vm.locals), stack: len(vm.stack), upvalues: upvalues}
+	vm.locals = append(vm.locals, args...)
+	for i := len(args); i < localCount; i++ {
+		vm.locals = append(vm.locals, nil)
+	}
+	return caller
+}
+
+// reuseFrame replaces the current frame with one for a tail call, like
+// pushFrame but keeping the caller's frame to return to and the stack height
+// to return at.
+func (vm *VM) reuseFrame(args []interface{}, localCount int, upvalues []interface{}) {
+	clear(vm.locals[vm.frame.base:])
+	vm.locals = append(vm.locals[:vm.frame.base], args...)
+	for i := len(args); i < localCount; i++ {
+		vm.locals = append(vm.locals, nil)
+	}
+	vm.frame.upvalues = upvalues
+}
+
+// popFrame leaves the current frame, returning to caller.
+func (vm *VM) popFrame(caller frame) {
+	if vm.frame.base < len(vm.locals) {
+		clear(vm.locals[vm.frame.base:])
+		vm.locals = vm.locals[:vm.frame.base]
+	}
+	vm.frame = caller
+}
+
+// capture reads the values of the variables captured by a function or lambda
+// created in the current frame.
+func (vm *VM) capture(captures []compiler.Capture) ([]interface{}, error) {
+	if len(captures) == 0 {
+		return nil, nil
+	}
+	upvalues := make([]interface{}, len(captures))
+	for i, capture := range captures {
+		var value interface{}
+		if capture.Local {
+			if slot := vm.frame.base + capture.Index; slot < len(vm.locals) {
+				value = vm.locals[slot]
+			}
+		} else if capture.Index < len(vm.frame.upvalues) {
+			value = vm.frame.upvalues[capture.Index]
 		}
+		if value == nil {
+			return nil, fmt.Errorf("Captured variable not found in the current scope: %s", capture.Name)
+		}
+		upvalues[i] = value
 	}
+	return upvalues, nil
+}
+
+// popListAndFunction pops the operands of MAP and FILTER: the list on top of
+// the stack and the function below it.
+func (vm *VM) popListAndFunction(opcode string) ([]interface{}, interface{}, error) {
+	poppedList, err := vm.pop()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error executing %s: %v", opcode, err)
+	}
+	list, ok := poppedList.([]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("error executing %s: expected a list", opcode)
+	}
+
+	poppedFunction, err := vm.pop()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error executing %s: %v", opcode, err)
+	}
+	if !isFunction(poppedFunction) {
+		return nil, nil, fmt.Errorf("error executing %s: expected a function", opcode)
+	}
+
+	return list, poppedFunction, nil
+}
+
+func (vm *VM) callNative(instruction *compiler.BytecodeInstruction) error {
+	name := instruction.Operands.Name
+	argCount := instruction.Operands.Count
+
+	native, ok := vm.natives.Lookup(name)
+	if !ok {
+		return fmt.Errorf("native function %s not registered", name)
+	}
+	if argCount != native.ParamCount() {
+		return fmt.Errorf("native function %s expects %d arguments, got %d", name, native.ParamCount(), argCount)
+	}
+	if len(vm.stack) < argCount {
+		return fmt.Errorf("Not enough arguments on stack for native function %s", name)
+	}
+
+	// the arguments are copied so that the function can keep them
+	args := make([]interface{}, argCount)
+	copy(args, vm.stack[len(vm.stack)-argCount:])
+	vm.stack = vm.stack[:len(vm.stack)-argCount]
+
+	result, err := native.Func(args)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if want := goTypes[native.ResultType()]; fmt.Sprintf("%T", result) != want {
+		return fmt.Errorf("native function %s returned %T, want %s", name, result, want)
+	}
+
+	if vm.trace != nil {
+		fmt.Fprintf(vm.trace, "CALL_NATIVE %s%v returned %v\n", name, args, result)
+	}
+	vm.push(result)
+	return nil
+}
+
+// goTypes are the Go types the VM uses to represent values of each type.
+var goTypes = map[compiler.DataType]string{
+	compiler.IntType:    "int64",
+	compiler.FloatType:  "float64",
+	compiler.StringType: "string",
+	compiler.BoolType:   "bool",
+	compiler.ListType:   "[]interface {}",
+}
+
+// jumpTo moves execution to the instruction at index, as resolved from a
+// jump's target offset.
+func (vm *VM) jumpTo(index int) error {
+	if index < 0 || index > len(vm.code) {
+		return fmt.Errorf("Jump leads to an invalid bytecode offset")
+	}
+	// the loop increments pc before the next instruction
+	vm.pc = index - 1
+	if vm.trace != nil {
+		fmt.Fprintf(vm.trace, "Updated PC: %v\n", index)
+	}
+	return nil
 }
 
-func vmPrint(v interface{}) {
+func vmPrint(w io.Writer, v interface{}) {
 	vStr := fmt.Sprintf("%v", v)
 	boxWidth := len(vStr) + 4
 	topBorder := strings.Repeat("-", boxWidth)
 	middle := fmt.Sprintf("| %s |", vStr)
-	fmt.Println(topBorder)
-	fmt.Println(middle)
-	fmt.Println(topBorder)
+	fmt.Fprintln(w, topBorder)
+	fmt.Fprintln(w, middle)
+	fmt.Fprintln(w, topBorder)
 }
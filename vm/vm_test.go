@@ -0,0 +1,446 @@
+package vm
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"teriyake/goo/compiler"
+	"teriyake/goo/lexer"
+	"teriyake/goo/parser"
+	"teriyake/goo/typecheck"
+	"testing"
+)
+
+// compile checks, compiles and verifies src, which can call the native
+// functions in natives, failing the test if any of those fails.
+func compile(t testing.TB, filename, src string, natives *compiler.Registry) ([]compiler.BytecodeInstruction, map[int]int) {
+	t.Helper()
+	ast, err := parser.NewParser(lexer.NewFileLexer(filename, src)).Parse()
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	checker, comp := typecheck.NewChecker(), compiler.NewCompiler(nil)
+	if natives != nil {
+		checker.DefineNatives(natives)
+		comp.DefineNatives(natives)
+	}
+	if _, err := checker.Check(ast); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	code, offsetMap, err := comp.CompileAST(ast)
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	if err := Verify(code, offsetMap); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	return code, offsetMap
+}
+
+// run runs src and returns what it printed and the error it stopped with.
+func run(t testing.TB, src string) (string, error) {
+	t.Helper()
+	code, offsetMap := compile(t, "test.goo", src, nil)
+	var out strings.Builder
+	err := NewVM(code, offsetMap, &out, nil).Run()
+	return out.String(), err
+}
+
+// runFile runs one of the programs in tests/input.
+func runFile(t testing.TB, name string) (string, error) {
+	t.Helper()
+	path := filepath.Join("..", "tests", "input", name)
+	src, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, offsetMap := compile(t, path, string(src), nil)
+	var out strings.Builder
+	err = NewVM(code, offsetMap, &out, nil).Run()
+	return out.String(), err
+}
+
+func TestClosureProgram(t *testing.T) {
+	out, err := runFile(t, "closure.goo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "6\n11\n115\n3\n1\n7\n6\n10\n14\n"
+	if out != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+}
+
+func TestClosures(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			name: "adder",
+			src: `(def adder (n:int):(int) -> int ((x:int) -> (+ x n)))
+				(let add2:(int) -> int (adder 2))
+				(print (add2 1))
+				(print (add2 40))`,
+			want: "3\n42\n",
+		},
+		{
+			// every call of the counter reads the upvalue it captured when
+			// counter returned, long after counter's frame is gone
+			name: "counter called again",
+			src: `(def counter (target:int):([int]) -> int
+					((l:[int]) -> (reduce ((n:int x:int) -> (if (= x target) (+ n 1) else (n))) 0 l)))
+				(let threes:([int]) -> int (counter 3))
+				(let fours:([int]) -> int (counter 4))
+				(print (threes [3 1 3]))
+				(print (fours [3 1 3]))
+				(print (threes [3 3 3 4]))
+				(print (fours [4]))
+				(print (threes []))`,
+			want: "2\n0\n3\n1\n0\n",
+		},
+		{
+			name: "curried",
+			src: `(def add3 (a:int):(int) -> (int) -> int ((b:int) -> ((c:int) -> (+ a (+ b c)))))
+				(let add1:(int) -> (int) -> int (add3 1))
+				(let add1and2:(int) -> int (add1 2))
+				(print (add1and2 3))
+				(print (add1and2 30))
+				(let add21:(int) -> int (add1 20))
+				(print (add21 300))`,
+			want: "6\n33\n321\n",
+		},
+		{
+			name: "captured by a lambda passed to map",
+			src: `(def scale (k:int xs:[int]):[int] (map ((x:int) -> (* k x)) xs))
+				(print (scale 3 [1 2 3]))
+				(print (scale -1 [1 2 3]))`,
+			want: "[3 6 9]\n[-1 -2 -3]\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := run(t, tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out != tt.want {
+				t.Errorf("output = %q, want %q", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestIfWithoutValue(t *testing.T) {
+	// a branch's value is dropped when the other branch, or a missing
+	// else, gives the if none
+	src := `(def show (n:int) (if (> n 0) (n) else (print n)))
+(show 1)
+(show -1)
+(if true (7))
+(if false (print 8) else (9))
+(def count (n:int) (if (> n 0) ((print n) (count (- n 1))) else (0)))
+(count 2)
+(print 'done')`
+	out, err := run(t, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "-1\n2\n1\ndone\n"; out != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+}
+
+func TestTopLevelValues(t *testing.T) {
+	// only the value of the last expression is left on the stack, however
+	// many come before it
+	src := `(def two ():int 2)
+(def greet (s:string) (print s))
+1
+'one'
+(greet 'hi')
+(try (two) (catch e (print e)))
+(if true (two) else (print 3))
+((x:int) -> x)
+[1 2]
+(+ 1 2)`
+	code, offsetMap := compile(t, "test.goo", src, nil)
+	machine := NewVM(code, offsetMap, io.Discard, nil)
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if len(machine.stack) != 1 || machine.stack[0] != int64(3) {
+		t.Errorf("stack = %v, want [3]", machine.stack)
+	}
+}
+
+func TestBodyValues(t *testing.T) {
+	// a body's value is that of its last expression, and those of the
+	// expressions before it do not stay on the caller's stack
+	src := `(def f (x:int) (+ x 1) (* x 2))
+(print (+ (f 1) (f 2)))
+(def g (x:int):int (print x) (+ x 1) (let y:int (* x 10)) (+ x y))
+(print (g 1))
+(print (map ((x:int) -> ((- x 1) (* x 3))) [1 2]))
+(print (if true ((+ 1 2) (- 5 1)) else (0)))`
+	code, offsetMap := compile(t, "test.goo", src, nil)
+	var out strings.Builder
+	machine := NewVM(code, offsetMap, &out, nil)
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "6\n1\n11\n[3 6]\n4\n"; out.String() != want {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+	if len(machine.stack) != 0 {
+		t.Errorf("stack = %v, want it empty", machine.stack)
+	}
+}
+
+func TestReturnRestoresStack(t *testing.T) {
+	// a function body that leaves more values than its result on the stack
+	// cannot change its caller's stack
+	code, offsetMap := compile(t, "test.goo", "(def f (x:int):int (+ x 1) (* x 2))\n(print (+ (f 1) (f 2)))", nil)
+	pop := &code[find(t, code, compiler.POP, "")]
+	pop.Opcode, pop.Operands = compiler.LOAD_LOCAL, compiler.Operands{Name: "x"}
+	var out strings.Builder
+	machine := NewVM(code, offsetMap, &out, nil)
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "6\n" || len(machine.stack) != 0 {
+		t.Errorf("output = %q and stack = %v, want %q and an empty stack", out.String(), machine.stack, "6\n")
+	}
+}
+
+func TestNestedIfProgram(t *testing.T) {
+	out, err := runFile(t, "nested_if.goo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "big\nzero\n[neg pos big]\n"; out != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+}
+
+func TestIf(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			name: "nested in the then branch",
+			src:  "(if (> 2 1) (if (> 1 2) (print 1) else (print 2)) else (print 3))",
+			want: "2\n",
+		},
+		{
+			name: "nested in the else branch",
+			src:  "(if (> 1 2) (print 1) else (if (> 1 2) (print 2) else (print 3)))",
+			want: "3\n",
+		},
+		{
+			// a false if without else skips its branch and nothing else
+			name: "without else",
+			src:  "(if (> 1 2) (print 1))\n(print 2)\n(if (> 2 1) (print 3) else (print 4))",
+			want: "2\n3\n",
+		},
+		{
+			name: "in a function",
+			src:  "(def pick (x:int) (if (> x 0) (1) else (if (> x -5) (2) else (3))))\n(print (pick 1))\n(print (pick -1))\n(print (pick -9))",
+			want: "1\n2\n3\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := run(t, tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out != tt.want {
+				t.Errorf("output = %q, want %q", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenericProgram(t *testing.T) {
+	out, err := runFile(t, "generic.goo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "6\nsix\n1\n[a b]\nlambda\n"; out != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+}
+
+func TestLists(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			name: "literals",
+			src:  "(print [1 2 3]) (print ['a', 'b']) (print [[1 2] [3]]) (print (filter ((x:int) -> (> x 9)) [1]))",
+			want: "[1 2 3]\n[a b]\n[[1 2] [3]]\n[]\n",
+		},
+		{
+			name: "passed and returned",
+			src: `(def double (l:[int]):[int] (map ((x:int) -> (* x 2)) l))
+				(print (double (filter ((x:int) -> (> x 3)) [1 5 3 4])))
+				(print (reduce ((acc:int x:int) -> (+ acc x)) 0 (double [1 2 3])))`,
+			want: "[10 8]\n12\n",
+		},
+		{
+			name: "of lists",
+			src:  "(print (map ((l:[int]) -> (reduce ((acc:int x:int) -> (+ acc x)) 0 l)) [[1 2] [3] [0]]))",
+			want: "[3 3 0]\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := run(t, tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out != tt.want {
+				t.Errorf("output = %q, want %q", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestOperatorsProgram(t *testing.T) {
+	out, err := runFile(t, "operators.goo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "3\n3.5\n1\n-1.5\ntrue\nfalse\ntrue\ntrue\nfalse\ntrue\ntrue\n4\n0\n[2 4 6]\ntrue\n"
+	if out != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+}
+
+func TestShortCircuit(t *testing.T) {
+	// the right operand is only evaluated when it decides the result
+	out, err := run(t, "(print (and false (> (/ 1 0) 0)))\n(print (or true (> (/ 1 0) 0)))\n(print (and true (> (/ 1 0) 0)))")
+	if !errors.Is(err, errDivisionByZero) {
+		t.Errorf("error = %v, want %v", err, errDivisionByZero)
+	}
+	if want := "false\ntrue\n"; out != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+}
+
+func TestNumbersProgram(t *testing.T) {
+	out, err := runFile(t, "numbers.goo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "3\n-3\n-1\n3.5\n9007199254740993\n3\n-3\n3\ntrue\n2.5\n-9223372036854775808\n6\n"
+	if out != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+}
+
+func TestVariables(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			name: "global in a function",
+			src:  "(let n:int 10)\n(def addn (x:int):int (+ x n))\n(print (addn 1))",
+			want: "11\n",
+		},
+		{
+			name: "locals",
+			src:  "(def f (x:int):int ((let y:int (* x 2)) (let z:int (+ y 1)) (+ x z)))\n(print (f 3))\n(print (f 4))",
+			want: "10\n13\n",
+		},
+		{
+			name: "upvalues of a lambda",
+			src:  "(def outer (a:int):[int] ((let b:int (* a 10)) (map ((x:int) -> (+ x (+ a b))) [1 2])))\n(print (outer 1))",
+			want: "[12 13]\n",
+		},
+		{
+			name: "parameter shadowing a global",
+			src:  "(let x:int 1)\n(def shadow (x:int):int (* x 100))\n(print (shadow 2))\n(print x)",
+			want: "200\n1\n",
+		},
+		{
+			name: "recursion",
+			src:  "(def fact (n:int):int (if (< n 2) (1) else (* n (fact (- n 1)))))\n(print (fact 10))",
+			want: "3628800\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := run(t, tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out != tt.want {
+				t.Errorf("output = %q, want %q", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestFirstClassProgram(t *testing.T) {
+	out, err := runFile(t, "first_class.goo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[2 4 6]\n[2 5]\n10\n[3 6]\n9\n42\n15\n8\n[a b]\n[120 3628800]\n"
+	if out != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+}
+
+func TestTailCallProgram(t *testing.T) {
+	out, err := runFile(t, "tail_call.goo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "1000000\nodd\n500000500000\n45\n"; out != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+}
+
+func TestNestedCallsProgram(t *testing.T) {
+	out, err := runFile(t, "nested_calls.goo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "21\n1000\n[10 100000]\n[small big]\n[[1 2 3] [2 4 6]]\n[3]\n"; out != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+}
+
+func TestErrorInLambdaUnwinds(t *testing.T) {
+	code, offsetMap := compile(t, "test.goo", "(def f (xs:[int]):[int] (map ((x:int) -> (/ 10 x)) xs))\n(print (f [5 0]))", nil)
+	vm := NewVM(code, offsetMap, io.Discard, nil)
+	err := vm.Run()
+	if !errors.Is(err, errDivisionByZero) {
+		t.Fatalf("error = %v, want division by zero", err)
+	}
+	if len(vm.callStack) != 0 || len(vm.stack) != 0 {
+		t.Errorf("after the error, the call stack has %d entries and the stack %d values, want none", len(vm.callStack), len(vm.stack))
+	}
+}
+
+func TestPureProgram(t *testing.T) {
+	out, err := runFile(t, "pure.goo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "12\n550\n14\n[6765 55 610]\n1\n2\n3\n[2 4 6]\n[7 8 9]\n7\n"; out != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+}